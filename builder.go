@@ -10,7 +10,6 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
-	"strings"
 	"syscall"
 
 	"github.com/davecgh/go-spew/spew"
@@ -24,6 +23,13 @@ var (
 	version      = flag.String("twl-version", "0.8.3", "The current version of TwitchyLinux.")
 	debProxyAddr = flag.String("deb-proxy-addr", "", "The address:port of a proxy to use when fetching deb packages.")
 	printUnits   = flag.Bool("print-units", false, "Print the computed build units before exiting.")
+	aptListsDir  = flag.String("apt-lists-dir", "", "Directory of apt Packages indexes to validate package names against, instead of fetching them.")
+	skipPkgCheck = flag.Bool("skip-package-check", false, "Do not check that the packages named by the configuration exist, which fetches the package indexes.")
+	pinHashes    = flag.Bool("pin-hashes", false, "Record the hashes of downloads verified by their signature in the resources directory, so later builds check against them.")
+	kernCacheDir = flag.String("kernel-cache-dir", "", "Directory in which to cache built kernel packages between builds.")
+	sbKeysDir    = flag.String("secure-boot-keys", os.Getenv("TWL_SECURE_BOOT_KEYS"), "Directory containing db.key and db.crt, used to sign the kernel, modules and bootloader for Secure Boot. Defaults to $TWL_SECURE_BOOT_KEYS.")
+	updateKey    = flag.String("update-key", os.Getenv("TWL_UPDATE_KEY"), "PEM encoded RSA or ECDSA private key which update bundles are signed with, required for A/B images. Defaults to $TWL_UPDATE_KEY.")
+	srcDateEpoch = flag.Int64("source-date-epoch", envSourceDateEpoch(), "Build reproducibly, with file times clamped to this Unix time. Defaults to $SOURCE_DATE_EPOCH.")
 
 	defaultNumThreads = int(math.Max(1, float64(runtime.NumCPU()-1)))
 	numThreads        = flag.Int("j", defaultNumThreads, "Number of concurrent threads to use while building.")
@@ -31,8 +37,26 @@ var (
 
 func printUsage() {
 	fmt.Fprintf(os.Stderr, "USAGE: %s [options] <build-directory> [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] pack <build-directory> <image-file> [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] iso <build-directory> <iso-file> [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] oci <build-directory> <layout-directory> [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] bundle <build-directory> <bundle-directory> [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] verify boot <image-file> [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] verify reproducible <build-directory> <build-directory>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] lint [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] lint actions\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] config sources [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] config dump [--json] [<build-options>...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] config explain [<key>] [<build-options>...]\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nBuild options:\n")
-	fmt.Fprintf(os.Stderr, "  -D <key>=<value>\n    \tOverride or set a configuration value.\n")
+	fmt.Fprintf(os.Stderr, "  -D <key>=<value>\n    \tOverride or set a configuration value. The value is a TOML value, or else a string.\n")
+	fmt.Fprintf(os.Stderr, "  -D <key>+=<value>, -D <key>-=<value>\n    \tAppend elements to, or remove them from, a list.\n")
+	fmt.Fprintf(os.Stderr, "  --override-file <file>\n    \tLayer a TOML file over the configuration and profiles.\n")
+	fmt.Fprintf(os.Stderr, "  --profile <name>\n    \tLayer the profile stage-conf/profiles/<name>.toml over the configuration.\n")
+	if features, err := stager.Features(filepath.Join(*resourcesDir, "stage-conf"), stager.Options{}); err == nil {
+		fmt.Fprintf(os.Stderr, "\nFeatures, set with -D features.<name>=<value>:\n")
+		printFeatures(os.Stderr, features)
+	}
 	fmt.Fprintf(os.Stderr, "\nRegular options:\n")
 	flag.PrintDefaults()
 }
@@ -42,12 +66,26 @@ func main() {
 	flag.Usage = printUsage
 	flag.Parse()
 
+	if cmd, ok := imageCommands[flag.Arg(0)]; ok {
+		if err := cmd(ctx, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	config := units.Opts{
-		Dir:        buildDir(),
-		Resources:  resourceDir(),
-		NumThreads: *numThreads,
-		Version:    *version,
-		DebProxy:   *debProxyAddr,
+		Dir:              buildDir(),
+		Resources:        resourceDir(),
+		NumThreads:       *numThreads,
+		Version:          *version,
+		DebProxy:         *debProxyAddr,
+		AptListsDir:      *aptListsDir,
+		SkipPackageCheck: *skipPkgCheck,
+		PinHashes:        *pinHashes,
+		KernelCacheDir:   *kernCacheDir,
+		SecureBootKeys:   *sbKeysDir,
+		SourceDateEpoch:  *srcDateEpoch,
 	}
 
 	var logger logger
@@ -76,7 +114,7 @@ func cancelCtxOnSignal(cancel context.CancelFunc) {
 }
 
 func selectUnits(config units.Opts, logger logger) ([]*unitState, error) {
-	opts, err := stageConfigOpts(flag.CommandLine)
+	opts, err := stageConfigOpts(flag.Args()[1:])
 	if err != nil {
 		return nil, err
 	}
@@ -120,6 +158,19 @@ func run(ctx context.Context, config units.Opts, logger logger) error {
 	}
 
 	if *printUnits {
+		opts, err := stageConfigOpts(flag.Args()[1:])
+		if err != nil {
+			return err
+		}
+		features, err := stager.Features(filepath.Join(config.Resources, "stage-conf"), opts)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Features:")
+		for _, f := range features {
+			fmt.Printf("  %s = %s\n", f.Name, featureValue(f.Value))
+		}
+		fmt.Println()
 		for i, s := range candidateUnits {
 			fmt.Printf("Unit %d/%d: %s\n", i, len(candidateUnits), s.unit.Name())
 			spew.Dump(s.unit)
@@ -144,27 +195,39 @@ func run(ctx context.Context, config units.Opts, logger logger) error {
 	return nil
 }
 
-// stageConfigOpts computes options to be provided to the stager.
-func stageConfigOpts(f *flag.FlagSet) (stager.Options, error) {
+// stageConfigOpts computes options to be provided to the stager from
+// the build options.
+func stageConfigOpts(args []string) (stager.Options, error) {
 	out := stager.Options{
-		Overrides: map[string]interface{}{},
+		SecureBoot:   *sbKeysDir != "",
+		Reproducible: *srcDateEpoch != 0,
 	}
 
-	for i := 1; i < f.NArg(); i++ {
-		switch a := f.Arg(i); a {
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; a {
 		case "-D", "--D":
-			s := f.Arg(i + 1)
-			eqIdx := strings.Index(s, "=")
-			if eqIdx == -1 {
-				return stager.Options{}, fmt.Errorf("invalid override string %q: must be form key=value", s)
+			if i+1 >= len(args) {
+				return stager.Options{}, fmt.Errorf("%s requires a key=value argument", a)
+			}
+			e, err := stager.ParseEdit(args[i+1])
+			if err != nil {
+				return stager.Options{}, err
+			}
+			out.Edits = append(out.Edits, e)
+			i++
+
+		case "--profile":
+			if i+1 >= len(args) {
+				return stager.Options{}, fmt.Errorf("%s requires a profile name", a)
 			}
+			out.Profiles = append(out.Profiles, args[i+1])
+			i++
 
-			var v interface{} = s[eqIdx+1:]
-			switch v {
-			case "false", "true":
-				v, _ = strconv.ParseBool(s[eqIdx+1:])
+		case "--override-file":
+			if i+1 >= len(args) {
+				return stager.Options{}, fmt.Errorf("%s requires a file", a)
 			}
-			out.Overrides[s[:eqIdx]] = v
+			out.OverrideFiles = append(out.OverrideFiles, args[i+1])
 			i++
 
 		default:
@@ -175,6 +238,16 @@ func stageConfigOpts(f *flag.FlagSet) (stager.Options, error) {
 	return out, nil
 }
 
+// envSourceDateEpoch returns the value of $SOURCE_DATE_EPOCH, or 0 if it
+// is unset or invalid.
+func envSourceDateEpoch() int64 {
+	e, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return e
+}
+
 // resourceDir returns the path to the resources directory. The program
 // exits if the path it references is not valid.
 func resourceDir() string {
@@ -0,0 +1,129 @@
+// Package apt interprets apt repository indexes.
+package apt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/twitchylinux/builder/editdist"
+)
+
+// Index describes the set of package names available from one or more
+// Packages indexes.
+type Index struct {
+	pkgs     map[string]bool
+	provides map[string][]string
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{
+		pkgs:     map[string]bool{},
+		provides: map[string][]string{},
+	}
+}
+
+// ParseIndex reads content formatted as a Packages index, adding each
+// package (and any virtual packages it provides) to the index.
+func (idx *Index) ParseIndex(r io.Reader) error {
+	var (
+		s    = bufio.NewScanner(r)
+		pkg  string
+		line int
+	)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for s.Scan() {
+		line++
+		l := s.Text()
+		if strings.TrimSpace(l) == "" {
+			pkg = ""
+			continue
+		}
+		if l[0] == ' ' || l[0] == '\t' { // Continuation line.
+			continue
+		}
+		colon := strings.Index(l, ":")
+		if colon <= 0 {
+			return fmt.Errorf("line %d: expected field, got %q", line, l)
+		}
+
+		switch field, val := l[:colon], strings.TrimSpace(l[colon+1:]); field {
+		case "Package":
+			pkg = val
+			idx.pkgs[pkg] = true
+		case "Provides":
+			if pkg == "" {
+				return fmt.Errorf("line %d: Provides field before Package field", line)
+			}
+			for _, p := range strings.Split(val, ",") {
+				p = stripQualifiers(p)
+				if p != "" {
+					idx.provides[p] = append(idx.provides[p], pkg)
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("scanning index: %v", err)
+	}
+	return nil
+}
+
+// NumPackages returns the number of concrete packages in the index.
+func (idx *Index) NumPackages() int {
+	return len(idx.pkgs)
+}
+
+// Contains returns true if the named package is present in the index, either
+// as a concrete package or as a virtual package provided by another.
+func (idx *Index) Contains(name string) bool {
+	name = stripQualifiers(name)
+	return idx.pkgs[name] || len(idx.provides[name]) > 0
+}
+
+// Suggest returns up to max package names which are a close match for the
+// given name, most similar first.
+func (idx *Index) Suggest(name string, max int) []string {
+	name = stripQualifiers(name)
+	threshold := len(name) / 3
+	if threshold < 2 {
+		threshold = 2
+	}
+
+	type candidate struct {
+		name string
+		dist int
+	}
+	var candidates []candidate
+	for pkg := range idx.pkgs {
+		if d := editdist.Distance(name, pkg); d <= threshold {
+			candidates = append(candidates, candidate{pkg, d})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].dist == candidates[j].dist {
+			return candidates[i].name < candidates[j].name
+		}
+		return candidates[i].dist < candidates[j].dist
+	})
+
+	out := make([]string, 0, max)
+	for i := 0; i < len(candidates) && i < max; i++ {
+		out = append(out, candidates[i].name)
+	}
+	return out
+}
+
+// stripQualifiers removes any version constraint or architecture qualifier
+// from a package reference, such as 'foo (>= 1.2)' or 'foo:i386'.
+func stripQualifiers(name string) string {
+	name = strings.TrimSpace(name)
+	if idx := strings.IndexAny(name, " (=:"); idx >= 0 {
+		name = name[:idx]
+	}
+	return name
+}
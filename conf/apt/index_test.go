@@ -0,0 +1,76 @@
+package apt
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadTestIndex(t *testing.T) *Index {
+	t.Helper()
+	f, err := os.Open("testdata/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	idx := NewIndex()
+	if err := idx.ParseIndex(f); err != nil {
+		t.Fatalf("ParseIndex() failed: %v", err)
+	}
+	return idx
+}
+
+func TestParseIndex(t *testing.T) {
+	idx := loadTestIndex(t)
+	if got, want := idx.NumPackages(), 4; got != want {
+		t.Errorf("NumPackages() = %d, want %d", got, want)
+	}
+
+	tcs := []struct {
+		name string
+		want bool
+	}{
+		{"htop", true},
+		{"screen", true},
+		{"awk", true},
+		{"mail-transport-agent", true},
+		{"exim4-localscanapi-4.1", true},
+		{"htop:amd64", true},
+		{"htop=3.0.5-7", true},
+		{"htopp", false},
+		{"Description", false},
+	}
+	for _, tc := range tcs {
+		if got := idx.Contains(tc.name); got != tc.want {
+			t.Errorf("Contains(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseIndexMalformed(t *testing.T) {
+	idx := NewIndex()
+	if err := idx.ParseIndex(strings.NewReader("Package: a\nno field here\n")); err == nil {
+		t.Error("ParseIndex() did not fail for malformed index")
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	idx := loadTestIndex(t)
+
+	tcs := []struct {
+		name string
+		want []string
+	}{
+		{"htopp", []string{"htop"}},
+		{"scren", []string{"screen"}},
+		{"exim4-daemon-lite", []string{"exim4-daemon-light"}},
+		{"kicad", []string{}},
+	}
+	for _, tc := range tcs {
+		if got := idx.Suggest(tc.name, 3); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Suggest(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Package grub generates grub configuration: /etc/default/grub for a built
+// system, and complete grub.cfg menus for images.
+package grub
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Entry describes a boot menu entry.
+type Entry struct {
+	Title string `toml:"title"`
+	// ID identifies the entry when setting the default.
+	ID string `toml:"id"`
+	// Search is the UUID of the filesystem which paths are relative to.
+	// If unset, paths are relative to the filesystem grub was loaded from.
+	Search string `toml:"search_uuid"`
+	Linux  string `toml:"linux"`
+	Initrd string `toml:"initrd"`
+	// Options is the kernel command line.
+	Options string `toml:"options"`
+	// Chainloader is an EFI executable to boot instead of a kernel.
+	Chainloader string `toml:"chainloader"`
+	// Commands are run after any other statements.
+	Commands []string `toml:"commands"`
+	// EFIOnly entries are only shown when booted by UEFI firmware.
+	EFIOnly bool `toml:"efi_only"`
+}
+
+// Validate returns an error if the entry is invalid.
+func (e *Entry) Validate() error {
+	if e.Title == "" {
+		return fmt.Errorf("entry has no title")
+	}
+	if strings.ContainsAny(e.Title, "\"\n") {
+		return fmt.Errorf("entry %q: title cannot contain quotes or newlines", e.Title)
+	}
+	if strings.ContainsAny(e.ID, " \"\n") {
+		return fmt.Errorf("entry %q: id cannot contain spaces, quotes or newlines", e.Title)
+	}
+	if e.Linux == "" && e.Chainloader == "" && len(e.Commands) == 0 {
+		return fmt.Errorf("entry %q: one of linux, chainloader or commands must be set", e.Title)
+	}
+	if e.Linux != "" && e.Chainloader != "" {
+		return fmt.Errorf("entry %q: linux and chainloader are mutually exclusive", e.Title)
+	}
+	return nil
+}
+
+// String returns the entry as a grub menuentry.
+func (e *Entry) String() string {
+	var out strings.Builder
+	indent := ""
+	if e.EFIOnly {
+		out.WriteString("if [ \"${grub_platform}\" = \"efi\" ]; then\n")
+		indent = "  "
+	}
+	if e.ID != "" {
+		fmt.Fprintf(&out, "%smenuentry \"%s\" --id %s {\n", indent, e.Title, e.ID)
+	} else {
+		fmt.Fprintf(&out, "%smenuentry \"%s\" {\n", indent, e.Title)
+	}
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&out, "%s        "+format+"\n", append([]interface{}{indent}, args...)...)
+	}
+	if e.Search != "" {
+		line("search --no-floppy --fs-uuid --set %s", e.Search)
+	}
+	if e.Linux != "" {
+		line("linux  %s", strings.TrimSpace(e.Linux+" "+e.Options))
+	}
+	if e.Initrd != "" {
+		line("initrd %s", e.Initrd)
+	}
+	if e.Chainloader != "" {
+		line("chainloader %s", e.Chainloader)
+	}
+	for _, c := range e.Commands {
+		line("%s", c)
+	}
+	fmt.Fprintf(&out, "%s}\n", indent)
+	if e.EFIOnly {
+		out.WriteString("fi\n")
+	}
+	return out.String()
+}
+
+// colors are the color names grub understands.
+var colors = map[string]bool{
+	"black": true, "blue": true, "green": true, "cyan": true, "red": true,
+	"magenta": true, "brown": true, "light-gray": true, "dark-gray": true,
+	"light-blue": true, "light-green": true, "light-cyan": true,
+	"light-red": true, "light-magenta": true, "yellow": true, "white": true,
+}
+
+func validColorPair(pair string) error {
+	spl := strings.Split(pair, "/")
+	if len(spl) != 2 {
+		return fmt.Errorf("color %q is not in the form foreground/background", pair)
+	}
+	for _, c := range spl {
+		if !colors[c] {
+			return fmt.Errorf("unknown color %q", c)
+		}
+	}
+	return nil
+}
+
+// Config describes the boot menu of a system.
+type Config struct {
+	DistroName string `toml:"distro_name"`
+	// Timeout is the number of seconds before the default entry is
+	// booted.
+	Timeout int `toml:"timeout"`
+	// Default is the index or title of the default entry. If unset,
+	// the generator of the menu picks one.
+	Default string `toml:"default"`
+	// Cmdline is added to the kernel command line of normal boots.
+	Cmdline string `toml:"cmdline"`
+	// Theme is the path to a theme.txt in the built system. The
+	// directory containing it is the theme.
+	Theme string `toml:"theme"`
+	// Background is the path to a background image in the built system.
+	Background string `toml:"background"`
+	// ColorNormal and ColorHighlight are foreground/background pairs,
+	// such as white/black.
+	ColorNormal    string `toml:"color_normal"`
+	ColorHighlight string `toml:"color_highlight"`
+	// SerialConsole shows the menu and kernel console on the first
+	// serial port, as well as the screen.
+	SerialConsole bool `toml:"serial_console"`
+	// Entries are added to the end of the menu.
+	Entries []Entry `toml:"entries"`
+}
+
+// serialCmdline sends kernel output to the first serial port. The screen
+// is listed last so it remains /dev/console.
+const serialCmdline = "console=ttyS0,115200 console=tty0"
+
+// DefaultConfig returns the boot menu used when none is configured.
+func DefaultConfig() Config {
+	return Config{
+		DistroName:     "TwitchyLinux",
+		Timeout:        7,
+		ColorNormal:    "white/black",
+		ColorHighlight: "black/light-gray",
+	}
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c *Config) Validate() error {
+	if c.DistroName == "" || strings.ContainsAny(c.DistroName, "\"\n") {
+		return fmt.Errorf("invalid distro name %q", c.DistroName)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+	if strings.ContainsAny(c.Default+c.Cmdline, "\"\n") {
+		return fmt.Errorf("default and cmdline cannot contain quotes or newlines")
+	}
+	for _, p := range []string{c.Theme, c.Background} {
+		if p != "" && !path.IsAbs(p) {
+			return fmt.Errorf("path %q must be absolute", p)
+		}
+	}
+	if c.Theme != "" && path.Base(c.Theme) != "theme.txt" {
+		return fmt.Errorf("theme %q is not a theme.txt file", c.Theme)
+	}
+	for _, pair := range []string{c.ColorNormal, c.ColorHighlight} {
+		if err := validColorPair(pair); err != nil {
+			return err
+		}
+	}
+	for i := range c.Entries {
+		if err := c.Entries[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultFile returns the contents of /etc/default/grub, which
+// grub-mkconfig reads when generating the menu of an installed system.
+func (c *Config) DefaultFile() string {
+	def := c.Default
+	if def == "" {
+		def = "0"
+	}
+	var out strings.Builder
+	out.WriteString("# Generated by twl-builder from the [bootloader] config.\n")
+	out.WriteString("# Run 'update-grub' after making changes.\n\n")
+	fmt.Fprintf(&out, "GRUB_DEFAULT=%s\n", strconv.Quote(def))
+	fmt.Fprintf(&out, "GRUB_TIMEOUT=%d\n", c.Timeout)
+	fmt.Fprintf(&out, "GRUB_DISTRIBUTOR=%s\n", strconv.Quote(c.DistroName))
+	fmt.Fprintf(&out, "GRUB_CMDLINE_LINUX_DEFAULT=%s\n", strconv.Quote(c.Cmdline))
+	if c.SerialConsole {
+		fmt.Fprintf(&out, "GRUB_CMDLINE_LINUX=%s\n", strconv.Quote(serialCmdline))
+		out.WriteString("GRUB_TERMINAL=\"console serial\"\n")
+		out.WriteString("GRUB_SERIAL_COMMAND=\"serial --unit=0 --speed=115200\"\n")
+	} else {
+		out.WriteString("GRUB_CMDLINE_LINUX=\"\"\n")
+	}
+	if c.Theme != "" {
+		fmt.Fprintf(&out, "GRUB_THEME=%s\n", strconv.Quote(c.Theme))
+	}
+	if c.Background != "" {
+		fmt.Fprintf(&out, "GRUB_BACKGROUND=%s\n", strconv.Quote(c.Background))
+	}
+	fmt.Fprintf(&out, "GRUB_COLOR_NORMAL=%s\n", strconv.Quote(c.ColorNormal))
+	fmt.Fprintf(&out, "GRUB_COLOR_HIGHLIGHT=%s\n", strconv.Quote(c.ColorHighlight))
+	return out.String()
+}
+
+// CustomScript returns a script for /etc/grub.d which adds the configured
+// entries to menus generated by grub-mkconfig, or the empty string if
+// there are none.
+func (c *Config) CustomScript() string {
+	if len(c.Entries) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteString("#!/bin/sh\nexec tail -n +3 $0\n")
+	for i := range c.Entries {
+		out.WriteString("\n")
+		out.WriteString(c.Entries[i].String())
+	}
+	return out.String()
+}
+
+// Menu describes a complete grub.cfg.
+type Menu struct {
+	Config *Config
+	// Default is the default entry used if the config does not set one.
+	Default string
+	// Theme and Background are the paths grub loads the theme and
+	// background from, which differ from the paths in the built system
+	// when /boot is a separate filesystem.
+	Theme      string
+	Background string
+	// Font is loaded for the graphical terminal if set.
+	Font string
+	// Script is run before the entries, and may change the default.
+	Script string
+	// Entries are generated for the system, and precede any configured
+	// entries.
+	Entries []Entry
+}
+
+// String returns the menu as a grub.cfg.
+func (m *Menu) String() string {
+	c := m.Config
+	def := c.Default
+	if def == "" {
+		def = m.Default
+	}
+	if def == "" {
+		def = "0"
+	}
+
+	var out strings.Builder
+	out.WriteString("# Generated by twl-builder.\n")
+	fmt.Fprintf(&out, "set menu_color_normal=%s\n", c.ColorNormal)
+	fmt.Fprintf(&out, "set menu_color_highlight=%s\n", c.ColorHighlight)
+	fmt.Fprintf(&out, "set timeout=%d\n", c.Timeout)
+	fmt.Fprintf(&out, "set default=%s\n\n", strconv.Quote(def))
+
+	out.WriteString(`if [ "${grub_platform}" = "efi" ]; then
+  insmod efi_gop
+  insmod efi_uga
+else
+  insmod vbe
+  insmod vga
+fi
+insmod all_video
+insmod gfxterm
+insmod png
+insmod jpeg
+`)
+	if m.Font != "" {
+		fmt.Fprintf(&out, "loadfont %s\n", m.Font)
+	}
+	out.WriteString("set gfxmode=1024x768x32,1024x768x16,auto\n")
+	out.WriteString("set gfxpayload=keep\n")
+	if c.SerialConsole {
+		out.WriteString("serial --unit=0 --speed=115200\n")
+		out.WriteString("terminal_input console serial\n")
+		out.WriteString("terminal_output gfxterm serial\n")
+	} else {
+		out.WriteString("terminal_output gfxterm\n")
+	}
+	if m.Background != "" {
+		fmt.Fprintf(&out, "background_image %s\n", m.Background)
+	}
+	if m.Theme != "" {
+		fmt.Fprintf(&out, "set theme=%s\n", m.Theme)
+	}
+	if m.Script != "" {
+		out.WriteString("\n")
+		out.WriteString(m.Script)
+	}
+
+	for _, entries := range [][]Entry{m.Entries, c.Entries} {
+		for _, e := range entries {
+			if c.SerialConsole && e.Linux != "" {
+				e.Options = strings.TrimSpace(e.Options + " " + serialCmdline)
+			}
+			out.WriteString("\n")
+			out.WriteString(e.String())
+		}
+	}
+	return out.String()
+}
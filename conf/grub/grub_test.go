@@ -0,0 +1,175 @@
+package grub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tcs := []struct {
+		name    string
+		mod     func(c *Config)
+		wantErr bool
+	}{
+		{name: "default", mod: func(c *Config) {}},
+		{name: "theme", mod: func(c *Config) { c.Theme = "/boot/grub/themes/twl/theme.txt" }},
+		{name: "bad color", mod: func(c *Config) { c.ColorNormal = "white" }, wantErr: true},
+		{name: "unknown color", mod: func(c *Config) { c.ColorHighlight = "black/orange" }, wantErr: true},
+		{name: "relative background", mod: func(c *Config) { c.Background = "bg.png" }, wantErr: true},
+		{name: "theme not theme.txt", mod: func(c *Config) { c.Theme = "/usr/share/grub/themes/twl" }, wantErr: true},
+		{name: "quoted cmdline", mod: func(c *Config) { c.Cmdline = `init="/bin/sh"` }, wantErr: true},
+		{name: "negative timeout", mod: func(c *Config) { c.Timeout = -1 }, wantErr: true},
+		{
+			name:    "empty entry",
+			mod:     func(c *Config) { c.Entries = []Entry{{Title: "Nothing"}} },
+			wantErr: true,
+		},
+		{
+			name:    "linux and chainloader",
+			mod:     func(c *Config) { c.Entries = []Entry{{Title: "Both", Linux: "/vmlinuz", Chainloader: "/a.efi"}} },
+			wantErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tc.mod(&c)
+			if err := c.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultFile(t *testing.T) {
+	c := DefaultConfig()
+	c.Cmdline = "quiet splash"
+	c.Background = "/usr/share/images/bg.png"
+	out := c.DefaultFile()
+	for _, want := range []string{
+		`GRUB_DEFAULT="0"`,
+		"GRUB_TIMEOUT=7\n",
+		`GRUB_DISTRIBUTOR="TwitchyLinux"`,
+		`GRUB_CMDLINE_LINUX_DEFAULT="quiet splash"`,
+		`GRUB_BACKGROUND="/usr/share/images/bg.png"`,
+		`GRUB_COLOR_HIGHLIGHT="black/light-gray"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("DefaultFile() does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "GRUB_THEME") {
+		t.Errorf("DefaultFile() sets a theme when none is configured:\n%s", out)
+	}
+}
+
+func TestEntryString(t *testing.T) {
+	tcs := []struct {
+		name  string
+		entry Entry
+		want  string
+	}{
+		{
+			name:  "linux",
+			entry: Entry{Title: "TwitchyLinux", Search: "abc", Linux: "/vmlinuz", Initrd: "/initrd.img", Options: "ro"},
+			want: `menuentry "TwitchyLinux" {
+        search --no-floppy --fs-uuid --set abc
+        linux  /vmlinuz ro
+        initrd /initrd.img
+}
+`,
+		},
+		{
+			name:  "id",
+			entry: Entry{Title: "TwitchyLinux (slot a)", ID: "slot-a", Linux: "/slot-a/vmlinuz"},
+			want: `menuentry "TwitchyLinux (slot a)" --id slot-a {
+        linux  /slot-a/vmlinuz
+}
+`,
+		},
+		{
+			name:  "efi only",
+			entry: Entry{Title: "Firmware setup", Commands: []string{"fwsetup"}, EFIOnly: true},
+			want: `if [ "${grub_platform}" = "efi" ]; then
+  menuentry "Firmware setup" {
+          fwsetup
+  }
+fi
+`,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.entry.String(); got != tc.want {
+				t.Errorf("String() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMenu(t *testing.T) {
+	c := DefaultConfig()
+	c.Entries = []Entry{{Title: "Memory test", Linux: "/memtest86+.bin"}}
+	m := Menu{
+		Config:  &c,
+		Default: "1",
+		Theme:   "/grub/themes/twl/theme.txt",
+		Entries: []Entry{{Title: "TwitchyLinux", Linux: "/vmlinuz"}},
+	}
+	out := m.String()
+	for _, want := range []string{
+		`set default="1"`,
+		"set menu_color_normal=white/black",
+		"set theme=/grub/themes/twl/theme.txt",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("String() does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, `"TwitchyLinux"`) > strings.Index(out, `"Memory test"`) {
+		t.Errorf("configured entries precede generated ones:\n%s", out)
+	}
+
+	c.Default = "Memory test"
+	if out := m.String(); !strings.Contains(out, `set default="Memory test"`) {
+		t.Errorf("configured default not used:\n%s", out)
+	}
+}
+
+func TestCustomScript(t *testing.T) {
+	c := DefaultConfig()
+	if s := c.CustomScript(); s != "" {
+		t.Errorf("CustomScript() = %q, want empty with no entries", s)
+	}
+	c.Entries = []Entry{{Title: "Memory test", Linux: "/memtest86+.bin"}}
+	if s := c.CustomScript(); !strings.HasPrefix(s, "#!/bin/sh\nexec tail -n +3 $0\n") || !strings.Contains(s, `menuentry "Memory test"`) {
+		t.Errorf("CustomScript() = %q", s)
+	}
+}
+
+func TestSerialConsole(t *testing.T) {
+	c := DefaultConfig()
+	c.SerialConsole = true
+	m := Menu{
+		Config: &c,
+		Entries: []Entry{
+			{Title: "TwitchyLinux", Linux: "/vmlinuz", Options: "ro"},
+			{Title: "Firmware setup", Commands: []string{"fwsetup"}},
+		},
+	}
+	out := m.String()
+	for _, want := range []string{
+		"terminal_output gfxterm serial\n",
+		"linux  /vmlinuz ro console=ttyS0,115200 console=tty0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("String() does not contain %q:\n%s", want, out)
+		}
+	}
+	if m.Entries[0].Options != "ro" {
+		t.Errorf("String() modified entry options: %q", m.Entries[0].Options)
+	}
+	if def := c.DefaultFile(); !strings.Contains(def, `GRUB_TERMINAL="console serial"`) {
+		t.Errorf("DefaultFile() does not enable the serial terminal:\n%s", def)
+	}
+}
@@ -0,0 +1,207 @@
+// Package kconfig parses, modifies and serializes Linux kernel .config files.
+package kconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	symbolPrefix = "CONFIG_"
+	notSetSuffix = " is not set"
+)
+
+// Tristate and boolean symbol values.
+const (
+	Yes    = "y"
+	Module = "m"
+	No     = "n"
+)
+
+var (
+	symbolRe  = regexp.MustCompile("^[A-Za-z0-9_]+$")
+	numericRe = regexp.MustCompile("^(-?[0-9]+|0x[0-9a-fA-F]+)$")
+)
+
+// line represents a single line of a .config file. Lines which do not
+// describe a symbol (comments and blank lines) have an empty symbol.
+type line struct {
+	symbol string
+	value  string
+	raw    string
+}
+
+// Config represents the contents of a kernel .config file. The order of
+// symbols and comments is preserved across parsing and serialization.
+type Config struct {
+	lines   []line
+	symbols map[string]int
+}
+
+// New returns an empty config.
+func New() *Config {
+	return &Config{symbols: map[string]int{}}
+}
+
+// Parse reads a .config file.
+func Parse(r io.Reader) (*Config, error) {
+	var (
+		s   = bufio.NewScanner(r)
+		out = New()
+		i   int
+	)
+
+	for s.Scan() {
+		i++
+		l := s.Text()
+		trimmed := strings.TrimSpace(l)
+
+		switch {
+		case strings.HasPrefix(trimmed, "# "+symbolPrefix) && strings.HasSuffix(trimmed, notSetSuffix):
+			sym := strings.TrimSuffix(strings.TrimPrefix(trimmed, "# "), notSetSuffix)
+			out.add(line{symbol: sym, value: No})
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			out.lines = append(out.lines, line{raw: l})
+		default:
+			eq := strings.Index(trimmed, "=")
+			if eq <= 0 || !strings.HasPrefix(trimmed, symbolPrefix) {
+				return nil, fmt.Errorf("line %d: expected %s<symbol>=<value>, got %q", i, symbolPrefix, l)
+			}
+			out.add(line{symbol: trimmed[:eq], value: trimmed[eq+1:]})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("scanning config: %v", err)
+	}
+	return out, nil
+}
+
+func (c *Config) add(l line) {
+	if idx, exists := c.symbols[l.symbol]; exists {
+		c.lines[idx] = l
+		return
+	}
+	c.symbols[l.symbol] = len(c.lines)
+	c.lines = append(c.lines, l)
+}
+
+// Get returns the value of the symbol. Symbols which are explicitly not set
+// have the value No. The boolean return value is false if the symbol is not
+// present at all.
+func (c *Config) Get(symbol string) (string, bool) {
+	idx, ok := c.symbols[CanonicalSymbol(symbol)]
+	if !ok {
+		return "", false
+	}
+	return c.lines[idx].value, true
+}
+
+// Set assigns a value to the symbol, adding it if it is not present. Values
+// should be formatted as they appear in a .config file, which
+// FormatValue can do.
+func (c *Config) Set(symbol, value string) {
+	c.add(line{symbol: CanonicalSymbol(symbol), value: value})
+}
+
+// Symbols returns the names of all symbols in the config, in file order.
+func (c *Config) Symbols() []string {
+	out := make([]string, 0, len(c.symbols))
+	for _, l := range c.lines {
+		if l.symbol != "" {
+			out = append(out, l.symbol)
+		}
+	}
+	return out
+}
+
+// Merge sets every symbol in the fragment, overriding existing values.
+// Symbols are applied in sorted order so the output is deterministic.
+func (c *Config) Merge(fragment map[string]string) {
+	syms := make([]string, 0, len(fragment))
+	for sym := range fragment {
+		syms = append(syms, sym)
+	}
+	sort.Strings(syms)
+
+	for _, sym := range syms {
+		c.Set(sym, fragment[sym])
+	}
+}
+
+// Serialize writes the config in the .config format.
+func (c *Config) Serialize(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, l := range c.lines {
+		var err error
+		switch {
+		case l.symbol == "":
+			_, err = bw.WriteString(l.raw + "\n")
+		case l.value == No:
+			_, err = bw.WriteString("# " + l.symbol + notSetSuffix + "\n")
+		default:
+			_, err = bw.WriteString(l.symbol + "=" + l.value + "\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// CanonicalSymbol returns the symbol name with the CONFIG_ prefix.
+func CanonicalSymbol(symbol string) string {
+	if strings.HasPrefix(symbol, symbolPrefix) {
+		return symbol
+	}
+	return symbolPrefix + symbol
+}
+
+// FormatValue converts a value into its .config representation. Booleans
+// become y or n, numbers are written in decimal, the tristate values and
+// numeric strings are kept as-is, and other strings are quoted.
+func FormatValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case bool:
+		if val {
+			return Yes, nil
+		}
+		return No, nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case int:
+		return strconv.Itoa(val), nil
+	case string:
+		switch {
+		case val == Yes, val == Module, val == No:
+			return val, nil
+		case numericRe.MatchString(val):
+			return val, nil
+		case len(val) >= 2 && strings.HasPrefix(val, "\"") && strings.HasSuffix(val, "\""):
+			return val, nil
+		}
+		return strconv.Quote(val), nil
+	}
+	return "", fmt.Errorf("unsupported value type %T", v)
+}
+
+// ParseFragment converts a map of symbols to values (such as decoded from
+// configuration) into canonical symbols and .config formatted values.
+func ParseFragment(in map[string]interface{}) (map[string]string, error) {
+	out := make(map[string]string, len(in))
+	for sym, v := range in {
+		if !symbolRe.MatchString(sym) {
+			return nil, fmt.Errorf("invalid symbol name %q", sym)
+		}
+		val, err := FormatValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", sym, err)
+		}
+		out[CanonicalSymbol(sym)] = val
+	}
+	return out, nil
+}
@@ -0,0 +1,164 @@
+package kconfig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `#
+# Automatically generated file; DO NOT EDIT.
+# Linux/x86 5.9.14 Kernel Configuration
+#
+CONFIG_CC_VERSION_TEXT="gcc (Debian 8.3.0-6) 8.3.0"
+CONFIG_CC_IS_GCC=y
+CONFIG_GCC_VERSION=80300
+
+#
+# General setup
+#
+# CONFIG_COMPILE_TEST is not set
+CONFIG_LOCALVERSION=""
+CONFIG_PHYSICAL_START=0x1000000
+CONFIG_USB_SERIAL=m
+`
+
+func TestRoundTrip(t *testing.T) {
+	c, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := c.Serialize(&out); err != nil {
+		t.Fatalf("Serialize() failed: %v", err)
+	}
+	if got := out.String(); got != testConfig {
+		t.Errorf("Serialize() = %q, want %q", got, testConfig)
+	}
+}
+
+func TestRoundTripResource(t *testing.T) {
+	d, err := ioutil.ReadFile("../../resources/linux/.config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Parse(bytes.NewReader(d))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	var out bytes.Buffer
+	if err := c.Serialize(&out); err != nil {
+		t.Fatalf("Serialize() failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), d) {
+		t.Error("serialized resources/linux/.config differs from the original")
+	}
+}
+
+func TestGet(t *testing.T) {
+	c, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+
+	tcs := []struct {
+		symbol string
+		val    string
+		ok     bool
+	}{
+		{"CONFIG_CC_IS_GCC", Yes, true},
+		{"CC_IS_GCC", Yes, true},
+		{"CONFIG_COMPILE_TEST", No, true},
+		{"CONFIG_USB_SERIAL", Module, true},
+		{"CONFIG_LOCALVERSION", `""`, true},
+		{"CONFIG_PHYSICAL_START", "0x1000000", true},
+		{"CONFIG_MISSING", "", false},
+	}
+	for _, tc := range tcs {
+		val, ok := c.Get(tc.symbol)
+		if val != tc.val || ok != tc.ok {
+			t.Errorf("Get(%q) = %q, %v, want %q, %v", tc.symbol, val, ok, tc.val, tc.ok)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	c, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+
+	frag, err := ParseFragment(map[string]interface{}{
+		"CONFIG_COMPILE_TEST": "y",
+		"CC_IS_GCC":           false,
+		"CONFIG_LOCALVERSION": "-twl",
+		"CONFIG_NEW_THING":    int64(42),
+	})
+	if err != nil {
+		t.Fatalf("ParseFragment() failed: %v", err)
+	}
+	c.Merge(frag)
+
+	var out bytes.Buffer
+	if err := c.Serialize(&out); err != nil {
+		t.Fatalf("Serialize() failed: %v", err)
+	}
+	want := `#
+# Automatically generated file; DO NOT EDIT.
+# Linux/x86 5.9.14 Kernel Configuration
+#
+CONFIG_CC_VERSION_TEXT="gcc (Debian 8.3.0-6) 8.3.0"
+# CONFIG_CC_IS_GCC is not set
+CONFIG_GCC_VERSION=80300
+
+#
+# General setup
+#
+CONFIG_COMPILE_TEST=y
+CONFIG_LOCALVERSION="-twl"
+CONFIG_PHYSICAL_START=0x1000000
+CONFIG_USB_SERIAL=m
+CONFIG_NEW_THING=42
+`
+	if got := out.String(); got != want {
+		t.Errorf("merged config = %q, want %q", got, want)
+	}
+}
+
+func TestParseFragmentInvalid(t *testing.T) {
+	if _, err := ParseFragment(map[string]interface{}{"CONFIG_A B": "y"}); err == nil {
+		t.Error("ParseFragment() did not fail on invalid symbol")
+	}
+	if _, err := ParseFragment(map[string]interface{}{"CONFIG_A": []string{"y"}}); err == nil {
+		t.Error("ParseFragment() did not fail on invalid value")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	resolved, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+
+	got := Verify(resolved, map[string]string{
+		"CONFIG_CC_IS_GCC":      Yes,
+		"CONFIG_COMPILE_TEST":   Yes,
+		"CONFIG_USB_SERIAL":     Yes,
+		"CONFIG_DROPPED":        Module,
+		"CONFIG_ABSENT_AND_OFF": No,
+	})
+	want := []Mismatch{
+		{Symbol: "CONFIG_COMPILE_TEST", Want: Yes, Got: No},
+		{Symbol: "CONFIG_DROPPED", Want: Module},
+		{Symbol: "CONFIG_USB_SERIAL", Want: Yes, Got: Module},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Verify() = %+v, want %+v", got, want)
+	}
+	if !got[1].Dropped() {
+		t.Errorf("%v.Dropped() = false, want true", got[1])
+	}
+}
@@ -0,0 +1,62 @@
+package kconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Mismatch describes a requested symbol value which was not present in
+// the resolved configuration.
+type Mismatch struct {
+	Symbol string
+	Want   string
+	// Got is the resolved value, or empty if the symbol was dropped.
+	Got string
+}
+
+// Dropped returns true if the symbol was removed from the configuration
+// entirely, typically because its dependencies were not met.
+func (m Mismatch) Dropped() bool {
+	return m.Got == ""
+}
+
+func (m Mismatch) String() string {
+	if m.Dropped() {
+		return fmt.Sprintf("%s: requested %s, but the option was dropped (unmet dependencies?)", m.Symbol, m.Want)
+	}
+	return fmt.Sprintf("%s: requested %s, but resolved to %s", m.Symbol, m.Want, m.Got)
+}
+
+// Verify checks that every symbol in want took its requested value in the
+// resolved config, returning any that did not in sorted order. A symbol
+// requested as No is satisfied if it is absent.
+func Verify(resolved *Config, want map[string]string) []Mismatch {
+	var out []Mismatch
+	for sym, wantVal := range want {
+		sym = CanonicalSymbol(sym)
+		got, ok := resolved.Get(sym)
+		switch {
+		case !ok && wantVal == No:
+		case !ok:
+			out = append(out, Mismatch{Symbol: sym, Want: wantVal})
+		case got != wantVal:
+			out = append(out, Mismatch{Symbol: sym, Want: wantVal, Got: got})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Symbol < out[j].Symbol
+	})
+	return out
+}
+
+// Report formats a list of mismatches as a human-readable report.
+func Report(mismatches []Mismatch) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%d kernel config option(s) did not take their requested value:\n", len(mismatches))
+	for _, m := range mismatches {
+		out.WriteString("  " + m.String() + "\n")
+	}
+	return out.String()
+}
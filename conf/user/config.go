@@ -227,6 +227,22 @@ func flattenAddUserOpts(opts ...AddUserOpt) AddUserOpt {
 	return out
 }
 
+// User returns the passwd entry of the named user.
+func (m *Config) User(name string) (PasswdEntry, bool) {
+	if idx := m.userIndex(name); idx >= 0 {
+		return m.users[idx], true
+	}
+	return PasswdEntry{}, false
+}
+
+// Group returns the group entry of the named group.
+func (m *Config) Group(name string) (GroupEntry, bool) {
+	if idx := m.groupIndex(name); idx >= 0 {
+		return m.groups[idx], true
+	}
+	return GroupEntry{}, false
+}
+
 func (m *Config) userIndex(name string) int {
 	idx := -1
 	for i, u := range m.users {
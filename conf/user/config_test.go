@@ -223,3 +223,23 @@ func makeTestRoot(t *testing.T, passwd, group, adduser string) (string, func())
 		}
 	}
 }
+
+func TestUserLookup(t *testing.T) {
+	root, cleanup := makeTestRoot(t, "root:x:0:0:root:/root:/bin/bash\ntwl:x:1000:1000:,,,:/home/twl:/bin/bash\n", "root:x:0:\ntwl:x:1000:\n", "")
+	defer cleanup()
+	c, err := ReadConfig(root)
+	if err != nil {
+		t.Fatalf("ReadConfig() failed: %v", err)
+	}
+
+	u, ok := c.User("twl")
+	if !ok {
+		t.Fatal("User(twl) not found")
+	}
+	if u.HomeDir != "/home/twl" || u.UID != 1000 {
+		t.Errorf("User(twl) = %+v, want home /home/twl, uid 1000", u)
+	}
+	if _, ok := c.User("nobody"); ok {
+		t.Error("User(nobody) unexpectedly found")
+	}
+}
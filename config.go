@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/twitchylinux/builder/stager"
+)
+
+// showConfig prints the effective stage config. In sources mode, it prints
+// each value with the file and line which set it. In dump mode, it prints
+// the merged config as TOML, or JSON with --json. In explain mode, it
+// prints whether each conditional part of the config is included, and the
+// values of its conditions.
+func showConfig(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		printUsage()
+		return errors.New("config requires a mode (sources, dump, explain)")
+	}
+	mode, args := args[0], args[1:]
+	asJSON, prefix := false, ""
+	switch mode {
+	case "sources":
+	case "dump":
+		if len(args) > 0 && args[0] == "--json" {
+			asJSON, args = true, args[1:]
+		}
+	case "explain":
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			prefix, args = args[0], args[1:]
+		}
+	default:
+		printUsage()
+		return fmt.Errorf("unknown config mode %q, want one of: sources, dump, explain", mode)
+	}
+	opts, err := stageConfigOpts(args)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(resourceDir(), "stage-conf")
+
+	switch mode {
+	case "dump":
+		return dumpConfig(dir, opts, asJSON)
+	case "explain":
+		return explainConfig(dir, opts, prefix)
+	}
+	sources, err := stager.Sources(dir, opts)
+	if err != nil {
+		return err
+	}
+	for _, s := range sources {
+		fmt.Printf("%s = %s  # %s\n", s.Key, tomlValue(s.Value), s)
+	}
+	return nil
+}
+
+// dumpConfig prints the merged stage config as TOML or JSON.
+func dumpConfig(dir string, opts stager.Options, asJSON bool) error {
+	tree, err := stager.LoadConfig(dir, opts)
+	if err != nil {
+		return err
+	}
+	if !asJSON {
+		s, err := tree.ToTomlString()
+		if err != nil {
+			return err
+		}
+		fmt.Print(s)
+		return nil
+	}
+	b, err := json.MarshalIndent(tree.ToMap(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// explainConfig prints whether each part of the config under prefix which
+// has a condition is included, with the value of each expression of the
+// condition and the features it read.
+func explainConfig(dir string, opts stager.Options, prefix string) error {
+	explanations, err := stager.Explain(dir, opts)
+	if err != nil {
+		return err
+	}
+	for _, e := range explanations {
+		if prefix != "" && e.Key != prefix && !strings.HasPrefix(e.Key, prefix+".") {
+			continue
+		}
+		state := "included"
+		if !e.Included {
+			state = "skipped"
+		}
+		if e.Reason != "" {
+			state += " (" + e.Reason + ")"
+		}
+		fmt.Printf("%s: %s\n", e.Key, state)
+		for _, r := range e.Results {
+			value := strconv.FormatBool(r.Value)
+			if r.Err != nil {
+				value = "error: " + r.Err.Error()
+			}
+			var features []string
+			for _, f := range sortedFeatures(r.Features) {
+				features = append(features, fmt.Sprintf("features.%s = %s", f, featureValue(r.Features[f])))
+			}
+			if len(features) > 0 {
+				value += " (" + strings.Join(features, ", ") + ")"
+			}
+			fmt.Printf("    %s %s = %s\n", r.Clause, r.Expr, value)
+		}
+		for i, a := range e.Actions {
+			fmt.Printf("    do[%d] %s: %s\n", i, a.Name, a.Doc)
+		}
+	}
+	return nil
+}
+
+func sortedFeatures(m map[string]interface{}) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// printFeatures writes the name, type, default and description of each
+// feature, in the style of flag.PrintDefaults.
+func printFeatures(w io.Writer, features []stager.Feature) {
+	for _, f := range features {
+		fmt.Fprintf(w, "  %s %s", f.Name, f.Type)
+		if f.Default != nil {
+			fmt.Fprintf(w, " (default %s)", tomlValue(f.Default))
+		}
+		fmt.Fprintf(w, "\n    \t%s", f.Description)
+		if len(f.Implies) > 0 {
+			fmt.Fprintf(w, " Implies %s.", strings.Join(f.Implies, ", "))
+		}
+		if len(f.Conflicts) > 0 {
+			fmt.Fprintf(w, " Conflicts with %s.", strings.Join(f.Conflicts, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// featureValue formats the value of a feature, which is nil if unset.
+func featureValue(v interface{}) string {
+	if v == nil {
+		return "unset"
+	}
+	return tomlValue(v)
+}
+
+// tomlValue formats a config value as it would be written in TOML, with
+// tables written inline.
+func tomlValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i := range v {
+			parts[i] = tomlValue(v[i])
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case []*toml.Tree:
+		parts := make([]string, len(v))
+		for i := range v {
+			parts[i] = tomlValue(v[i])
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case *toml.Tree:
+		keys := v.Keys()
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = k + " = " + tomlValue(v.GetPath([]string{k}))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return fmt.Sprint(v)
+}
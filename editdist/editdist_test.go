@@ -0,0 +1,23 @@
+package editdist
+
+import "testing"
+
+func TestDistance(t *testing.T) {
+	tcs := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"vim", "vim", 0},
+		{"vmi", "vim", 2},
+		{"kitten", "sitting", 3},
+		{"graphical", "graphcal", 1},
+	}
+	for _, tc := range tcs {
+		if got := Distance(tc.a, tc.b); got != tc.want {
+			t.Errorf("Distance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
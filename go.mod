@@ -12,4 +12,7 @@ require (
 	github.com/google/go-cmp v0.5.0
 	github.com/pelletier/go-toml v1.6.0
 	github.com/tredoe/osutil v0.0.0-20191018075336-e272fdda81c8
+	github.com/ulikunitz/xz v0.5.8
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
 )
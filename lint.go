@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/twitchylinux/builder/stager"
+)
+
+// lintConfig checks the stage config, printing each problem found with the
+// file and line it is at. In actions mode, it instead prints the install
+// actions steps may use.
+func lintConfig(ctx context.Context, args []string) error {
+	if len(args) > 0 && args[0] == "actions" {
+		printActions()
+		return nil
+	}
+	opts, err := stageConfigOpts(args)
+	if err != nil {
+		return err
+	}
+	err = stager.Lint(filepath.Join(resourceDir(), "stage-conf"), opts)
+	if problems, ok := err.(stager.Problems); ok {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		return fmt.Errorf("found %d problems in the stage config", len(problems))
+	}
+	return err
+}
+
+// printActions prints the name, description and keys of each registered
+// install action.
+func printActions() {
+	for _, a := range stager.ActionTypes() {
+		fmt.Printf("%s\n    %s\n", a.Name, a.Doc)
+		for _, f := range a.Fields() {
+			fmt.Printf("    %s: %s\n", f.Key, f.Type)
+		}
+	}
+}
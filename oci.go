@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/twitchylinux/builder/oci"
+	"github.com/twitchylinux/builder/stager"
+	"github.com/twitchylinux/builder/units"
+)
+
+// exportOCI writes a built system as an OCI image layout, as described by
+// the oci section of the stage config.
+func exportOCI(ctx context.Context, args []string) error {
+	dir, layout, opts, err := outputArgs("oci", args)
+	if err != nil {
+		return err
+	}
+	stageConf := filepath.Join(resourceDir(), "stage-conf")
+	conf, err := stager.OCIConfig(stageConf, opts)
+	if err != nil {
+		return err
+	}
+	conf.Exclude = append(conf.Exclude, statusDir)
+	if conf.Labels == nil {
+		conf.Labels = map[string]string{}
+	}
+	if _, ok := conf.Labels["org.opencontainers.image.version"]; !ok {
+		conf.Labels["org.opencontainers.image.version"] = *version
+	}
+
+	var (
+		groups []oci.Group
+		ctimes map[string]time.Time
+	)
+	if conf.LayerPerGroup {
+		if groups, err = unitGroupTimes(dir, stageConf, opts); err != nil {
+			return err
+		}
+		if ctimes, err = units.ReadChangeTimes(dir); err != nil {
+			return err
+		}
+	}
+
+	var created time.Time
+	if *srcDateEpoch != 0 {
+		created = time.Unix(*srcDateEpoch, 0).UTC()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancelCtxOnSignal(cancel)
+	return oci.Export(ctx, oci.Options{
+		BuildDir:    dir,
+		Dir:         layout,
+		Config:      conf,
+		Groups:      groups,
+		ChangeTimes: ctimes,
+		Created:     created,
+		Stdout:      os.Stdout,
+	})
+}
+
+// unitGroupTimes returns when each group of units finished building the
+// system in dir, from the status recorded as each unit completed. Groups
+// with no recorded units have no time.
+func unitGroupTimes(dir, stageConf string, opts stager.Options) ([]oci.Group, error) {
+	groups, err := stager.UnitGroups(stageConf, opts)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]oci.Group, 0, len(groups))
+	for _, g := range groups {
+		og := oci.Group{Name: g.Name}
+		for _, u := range g.Units {
+			fi, err := os.Stat(filepath.Join(dir, statusDir, u.Name()))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			if fi.ModTime().After(og.Done) {
+				og.Done = fi.ModTime()
+			}
+		}
+		out = append(out, og)
+	}
+	return out, nil
+}
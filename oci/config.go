@@ -0,0 +1,93 @@
+// Package oci exports a built system as an OCI image layout, which can be
+// copied to a registry or container engine with skopeo.
+package oci
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultExclude lists paths relative to the build directory which are
+// never part of the image: the kernel and bootloader, artifacts of the
+// kernel build, and the contents of filesystems the container engine
+// mounts.
+var defaultExclude = []string{
+	"boot",
+	"lib/modules",
+	"usr/lib/modules",
+	"linux-*",
+	"*.deb",
+	"*.buildinfo",
+	"*.changes",
+	"*.tar.*",
+	"dev/*",
+	"proc/*",
+	"sys/*",
+	"run/*",
+	"tmp/*",
+}
+
+// Config describes the image written from a built system.
+type Config struct {
+	// Tag is the reference name of the image in the layout.
+	Tag        string   `toml:"tag"`
+	Entrypoint []string `toml:"entrypoint"`
+	Cmd        []string `toml:"cmd"`
+	// Env lists variables in the form KEY=value.
+	Env        []string          `toml:"env"`
+	WorkingDir string            `toml:"working_dir"`
+	User       string            `toml:"user"`
+	Labels     map[string]string `toml:"labels"`
+	// LayerPerGroup writes the files changed by each group of units,
+	// such as the base system, into a layer of its own. Otherwise the
+	// image has a single layer.
+	LayerPerGroup bool `toml:"layer_per_group"`
+	// Exclude lists glob patterns of paths relative to the build
+	// directory which are not part of the image.
+	Exclude []string `toml:"exclude"`
+}
+
+// DefaultConfig returns the configuration used when none is specified.
+func DefaultConfig() Config {
+	return Config{
+		Tag: "latest",
+		Cmd: []string{"/bin/bash"},
+		Env: []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+	}
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c *Config) Validate() error {
+	if c.Tag == "" || strings.ContainsAny(c.Tag, "/: \t\n") {
+		return fmt.Errorf("invalid tag %q", c.Tag)
+	}
+	for _, e := range c.Env {
+		if i := strings.Index(e, "="); i <= 0 {
+			return fmt.Errorf("env %q is not in the form KEY=value", e)
+		}
+	}
+	if c.WorkingDir != "" && !path.IsAbs(c.WorkingDir) {
+		return fmt.Errorf("working_dir %q must be absolute", c.WorkingDir)
+	}
+	for _, p := range c.Exclude {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// excluded returns true if the path, relative to the build directory,
+// is not part of the image.
+func (c *Config) excluded(rel string) bool {
+	for _, patterns := range [][]string{defaultExclude, c.Exclude} {
+		for _, p := range patterns {
+			if m, _ := filepath.Match(p, rel); m {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+package oci
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Media types of the blobs in the image layout.
+const (
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	annotationRefName = "org.opencontainers.image.ref.name"
+	annotationCreated = "org.opencontainers.image.created"
+)
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type containerConfig struct {
+	User       string            `json:"User,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+}
+
+type history struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
+
+type imageConfig struct {
+	Created      time.Time       `json:"created"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       containerConfig `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []history `json:"history"`
+}
+
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+// Options describes an image to export.
+type Options struct {
+	// BuildDir is the root of the built system.
+	BuildDir string
+	// Dir is the image layout directory to create.
+	Dir    string
+	Config Config
+	// Groups are the groups of units the system was built with, in
+	// order, which are written as separate layers if configured.
+	Groups []Group
+	// ChangeTimes are the change times of files, by path relative to
+	// BuildDir, from before their times were clamped for a reproducible
+	// build. They are used in place of the current change time to find
+	// the group of a file.
+	ChangeTimes map[string]time.Time
+	// Created is recorded as the creation time of the image, the
+	// current time if unset.
+	Created time.Time
+
+	Stdout io.Writer
+}
+
+func (o *Options) logf(format string, args ...interface{}) {
+	fmt.Fprintf(o.Stdout, format+"\n", args...)
+}
+
+// Export writes the built system as an OCI image layout. On failure, the
+// layout directory is removed.
+func Export(ctx context.Context, opts Options) (err error) {
+	if opts.Stdout == nil {
+		opts.Stdout = ioutil.Discard
+	}
+	if opts.Created.IsZero() {
+		opts.Created = time.Now().UTC()
+	}
+	if err := opts.Config.Validate(); err != nil {
+		return err
+	}
+	groups := opts.Groups
+	if !opts.Config.LayerPerGroup || len(groups) == 0 {
+		groups = []Group{{Name: "rootfs"}}
+	}
+
+	if err := os.Mkdir(opts.Dir, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(opts.Dir)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Join(opts.Dir, "blobs", "sha256"), 0755); err != nil {
+		return err
+	}
+
+	entries, dirs, err := collect(opts.BuildDir, &opts.Config, groups, opts.ChangeTimes)
+	if err != nil {
+		return fmt.Errorf("reading system: %v", err)
+	}
+	layers := make([][]*entry, len(groups))
+	for _, e := range entries {
+		layers[e.layer] = append(layers[e.layer], e)
+	}
+
+	conf := imageConfig{
+		Created:      opts.Created,
+		Architecture: "amd64",
+		OS:           "linux",
+		Config: containerConfig{
+			User:       opts.Config.User,
+			Env:        opts.Config.Env,
+			Entrypoint: opts.Config.Entrypoint,
+			Cmd:        opts.Config.Cmd,
+			WorkingDir: opts.Config.WorkingDir,
+			Labels:     opts.Config.Labels,
+		},
+	}
+	conf.RootFS.Type = "layers"
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeManifest,
+		Annotations:   map[string]string{annotationCreated: opts.Created.Format(time.RFC3339)},
+	}
+
+	for i, layer := range layers {
+		if len(layer) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		opts.logf("Writing %s layer (%d files)...", groups[i].Name, len(layer))
+		desc, diffID, err := writeLayer(opts.Dir, opts.BuildDir, layer, dirs)
+		if err != nil {
+			return fmt.Errorf("writing %s layer: %v", groups[i].Name, err)
+		}
+		m.Layers = append(m.Layers, desc)
+		conf.RootFS.DiffIDs = append(conf.RootFS.DiffIDs, diffID)
+		conf.History = append(conf.History, history{Created: opts.Created, CreatedBy: "twl-builder: " + groups[i].Name})
+	}
+	if len(m.Layers) == 0 {
+		return fmt.Errorf("no files in %s", opts.BuildDir)
+	}
+
+	if m.Config, err = writeJSONBlob(opts.Dir, mediaTypeConfig, conf); err != nil {
+		return err
+	}
+	md, err := writeJSONBlob(opts.Dir, mediaTypeManifest, m)
+	if err != nil {
+		return err
+	}
+	md.Annotations = map[string]string{annotationRefName: opts.Config.Tag}
+
+	idx, err := json.Marshal(index{SchemaVersion: 2, Manifests: []descriptor{md}})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(opts.Dir, "index.json"), idx, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(opts.Dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+// blobWriter writes a blob to the layout, named by its digest once
+// complete.
+type blobWriter struct {
+	dir  string
+	f    *os.File
+	h    hash.Hash
+	size int64
+}
+
+func newBlobWriter(dir string) (*blobWriter, error) {
+	f, err := ioutil.TempFile(filepath.Join(dir, "blobs", "sha256"), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{dir: dir, f: f, h: sha256.New()}, nil
+}
+
+func (b *blobWriter) Write(p []byte) (int, error) {
+	n, err := b.f.Write(p)
+	b.h.Write(p[:n])
+	b.size += int64(n)
+	return n, err
+}
+
+// commit closes the blob and moves it to its final path.
+func (b *blobWriter) commit(mediaType string) (descriptor, error) {
+	if err := b.f.Close(); err != nil {
+		os.Remove(b.f.Name())
+		return descriptor{}, err
+	}
+	sum := hex.EncodeToString(b.h.Sum(nil))
+	if err := os.Rename(b.f.Name(), filepath.Join(b.dir, "blobs", "sha256", sum)); err != nil {
+		os.Remove(b.f.Name())
+		return descriptor{}, err
+	}
+	return descriptor{MediaType: mediaType, Digest: "sha256:" + sum, Size: b.size}, nil
+}
+
+func (b *blobWriter) abort() {
+	b.f.Close()
+	os.Remove(b.f.Name())
+}
+
+// writeLayer writes the entries as a compressed layer, returning its
+// descriptor and the digest of the uncompressed tarball.
+func writeLayer(dir, root string, entries []*entry, dirs map[string]*entry) (descriptor, string, error) {
+	b, err := newBlobWriter(dir)
+	if err != nil {
+		return descriptor{}, "", err
+	}
+	var (
+		gz     = gzip.NewWriter(b)
+		diffID = sha256.New()
+		lw     = newLayerWriter(io.MultiWriter(gz, diffID), root, dirs)
+	)
+	for _, e := range entries {
+		if err := lw.add(e); err != nil {
+			b.abort()
+			return descriptor{}, "", err
+		}
+	}
+	if err := lw.Close(); err != nil {
+		b.abort()
+		return descriptor{}, "", err
+	}
+	if err := gz.Close(); err != nil {
+		b.abort()
+		return descriptor{}, "", err
+	}
+	desc, err := b.commit(mediaTypeLayer)
+	return desc, "sha256:" + hex.EncodeToString(diffID.Sum(nil)), err
+}
+
+func writeJSONBlob(dir, mediaType string, v interface{}) (descriptor, error) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return descriptor{}, err
+	}
+	b, err := newBlobWriter(dir)
+	if err != nil {
+		return descriptor{}, err
+	}
+	if _, err := b.Write(d); err != nil {
+		b.abort()
+		return descriptor{}, err
+	}
+	return b.commit(mediaType)
+}
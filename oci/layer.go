@@ -0,0 +1,245 @@
+package oci
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Group describes the files written by a group of units, such as the
+// base system.
+type Group struct {
+	Name string
+	// Done is when the last unit of the group finished. Files last
+	// changed after the previous group was done and before then belong
+	// to the group.
+	Done time.Time
+}
+
+type inode struct {
+	dev, ino uint64
+}
+
+// entry is a file in the built system.
+type entry struct {
+	rel   string
+	fi    os.FileInfo
+	st    *syscall.Stat_t
+	layer int
+}
+
+// layerOf returns the index of the group which last changed a file. The
+// change time is used as it cannot be set by package managers or
+// archives, unlike the modification time. Files changed after every
+// group was done belong to the last.
+func layerOf(ctime time.Time, groups []Group) int {
+	for i, g := range groups {
+		if !g.Done.IsZero() && !ctime.After(g.Done) {
+			return i
+		}
+	}
+	if len(groups) == 0 {
+		return 0
+	}
+	return len(groups) - 1
+}
+
+// collect returns the files under root which are part of the image, in
+// lexical order, and the directories indexed by path. The change times
+// in ctimes take precedence over those of the files.
+func collect(root string, conf *Config, groups []Group, ctimes map[string]time.Time) ([]*entry, map[string]*entry, error) {
+	var (
+		out  []*entry
+		dirs = map[string]*entry{}
+	)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if conf.excluded(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%s: stat.sys is %T, expected syscall.Stat_t", path, fi.Sys())
+		}
+		ctime, ok := ctimes[rel]
+		if !ok {
+			ctime = time.Unix(st.Ctim.Unix())
+		}
+		e := &entry{rel: rel, fi: fi, st: st, layer: layerOf(ctime, groups)}
+		out = append(out, e)
+		if fi.IsDir() {
+			dirs[rel] = e
+		}
+		return nil
+	})
+	return out, dirs, err
+}
+
+// layerWriter writes files of the built system to a layer tarball.
+type layerWriter struct {
+	root string
+	tw   *tar.Writer
+	dirs map[string]*entry
+	// written tracks the directories in the layer, as the parents of
+	// every file are included even if they belong to an earlier layer.
+	written map[string]bool
+	links   map[inode]string
+}
+
+func newLayerWriter(w io.Writer, root string, dirs map[string]*entry) *layerWriter {
+	return &layerWriter{
+		root:    root,
+		tw:      tar.NewWriter(w),
+		dirs:    dirs,
+		written: map[string]bool{},
+		links:   map[inode]string{},
+	}
+}
+
+func (l *layerWriter) add(e *entry) error {
+	if err := l.addParents(filepath.Dir(e.rel)); err != nil {
+		return err
+	}
+	if e.fi.IsDir() {
+		if l.written[e.rel] {
+			return nil
+		}
+		l.written[e.rel] = true
+	}
+	return l.write(e)
+}
+
+func (l *layerWriter) addParents(dir string) error {
+	if dir == "." || l.written[dir] {
+		return nil
+	}
+	if err := l.addParents(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	e, ok := l.dirs[dir]
+	if !ok {
+		return fmt.Errorf("parent directory %s is not part of the image", dir)
+	}
+	l.written[dir] = true
+	return l.write(e)
+}
+
+func (l *layerWriter) write(e *entry) error {
+	path := filepath.Join(l.root, e.rel)
+	var target string
+	if e.fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if target, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(e.fi, target)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	hdr.Name = e.rel
+	if e.fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// Names are resolved in the built system, not on the host.
+	hdr.Uid, hdr.Gid = int(e.st.Uid), int(e.st.Gid)
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+	if !e.fi.IsDir() && e.st.Nlink > 1 {
+		key := inode{dev: uint64(e.st.Dev), ino: e.st.Ino}
+		if first, ok := l.links[key]; ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+		} else {
+			l.links[key] = e.rel
+		}
+	}
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return fmt.Errorf("reading xattrs of %s: %v", path, err)
+	}
+	for name, val := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords["SCHILY.xattr."+name] = val
+	}
+
+	if err := l.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(l.tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func (l *layerWriter) Close() error {
+	return l.tw.Close()
+}
+
+// readXattrs returns the extended attributes of the file at path.
+func readXattrs(path string) (map[string]string, error) {
+	sz, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if sz == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, sz)
+	if sz, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	out := map[string]string{}
+	for _, name := range strings.Split(string(buf[:sz]), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsz, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, vsz)
+		if vsz, err = unix.Lgetxattr(path, name, val); err != nil {
+			return nil, err
+		}
+		out[name] = string(val[:vsz])
+	}
+	return out, nil
+}
@@ -0,0 +1,270 @@
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twitchylinux/builder/units"
+)
+
+func readBlob(t *testing.T, dir, digest string, v interface{}) []byte {
+	t.Helper()
+	d, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(d); "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		t.Errorf("blob %s has digest sha256:%x", digest, sum)
+	}
+	if v != nil {
+		if err := json.Unmarshal(d, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+// readLayout returns the image config of the layout, and the headers in
+// each of its layers.
+func readLayout(t *testing.T, dir string) (imageConfig, [][]*tar.Header) {
+	t.Helper()
+	var idx index
+	d, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(d, &idx); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("index has %d manifests, want 1", len(idx.Manifests))
+	}
+	var (
+		m    manifest
+		conf imageConfig
+		out  [][]*tar.Header
+	)
+	readBlob(t, dir, idx.Manifests[0].Digest, &m)
+	readBlob(t, dir, m.Config.Digest, &conf)
+
+	for i, l := range m.Layers {
+		gz, err := gzip.NewReader(strings.NewReader(string(readBlob(t, dir, l.Digest, nil))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.New()
+		tr := tar.NewReader(io.TeeReader(gz, h))
+		var hdrs []*tar.Header
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdrs = append(hdrs, hdr)
+		}
+		io.Copy(ioutil.Discard, tr)
+		io.Copy(h, gz)
+		if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != conf.RootFS.DiffIDs[i] {
+			t.Errorf("layer %d diff_id = %s, want %s", i, conf.RootFS.DiffIDs[i], got)
+		}
+		out = append(out, hdrs)
+	}
+	return conf, out
+}
+
+func names(hdrs []*tar.Header) []string {
+	var out []string
+	for _, h := range hdrs {
+		out = append(out, h.Name)
+	}
+	return out
+}
+
+func TestExport(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	for _, d := range []string{"boot", "build-status", "usr/bin", "etc"} {
+		os.MkdirAll(filepath.Join(root, d), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(root, "boot", "vmlinuz-5.9.14"), []byte("kernel"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "build-status", "Debootstrap"), []byte("complete"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "usr", "bin", "bash"), []byte("#!bash"), 0755)
+	os.Link(filepath.Join(root, "usr", "bin", "bash"), filepath.Join(root, "usr", "bin", "sh"))
+	os.Symlink("usr/bin", filepath.Join(root, "bin"))
+	ioutil.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("twl\n"), 0644)
+
+	conf := DefaultConfig()
+	conf.Tag = "0.8.3"
+	conf.Exclude = []string{"build-status"}
+	conf.Labels = map[string]string{"org.opencontainers.image.title": "TwitchyLinux"}
+	dir := filepath.Join(tmp, "layout")
+	if err := Export(context.Background(), Options{BuildDir: root, Dir: dir, Config: conf}); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil || !strings.Contains(string(d), `"org.opencontainers.image.ref.name":"0.8.3"`) {
+		t.Errorf("index.json = %s, %v", d, err)
+	}
+	ic, layers := readLayout(t, dir)
+	if !reflect.DeepEqual(ic.Config.Cmd, []string{"/bin/bash"}) || ic.Config.Labels["org.opencontainers.image.title"] != "TwitchyLinux" {
+		t.Errorf("config = %+v", ic.Config)
+	}
+	if len(layers) != 1 {
+		t.Fatalf("got %d layers, want 1", len(layers))
+	}
+	if got, want := names(layers[0]), []string{"bin", "etc/", "etc/hostname", "usr/", "usr/bin/", "usr/bin/bash", "usr/bin/sh"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("layer = %v, want %v", got, want)
+	}
+	for _, h := range layers[0] {
+		switch h.Name {
+		case "bin":
+			if h.Typeflag != tar.TypeSymlink || h.Linkname != "usr/bin" {
+				t.Errorf("bin = %+v, want a symlink to usr/bin", h)
+			}
+		case "usr/bin/sh":
+			if h.Typeflag != tar.TypeLink || h.Linkname != "usr/bin/bash" {
+				t.Errorf("sh = %+v, want a hard link to usr/bin/bash", h)
+			}
+		case "usr/bin/bash":
+			if h.Mode&0777 != 0755 || h.Size != 6 || h.Uname != "" {
+				t.Errorf("bash = %+v", h)
+			}
+		}
+	}
+
+	if err := Export(context.Background(), Options{BuildDir: root, Dir: dir, Config: conf}); err == nil {
+		t.Error("Export() overwrote an existing layout")
+	}
+}
+
+func TestExportLayerPerGroup(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755)
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr", "bin", "bash"), []byte("#!bash"), 0755)
+	baseDone := time.Now()
+	// File timestamps come from a coarse clock.
+	time.Sleep(50 * time.Millisecond)
+	ioutil.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("twl\n"), 0644)
+
+	conf := DefaultConfig()
+	conf.LayerPerGroup = true
+	groups := []Group{
+		{Name: "base", Done: baseDone},
+		{Name: "graphical"},
+		{Name: "final", Done: time.Now()},
+	}
+	dir := filepath.Join(tmp, "layout")
+	if err := Export(context.Background(), Options{BuildDir: root, Dir: dir, Config: conf, Groups: groups}); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	ic, layers := readLayout(t, dir)
+	if len(layers) != 2 {
+		t.Fatalf("got %d layers, want 2", len(layers))
+	}
+	if got, want := names(layers[0]), []string{"usr/", "usr/bin/", "usr/bin/bash"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("base layer = %v, want %v", got, want)
+	}
+	if got, want := names(layers[1]), []string{"etc/", "etc/hostname"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("final layer = %v, want %v", got, want)
+	}
+	if len(ic.History) != 2 || ic.History[1].CreatedBy != "twl-builder: final" {
+		t.Errorf("history = %+v", ic.History)
+	}
+}
+
+func TestExportLayerPerGroupReproducible(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755)
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr", "bin", "bash"), []byte("#!bash"), 0755)
+	baseDone := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	ioutil.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("twl\n"), 0644)
+	finalDone := time.Now()
+	time.Sleep(50 * time.Millisecond)
+
+	// Clamping the times of every file changes them all after the final
+	// group was done.
+	if err := units.ClampTimes(root, 1e9); err != nil {
+		t.Fatalf("ClampTimes() failed: %v", err)
+	}
+	ctimes, err := units.ReadChangeTimes(root)
+	if err != nil {
+		t.Fatalf("ReadChangeTimes() failed: %v", err)
+	}
+
+	conf := DefaultConfig()
+	conf.LayerPerGroup = true
+	conf.Exclude = append(conf.Exclude, units.StatusDir)
+	groups := []Group{
+		{Name: "base", Done: baseDone},
+		{Name: "final", Done: finalDone},
+	}
+	dir := filepath.Join(tmp, "layout")
+	if err := Export(context.Background(), Options{BuildDir: root, Dir: dir, Config: conf, Groups: groups, ChangeTimes: ctimes}); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	_, layers := readLayout(t, dir)
+	if len(layers) != 2 {
+		t.Fatalf("got %d layers, want 2", len(layers))
+	}
+	if got, want := names(layers[0]), []string{"usr/", "usr/bin/", "usr/bin/bash"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("base layer = %v, want %v", got, want)
+	}
+	if got, want := names(layers[1]), []string{"etc/", "etc/hostname"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("final layer = %v, want %v", got, want)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tcs := []struct {
+		name   string
+		mutate func(c *Config)
+		ok     bool
+	}{
+		{"default", func(c *Config) {}, true},
+		{"no tag", func(c *Config) { c.Tag = "" }, false},
+		{"bad tag", func(c *Config) { c.Tag = "twl:latest" }, false},
+		{"bad env", func(c *Config) { c.Env = []string{"PATH"} }, false},
+		{"relative workdir", func(c *Config) { c.WorkingDir = "src" }, false},
+		{"bad exclude", func(c *Config) { c.Exclude = []string{"["} }, false},
+	}
+	for _, tc := range tcs {
+		c := DefaultConfig()
+		tc.mutate(&c)
+		if err := c.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: Validate() = %v, want ok = %v", tc.name, err, tc.ok)
+		}
+	}
+}
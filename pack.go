@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/twitchylinux/builder/pack"
+	"github.com/twitchylinux/builder/stager"
+)
+
+// imageCommands are the subcommands which write a built system into an
+// image or check one or the stage config, keyed by name.
+var imageCommands = map[string]func(context.Context, []string) error{
+	"pack":   packImage,
+	"iso":    packISO,
+	"oci":    exportOCI,
+	"bundle": writeBundle,
+	"verify": verifyImage,
+	"lint":   lintConfig,
+	"config": showConfig,
+}
+
+// outputArgs parses the arguments of commands which write a built system
+// to a new file or directory, returning the build directory, output path
+// and stager options.
+func outputArgs(cmd string, args []string) (string, string, stager.Options, error) {
+	if len(args) < 2 {
+		printUsage()
+		return "", "", stager.Options{}, fmt.Errorf("%s requires a build directory and output file", cmd)
+	}
+	dir, out := args[0], args[1]
+	if s, err := os.Stat(dir); err != nil {
+		return "", "", stager.Options{}, fmt.Errorf("could not stat build directory: %v", err)
+	} else if !s.IsDir() {
+		return "", "", stager.Options{}, fmt.Errorf("%s is not a directory", dir)
+	}
+	if _, err := os.Stat(out); err == nil {
+		return "", "", stager.Options{}, fmt.Errorf("%s already exists", out)
+	}
+
+	opts, err := stageConfigOpts(args[2:])
+	if err != nil {
+		return "", "", stager.Options{}, err
+	}
+	return dir, out, opts, nil
+}
+
+// imageArgs parses the arguments of the pack and iso commands, returning
+// the build directory, output file and image config.
+func imageArgs(cmd string, args []string) (string, string, pack.Config, error) {
+	dir, image, opts, err := outputArgs(cmd, args)
+	if err != nil {
+		return "", "", pack.Config{}, err
+	}
+	conf, err := stager.ImageConfig(filepath.Join(resourceDir(), "stage-conf"), opts)
+	if err != nil {
+		return "", "", pack.Config{}, err
+	}
+	conf.Exclude = append(conf.Exclude, statusDir)
+	return dir, image, conf, nil
+}
+
+// packImage writes a built system into a bootable disk image, as
+// described by the image section of the stage config.
+func packImage(ctx context.Context, args []string) error {
+	dir, image, conf, err := imageArgs("pack", args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancelCtxOnSignal(cancel)
+	return pack.Pack(ctx, pack.Options{
+		BuildDir:       dir,
+		Image:          image,
+		Config:         conf,
+		SecureBootKeys: *sbKeysDir,
+		UpdateKey:      *updateKey,
+		Stdout:         os.Stdout,
+		Stderr:         os.Stderr,
+	})
+}
+
+// packISO writes a built system into a hybrid live ISO, which can be
+// written to a USB drive with dd or booted in a VM.
+func packISO(ctx context.Context, args []string) error {
+	dir, image, conf, err := imageArgs("iso", args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancelCtxOnSignal(cancel)
+	return pack.PackISO(ctx, pack.ISOOptions{
+		BuildDir: dir,
+		Image:    image,
+		Config:   conf,
+		Stdout:   os.Stdout,
+		Stderr:   os.Stderr,
+	})
+}
+
+// writeBundle writes a built system as a signed update bundle, which
+// systems packed with ab_root install with twl-update.
+func writeBundle(ctx context.Context, args []string) error {
+	dir, bundle, conf, err := imageArgs("bundle", args)
+	if err != nil {
+		return err
+	}
+
+	var created time.Time
+	if *srcDateEpoch != 0 {
+		created = time.Unix(*srcDateEpoch, 0)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cancelCtxOnSignal(cancel)
+	return pack.Bundle(ctx, pack.BundleOptions{
+		BuildDir:  dir,
+		Dir:       bundle,
+		Config:    conf,
+		Version:   *version,
+		UpdateKey: *updateKey,
+		Created:   created,
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+	})
+}
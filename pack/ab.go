@@ -0,0 +1,350 @@
+package pack
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	// grubEnvPath is the grub environment block on the boot partition,
+	// which records the slot to boot.
+	grubEnvPath = "/grub/grubenv"
+	grubEnvSize = 1024
+	grubEditEnv = "/usr/bin/grub-editenv"
+
+	updaterScript  = "/usr/local/sbin/twl-update"
+	confirmService = "twl-update-confirm.service"
+	// updateKeyPath holds the public key bundles must be signed with.
+	updateKeyPath = "/usr/share/twitchylinux/update/signing.pem"
+)
+
+// slot is a root partition of an image with an A/B layout.
+type slot string
+
+// slots are the root partitions of an A/B image, in partition order. The
+// first is populated when packing.
+var slots = []slot{"a", "b"}
+
+// label is the GPT partition name of the slot, used by the updater to
+// find it.
+func (s slot) label() string {
+	return "root_" + string(s)
+}
+
+// bootDir is the directory of the boot partition holding the kernel and
+// initramfs the slot is booted with.
+func (s slot) bootDir() string {
+	return "slot-" + string(s)
+}
+
+// entryID is the id of the grub menu entry which boots the slot.
+func (s slot) entryID() string {
+	return "slot-" + string(s)
+}
+
+func (c *Config) validateAB() error {
+	if c.PartitionTable != TableGPT {
+		return fmt.Errorf("requires a %s partition table", TableGPT)
+	}
+	if !strings.HasPrefix(c.RootFS, "ext") {
+		return fmt.Errorf("requires an ext2, ext3 or ext4 root filesystem, got %q", c.RootFS)
+	}
+	if c.Bootloader != BootloaderGrub {
+		return fmt.Errorf("requires the %s bootloader", BootloaderGrub)
+	}
+	if c.Encryption != nil || c.UnifiedKernelImage {
+		return fmt.Errorf("cannot be combined with encryption or unified kernel images")
+	}
+	return nil
+}
+
+// abGrubScript picks the slot to boot from the grub environment. A newly
+// written slot is tried once: twl_try is cleared before booting it, so if
+// the slot fails to boot and confirm it, the next boot rolls back.
+const abGrubScript = `load_env twl_slot twl_next twl_try
+if [ -z "${twl_slot}" ]; then
+  set twl_slot=a
+fi
+set default="slot-${twl_slot}"
+if [ "${twl_try}" = "1" -a -n "${twl_next}" ]; then
+  set twl_try=0
+  save_env twl_try
+  set default="slot-${twl_next}"
+fi
+`
+
+// abCmdline is the kernel command line of a slot. The system reboots
+// after a panic, so a slot which panics is rolled back.
+func abCmdline(s slot, partUUID, rootFS string) string {
+	return rootCmdline("PARTUUID="+partUUID, rootFS) + " twl.slot=" + string(s) + " panic=10"
+}
+
+// grubEnv returns a grub environment block setting the variables.
+func grubEnv(vars map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out bytes.Buffer
+	out.WriteString("# GRUB Environment Block\n")
+	for _, k := range keys {
+		fmt.Fprintf(&out, "%s=%s\n", k, vars[k])
+	}
+	if out.Len() > grubEnvSize {
+		return nil, fmt.Errorf("grub environment is %d bytes, larger than %d", out.Len(), grubEnvSize)
+	}
+	out.Write(bytes.Repeat([]byte("#"), grubEnvSize-out.Len()))
+	return out.Bytes(), nil
+}
+
+// abFstabSources are the devices mounted by the fstab of an A/B system,
+// keyed by mount point. As the same root filesystem may be written to
+// either slot of any machine, partitions are referenced by label.
+func abFstabSources(uefi bool) map[string]string {
+	out := map[string]string{
+		"/":     "/dev/root",
+		"/boot": "LABEL=boot",
+	}
+	if uefi {
+		out[espMountPoint] = "LABEL=EFI"
+	}
+	return out
+}
+
+// checkGrubEditEnv returns an error if the system at root cannot change
+// the grub environment, which the updater needs.
+func checkGrubEditEnv(root string) error {
+	if _, err := os.Stat(filepath.Join(root, grubEditEnv)); err != nil {
+		return fmt.Errorf("A/B images need grub-editenv (grub-common) in the built system: %v", err)
+	}
+	return nil
+}
+
+var updaterScriptTmpl = template.Must(template.New("twl-update").Parse(`#!/bin/sh
+# Generated by twl-builder. Updates the system from a bundle by writing the
+# inactive root partition, which is tried on the next boot. The new slot
+# becomes the default once it has booted, otherwise grub rolls back.
+set -eu
+
+GRUBENV=/boot{{.GrubEnv}}
+KEY={{.Key}}
+
+die() {
+  echo "twl-update: $*" >&2
+  exit 1
+}
+
+current_slot() {
+  for arg in $(cat /proc/cmdline); do
+    case "$arg" in
+      twl.slot=*) echo "${arg#twl.slot=}"; return ;;
+    esac
+  done
+  die "the system was not booted from a slot"
+}
+
+env_get() {
+  grub-editenv "$GRUBENV" list | sed -n "s/^$1=//p"
+}
+
+manifest_get() {
+  sed -n "s/^$2=//p" "$1/manifest"
+}
+
+verify_file() {
+  sum=$(sha256sum "$1/$2" | cut -d' ' -f1)
+  [ "$sum" = "$(manifest_get "$1" "$3")" ] || die "$1/$2: checksum mismatch"
+}
+
+install_bundle() {
+  bundle=$1
+  [ -f "$bundle/manifest" ] || die "$bundle is not an update bundle"
+  openssl dgst -sha256 -verify "$KEY" -signature "$bundle/manifest.sig" "$bundle/manifest" >/dev/null ||
+    die "$bundle/manifest: bad signature"
+  [ "$(manifest_get "$bundle" format)" = "{{.Format}}" ] || die "$bundle: unsupported bundle format"
+  verify_file "$bundle" {{.RootFS}} rootfs_sha256
+  verify_file "$bundle" {{.Kernel}} kernel_sha256
+  verify_file "$bundle" {{.Initrd}} initrd_sha256
+
+  case "$(current_slot)" in
+    a) next=b ;;
+    b) next=a ;;
+    *) die "unknown slot $(current_slot)" ;;
+  esac
+  dev=/dev/disk/by-partlabel/root_$next
+  [ -b "$dev" ] || die "no partition for slot $next"
+  size=$(manifest_get "$bundle" rootfs_size)
+  [ "$size" -le "$(blockdev --getsize64 "$dev")" ] || die "the update does not fit in slot $next"
+
+  # The slot must not be tried while it is partially written.
+  grub-editenv "$GRUBENV" set twl_try=0 twl_next=
+  echo "Writing $(manifest_get "$bundle" version) to slot $next..."
+  gzip -dc "$bundle/{{.RootFS}}" | dd of="$dev" bs=4M conv=fsync status=none
+  e2fsck -fp "$dev" >/dev/null || [ $? -eq 1 ] || die "checking the filesystem in slot $next failed"
+  resize2fs "$dev" >/dev/null 2>&1
+  mkdir -p /boot/slot-$next
+  cp "$bundle/{{.Kernel}}" /boot/slot-$next/vmlinuz
+  cp "$bundle/{{.Initrd}}" /boot/slot-$next/initrd.img
+  sync
+  grub-editenv "$GRUBENV" set twl_next=$next twl_try=1
+  echo "Slot $next will be booted on the next restart."
+}
+
+confirm() {
+  cur=$(current_slot)
+  if [ "$(env_get twl_next)" = "$cur" ]; then
+    grub-editenv "$GRUBENV" set twl_slot=$cur twl_next= twl_try=0
+    echo "Slot $cur booted and is now the default."
+  fi
+}
+
+status() {
+  cur=$(current_slot)
+  slot=$(env_get twl_slot)
+  next=$(env_get twl_next)
+  echo "Booted slot: $cur"
+  echo "Default slot: ${slot:-a}"
+  if [ -n "$next" ] && [ "$(env_get twl_try)" = 1 ]; then
+    echo "Slot $next will be tried on the next boot."
+  elif [ -n "$next" ] && [ "$next" != "$cur" ]; then
+    echo "Slot $next failed to boot, and was rolled back."
+  fi
+}
+
+case "${1:-}" in
+  install) [ $# -eq 2 ] || die "usage: $0 install <bundle-directory>"; install_bundle "$2" ;;
+  confirm) confirm ;;
+  status) status ;;
+  *) die "usage: $0 install <bundle-directory> | confirm | status" ;;
+esac
+`))
+
+var confirmServiceTmpl = template.Must(template.New(confirmService).Parse(`[Unit]
+Description=Make the booted root partition the default once it is up
+After=systemd-user-sessions.service getty.target
+ConditionKernelCommandLine=twl.slot
+
+[Service]
+Type=oneshot
+ExecStart={{.Script}} confirm
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// installUpdater installs the updater, the service which confirms a
+// slot has booted, and the public key bundles are verified with, into
+// the system at root.
+func installUpdater(root string, pubKey []byte) error {
+	data := struct {
+		GrubEnv, Key, Script, Format string
+		RootFS, Kernel, Initrd       string
+	}{
+		GrubEnv: grubEnvPath,
+		Key:     updateKeyPath,
+		Script:  updaterScript,
+		Format:  bundleFormat,
+		RootFS:  bundleRootFS,
+		Kernel:  bundleKernel,
+		Initrd:  bundleInitrd,
+	}
+	var script, svc bytes.Buffer
+	if err := updaterScriptTmpl.Execute(&script, data); err != nil {
+		return err
+	}
+	if err := confirmServiceTmpl.Execute(&svc, data); err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{updaterScript, script.Bytes(), 0755},
+		{updateKeyPath, pubKey, 0644},
+		{"/etc/systemd/system/" + confirmService, svc.Bytes(), 0644},
+	} {
+		path := filepath.Join(root, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, f.data, f.mode); err != nil {
+			return err
+		}
+	}
+	wants := filepath.Join(root, "etc", "systemd", "system", "multi-user.target.wants")
+	if err := os.MkdirAll(wants, 0755); err != nil {
+		return err
+	}
+	if err := os.Symlink("../"+confirmService, filepath.Join(wants, confirmService)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadUpdateKey reads the PEM encoded RSA or ECDSA private key which
+// update bundles are signed with.
+func loadUpdateKey(path string) (crypto.Signer, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("update key: %v", err)
+	}
+	b, _ := pem.Decode(d)
+	if b == nil {
+		return nil, fmt.Errorf("%s is not a PEM encoded key", path)
+	}
+	var key interface{}
+	switch b.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(b.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(b.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(b.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %q", path, b.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s: update keys must be RSA or ECDSA, got %T", path, key)
+}
+
+// publicKeyPEM returns the public half of the key, in the form openssl
+// verifies signatures with.
+func publicKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// sign returns a signature of the SHA-256 digest of data, as produced by
+// openssl dgst -sha256 -sign.
+func sign(key crypto.Signer, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
@@ -0,0 +1,211 @@
+package pack
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrubEnv(t *testing.T) {
+	env, err := grubEnv(map[string]string{"twl_slot": "a", "twl_next": ""})
+	if err != nil {
+		t.Fatalf("grubEnv() failed: %v", err)
+	}
+	if len(env) != grubEnvSize {
+		t.Errorf("len(grubEnv()) = %d, want %d", len(env), grubEnvSize)
+	}
+	if want := "# GRUB Environment Block\ntwl_next=\ntwl_slot=a\n##"; !strings.HasPrefix(string(env), want) {
+		t.Errorf("grubEnv() = %q, want prefix %q", env, want)
+	}
+	if _, err := grubEnv(map[string]string{"x": strings.Repeat("y", grubEnvSize)}); err == nil {
+		t.Error("grubEnv() accepted an oversized environment")
+	}
+}
+
+func TestGrubConfigAB(t *testing.T) {
+	g := grubConfig{
+		Menu:          DefaultConfig().Menu,
+		Kernel:        kernel{Release: "5.9.14", Image: "vmlinuz-5.9.14", Initrd: "initrd.img-5.9.14"},
+		BootUUID:      "b-uuid",
+		RootFS:        "ext4",
+		SlotPartUUIDs: []string{"pa", "pb"},
+	}
+	out, err := g.render()
+	if err != nil {
+		t.Fatalf("render() failed: %v", err)
+	}
+	for _, want := range []string{
+		"load_env twl_slot twl_next twl_try\n",
+		`set default="slot-${twl_next}"`,
+		`menuentry "TwitchyLinux (slot a)" --id slot-a {`,
+		"linux  /slot-b/vmlinuz root=PARTUUID=pb rootfstype=ext4 apparmor=1 security=apparmor twl.slot=b panic=10",
+		"initrd /slot-b/initrd.img",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("grub.cfg does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "installer.target") {
+		t.Errorf("A/B grub.cfg has an installer entry:\n%s", out)
+	}
+
+	g.SlotPartUUIDs = g.SlotPartUUIDs[:1]
+	if _, err := g.render(); err == nil {
+		t.Error("render() succeeded with one slot")
+	}
+}
+
+func TestABFstab(t *testing.T) {
+	fstab := []byte("FSTAB_DEV / ext4 defaults 1 1\nBOOT_DEV /boot auto defaults 1 1\n")
+	got, err := substituteFstab(fstab, abFstabSources(true))
+	if err != nil {
+		t.Fatalf("substituteFstab() failed: %v", err)
+	}
+	if want := "/dev/root / ext4 defaults 1 1\nLABEL=boot /boot auto defaults 1 1\nLABEL=EFI /boot/efi vfat umask=0077 0 1\n"; string(got) != want {
+		t.Errorf("substituteFstab() = %q, want %q", got, want)
+	}
+}
+
+func TestInstallUpdater(t *testing.T) {
+	root, err := ioutil.TempDir("", "pack-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := installUpdater(root, []byte("public key")); err != nil {
+		t.Fatalf("installUpdater() failed: %v", err)
+	}
+	script, err := ioutil.ReadFile(filepath.Join(root, updaterScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"GRUBENV=/boot/grub/grubenv\n",
+		"KEY=/usr/share/twitchylinux/update/signing.pem\n",
+		`verify_file "$bundle" rootfs.img.gz rootfs_sha256`,
+		`gzip -dc "$bundle/rootfs.img.gz" | dd of="$dev"`,
+		`grub-editenv "$GRUBENV" set twl_next=$next twl_try=1`,
+	} {
+		if !strings.Contains(string(script), want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	if sh, err := exec.LookPath("sh"); err == nil {
+		if out, err := exec.Command(sh, "-n", filepath.Join(root, updaterScript)).CombinedOutput(); err != nil {
+			t.Errorf("sh -n: %v\n%s", err, out)
+		}
+	}
+	if d, err := ioutil.ReadFile(filepath.Join(root, updateKeyPath)); err != nil || string(d) != "public key" {
+		t.Errorf("public key = %q, %v", d, err)
+	}
+	link, err := os.Readlink(filepath.Join(root, "etc", "systemd", "system", "multi-user.target.wants", confirmService))
+	if err != nil || link != "../"+confirmService {
+		t.Errorf("wants link = %q, %v", link, err)
+	}
+}
+
+func TestUpdateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("format=1\n")
+	digest := sha256.Sum256(data)
+	for _, tc := range []struct {
+		name  string
+		block *pem.Block
+	}{
+		{"rsa", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}},
+		{"ec", &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}},
+		{"pkcs8", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}},
+	} {
+		path := filepath.Join(dir, tc.name+".pem")
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(tc.block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := loadUpdateKey(path)
+		if err != nil {
+			t.Errorf("%s: loadUpdateKey() failed: %v", tc.name, err)
+			continue
+		}
+		sig, err := sign(key, data)
+		if err != nil {
+			t.Errorf("%s: sign() failed: %v", tc.name, err)
+			continue
+		}
+		pubPEM, err := publicKeyPEM(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := pem.Decode(pubPEM)
+		pub, err := x509.ParsePKIXPublicKey(b.Bytes)
+		if err != nil {
+			t.Fatalf("%s: parsing public key: %v", tc.name, err)
+		}
+		switch pub := pub.(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+				err = os.ErrInvalid
+			}
+		}
+		if err != nil {
+			t.Errorf("%s: signature does not verify: %v", tc.name, err)
+		}
+	}
+
+	path := filepath.Join(dir, "cert.pem")
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("x")}), 0600)
+	if _, err := loadUpdateKey(path); err == nil {
+		t.Error("loadUpdateKey() accepted a certificate")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	m := manifest{
+		Version:    "0.8.3",
+		Created:    time.Unix(1600000000, 0),
+		Kernel:     "5.9.14",
+		RootFS:     "ext4",
+		RootFSSize: 4096,
+		Digests:    map[string]string{bundleRootFS: "aa", bundleKernel: "bb", bundleInitrd: "cc"},
+	}
+	want := "format=1\nversion=0.8.3\ncreated=2020-09-13T12:26:40Z\nkernel=5.9.14\nfs=ext4\n" +
+		"rootfs_size=4096\nrootfs_sha256=aa\nkernel_sha256=bb\ninitrd_sha256=cc\n"
+	if got := m.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package pack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/twitchylinux/builder/conf/user"
+)
+
+// Based on systemd's getty@.service.
+var autologinTmpl = template.Must(template.New("autologin@.service").Parse(`#  SPDX-License-Identifier: LGPL-2.1+
+#
+#  This file is part of systemd, but modified.
+#
+#  systemd is free software; you can redistribute it and/or modify it
+#  under the terms of the GNU Lesser General Public License as published by
+#  the Free Software Foundation; either version 2.1 of the License, or
+#  (at your option) any later version.
+
+[Unit]
+Description=Autologin for user {{.User}} on %I
+Documentation=man:agetty(8) man:systemd-getty-generator(8)
+After=systemd-user-sessions.service plymouth-quit-wait.service getty-pre.target
+After=rc-local.service
+Conflicts=getty@{{.TTY}}.service
+Before=getty.target
+IgnoreOnIsolate=yes
+Conflicts=rescue.service
+Before=rescue.service
+ConditionPathExists=/dev/tty0
+
+[Service]
+ExecStart=-/sbin/agetty --noclear -a {{.User}} %I $TERM
+Type=idle
+Restart=always
+RestartSec=0
+UtmpIdentifier=%I
+TTYPath=/dev/%I
+TTYReset=yes
+TTYVHangup=yes
+TTYVTDisallocate=yes
+KillMode=process
+IgnoreSIGPIPE=no
+SendSIGHUP=yes
+UnsetEnvironment=LANG LANGUAGE LC_CTYPE LC_NUMERIC LC_TIME LC_COLLATE LC_MONETARY LC_MESSAGES LC_PAPER LC_NAME LC_ADDRESS LC_TELEPHONE LC_MEASUREMENT LC_IDENTIFICATION
+
+[Install]
+WantedBy=getty.target
+DefaultInstance={{.TTY}}
+`))
+
+var autologinBashrcTmpl = template.Must(template.New("bashrc").Parse(`
+# Start TwitchyLinux trailing section
+if [[ $(tty) == '/dev/{{.TTY}}' ]]; then
+  {{.Command}}
+fi
+`))
+
+// setupAutologin configures the system at root to log the user in on
+// boot, running the configured command from their shell.
+func setupAutologin(root string, conf AutologinConfig) error {
+	if conf.TTY == "" {
+		conf.TTY = "tty1"
+	}
+
+	var svc bytes.Buffer
+	if err := autologinTmpl.Execute(&svc, conf); err != nil {
+		return err
+	}
+	sysdDir := filepath.Join(root, "etc", "systemd", "system")
+	if err := os.MkdirAll(filepath.Join(sysdDir, "getty.target.wants"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(sysdDir, "autologin@.service"), svc.Bytes(), 0644); err != nil {
+		return err
+	}
+	link := filepath.Join(sysdDir, "getty.target.wants", "autologin@"+conf.TTY+".service")
+	if err := os.Symlink("../autologin@.service", link); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	if conf.Command == "" {
+		return nil
+	}
+	users, err := user.ReadConfig(root)
+	if err != nil {
+		return err
+	}
+	u, ok := users.User(conf.User)
+	if !ok {
+		return fmt.Errorf("autologin user %q does not exist", conf.User)
+	}
+	var snippet bytes.Buffer
+	if err := autologinBashrcTmpl.Execute(&snippet, conf); err != nil {
+		return err
+	}
+
+	bashrc := filepath.Join(root, u.HomeDir, ".bashrc")
+	f, err := os.OpenFile(bashrc, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(snippet.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chown(bashrc, u.UID, u.GID)
+}
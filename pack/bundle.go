@@ -0,0 +1,278 @@
+package pack
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Files in an update bundle.
+const (
+	bundleFormat    = "1"
+	bundleManifest  = "manifest"
+	bundleSignature = "manifest.sig"
+	bundleRootFS    = "rootfs.img.gz"
+	bundleKernel    = "vmlinuz"
+	bundleInitrd    = "initrd.img"
+)
+
+// BundleOptions describes an update bundle to write.
+type BundleOptions struct {
+	// BuildDir is the root of the built system.
+	BuildDir string
+	// Dir is the bundle directory to create.
+	Dir    string
+	Config Config
+	// Version is recorded in the manifest of the bundle.
+	Version string
+	// UpdateKey is the path to the private key the bundle is signed
+	// with.
+	UpdateKey string
+	// Created is recorded as the creation time of the bundle, the
+	// current time if unset.
+	Created time.Time
+
+	Stdout, Stderr io.Writer
+}
+
+// manifest describes the contents of an update bundle. It is signed, and
+// read by the updater with sed, so it is a list of key=value lines.
+type manifest struct {
+	Version string
+	Created time.Time
+	Kernel  string
+	RootFS  string
+	// RootFSSize is the size of the uncompressed filesystem image.
+	RootFSSize int64
+	// Digests of the files in the bundle, keyed by name.
+	Digests map[string]string
+}
+
+func (m *manifest) String() string {
+	var out strings.Builder
+	for _, kv := range [][2]string{
+		{"format", bundleFormat},
+		{"version", m.Version},
+		{"created", m.Created.UTC().Format(time.RFC3339)},
+		{"kernel", m.Kernel},
+		{"fs", m.RootFS},
+		{"rootfs_size", fmt.Sprint(m.RootFSSize)},
+		{"rootfs_sha256", m.Digests[bundleRootFS]},
+		{"kernel_sha256", m.Digests[bundleKernel]},
+		{"initrd_sha256", m.Digests[bundleInitrd]},
+	} {
+		fmt.Fprintf(&out, "%s=%s\n", kv[0], kv[1])
+	}
+	return out.String()
+}
+
+// Bundle writes the built system as an update bundle for images packed
+// with an A/B layout: a compressed image of the root filesystem, the
+// kernel and initramfs, and a signed manifest. On failure, the bundle
+// directory is removed.
+func Bundle(ctx context.Context, opts BundleOptions) (err error) {
+	if opts.Stdout == nil {
+		opts.Stdout = ioutil.Discard
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = ioutil.Discard
+	}
+	if opts.Created.IsZero() {
+		opts.Created = time.Now()
+	}
+	if err := opts.Config.Validate(); err != nil {
+		return err
+	}
+	if !opts.Config.ABRoot {
+		return fmt.Errorf("update bundles require ab_root to be set in the image config")
+	}
+	if opts.UpdateKey == "" {
+		return fmt.Errorf("update bundles must be signed with an update key")
+	}
+	key, err := loadUpdateKey(opts.UpdateKey)
+	if err != nil {
+		return err
+	}
+	pubKey, err := publicKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	if err := checkGrubEditEnv(opts.BuildDir); err != nil {
+		return err
+	}
+	k, err := findKernel(filepath.Join(opts.BuildDir, "boot"))
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(opts.Dir, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(opts.Dir)
+		}
+	}()
+
+	img := filepath.Join(opts.Dir, "rootfs.img")
+	p := &packer{Options: Options{
+		BuildDir: opts.BuildDir,
+		Image:    img,
+		Config:   opts.Config,
+		Stdout:   opts.Stdout,
+		Stderr:   opts.Stderr,
+	}}
+	defer os.Remove(img)
+	if err := p.writeRootFS(ctx, pubKey); err != nil {
+		if rErr := p.release(); rErr != nil {
+			return fmt.Errorf("%v (and releasing resources: %v)", err, rErr)
+		}
+		return err
+	}
+	if err := p.release(); err != nil {
+		return err
+	}
+
+	m := manifest{
+		Version: opts.Version,
+		Created: opts.Created,
+		Kernel:  k.Release,
+		RootFS:  opts.Config.RootFS,
+		Digests: map[string]string{},
+	}
+	fi, err := os.Stat(img)
+	if err != nil {
+		return err
+	}
+	m.RootFSSize = fi.Size()
+
+	fmt.Fprintf(opts.Stdout, "Compressing root filesystem...\n")
+	if m.Digests[bundleRootFS], err = compressFile(img, filepath.Join(opts.Dir, bundleRootFS)); err != nil {
+		return fmt.Errorf("compressing root filesystem: %v", err)
+	}
+	for name, src := range map[string]string{bundleKernel: k.Image, bundleInitrd: k.Initrd} {
+		if m.Digests[name], err = copyFileDigest(filepath.Join(opts.BuildDir, "boot", src), filepath.Join(opts.Dir, name)); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(opts.Stdout, "Signing manifest...\n")
+	md := []byte(m.String())
+	sig, err := sign(key, md)
+	if err != nil {
+		return fmt.Errorf("signing manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(opts.Dir, bundleManifest), md, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(opts.Dir, bundleSignature), sig, 0644)
+}
+
+// writeRootFS creates a filesystem image holding the root filesystem of
+// the system, configured for an A/B image. It is sized to fit, and grown
+// to fill the slot when installed.
+func (p *packer) writeRootFS(ctx context.Context, pubKey []byte) error {
+	usage, err := diskUsage(p.BuildDir, p.skipRoot)
+	if err != nil {
+		return fmt.Errorf("computing size of system: %v", err)
+	}
+	used := mbFromBytes(usage)
+	size := used + used/10 + 64
+
+	fmt.Fprintf(p.Stdout, "Creating %dMB root filesystem...\n", size)
+	f, err := os.OpenFile(p.Image, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(size) << 20); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	part := Partition{Label: "root", FS: p.Config.RootFS}
+	if err := p.run(ctx, nil, "mkfs."+part.FS, append(mkfsArgs(part), p.Image)...); err != nil {
+		return err
+	}
+
+	if p.loop, err = attachLoop(ctx, p.Image); err != nil {
+		return err
+	}
+	p.onCleanup(p.loop.Detach)
+	if p.mnt, err = ioutil.TempDir("", "twl-bundle"); err != nil {
+		return err
+	}
+	mnt := p.mnt
+	p.onCleanup(func() error { return os.Remove(mnt) })
+	if err := syscall.Mount(p.loop.Path, mnt, part.FS, 0, ""); err != nil {
+		return fmt.Errorf("mounting %s: %v", p.loop.Path, err)
+	}
+	p.onCleanup(func() error { return syscall.Unmount(mnt, 0) })
+
+	fmt.Fprintf(p.Stdout, "Copying system...\n")
+	if err := copyTree(p.BuildDir, mnt, p.skipRoot); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(mnt, "boot"), 0755); err != nil {
+		return err
+	}
+	if err := writeFstab(filepath.Join(mnt, "etc", "fstab"), abFstabSources(p.Config.UEFI())); err != nil {
+		return fmt.Errorf("writing fstab: %v", err)
+	}
+	return installUpdater(mnt, pubKey)
+}
+
+// compressFile writes a gzip compressed copy of src to dst, returning the
+// digest of the compressed file.
+func compressFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(out, h))
+	if _, err := io.Copy(gz, in); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), out.Close()
+}
+
+// copyFileDigest copies src to dst, returning the digest of its contents.
+func copyFileDigest(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), out.Close()
+}
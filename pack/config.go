@@ -0,0 +1,188 @@
+// Package pack writes a built system into a bootable disk image.
+package pack
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/twitchylinux/builder/conf/grub"
+)
+
+// Partition table kinds.
+const (
+	TableGPT   = "gpt"
+	TableMSDOS = "msdos"
+)
+
+// Firmware the image can be booted by.
+const (
+	FirmwareBIOS = "bios"
+	FirmwareUEFI = "uefi"
+	// FirmwareHybrid images boot with both BIOS and UEFI firmware.
+	FirmwareHybrid = "hybrid"
+)
+
+// Bootloaders which can be installed to the image.
+const (
+	BootloaderGrub        = "grub"
+	BootloaderSystemdBoot = "systemd-boot"
+)
+
+var (
+	defaultExclude = []string{
+		"linux-*",
+		"*.deb",
+		"*.buildinfo",
+		"*.changes",
+		"*.tar.*",
+	}
+)
+
+// Config describes the layout and contents of a disk image.
+type Config struct {
+	// PartitionTable is either gpt or msdos.
+	PartitionTable string `toml:"partition_table"`
+	// BootSizeMB is the size of the /boot partition.
+	BootSizeMB int `toml:"boot_size_mb"`
+	// RootSizeMB is the size of the root partition. If zero, it is
+	// computed from the size of the built system plus FreeSpaceMB.
+	RootSizeMB int `toml:"root_size_mb"`
+	// FreeSpaceMB is the space left free on a computed root partition.
+	FreeSpaceMB int `toml:"free_space_mb"`
+	// RootFS is the filesystem of the root partition.
+	RootFS string `toml:"root_fs"`
+
+	// Firmware is one of bios, uefi or hybrid. Images for UEFI firmware
+	// have an EFI system partition.
+	Firmware string `toml:"firmware"`
+	// Bootloader is grub or systemd-boot. systemd-boot can only be used
+	// with UEFI firmware.
+	Bootloader string `toml:"bootloader"`
+	// ESPSizeMB is the size of the EFI system partition.
+	ESPSizeMB int `toml:"esp_size_mb"`
+	// UnifiedKernelImage builds the kernel, initramfs and command line
+	// into a single EFI executable, which is added to the boot menu.
+	UnifiedKernelImage bool `toml:"unified_kernel_image"`
+	// Exclude lists glob patterns of paths relative to the build
+	// directory which are not copied into the image.
+	Exclude []string `toml:"exclude"`
+	// ABRoot gives the image two root partitions, so the system can be
+	// updated from bundles by writing the inactive one.
+	ABRoot bool `toml:"ab_root"`
+
+	Autologin *AutologinConfig `toml:"autologin"`
+	// Encryption, if set, encrypts the root partition with LUKS2.
+	Encryption *EncryptionConfig `toml:"encryption"`
+	ISO        ISOConfig         `toml:"iso"`
+
+	// Menu is the [bootloader] config of the system rather than part
+	// of the image config.
+	Menu grub.Config `toml:"-"`
+}
+
+// AutologinConfig describes a user which is logged in automatically on
+// boot.
+type AutologinConfig struct {
+	User string `toml:"user"`
+	// TTY is the terminal on which the user is logged in, tty1 if unset.
+	TTY string `toml:"tty"`
+	// Command is run from the user's shell after logging in on the TTY.
+	Command string `toml:"command"`
+}
+
+// DefaultConfig returns the configuration used when none is specified.
+func DefaultConfig() Config {
+	return Config{
+		PartitionTable: TableMSDOS,
+		BootSizeMB:     256,
+		FreeSpaceMB:    2048,
+		RootFS:         "ext4",
+		Firmware:       FirmwareBIOS,
+		Bootloader:     BootloaderGrub,
+		ESPSizeMB:      256,
+		ISO:            DefaultISOConfig(),
+		Menu:           grub.DefaultConfig(),
+	}
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c *Config) Validate() error {
+	switch c.PartitionTable {
+	case TableGPT, TableMSDOS:
+	default:
+		return fmt.Errorf("unknown partition table %q (want %q or %q)", c.PartitionTable, TableGPT, TableMSDOS)
+	}
+	switch c.RootFS {
+	case "ext4", "ext3", "ext2", "btrfs", "xfs":
+	default:
+		return fmt.Errorf("unsupported root filesystem %q", c.RootFS)
+	}
+	switch c.Firmware {
+	case FirmwareBIOS, FirmwareUEFI, FirmwareHybrid:
+	default:
+		return fmt.Errorf("unknown firmware %q (want %q, %q or %q)", c.Firmware, FirmwareBIOS, FirmwareUEFI, FirmwareHybrid)
+	}
+	switch c.Bootloader {
+	case BootloaderGrub:
+	case BootloaderSystemdBoot:
+		if c.Firmware != FirmwareUEFI {
+			return fmt.Errorf("%s requires %s firmware", BootloaderSystemdBoot, FirmwareUEFI)
+		}
+	default:
+		return fmt.Errorf("unknown bootloader %q (want %q or %q)", c.Bootloader, BootloaderGrub, BootloaderSystemdBoot)
+	}
+	if c.UnifiedKernelImage && !c.UEFI() {
+		return fmt.Errorf("unified kernel images require UEFI firmware")
+	}
+	if c.UEFI() && c.ESPSizeMB < 32 {
+		return fmt.Errorf("EFI system partition must be at least 32MB, got %dMB", c.ESPSizeMB)
+	}
+	if c.BootSizeMB < 32 {
+		return fmt.Errorf("boot partition must be at least 32MB, got %dMB", c.BootSizeMB)
+	}
+	if c.RootSizeMB < 0 || c.FreeSpaceMB < 0 {
+		return fmt.Errorf("partition sizes cannot be negative")
+	}
+	for _, p := range c.Exclude {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", p, err)
+		}
+	}
+	if c.Autologin != nil && c.Autologin.User == "" {
+		return fmt.Errorf("autologin requires a user")
+	}
+	if c.Encryption != nil {
+		if err := c.Encryption.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.ABRoot {
+		if err := c.validateAB(); err != nil {
+			return fmt.Errorf("ab_root: %v", err)
+		}
+	}
+	return nil
+}
+
+// UEFI returns true if the image can be booted by UEFI firmware.
+func (c *Config) UEFI() bool {
+	return c.Firmware == FirmwareUEFI || c.Firmware == FirmwareHybrid
+}
+
+// BIOS returns true if the image can be booted by BIOS firmware.
+func (c *Config) BIOS() bool {
+	return c.Firmware == FirmwareBIOS || c.Firmware == FirmwareHybrid
+}
+
+// excluded returns true if the path, relative to the build directory,
+// should not be copied into the image.
+func (c *Config) excluded(rel string) bool {
+	for _, patterns := range [][]string{defaultExclude, c.Exclude} {
+		for _, p := range patterns {
+			if m, _ := filepath.Match(p, rel); m {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package pack
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+type inode struct {
+	dev, ino uint64
+}
+
+// copier copies a filesystem tree, preserving ownership, permissions,
+// timestamps, extended attributes, hard links and special files.
+type copier struct {
+	// skip returns true for paths (relative to the source root) which
+	// should not be copied.
+	skip  func(rel string) bool
+	links map[inode]string
+}
+
+// copyTree copies the contents of the directory src into the existing
+// directory dst.
+func copyTree(src, dst string, skip func(rel string) bool) error {
+	c := copier{skip: skip, links: map[inode]string{}}
+	return c.copyDir(src, dst, "")
+}
+
+func (c *copier) copyDir(src, dst, rel string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(src, rel))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		r := filepath.Join(rel, e.Name())
+		if c.skip != nil && c.skip(r) {
+			continue
+		}
+		if err := c.copyEntry(src, dst, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *copier) copyEntry(src, dst, rel string) error {
+	from, to := filepath.Join(src, rel), filepath.Join(dst, rel)
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: stat.sys is %T, expected syscall.Stat_t", from, fi.Sys())
+	}
+
+	if !fi.IsDir() && st.Nlink > 1 {
+		key := inode{dev: uint64(st.Dev), ino: st.Ino}
+		if first, ok := c.links[key]; ok {
+			return os.Link(first, to)
+		}
+		c.links[key] = to
+	}
+
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		if err := os.Mkdir(to, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := c.copyDir(src, dst, rel); err != nil {
+			return err
+		}
+	case mode.IsRegular():
+		if err := copyContents(from, to); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, to); err != nil {
+			return err
+		}
+	case mode&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0:
+		if err := unix.Mknod(to, st.Mode, int(st.Rdev)); err != nil {
+			return fmt.Errorf("mknod %s: %v", to, err)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported file type %v", from, mode)
+	}
+
+	return copyMetadata(from, to, fi, st)
+}
+
+func copyContents(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyMetadata applies the ownership, permissions, extended attributes
+// and timestamps of the source to the copy. Ownership is set before
+// permissions, as chown clears the setuid and setgid bits.
+func copyMetadata(from, to string, fi os.FileInfo, st *syscall.Stat_t) error {
+	if err := os.Lchown(to, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if err := unix.Chmod(to, st.Mode&07777); err != nil {
+			return fmt.Errorf("chmod %s: %v", to, err)
+		}
+	}
+	if err := copyXattrs(from, to); err != nil {
+		return fmt.Errorf("copying xattrs of %s: %v", from, err)
+	}
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Mtim)),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, to, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("setting times of %s: %v", to, err)
+	}
+	return nil
+}
+
+func copyXattrs(from, to string) error {
+	sz, err := unix.Llistxattr(from, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	if sz == 0 {
+		return nil
+	}
+	buf := make([]byte, sz)
+	if sz, err = unix.Llistxattr(from, buf); err != nil {
+		return err
+	}
+
+	for _, name := range splitXattrNames(buf[:sz]) {
+		vsz, err := unix.Lgetxattr(from, name, nil)
+		if err != nil {
+			return err
+		}
+		val := make([]byte, vsz)
+		if vsz, err = unix.Lgetxattr(from, name, val); err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(to, name, val[:vsz], 0); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// splitXattrNames splits the NUL-separated list returned by listxattr.
+func splitXattrNames(buf []byte) []string {
+	var (
+		out   []string
+		start int
+	)
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				out = append(out, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return out
+}
+
+// diskUsage returns the number of bytes allocated to files under root,
+// counting hard-linked files once.
+func diskUsage(root string, skip func(rel string) bool) (int64, error) {
+	var (
+		total int64
+		seen  = map[inode]bool{}
+	)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && skip != nil && skip(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%s: stat.sys is %T, expected syscall.Stat_t", path, fi.Sys())
+		}
+		if st.Nlink > 1 && !fi.IsDir() {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		total += st.Blocks * 512
+		return nil
+	})
+	return total, err
+}
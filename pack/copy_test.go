@@ -0,0 +1,106 @@
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyTree(t *testing.T) {
+	src, err := ioutil.TempDir("", "pack-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "pack-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	os.MkdirAll(filepath.Join(src, "usr", "bin"), 0755)
+	os.Mkdir(filepath.Join(src, "skipped"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "usr", "bin", "tool"), []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "skipped", "file"), []byte("nope"), 0644)
+	os.Chmod(filepath.Join(src, "usr", "bin", "tool"), 04755)
+	os.Link(filepath.Join(src, "usr", "bin", "tool"), filepath.Join(src, "usr", "bin", "tool-alias"))
+	os.Symlink("usr/bin", filepath.Join(src, "bin"))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "usr", "bin", "tool"), mtime, mtime)
+	hasXattr := unix.Lsetxattr(filepath.Join(src, "usr", "bin", "tool"), "user.twl", []byte("yes"), 0) == nil
+
+	if err := copyTree(src, dst, func(rel string) bool { return rel == "skipped" }); err != nil {
+		t.Fatalf("copyTree() failed: %v", err)
+	}
+
+	srcInfo, err := os.Stat(filepath.Join(src, "usr", "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := filepath.Join(dst, "usr", "bin", "tool")
+	fi, err := os.Stat(tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Some filesystems do not allow setuid bits to be set.
+	if got, want := fi.Mode(), srcInfo.Mode(); got != want {
+		t.Errorf("mode = %v, want %v", got, want)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", fi.ModTime(), mtime)
+	}
+	if d, _ := ioutil.ReadFile(tool); string(d) != "#!/bin/sh\n" {
+		t.Errorf("contents = %q", d)
+	}
+	if alias, err := os.Stat(filepath.Join(dst, "usr", "bin", "tool-alias")); err != nil || !os.SameFile(fi, alias) {
+		t.Errorf("hard link was not preserved (%v)", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "bin")); err != nil || target != "usr/bin" {
+		t.Errorf("Readlink(bin) = %q, %v, want usr/bin", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "skipped")); !os.IsNotExist(err) {
+		t.Errorf("skipped directory was copied (%v)", err)
+	}
+	if hasXattr {
+		val := make([]byte, 16)
+		n, err := unix.Lgetxattr(tool, "user.twl", val)
+		if err != nil || string(val[:n]) != "yes" {
+			t.Errorf("xattr user.twl = %q, %v, want yes", val[:n], err)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pack-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := make([]byte, 1<<20)
+	ioutil.WriteFile(filepath.Join(dir, "a"), data, 0644)
+	os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b"))
+	os.Mkdir(filepath.Join(dir, "skip"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "skip", "c"), data, 0644)
+
+	usage, err := diskUsage(dir, func(rel string) bool { return rel == "skip" })
+	if err != nil {
+		t.Fatalf("diskUsage() failed: %v", err)
+	}
+	var st syscall.Stat_t
+	syscall.Stat(filepath.Join(dir, "a"), &st)
+	if usage < st.Blocks*512 || usage >= 2*st.Blocks*512 {
+		t.Errorf("diskUsage() = %d, want one copy of a (%d) plus directories", usage, st.Blocks*512)
+	}
+}
+
+func TestSplitXattrNames(t *testing.T) {
+	got := splitXattrNames([]byte("user.a\x00security.selinux\x00"))
+	if len(got) != 2 || got[0] != "user.a" || got[1] != "security.selinux" {
+		t.Errorf("splitXattrNames() = %q", got)
+	}
+}
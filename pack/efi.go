@@ -0,0 +1,189 @@
+package pack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// efiStubPath is the location of the systemd EFI stub, which a
+	// unified kernel image is built from.
+	efiStubPath = "/usr/lib/systemd/boot/efi/linuxx64.efi.stub"
+	// ukiDir is the directory on the ESP which systemd-boot scans for
+	// unified kernel images.
+	ukiDir = "/EFI/Linux"
+	// efiKernelDir is the directory on the ESP where systemd-boot loads
+	// kernels from.
+	efiKernelDir = "/twitchylinux"
+)
+
+// ukiPath returns the path of the unified kernel image on the ESP.
+func (k kernel) ukiPath() string {
+	return path.Join(ukiDir, "twitchylinux-"+k.Release+".efi")
+}
+
+// kernelCmdline returns the command line used to boot the system
+// normally.
+func kernelCmdline(rootUUID, rootFS string) string {
+	return rootCmdline("UUID="+rootUUID, rootFS)
+}
+
+// rootCmdline is the kernel command line booting the root filesystem on
+// the given device.
+func rootCmdline(root, rootFS string) string {
+	return fmt.Sprintf("root=%s rootfstype=%s apparmor=1 security=apparmor", root, rootFS)
+}
+
+// findEFIStub returns the path to the systemd EFI stub, preferring the
+// one shipped in the built system.
+func findEFIStub(root string) (string, error) {
+	for _, p := range []string{filepath.Join(root, efiStubPath), efiStubPath} {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("EFI stub %s not found in the system or on the host (install systemd-boot-efi)", efiStubPath)
+}
+
+// buildUKI builds a unified kernel image, which bundles the kernel,
+// initramfs, command line and os-release into an EFI executable.
+func buildUKI(ctx context.Context, root, bootDir string, k kernel, cmdline, out string) error {
+	stub, err := findEFIStub(root)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir("", "twl-uki")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	cmdlinePath := filepath.Join(tmp, "cmdline")
+	if err := ioutil.WriteFile(cmdlinePath, []byte(cmdline), 0644); err != nil {
+		return err
+	}
+	osRelease := filepath.Join(root, "etc", "os-release")
+	if _, err := os.Stat(osRelease); err != nil {
+		osRelease = filepath.Join(root, "usr", "lib", "os-release")
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+
+	// Section addresses follow the layout documented for the systemd stub.
+	cmd := exec.CommandContext(ctx, "objcopy",
+		"--add-section", ".osrel="+osRelease, "--change-section-vma", ".osrel=0x20000",
+		"--add-section", ".cmdline="+cmdlinePath, "--change-section-vma", ".cmdline=0x30000",
+		"--add-section", ".linux="+filepath.Join(bootDir, k.Image), "--change-section-vma", ".linux=0x2000000",
+		"--add-section", ".initrd="+filepath.Join(bootDir, k.Initrd), "--change-section-vma", ".initrd=0x3000000",
+		stub, out)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("objcopy: %v\n%s", err, out)
+	}
+	return nil
+}
+
+// installGrubEFI installs grub to the fallback path of the ESP, so the
+// image boots without NVRAM entries.
+func installGrubEFI(ctx context.Context, espMnt, bootMnt string) error {
+	cmd := exec.CommandContext(ctx, "grub-install",
+		"--target=x86_64-efi",
+		"--efi-directory="+espMnt,
+		"--boot-directory="+bootMnt,
+		"--removable",
+		"--no-nvram")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("grub-install: %v\n%s", err, out)
+	}
+	return nil
+}
+
+type loaderEntry struct {
+	Title   string
+	Kernel  string
+	Initrd  string
+	Options string
+}
+
+func (e loaderEntry) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "title   %s\n", e.Title)
+	fmt.Fprintf(&out, "linux   %s\n", e.Kernel)
+	fmt.Fprintf(&out, "initrd  %s\n", e.Initrd)
+	fmt.Fprintf(&out, "options %s\n", e.Options)
+	return out.String()
+}
+
+// systemdBootEntries returns the loader entries for the system, keyed by
+// filename. Kernels are loaded from the ESP, as systemd-boot cannot read
+// other filesystems.
+func systemdBootEntries(k kernel, rootUUID, rootFS string) map[string]loaderEntry {
+	base := loaderEntry{
+		Kernel: path.Join(efiKernelDir, k.Image),
+		Initrd: path.Join(efiKernelDir, k.Initrd),
+	}
+	normal, installer, rescue := base, base, base
+	normal.Title, normal.Options = "TwitchyLinux", kernelCmdline(rootUUID, rootFS)
+	installer.Title = "Install TwitchyLinux"
+	installer.Options = fmt.Sprintf("root=UUID=%s rootfstype=%s systemd.unit=installer.target", rootUUID, rootFS)
+	rescue.Title = "Linux " + k.Release + " (rescue)"
+	rescue.Options = fmt.Sprintf("root=UUID=%s systemd.unit=rescue.target", rootUUID)
+
+	return map[string]loaderEntry{
+		"twitchylinux.conf":           normal,
+		"twitchylinux-installer.conf": installer,
+		"twitchylinux-rescue.conf":    rescue,
+	}
+}
+
+// installSystemdBoot installs systemd-boot to the ESP, along with loader
+// entries for the kernel.
+func installSystemdBoot(ctx context.Context, espMnt, bootDir string, k kernel, rootUUID, rootFS string, uki bool) error {
+	cmd := exec.CommandContext(ctx, "bootctl", "--esp-path="+espMnt, "--no-variables", "install")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("bootctl: %v\n%s", err, out)
+	}
+
+	def := "twitchylinux.conf"
+	if uki {
+		// systemd-boot lists unified kernel images in EFI/Linux
+		// automatically.
+		def = path.Base(k.ukiPath())
+	}
+	var loader bytes.Buffer
+	fmt.Fprintf(&loader, "default %s\ntimeout 5\neditor no\n", def)
+	if err := ioutil.WriteFile(filepath.Join(espMnt, "loader", "loader.conf"), loader.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	kernelDir := filepath.Join(espMnt, efiKernelDir)
+	if err := os.MkdirAll(kernelDir, 0755); err != nil {
+		return err
+	}
+	for _, f := range []string{k.Image, k.Initrd} {
+		d, err := ioutil.ReadFile(filepath.Join(bootDir, f))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(kernelDir, f), d, 0644); err != nil {
+			return err
+		}
+	}
+
+	entriesDir := filepath.Join(espMnt, "loader", "entries")
+	if err := os.MkdirAll(entriesDir, 0755); err != nil {
+		return err
+	}
+	for name, e := range systemdBootEntries(k, rootUUID, rootFS) {
+		if err := ioutil.WriteFile(filepath.Join(entriesDir, name), []byte(e.String()), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package pack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// fstabPlaceholders maps placeholders in the fstab of the built system to
+// the mount point of the partition they are replaced with.
+var fstabPlaceholders = map[string]string{
+	"FSTAB_DEV": "/",
+	"BOOT_DEV":  "/boot",
+}
+
+// fsUUID returns the UUID of the filesystem on the given device.
+func fsUUID(ctx context.Context, dev string) (string, error) {
+	return blkid(ctx, "UUID", dev)
+}
+
+// partUUID returns the UUID of the partition on the given device.
+func partUUID(ctx context.Context, dev string) (string, error) {
+	return blkid(ctx, "PARTUUID", dev)
+}
+
+func blkid(ctx context.Context, tag, dev string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "blkid", "-s", tag, "-o", "value", dev)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("blkid %s: %v: %s", dev, err, strings.TrimSpace(stderr.String()))
+	}
+	uuid := strings.TrimSpace(string(out))
+	if uuid == "" {
+		return "", fmt.Errorf("no %s for %s", tag, dev)
+	}
+	return uuid, nil
+}
+
+// uuidSources returns fstab sources referencing the filesystem UUIDs,
+// keyed by mount point.
+func uuidSources(uuids map[string]string) map[string]string {
+	out := make(map[string]string, len(uuids))
+	for mp, uuid := range uuids {
+		out[mp] = "UUID=" + uuid
+	}
+	return out
+}
+
+// substituteFstab replaces device placeholders in fstab with the sources
+// of the filesystems, keyed by mount point. An entry for the EFI system
+// partition is added if it is not already present.
+func substituteFstab(fstab []byte, sources map[string]string) ([]byte, error) {
+	out := string(fstab)
+	if src, ok := sources[espMountPoint]; ok && !strings.Contains(out, " "+espMountPoint+" ") {
+		if !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += fmt.Sprintf("%s %s vfat umask=0077 0 1\n", src, espMountPoint)
+	}
+	for placeholder, mountPoint := range fstabPlaceholders {
+		if !strings.Contains(out, placeholder) {
+			continue
+		}
+		src, ok := sources[mountPoint]
+		if !ok {
+			return nil, fmt.Errorf("fstab references %s, but the image has no partition for %s", placeholder, mountPoint)
+		}
+		out = strings.Replace(out, placeholder, src, -1)
+	}
+	return []byte(out), nil
+}
+
+func writeFstab(path string, sources map[string]string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if d, err = substituteFstab(d, sources); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d, 0644)
+}
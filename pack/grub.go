@@ -0,0 +1,189 @@
+package pack
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/twitchylinux/builder/conf/grub"
+)
+
+// kernel describes a kernel in /boot of the built system.
+type kernel struct {
+	Release string
+	Image   string
+	Initrd  string
+}
+
+// findKernel returns the newest kernel in the boot directory.
+func findKernel(bootDir string) (kernel, error) {
+	images, err := filepath.Glob(filepath.Join(bootDir, "vmlinuz-*"))
+	if err != nil {
+		return kernel{}, err
+	}
+	if len(images) == 0 {
+		return kernel{}, fmt.Errorf("no kernel image in %s", bootDir)
+	}
+	sort.Strings(images)
+	k := kernel{Image: filepath.Base(images[len(images)-1])}
+	k.Release = strings.TrimPrefix(k.Image, "vmlinuz-")
+	k.Initrd = "initrd.img-" + k.Release
+
+	if _, err := os.Stat(filepath.Join(bootDir, k.Initrd)); err != nil {
+		return kernel{}, fmt.Errorf("no initramfs for %s: %v", k.Release, err)
+	}
+	return k, nil
+}
+
+type grubConfig struct {
+	Menu     grub.Config
+	Kernel   kernel
+	BootUUID string
+	RootUUID string
+	RootFS   string
+
+	// ESPUUID and UKI describe a unified kernel image on the EFI system
+	// partition, which is chainloaded when booted by UEFI firmware.
+	ESPUUID string
+	UKI     string
+
+	// SlotPartUUIDs are the partition UUIDs of the root partitions of
+	// an A/B image, in the order of slots. If set, the menu boots the
+	// slot selected by the grub environment.
+	SlotPartUUIDs []string
+
+	// Theme and Background are the paths grub loads menu assets from.
+	Theme, Background string
+}
+
+// As /boot is a separate partition, paths are relative to it. The second
+// entry, which boots the system normally, is the default.
+func (g *grubConfig) render() ([]byte, error) {
+	if len(g.SlotPartUUIDs) > 0 {
+		return g.renderAB()
+	}
+	var (
+		k      = g.Kernel
+		name   = g.Menu.DistroName
+		root   = fmt.Sprintf("root=UUID=%s rootfstype=%s", g.RootUUID, g.RootFS)
+		kernel = grub.Entry{Search: g.BootUUID, Linux: "/" + k.Image, Initrd: "/" + k.Initrd}
+	)
+	installer, normal, rescue, emergency := kernel, kernel, kernel, kernel
+	installer.Title, installer.Options = "Install "+name, root+" systemd.unit=installer.target"
+	normal.Title = name
+	normal.Options = strings.TrimSpace(kernelCmdline(g.RootUUID, g.RootFS) + " " + g.Menu.Cmdline)
+	rescue.Title, rescue.Options = "Linux "+k.Release+" (rescue)", "root=UUID="+g.RootUUID+" systemd.unit=rescue.target"
+	emergency.Title, emergency.Options = "Linux "+k.Release+" (emergency)", "root=UUID="+g.RootUUID+" systemd.unit=emergency.target"
+
+	entries := []grub.Entry{installer, normal}
+	if g.UKI != "" {
+		entries = append(entries, grub.Entry{
+			Title:       name + " (unified kernel image)",
+			Search:      g.ESPUUID,
+			Chainloader: g.UKI,
+			EFIOnly:     true,
+		})
+	}
+	entries = append(entries, rescue, emergency)
+	entries = append(entries, powerEntries...)
+
+	m := grub.Menu{
+		Config:     &g.Menu,
+		Default:    "1",
+		Font:       "($root)/grub/fonts/unicode.pf2",
+		Theme:      g.Theme,
+		Background: g.Background,
+		Entries:    entries,
+	}
+	return []byte(m.String()), nil
+}
+
+// renderAB renders the menu of an A/B image, which has an entry for each
+// slot, booting the kernel written with it.
+func (g *grubConfig) renderAB() ([]byte, error) {
+	if len(g.SlotPartUUIDs) != len(slots) {
+		return nil, fmt.Errorf("got %d slot partitions, want %d", len(g.SlotPartUUIDs), len(slots))
+	}
+	var entries []grub.Entry
+	for i, s := range slots {
+		entries = append(entries, grub.Entry{
+			Title:   fmt.Sprintf("%s (slot %s)", g.Menu.DistroName, s),
+			ID:      s.entryID(),
+			Search:  g.BootUUID,
+			Linux:   "/" + s.bootDir() + "/" + bundleKernel,
+			Initrd:  "/" + s.bootDir() + "/" + bundleInitrd,
+			Options: strings.TrimSpace(abCmdline(s, g.SlotPartUUIDs[i], g.RootFS) + " " + g.Menu.Cmdline),
+		})
+	}
+	m := grub.Menu{
+		Config:     &g.Menu,
+		Default:    slots[0].entryID(),
+		Font:       "($root)/grub/fonts/unicode.pf2",
+		Theme:      g.Theme,
+		Background: g.Background,
+		Script:     abGrubScript,
+		Entries:    append(entries, powerEntries...),
+	}
+	return []byte(m.String()), nil
+}
+
+// powerEntries end every generated menu.
+var powerEntries = []grub.Entry{
+	{Title: "System shutdown", Commands: []string{"halt"}},
+	{Title: "System restart", Commands: []string{"reboot"}},
+}
+
+// installMenuAssets copies the theme and background image configured for
+// the menu from the built system into grubDir, where grub can read them.
+// It returns the paths to them as seen by grub, which sees grubDir as
+// prefix.
+func installMenuAssets(root, grubDir, prefix string, c grub.Config) (theme, background string, err error) {
+	if c.Theme != "" {
+		src := filepath.Dir(filepath.Join(root, c.Theme))
+		name := filepath.Base(src)
+		if err := os.MkdirAll(filepath.Join(grubDir, "themes", name), 0755); err != nil {
+			return "", "", err
+		}
+		if err := copyTree(src, filepath.Join(grubDir, "themes", name), nil); err != nil {
+			return "", "", fmt.Errorf("copying theme: %v", err)
+		}
+		theme = path.Join(prefix, "themes", name, "theme.txt")
+	}
+	if c.Background != "" {
+		d, err := ioutil.ReadFile(filepath.Join(root, c.Background))
+		if err != nil {
+			return "", "", fmt.Errorf("reading background: %v", err)
+		}
+		name := path.Base(c.Background)
+		if err := ioutil.WriteFile(filepath.Join(grubDir, name), d, 0644); err != nil {
+			return "", "", err
+		}
+		background = path.Join(prefix, name)
+	}
+	return theme, background, nil
+}
+
+// installGrubBIOS installs the BIOS grub bootloader onto the disk, with its
+// files in the mounted boot partition.
+func installGrubBIOS(ctx context.Context, disk, bootMnt, table string) error {
+	partModule := "part_msdos"
+	if table == TableGPT {
+		partModule = "part_gpt"
+	}
+	cmd := exec.CommandContext(ctx, "grub-install",
+		"--target=i386-pc",
+		"--no-floppy",
+		"--boot-directory="+bootMnt,
+		"--modules=biosdisk "+partModule+" ext2 configfile normal",
+		disk)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("grub-install: %v\n%s", err, out)
+	}
+	return nil
+}
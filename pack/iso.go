@@ -0,0 +1,192 @@
+package pack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/twitchylinux/builder/conf/grub"
+)
+
+// ISOConfig describes a live ISO image.
+type ISOConfig struct {
+	// VolumeID is the label of the ISO filesystem.
+	VolumeID string `toml:"volume_id"`
+	// Compression is the squashfs compressor, such as xz, zstd or gzip.
+	Compression string `toml:"compression"`
+}
+
+// DefaultISOConfig returns the ISO configuration used when none is
+// specified.
+func DefaultISOConfig() ISOConfig {
+	return ISOConfig{
+		VolumeID:    "TWITCHYLINUX",
+		Compression: "xz",
+	}
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c *ISOConfig) Validate() error {
+	if c.VolumeID == "" || len(c.VolumeID) > 32 {
+		return fmt.Errorf("volume ID must be 1-32 characters, got %q", c.VolumeID)
+	}
+	switch c.Compression {
+	case "gzip", "lzo", "lz4", "xz", "zstd":
+	default:
+		return fmt.Errorf("unsupported squashfs compression %q", c.Compression)
+	}
+	return nil
+}
+
+// ISOOptions describes a live ISO to build.
+type ISOOptions struct {
+	// BuildDir is the root of the built system.
+	BuildDir string
+	// Image is the path of the ISO file to write.
+	Image  string
+	Config Config
+
+	Stdout, Stderr io.Writer
+}
+
+const liveDir = "live"
+
+type isoGrubConfig struct {
+	Kernel kernel
+	Menu   grub.Config
+
+	// Theme and Background are the paths grub loads menu assets from.
+	Theme, Background string
+}
+
+// The first entry, which is the default, boots the installer. The system
+// must have live-boot in its initramfs, which finds the squashfs by
+// scanning attached media for /live.
+func (g *isoGrubConfig) render() ([]byte, error) {
+	var (
+		name = g.Menu.DistroName
+		live = grub.Entry{Linux: "/" + liveDir + "/vmlinuz", Initrd: "/" + liveDir + "/initrd.img"}
+		opts = strings.TrimSpace("boot=live components apparmor=1 security=apparmor " + g.Menu.Cmdline)
+	)
+	installer, normal, toram, rescue := live, live, live, live
+	installer.Title, installer.Options = "Install "+name, opts+" systemd.unit=installer.target"
+	normal.Title, normal.Options = name+" (live)", opts
+	toram.Title, toram.Options = name+" (live, copy to RAM)", opts+" toram"
+	rescue.Title, rescue.Options = "Linux "+g.Kernel.Release+" (rescue)", "boot=live components systemd.unit=rescue.target"
+
+	m := grub.Menu{
+		Config:     &g.Menu,
+		Default:    "0",
+		Theme:      g.Theme,
+		Background: g.Background,
+		Entries:    append([]grub.Entry{installer, normal, toram, rescue}, powerEntries...),
+	}
+	return []byte(m.String()), nil
+}
+
+// squashfsExcludes returns the -e arguments to mksquashfs which exclude
+// paths which are not part of the live system.
+func (c *Config) squashfsExcludes() []string {
+	var out []string
+	for _, patterns := range [][]string{defaultExclude, c.Exclude} {
+		out = append(out, patterns...)
+	}
+	return append([]string{"-wildcards", "-e"}, out...)
+}
+
+// checkLiveBoot returns an error if the initramfs tooling of the system
+// at root cannot boot from a live medium.
+func checkLiveBoot(root string) error {
+	if _, err := os.Stat(filepath.Join(root, "usr", "share", "initramfs-tools", "scripts", "live")); err != nil {
+		return fmt.Errorf("live-boot is not installed in the system (build it with --profile iso): %v", err)
+	}
+	return nil
+}
+
+// PackISO writes the built system into a hybrid ISO, which boots with BIOS
+// or UEFI firmware either from optical media or when written to a disk.
+func PackISO(ctx context.Context, opts ISOOptions) (err error) {
+	if opts.Stdout == nil {
+		opts.Stdout = ioutil.Discard
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = ioutil.Discard
+	}
+	if err := opts.Config.ISO.Validate(); err != nil {
+		return err
+	}
+	if err := checkLiveBoot(opts.BuildDir); err != nil {
+		return err
+	}
+	k, err := findKernel(filepath.Join(opts.BuildDir, "boot"))
+	if err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir("", "twl-iso")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	defer func() {
+		if err != nil {
+			os.Remove(opts.Image)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Join(staging, liveDir), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(staging, "boot", "grub"), 0755); err != nil {
+		return err
+	}
+
+	run := func(bin string, args ...string) error {
+		cmd := exec.CommandContext(ctx, bin, args...)
+		cmd.Stdout = opts.Stdout
+		cmd.Stderr = opts.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v", bin, err)
+		}
+		return nil
+	}
+
+	fmt.Fprintln(opts.Stdout, "Creating squashfs...")
+	sqArgs := []string{opts.BuildDir, filepath.Join(staging, liveDir, "filesystem.squashfs"),
+		"-noappend", "-comp", opts.Config.ISO.Compression}
+	if err := run("mksquashfs", append(sqArgs, opts.Config.squashfsExcludes()...)...); err != nil {
+		return err
+	}
+
+	for src, dst := range map[string]string{k.Image: "vmlinuz", k.Initrd: "initrd.img"} {
+		d, err := ioutil.ReadFile(filepath.Join(opts.BuildDir, "boot", src))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(staging, liveDir, dst), d, 0644); err != nil {
+			return err
+		}
+	}
+
+	theme, background, err := installMenuAssets(opts.BuildDir, filepath.Join(staging, "boot", "grub"), "/boot/grub", opts.Config.Menu)
+	if err != nil {
+		return err
+	}
+	g := isoGrubConfig{Kernel: k, Menu: opts.Config.Menu, Theme: theme, Background: background}
+	cfg, err := g.render()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, "boot", "grub", "grub.cfg"), cfg, 0644); err != nil {
+		return err
+	}
+
+	// grub-mkrescue builds an El Torito image for BIOS, an EFI system
+	// partition image for UEFI, and an MBR so the ISO boots as a disk.
+	fmt.Fprintln(opts.Stdout, "Creating ISO...")
+	return run("grub-mkrescue", "-o", opts.Image, staging, "--", "-volid", opts.Config.ISO.VolumeID)
+}
@@ -0,0 +1,72 @@
+package pack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestISOGrubConfig(t *testing.T) {
+	menu := DefaultConfig().Menu
+	menu.ColorHighlight = "black/light-gray"
+	menu.Cmdline = "quiet splash"
+	g := isoGrubConfig{
+		Kernel: kernel{Release: "5.9.14", Image: "vmlinuz-5.9.14", Initrd: "initrd.img-5.9.14"},
+		Menu:   menu,
+	}
+	out, err := g.render()
+	if err != nil {
+		t.Fatalf("render() failed: %v", err)
+	}
+	cfg := string(out)
+	for _, want := range []string{
+		`set default="0"`,
+		"set menu_color_highlight=black/light-gray",
+		"linux  /live/vmlinuz boot=live components apparmor=1 security=apparmor quiet splash toram",
+		"initrd /live/initrd.img",
+		`menuentry "Linux 5.9.14 (rescue)"`,
+	} {
+		if !strings.Contains(cfg, want) {
+			t.Errorf("grub.cfg does not contain %q:\n%s", want, cfg)
+		}
+	}
+
+	// The installer must be the first, and so default, entry.
+	first := cfg[strings.Index(cfg, "menuentry"):]
+	first = first[:strings.Index(first, "}")]
+	if !strings.HasPrefix(first, `menuentry "Install TwitchyLinux"`) || !strings.Contains(first, "boot=live components apparmor=1 security=apparmor quiet splash systemd.unit=installer.target") {
+		t.Errorf("first menu entry does not boot the installer:\n%s", first)
+	}
+}
+
+func TestSquashfsExcludes(t *testing.T) {
+	c := DefaultConfig()
+	c.Exclude = []string{"build-status"}
+	want := []string{"-wildcards", "-e", "linux-*", "*.deb", "*.buildinfo", "*.changes", "*.tar.*", "build-status"}
+	if got := c.squashfsExcludes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("squashfsExcludes() = %v, want %v", got, want)
+	}
+}
+
+func TestISOConfigValidate(t *testing.T) {
+	tcs := []struct {
+		name    string
+		mod     func(c *ISOConfig)
+		wantErr bool
+	}{
+		{name: "default", mod: func(c *ISOConfig) {}},
+		{name: "zstd", mod: func(c *ISOConfig) { c.Compression = "zstd" }},
+		{name: "bad compression", mod: func(c *ISOConfig) { c.Compression = "bzip2" }, wantErr: true},
+		{name: "no volume", mod: func(c *ISOConfig) { c.VolumeID = "" }, wantErr: true},
+		{name: "long volume", mod: func(c *ISOConfig) { c.VolumeID = strings.Repeat("A", 33) }, wantErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultISOConfig()
+			tc.mod(&c)
+			if err := c.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
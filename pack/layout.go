@@ -0,0 +1,168 @@
+package pack
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// alignMB is the offset of the first partition, and the space
+	// reserved at the end of the disk for the backup GPT header.
+	alignMB = 1
+
+	gptTypeBIOSBoot = "21686148-6E6F-744E-6564-4E6565644946"
+	gptTypeESP      = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	gptTypeLinux    = "0FC63DAF-8483-4772-8EC4-2F0BA2D10B7D"
+	mbrTypeESP      = "ef"
+	mbrTypeLinux    = "83"
+
+	// espMountPoint is where the EFI system partition is mounted.
+	espMountPoint = "/boot/efi"
+)
+
+// Partition describes a partition in the image.
+type Partition struct {
+	Label  string
+	SizeMB int
+	// FS is the filesystem to create on the partition, or empty if the
+	// partition should not be formatted.
+	FS string
+	// MountPoint is where the partition is mounted in the built system.
+	MountPoint string
+	Bootable   bool
+
+	gptType, mbrType string
+}
+
+// Layout describes the partitions of an image.
+type Layout struct {
+	Table      string
+	Partitions []Partition
+}
+
+// SizeMB returns the size of the image.
+func (l *Layout) SizeMB() int {
+	total := 2 * alignMB
+	for _, p := range l.Partitions {
+		total += p.SizeMB
+	}
+	return total
+}
+
+// partition returns the index (from 1) and details of the partition
+// mounted at the given mount point.
+func (l *Layout) partition(mountPoint string) (int, *Partition) {
+	for i := range l.Partitions {
+		if l.Partitions[i].MountPoint == mountPoint {
+			return i + 1, &l.Partitions[i]
+		}
+	}
+	return 0, nil
+}
+
+// partitionByLabel returns the index (from 1) and details of the
+// partition with the given label.
+func (l *Layout) partitionByLabel(label string) (int, *Partition) {
+	for i := range l.Partitions {
+		if l.Partitions[i].Label == label {
+			return i + 1, &l.Partitions[i]
+		}
+	}
+	return 0, nil
+}
+
+// sfdiskScript returns input to sfdisk which creates the partitions.
+func (l *Layout) sfdiskScript() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "label: %s\n", map[string]string{TableGPT: "gpt", TableMSDOS: "dos"}[l.Table])
+	fmt.Fprintf(&out, "unit: sectors\n\n")
+
+	for _, p := range l.Partitions {
+		fields := []string{fmt.Sprintf("size=%dMiB", p.SizeMB)}
+		if l.Table == TableGPT {
+			fields = append(fields, "type="+p.gptType, "name="+p.Label)
+		} else {
+			fields = append(fields, "type="+p.mbrType)
+			if p.Bootable {
+				fields = append(fields, "bootable")
+			}
+		}
+		fmt.Fprintln(&out, strings.Join(fields, ", "))
+	}
+	return out.String()
+}
+
+// mbFromBytes returns the number of MB needed to store n bytes.
+func mbFromBytes(n int64) int {
+	return int((n + (1 << 20) - 1) >> 20)
+}
+
+// rootSizeMB estimates the root partition size needed to hold usage
+// bytes, leaving room for filesystem metadata and free space.
+func (c *Config) rootSizeMB(usage int64) int {
+	if c.RootSizeMB > 0 {
+		return c.RootSizeMB
+	}
+	used := mbFromBytes(usage)
+	// Inode tables, the journal and reserved blocks take roughly 10%.
+	size := used + used/10 + 64 + c.FreeSpaceMB
+	if c.Encryption != nil {
+		size += luksHeaderMB
+	}
+	return size
+}
+
+// Layout computes the partitions of the image, given the number of bytes
+// used by the files which are copied to the root filesystem.
+func (c *Config) Layout(rootUsage int64) Layout {
+	out := Layout{Table: c.PartitionTable}
+	if c.PartitionTable == TableGPT && c.BIOS() {
+		// grub stores its core image in a dedicated partition on
+		// GPT disks booted by BIOS.
+		out.Partitions = append(out.Partitions, Partition{
+			Label:   "bios-grub",
+			SizeMB:  1,
+			gptType: gptTypeBIOSBoot,
+		})
+	}
+	if c.UEFI() {
+		out.Partitions = append(out.Partitions, Partition{
+			Label:      "EFI",
+			SizeMB:     c.ESPSizeMB,
+			FS:         "vfat",
+			MountPoint: espMountPoint,
+			gptType:    gptTypeESP,
+			mbrType:    mbrTypeESP,
+		})
+	}
+	out.Partitions = append(out.Partitions, Partition{
+		Label:      "boot",
+		SizeMB:     c.BootSizeMB,
+		FS:         "ext4",
+		MountPoint: "/boot",
+		Bootable:   c.BIOS(),
+		gptType:    gptTypeLinux,
+		mbrType:    mbrTypeLinux,
+	})
+	if c.ABRoot {
+		// The first slot is populated, and mounted while packing.
+		size := c.rootSizeMB(rootUsage)
+		for i, slot := range slots {
+			p := Partition{Label: slot.label(), SizeMB: size, FS: c.RootFS, gptType: gptTypeLinux}
+			if i == 0 {
+				p.MountPoint = "/"
+			}
+			out.Partitions = append(out.Partitions, p)
+		}
+		return out
+	}
+	out.Partitions = append(out.Partitions, Partition{
+		Label:      "root",
+		SizeMB:     c.rootSizeMB(rootUsage),
+		FS:         c.RootFS,
+		MountPoint: "/",
+		gptType:    gptTypeLinux,
+		mbrType:    mbrTypeLinux,
+	})
+	return out
+}
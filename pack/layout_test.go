@@ -0,0 +1,173 @@
+package pack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	c := DefaultConfig()
+	c.RootSizeMB = 4096
+	c.BootSizeMB = 128
+
+	msdos := c.Layout(0)
+	if got, want := msdos.SizeMB(), 2+128+4096; got != want {
+		t.Errorf("msdos SizeMB() = %d, want %d", got, want)
+	}
+	if got, want := msdos.sfdiskScript(), "label: dos\nunit: sectors\n\n"+
+		"size=128MiB, type=83, bootable\n"+
+		"size=4096MiB, type=83\n"; got != want {
+		t.Errorf("msdos sfdiskScript() = %q, want %q", got, want)
+	}
+
+	c.PartitionTable = TableGPT
+	gpt := c.Layout(0)
+	if got, want := gpt.SizeMB(), 2+1+128+4096; got != want {
+		t.Errorf("gpt SizeMB() = %d, want %d", got, want)
+	}
+	if got, want := gpt.sfdiskScript(), "label: gpt\nunit: sectors\n\n"+
+		"size=1MiB, type="+gptTypeBIOSBoot+", name=bios-grub\n"+
+		"size=128MiB, type="+gptTypeLinux+", name=boot\n"+
+		"size=4096MiB, type="+gptTypeLinux+", name=root\n"; got != want {
+		t.Errorf("gpt sfdiskScript() = %q, want %q", got, want)
+	}
+	if idx, p := gpt.partition("/"); idx != 3 || p.Label != "root" {
+		t.Errorf("partition(/) = %d, %+v, want 3, root", idx, p)
+	}
+}
+
+func TestRootSize(t *testing.T) {
+	c := DefaultConfig()
+	c.FreeSpaceMB = 100
+	if got, want := c.rootSizeMB(1000<<20), 1000+100+64+100; got != want {
+		t.Errorf("rootSizeMB() = %d, want %d", got, want)
+	}
+	c.Encryption = &EncryptionConfig{KeyFile: "key"}
+	if got, want := c.rootSizeMB(1000<<20), 1000+100+64+100+luksHeaderMB; got != want {
+		t.Errorf("encrypted rootSizeMB() = %d, want %d", got, want)
+	}
+	c.RootSizeMB = 50
+	if got := c.rootSizeMB(1000 << 20); got != 50 {
+		t.Errorf("rootSizeMB() = %d, want the configured 50", got)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tcs := []struct {
+		name   string
+		mutate func(c *Config)
+		ok     bool
+	}{
+		{"default", func(c *Config) {}, true},
+		{"gpt", func(c *Config) { c.PartitionTable = TableGPT }, true},
+		{"bad table", func(c *Config) { c.PartitionTable = "apm" }, false},
+		{"bad fs", func(c *Config) { c.RootFS = "ntfs" }, false},
+		{"small boot", func(c *Config) { c.BootSizeMB = 8 }, false},
+		{"bad exclude", func(c *Config) { c.Exclude = []string{"["} }, false},
+		{"autologin no user", func(c *Config) { c.Autologin = &AutologinConfig{} }, false},
+		{"uefi", func(c *Config) { c.Firmware = FirmwareUEFI }, true},
+		{"bad firmware", func(c *Config) { c.Firmware = "coreboot" }, false},
+		{"systemd-boot", func(c *Config) { c.Firmware, c.Bootloader = FirmwareUEFI, BootloaderSystemdBoot }, true},
+		{"systemd-boot hybrid", func(c *Config) { c.Firmware, c.Bootloader = FirmwareHybrid, BootloaderSystemdBoot }, false},
+		{"bad bootloader", func(c *Config) { c.Bootloader = "lilo" }, false},
+		{"uki bios", func(c *Config) { c.UnifiedKernelImage = true }, false},
+		{"uki uefi", func(c *Config) { c.Firmware, c.UnifiedKernelImage = FirmwareHybrid, true }, true},
+		{"small esp", func(c *Config) { c.Firmware, c.ESPSizeMB = FirmwareUEFI, 8 }, false},
+		{"luks passphrase", func(c *Config) { c.Encryption = &EncryptionConfig{PassphraseFile: "pw"} }, true},
+		{"luks no key", func(c *Config) { c.Encryption = &EncryptionConfig{} }, false},
+		{"luks two keys", func(c *Config) { c.Encryption = &EncryptionConfig{PassphraseFile: "pw", KeyFile: "key"} }, false},
+		{"ab", func(c *Config) { c.PartitionTable, c.ABRoot = TableGPT, true }, true},
+		{"ab msdos", func(c *Config) { c.ABRoot = true }, false},
+		{"ab xfs", func(c *Config) { c.PartitionTable, c.RootFS, c.ABRoot = TableGPT, "xfs", true }, false},
+		{"ab luks", func(c *Config) {
+			c.PartitionTable, c.ABRoot = TableGPT, true
+			c.Encryption = &EncryptionConfig{PassphraseFile: "pw"}
+		}, false},
+	}
+	for _, tc := range tcs {
+		c := DefaultConfig()
+		tc.mutate(&c)
+		if err := c.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: Validate() = %v, want ok = %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	c := DefaultConfig()
+	c.Exclude = []string{"build-status"}
+	for path, want := range map[string]bool{
+		"linux-5.9.14":                          true,
+		"linux-image-5.9.14_5.9.14-1_amd64.deb": true,
+		"build-status":                          true,
+		"usr":                                   false,
+		"usr/lib/linux-5.9.14":                  false,
+		"deb-pkgs":                              false,
+	} {
+		if got := c.excluded(path); got != want {
+			t.Errorf("excluded(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestLayoutUEFI(t *testing.T) {
+	c := DefaultConfig()
+	c.PartitionTable = TableGPT
+	c.RootSizeMB = 4096
+	c.BootSizeMB = 128
+	c.ESPSizeMB = 64
+
+	c.Firmware = FirmwareUEFI
+	uefi := c.Layout(0)
+	if got, want := uefi.sfdiskScript(), "label: gpt\nunit: sectors\n\n"+
+		"size=64MiB, type="+gptTypeESP+", name=EFI\n"+
+		"size=128MiB, type="+gptTypeLinux+", name=boot\n"+
+		"size=4096MiB, type="+gptTypeLinux+", name=root\n"; got != want {
+		t.Errorf("uefi sfdiskScript() = %q, want %q", got, want)
+	}
+
+	c.Firmware = FirmwareHybrid
+	hybrid := c.Layout(0)
+	var labels []string
+	for _, p := range hybrid.Partitions {
+		labels = append(labels, p.Label)
+	}
+	if got, want := strings.Join(labels, ","), "bios-grub,EFI,boot,root"; got != want {
+		t.Errorf("hybrid partitions = %s, want %s", got, want)
+	}
+	if idx, p := hybrid.partition(espMountPoint); idx != 2 || p.FS != "vfat" {
+		t.Errorf("partition(%s) = %d, %+v, want 2 with vfat", espMountPoint, idx, p)
+	}
+
+	c.PartitionTable = TableMSDOS
+	msdos := c.Layout(0)
+	if got := msdos.sfdiskScript(); !strings.Contains(got, "size=64MiB, type=ef\n") || !strings.Contains(got, "size=128MiB, type=83, bootable\n") {
+		t.Errorf("hybrid msdos sfdiskScript() = %q, want ESP and bootable /boot", got)
+	}
+}
+
+func TestLayoutAB(t *testing.T) {
+	c := DefaultConfig()
+	c.PartitionTable = TableGPT
+	c.RootSizeMB = 4096
+	c.BootSizeMB = 128
+	c.ABRoot = true
+
+	ab := c.Layout(0)
+	if got, want := ab.SizeMB(), 2+1+128+2*4096; got != want {
+		t.Errorf("SizeMB() = %d, want %d", got, want)
+	}
+	if got, want := ab.sfdiskScript(), "label: gpt\nunit: sectors\n\n"+
+		"size=1MiB, type="+gptTypeBIOSBoot+", name=bios-grub\n"+
+		"size=128MiB, type="+gptTypeLinux+", name=boot\n"+
+		"size=4096MiB, type="+gptTypeLinux+", name=root_a\n"+
+		"size=4096MiB, type="+gptTypeLinux+", name=root_b\n"; got != want {
+		t.Errorf("sfdiskScript() = %q, want %q", got, want)
+	}
+	if idx, p := ab.partition("/"); idx != 3 || p.Label != "root_a" {
+		t.Errorf("partition(/) = %d, %+v, want 3, root_a", idx, p)
+	}
+	if idx, p := ab.partitionByLabel("root_b"); idx != 4 || p.MountPoint != "" || p.FS != "ext4" {
+		t.Errorf("partitionByLabel(root_b) = %d, %+v, want an unmounted ext4 partition 4", idx, p)
+	}
+}
@@ -0,0 +1,69 @@
+package pack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// loopDevice is a loop device backed by the image file.
+type loopDevice struct {
+	Path string
+}
+
+// attachLoop attaches the image to the first free loop device, scanning
+// it for partitions.
+func attachLoop(ctx context.Context, image string) (*loopDevice, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "losetup", "--find", "--show", "--partscan", image)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("losetup: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	dev := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(dev, "/dev/loop") {
+		return nil, fmt.Errorf("losetup: unexpected device %q", dev)
+	}
+	return &loopDevice{Path: dev}, nil
+}
+
+// partition returns the path of the device for the nth partition,
+// counting from 1.
+func (l *loopDevice) partition(n int) string {
+	return fmt.Sprintf("%sp%d", l.Path, n)
+}
+
+// waitPartitions waits for the device nodes of the first n partitions
+// to appear.
+func (l *loopDevice) waitPartitions(ctx context.Context, n int) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 1; i <= n; i++ {
+		for {
+			if _, err := os.Stat(l.partition(i)); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for %s", l.partition(i))
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+	return nil
+}
+
+// Detach releases the loop device.
+func (l *loopDevice) Detach() error {
+	if out, err := exec.Command("losetup", "--detach", l.Path).CombinedOutput(); err != nil {
+		return fmt.Errorf("detaching %s: %v: %s", l.Path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
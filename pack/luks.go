@@ -0,0 +1,309 @@
+package pack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+const (
+	// luksHeaderMB is the space taken by the LUKS2 header at the start
+	// of an encrypted partition.
+	luksHeaderMB = 16
+
+	// cryptName is the device mapper name of the encrypted root in the
+	// packed system.
+	cryptName = "twl_root"
+	// cryptKeyPath is where a keyfile is installed in the packed system.
+	// It matches cryptKeyPattern, which selects keys for the initramfs.
+	cryptKeyPath    = "/etc/cryptsetup-keys.d/" + cryptName + ".key"
+	cryptKeyPattern = "/etc/cryptsetup-keys.d/*.key"
+
+	cryptrootHook = "/usr/share/initramfs-tools/hooks/cryptroot"
+	cryptConfHook = "/etc/cryptsetup-initramfs/conf-hook"
+	initramfsConf = "/etc/initramfs-tools/initramfs.conf"
+
+	rekeyScript  = "/usr/local/sbin/twl-rekey"
+	rekeyService = "twl-rekey.service"
+)
+
+// EncryptionConfig describes encryption of the root partition with LUKS2.
+// The key is read from a file on the host when packing, and is never part
+// of the stage config.
+type EncryptionConfig struct {
+	// PassphraseFile holds the passphrase entered at boot. A trailing
+	// newline is not part of the passphrase.
+	PassphraseFile string `toml:"passphrase_file"`
+	// KeyFile holds a key which is included in the initramfs, so the
+	// image boots unattended until it is re-keyed.
+	KeyFile string `toml:"key_file"`
+	// RekeyOnFirstBoot prompts for a new passphrase on the first boot,
+	// which replaces the build-time key.
+	RekeyOnFirstBoot bool `toml:"rekey_on_first_boot"`
+}
+
+// Validate returns an error if the configuration is invalid.
+func (e *EncryptionConfig) Validate() error {
+	if (e.PassphraseFile == "") == (e.KeyFile == "") {
+		return fmt.Errorf("encryption requires exactly one of passphrase_file or key_file")
+	}
+	return nil
+}
+
+// key reads the key the root partition is encrypted with.
+func (e *EncryptionConfig) key() ([]byte, error) {
+	path := e.KeyFile
+	if e.PassphraseFile != "" {
+		path = e.PassphraseFile
+	}
+	k, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption key: %v", err)
+	}
+	if e.PassphraseFile != "" {
+		k = bytes.TrimSuffix(bytes.TrimSuffix(k, []byte("\n")), []byte("\r"))
+	}
+	if len(k) == 0 {
+		return nil, fmt.Errorf("encryption key %s is empty", path)
+	}
+	return k, nil
+}
+
+// checkCryptsetupInitramfs returns an error if the initramfs of the system
+// at root cannot unlock an encrypted root.
+func checkCryptsetupInitramfs(root string) error {
+	if _, err := os.Stat(filepath.Join(root, cryptrootHook)); err != nil {
+		return fmt.Errorf("cryptsetup-initramfs is not installed in the system: %v", err)
+	}
+	return nil
+}
+
+// crypttabLine returns the crypttab entry which unlocks the root
+// partition. The initramfs option includes it in the initramfs even
+// though the packer cannot resolve the root device from a chroot.
+func crypttabLine(luksUUID string, keyFile bool) string {
+	key := "none"
+	if keyFile {
+		key = cryptKeyPath
+	}
+	return fmt.Sprintf("%s UUID=%s %s luks,discard,initramfs\n", cryptName, luksUUID, key)
+}
+
+// substituteCrypttab replaces any entry for the root in crypttab with
+// line.
+func substituteCrypttab(crypttab []byte, line string) []byte {
+	var out strings.Builder
+	for _, l := range strings.SplitAfter(string(crypttab), "\n") {
+		if f := strings.Fields(l); len(f) > 0 && f[0] == cryptName {
+			continue
+		}
+		out.WriteString(l)
+	}
+	if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+		out.WriteString("\n")
+	}
+	out.WriteString(line)
+	return []byte(out.String())
+}
+
+func writeCrypttab(root, line string) error {
+	path := filepath.Join(root, "etc", "crypttab")
+	d, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, substituteCrypttab(d, line), 0644)
+}
+
+// appendConf adds lines to a shell-style configuration file in the system
+// at root.
+func appendConf(root, path string, lines ...string) error {
+	path = filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString("\n# Added by twl-builder pack.\n" + strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// installKeyFile copies the key into the system at root, and configures
+// the initramfs to include it without making the initramfs readable by
+// other users.
+func installKeyFile(root string, key []byte) error {
+	path := filepath.Join(root, cryptKeyPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, key, 0400); err != nil {
+		return err
+	}
+	if err := appendConf(root, cryptConfHook, fmt.Sprintf("KEYFILE_PATTERN=%q", cryptKeyPattern)); err != nil {
+		return err
+	}
+	return appendConf(root, initramfsConf, "UMASK=0077")
+}
+
+var rekeyScriptTmpl = template.Must(template.New("twl-rekey").Parse(`#!/bin/sh
+# Generated by twl-builder pack. Replaces the key the root filesystem was
+# encrypted with when the image was built, then disables itself.
+set -e
+
+echo
+echo "The root filesystem is encrypted with a key set when this system was built."
+echo "Choose a new passphrase to unlock it with."
+until cryptsetup luksChangeKey --verify-passphrase{{if .KeyFile}} --key-file {{.KeyFile}}{{end}} {{.Device}}; do
+  echo "Changing the passphrase failed, try again."
+done
+{{- if .KeyFile}}
+
+# The build-time key must no longer be in the initramfs.
+rm -f {{.KeyFile}}
+sed -i 's|^\({{.Name}} .*\) {{.KeyFile}} |\1 none |' /etc/crypttab
+update-initramfs -u -k all
+{{- end}}
+
+systemctl disable {{.Service}}
+echo "Passphrase changed."
+`))
+
+var rekeyServiceTmpl = template.Must(template.New(rekeyService).Parse(`[Unit]
+Description=Choose a passphrase for the encrypted root filesystem
+After=local-fs.target
+Before=getty.target display-manager.service
+ConditionPathExists={{.Script}}
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart={{.Script}}
+StandardInput=tty
+StandardOutput=tty
+TTYPath=/dev/tty1
+TTYReset=yes
+TTYVHangup=yes
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// setupRekey installs a service which prompts on tty1 during the first
+// boot for a passphrase to replace the build-time key.
+func setupRekey(root, luksUUID string, keyFile bool) error {
+	data := struct {
+		Name, Device, KeyFile, Script, Service string
+	}{
+		Name:    cryptName,
+		Device:  "/dev/disk/by-uuid/" + luksUUID,
+		Script:  rekeyScript,
+		Service: rekeyService,
+	}
+	if keyFile {
+		data.KeyFile = cryptKeyPath
+	}
+
+	var script, svc bytes.Buffer
+	if err := rekeyScriptTmpl.Execute(&script, data); err != nil {
+		return err
+	}
+	if err := rekeyServiceTmpl.Execute(&svc, data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(root, filepath.Dir(rekeyScript)), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, rekeyScript), script.Bytes(), 0755); err != nil {
+		return err
+	}
+	sysdDir := filepath.Join(root, "etc", "systemd", "system")
+	if err := os.MkdirAll(filepath.Join(sysdDir, "multi-user.target.wants"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(sysdDir, rekeyService), svc.Bytes(), 0644); err != nil {
+		return err
+	}
+	link := filepath.Join(sysdDir, "multi-user.target.wants", rekeyService)
+	if err := os.Symlink("../"+rekeyService, link); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// encrypt formats the root partition as LUKS2 and opens it, so the
+// filesystem is created on the mapped device.
+func (p *packer) encrypt(ctx context.Context) error {
+	idx, _ := p.layout.partition("/")
+	dev := p.loop.partition(idx)
+	if err := p.run(ctx, bytes.NewReader(p.key), "cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file=-", dev); err != nil {
+		return err
+	}
+	// The host may have its own twl_root mapping, so a name unique to
+	// this packer is used while packing.
+	name := fmt.Sprintf("twl-pack-%d", os.Getpid())
+	if err := p.run(ctx, bytes.NewReader(p.key), "cryptsetup", "open", "--key-file=-", dev, name); err != nil {
+		return err
+	}
+	p.onCleanup(func() error {
+		return p.run(context.Background(), nil, "cryptsetup", "close", name)
+	})
+	p.cryptDev = "/dev/mapper/" + name
+	return nil
+}
+
+// configureEncryption sets up the packed system to unlock the root
+// partition at boot, and regenerates its initramfs to do so.
+func (p *packer) configureEncryption(ctx context.Context) error {
+	idx, _ := p.layout.partition("/")
+	luksUUID, err := fsUUID(ctx, p.loop.partition(idx))
+	if err != nil {
+		return err
+	}
+	enc := p.Config.Encryption
+	keyFile := enc.KeyFile != ""
+
+	if err := writeCrypttab(p.mnt, crypttabLine(luksUUID, keyFile)); err != nil {
+		return fmt.Errorf("writing crypttab: %v", err)
+	}
+	if err := appendConf(p.mnt, cryptConfHook, "CRYPTSETUP=y"); err != nil {
+		return err
+	}
+	if keyFile {
+		if err := installKeyFile(p.mnt, p.key); err != nil {
+			return fmt.Errorf("installing keyfile: %v", err)
+		}
+	}
+	if enc.RekeyOnFirstBoot {
+		if err := setupRekey(p.mnt, luksUUID, keyFile); err != nil {
+			return fmt.Errorf("configuring first-boot re-key: %v", err)
+		}
+	}
+	return p.chroot(ctx, "update-initramfs", "-u", "-k", p.kernel.Release)
+}
+
+// chroot runs a command in the mounted image, with the kernel filesystems
+// of the host available.
+func (p *packer) chroot(ctx context.Context, bin string, args ...string) error {
+	for _, fs := range []string{"dev", "proc", "sys"} {
+		target := filepath.Join(p.mnt, fs)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount("/"+fs, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("mounting %s: %v", target, err)
+		}
+		defer syscall.Unmount(target, syscall.MNT_DETACH)
+	}
+	return p.run(ctx, nil, "chroot", append([]string{p.mnt, bin}, args...)...)
+}
@@ -0,0 +1,91 @@
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pack-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pw, key, empty := filepath.Join(dir, "pw"), filepath.Join(dir, "key"), filepath.Join(dir, "empty")
+	ioutil.WriteFile(pw, []byte("hunter2\n"), 0600)
+	ioutil.WriteFile(key, []byte("\x00\x01\n"), 0600)
+	ioutil.WriteFile(empty, []byte("\n"), 0600)
+
+	tcs := []struct {
+		conf EncryptionConfig
+		want string
+		ok   bool
+	}{
+		{EncryptionConfig{PassphraseFile: pw}, "hunter2", true},
+		{EncryptionConfig{KeyFile: key}, "\x00\x01\n", true},
+		{EncryptionConfig{PassphraseFile: empty}, "", false},
+		{EncryptionConfig{KeyFile: filepath.Join(dir, "missing")}, "", false},
+	}
+	for _, tc := range tcs {
+		got, err := tc.conf.key()
+		if (err == nil) != tc.ok || string(got) != tc.want {
+			t.Errorf("%+v: key() = %q, %v, want %q, ok = %v", tc.conf, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestSubstituteCrypttab(t *testing.T) {
+	in := "# <target name> <source device> <key file> <options>\n" +
+		"twl_root UUID=old none luks\n" +
+		"swap /dev/sda3 /dev/urandom swap"
+	want := "# <target name> <source device> <key file> <options>\n" +
+		"swap /dev/sda3 /dev/urandom swap\n" +
+		"twl_root UUID=1234 /etc/cryptsetup-keys.d/twl_root.key luks,discard,initramfs\n"
+	if got := string(substituteCrypttab([]byte(in), crypttabLine("1234", true))); got != want {
+		t.Errorf("substituteCrypttab() = %q, want %q", got, want)
+	}
+	if got, want := string(substituteCrypttab(nil, crypttabLine("1234", false))), "twl_root UUID=1234 none luks,discard,initramfs\n"; got != want {
+		t.Errorf("substituteCrypttab(nil) = %q, want %q", got, want)
+	}
+}
+
+func TestSetupRekey(t *testing.T) {
+	root, err := ioutil.TempDir("", "pack-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := setupRekey(root, "1234", true); err != nil {
+		t.Fatalf("setupRekey() failed: %v", err)
+	}
+	script, err := ioutil.ReadFile(filepath.Join(root, rekeyScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"cryptsetup luksChangeKey --verify-passphrase --key-file /etc/cryptsetup-keys.d/twl_root.key /dev/disk/by-uuid/1234;",
+		"rm -f /etc/cryptsetup-keys.d/twl_root.key\n",
+		"update-initramfs -u -k all\n",
+		"systemctl disable twl-rekey.service\n",
+	} {
+		if !strings.Contains(string(script), want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	link, err := os.Readlink(filepath.Join(root, "etc", "systemd", "system", "multi-user.target.wants", rekeyService))
+	if err != nil || link != "../"+rekeyService {
+		t.Errorf("wants link = %q, %v", link, err)
+	}
+
+	if err := setupRekey(root, "1234", false); err != nil {
+		t.Fatalf("setupRekey() failed: %v", err)
+	}
+	script, _ = ioutil.ReadFile(filepath.Join(root, rekeyScript))
+	if strings.Contains(string(script), "--key-file") || strings.Contains(string(script), "update-initramfs") {
+		t.Errorf("passphrase re-key script references a keyfile:\n%s", script)
+	}
+}
@@ -0,0 +1,486 @@
+package pack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/twitchylinux/builder/secureboot"
+)
+
+// Options describes an image to pack.
+type Options struct {
+	// BuildDir is the root of the built system.
+	BuildDir string
+	// Image is the path of the image file to write.
+	Image  string
+	Config Config
+	// SecureBootKeys is an optional directory of keys which EFI
+	// binaries on the EFI system partition are signed with.
+	SecureBootKeys string
+	// UpdateKey is the path to the private key update bundles are
+	// signed with, required for images with an A/B layout.
+	UpdateKey string
+
+	Stdout, Stderr io.Writer
+}
+
+func (o *Options) logf(format string, args ...interface{}) {
+	fmt.Fprintf(o.Stdout, format+"\n", args...)
+}
+
+// packer tracks the resources held while packing an image, so they can
+// be released in reverse order if packing fails.
+type packer struct {
+	Options
+	layout  Layout
+	kernel  kernel
+	keys    *secureboot.Keys
+	loop    *loopDevice
+	mnt     string
+	cleanup []func() error
+
+	// key encrypts the root partition, which is mapped to cryptDev
+	// while packing.
+	key      []byte
+	cryptDev string
+	// updatePubKey verifies update bundles in A/B images.
+	updatePubKey []byte
+
+	// uuidsByMount holds the filesystem UUIDs of the partitions, keyed
+	// by mount point.
+	uuidsByMount map[string]string
+}
+
+func (p *packer) onCleanup(f func() error) {
+	p.cleanup = append(p.cleanup, f)
+}
+
+func (p *packer) release() error {
+	var first error
+	for i := len(p.cleanup) - 1; i >= 0; i-- {
+		if err := p.cleanup[i](); err != nil {
+			fmt.Fprintf(p.Stderr, "Cleanup failed: %v\n", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	p.cleanup = nil
+	return first
+}
+
+type step struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// Pack writes the built system into a bootable disk image. On failure,
+// any mounts and loop devices are released and the image is removed.
+func Pack(ctx context.Context, opts Options) (err error) {
+	if opts.Stdout == nil {
+		opts.Stdout = ioutil.Discard
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = ioutil.Discard
+	}
+	if err := opts.Config.Validate(); err != nil {
+		return err
+	}
+	p := &packer{Options: opts}
+	defer func() {
+		if cErr := p.release(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			os.Remove(opts.Image)
+		}
+	}()
+
+	if p.kernel, err = findKernel(filepath.Join(opts.BuildDir, "boot")); err != nil {
+		return err
+	}
+	usage, err := diskUsage(opts.BuildDir, p.skipRoot)
+	if err != nil {
+		return fmt.Errorf("computing size of system: %v", err)
+	}
+	bootUsage, err := diskUsage(filepath.Join(opts.BuildDir, "boot"), nil)
+	if err != nil {
+		return fmt.Errorf("computing size of /boot: %v", err)
+	}
+	if mb := mbFromBytes(bootUsage); mb+mb/10+16 > opts.Config.BootSizeMB {
+		return fmt.Errorf("/boot needs %dMB, which does not fit in a %dMB boot partition", mb, opts.Config.BootSizeMB)
+	}
+	if opts.Config.RootSizeMB > 0 && mbFromBytes(usage) > opts.Config.RootSizeMB {
+		return fmt.Errorf("system needs %dMB, which does not fit in a %dMB root partition", mbFromBytes(usage), opts.Config.RootSizeMB)
+	}
+	p.layout = opts.Config.Layout(usage)
+	if opts.SecureBootKeys != "" && opts.Config.UEFI() {
+		if p.keys, err = secureboot.LoadKeys(opts.SecureBootKeys); err != nil {
+			return err
+		}
+	}
+
+	if enc := opts.Config.Encryption; enc != nil {
+		if err := checkCryptsetupInitramfs(opts.BuildDir); err != nil {
+			return err
+		}
+		if p.key, err = enc.key(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Config.ABRoot {
+		if err := checkGrubEditEnv(opts.BuildDir); err != nil {
+			return err
+		}
+		if opts.UpdateKey == "" {
+			return fmt.Errorf("images with ab_root require an update key")
+		}
+		key, err := loadUpdateKey(opts.UpdateKey)
+		if err != nil {
+			return err
+		}
+		if p.updatePubKey, err = publicKeyPEM(key); err != nil {
+			return err
+		}
+	}
+
+	steps := []step{
+		{"Creating image", p.createImage},
+		{"Attaching loop device", p.attach},
+	}
+	if p.key != nil {
+		steps = append(steps, step{"Encrypting root partition", p.encrypt})
+	}
+	steps = append(steps, []step{
+		{"Creating filesystems", p.mkfs},
+		{"Mounting filesystems", p.mount},
+		{"Copying system", p.copy},
+		{"Configuring system", p.configure},
+		{"Installing bootloader", p.installBootloader},
+	}...)
+	if p.keys != nil {
+		steps = append(steps, step{"Signing EFI binaries", p.signEFI})
+	}
+	for _, s := range steps {
+		p.logf("%s...", s.name)
+		if err := s.fn(ctx); err != nil {
+			return fmt.Errorf("%s: %v", strings.ToLower(s.name), err)
+		}
+	}
+	syscall.Sync()
+	return nil
+}
+
+// skipRoot returns true for paths which are not copied to the root
+// partition.
+func (p *packer) skipRoot(rel string) bool {
+	return rel == "boot" || p.Config.excluded(rel)
+}
+
+func (p *packer) run(ctx context.Context, stdin io.Reader, bin string, args ...string) error {
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = p.Stdout
+	cmd.Stderr = p.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", bin, err)
+	}
+	return nil
+}
+
+func (p *packer) createImage(ctx context.Context) error {
+	f, err := os.OpenFile(p.Image, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(p.layout.SizeMB()) << 20); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	p.logf("Image is %dMB, partitioned as %s.", p.layout.SizeMB(), p.layout.Table)
+	return p.run(ctx, strings.NewReader(p.layout.sfdiskScript()), "sfdisk", "--quiet", p.Image)
+}
+
+func (p *packer) attach(ctx context.Context) error {
+	loop, err := attachLoop(ctx, p.Image)
+	if err != nil {
+		return err
+	}
+	p.loop = loop
+	p.onCleanup(loop.Detach)
+	p.logf("Attached image to %s.", loop.Path)
+	return loop.waitPartitions(ctx, len(p.layout.Partitions))
+}
+
+func (p *packer) mkfs(ctx context.Context) error {
+	for i, part := range p.layout.Partitions {
+		if part.FS == "" {
+			continue
+		}
+		if err := p.run(ctx, nil, "mkfs."+part.FS, append(mkfsArgs(part), p.device(i+1))...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mkfsArgs(part Partition) []string {
+	switch {
+	case part.FS == "vfat":
+		return []string{"-F", "32", "-n", part.Label}
+	case strings.HasPrefix(part.FS, "ext"):
+		return []string{"-q", "-L", part.Label}
+	default:
+		return []string{"-L", part.Label}
+	}
+}
+
+// device returns the block device holding the filesystem of the nth
+// partition, which is the mapped device for an encrypted root.
+func (p *packer) device(n int) string {
+	if idx, _ := p.layout.partition("/"); n == idx && p.cryptDev != "" {
+		return p.cryptDev
+	}
+	return p.loop.partition(n)
+}
+
+func (p *packer) mountPartition(mountPoint string) error {
+	idx, part := p.layout.partition(mountPoint)
+	if part == nil {
+		return nil
+	}
+	target := filepath.Join(p.mnt, mountPoint)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(p.device(idx), target, part.FS, 0, ""); err != nil {
+		return fmt.Errorf("mounting %s: %v", p.device(idx), err)
+	}
+	p.onCleanup(func() error { return syscall.Unmount(target, 0) })
+	return nil
+}
+
+func (p *packer) mount(ctx context.Context) error {
+	var err error
+	if p.mnt, err = ioutil.TempDir("", "twl-pack"); err != nil {
+		return err
+	}
+	mnt := p.mnt
+	p.onCleanup(func() error { return os.Remove(mnt) })
+
+	for _, mp := range []string{"/", "/boot", espMountPoint} {
+		if err := p.mountPartition(mp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *packer) copy(ctx context.Context) error {
+	if err := copyTree(p.BuildDir, p.mnt, p.skipRoot); err != nil {
+		return err
+	}
+	// The ESP is populated when installing the bootloader, and cannot
+	// hold ownership or permissions.
+	bootDir := filepath.Join(p.BuildDir, "boot")
+	skipESP := func(rel string) bool { return rel == "efi" }
+	if err := copyTree(bootDir, filepath.Join(p.mnt, "boot"), skipESP); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(bootDir)
+	if err != nil {
+		return err
+	}
+	if err := copyMetadata(bootDir, filepath.Join(p.mnt, "boot"), fi, fi.Sys().(*syscall.Stat_t)); err != nil {
+		return err
+	}
+	if p.Config.ABRoot {
+		return p.copySlotKernel(slots[0])
+	}
+	return nil
+}
+
+// copySlotKernel copies the kernel and initramfs into the directory of
+// the boot partition the slot is booted from.
+func (p *packer) copySlotKernel(s slot) error {
+	dir := filepath.Join(p.mnt, "boot", s.bootDir())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, src := range map[string]string{bundleKernel: p.kernel.Image, bundleInitrd: p.kernel.Initrd} {
+		if _, err := copyFileDigest(filepath.Join(p.BuildDir, "boot", src), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uuids returns the filesystem UUIDs of the partitions, keyed by their
+// mount point.
+func (p *packer) uuids(ctx context.Context) (map[string]string, error) {
+	out := map[string]string{}
+	for i, part := range p.layout.Partitions {
+		if part.MountPoint == "" {
+			continue
+		}
+		uuid, err := fsUUID(ctx, p.device(i+1))
+		if err != nil {
+			return nil, err
+		}
+		out[part.MountPoint] = uuid
+	}
+	return out, nil
+}
+
+func (p *packer) configure(ctx context.Context) error {
+	uuids, err := p.uuids(ctx)
+	if err != nil {
+		return err
+	}
+	sources := uuidSources(uuids)
+	if p.Config.ABRoot {
+		sources = abFstabSources(p.Config.UEFI())
+	}
+	if err := writeFstab(filepath.Join(p.mnt, "etc", "fstab"), sources); err != nil {
+		return fmt.Errorf("writing fstab: %v", err)
+	}
+	if p.Config.Autologin != nil {
+		if err := setupAutologin(p.mnt, *p.Config.Autologin); err != nil {
+			return fmt.Errorf("configuring autologin: %v", err)
+		}
+	}
+	if p.key != nil {
+		if err := p.configureEncryption(ctx); err != nil {
+			return fmt.Errorf("configuring encryption: %v", err)
+		}
+	}
+	if p.Config.ABRoot {
+		if err := installUpdater(p.mnt, p.updatePubKey); err != nil {
+			return fmt.Errorf("installing updater: %v", err)
+		}
+	}
+
+	p.uuidsByMount = uuids
+	return nil
+}
+
+func (p *packer) installBootloader(ctx context.Context) error {
+	var (
+		bootMnt = filepath.Join(p.mnt, "boot")
+		espMnt  = filepath.Join(p.mnt, espMountPoint)
+		uuids   = p.uuidsByMount
+		uki     string
+	)
+	if p.Config.UnifiedKernelImage {
+		uki = p.kernel.ukiPath()
+		cmdline := kernelCmdline(uuids["/"], p.Config.RootFS)
+		if err := buildUKI(ctx, p.mnt, bootMnt, p.kernel, cmdline, filepath.Join(espMnt, uki)); err != nil {
+			return fmt.Errorf("building unified kernel image: %v", err)
+		}
+	}
+
+	if p.Config.Bootloader == BootloaderSystemdBoot {
+		return installSystemdBoot(ctx, espMnt, bootMnt, p.kernel, uuids["/"], p.Config.RootFS, uki != "")
+	}
+
+	if err := os.MkdirAll(filepath.Join(bootMnt, "grub"), 0755); err != nil {
+		return err
+	}
+	theme, background, err := installMenuAssets(p.mnt, filepath.Join(bootMnt, "grub"), "/grub", p.Config.Menu)
+	if err != nil {
+		return err
+	}
+	g := grubConfig{
+		Menu:     p.Config.Menu,
+		Kernel:   p.kernel,
+		BootUUID: uuids["/boot"],
+		RootUUID: uuids["/"],
+		RootFS:   p.Config.RootFS,
+		ESPUUID:  uuids[espMountPoint],
+		UKI:      uki,
+
+		Theme:      theme,
+		Background: background,
+	}
+	if p.Config.ABRoot {
+		if err := p.setupSlots(ctx, &g); err != nil {
+			return err
+		}
+	}
+	cfg, err := g.render()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(bootMnt, "grub", "grub.cfg"), cfg, 0644); err != nil {
+		return err
+	}
+
+	if p.Config.BIOS() {
+		if err := installGrubBIOS(ctx, p.loop.Path, bootMnt, p.layout.Table); err != nil {
+			return err
+		}
+	}
+	if p.Config.UEFI() {
+		if err := installGrubEFI(ctx, espMnt, bootMnt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupSlots adds the root partitions of an A/B image to the grub
+// config, and creates the grub environment which selects the first.
+func (p *packer) setupSlots(ctx context.Context, g *grubConfig) error {
+	for _, s := range slots {
+		idx, _ := p.layout.partitionByLabel(s.label())
+		uuid, err := partUUID(ctx, p.loop.partition(idx))
+		if err != nil {
+			return err
+		}
+		g.SlotPartUUIDs = append(g.SlotPartUUIDs, uuid)
+	}
+	env, err := grubEnv(map[string]string{"twl_slot": string(slots[0])})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(p.mnt, "boot", grubEnvPath), env, 0644)
+}
+
+// signEFI signs every EFI binary on the EFI system partition, including
+// the bootloader and any unified kernel image, then checks the
+// signatures.
+func (p *packer) signEFI(ctx context.Context) error {
+	var bins []string
+	err := filepath.Walk(filepath.Join(p.mnt, espMountPoint), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.EqualFold(filepath.Ext(path), ".efi") {
+			bins = append(bins, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, b := range bins {
+		if err := secureboot.SignEFI(ctx, p.keys, b); err != nil {
+			return err
+		}
+		if err := secureboot.VerifyEFI(ctx, p.keys, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
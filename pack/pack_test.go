@@ -0,0 +1,151 @@
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSubstituteFstab(t *testing.T) {
+	fstab := []byte("FSTAB_DEV / ext4 defaults 1 1\nBOOT_DEV /boot auto defaults 1 1\n")
+	got, err := substituteFstab(fstab, uuidSources(map[string]string{"/": "1111", "/boot": "2222"}))
+	if err != nil {
+		t.Fatalf("substituteFstab() failed: %v", err)
+	}
+	if want := "UUID=1111 / ext4 defaults 1 1\nUUID=2222 /boot auto defaults 1 1\n"; string(got) != want {
+		t.Errorf("substituteFstab() = %q, want %q", got, want)
+	}
+
+	got, err = substituteFstab(fstab, uuidSources(map[string]string{"/": "1111", "/boot": "2222", "/boot/efi": "AB-CD"}))
+	if err != nil {
+		t.Fatalf("substituteFstab() failed: %v", err)
+	}
+	if want := "UUID=AB-CD /boot/efi vfat umask=0077 0 1\n"; !strings.HasSuffix(string(got), want) {
+		t.Errorf("substituteFstab() = %q, want ESP entry %q", got, want)
+	}
+
+	if _, err := substituteFstab(fstab, uuidSources(map[string]string{"/": "1111"})); err == nil {
+		t.Error("substituteFstab() did not fail with a missing boot partition")
+	}
+}
+
+func TestFindKernel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pack-boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := findKernel(dir); err == nil {
+		t.Error("findKernel() did not fail on an empty /boot")
+	}
+	for _, f := range []string{"vmlinuz-5.9.14", "initrd.img-5.9.14", "vmlinuz-5.4.0"} {
+		ioutil.WriteFile(filepath.Join(dir, f), nil, 0644)
+	}
+	k, err := findKernel(dir)
+	if err != nil {
+		t.Fatalf("findKernel() failed: %v", err)
+	}
+	if want := (kernel{Release: "5.9.14", Image: "vmlinuz-5.9.14", Initrd: "initrd.img-5.9.14"}); k != want {
+		t.Errorf("findKernel() = %+v, want %+v", k, want)
+	}
+}
+
+func TestGrubConfig(t *testing.T) {
+	g := grubConfig{
+		Menu:     DefaultConfig().Menu,
+		Kernel:   kernel{Release: "5.9.14", Image: "vmlinuz-5.9.14", Initrd: "initrd.img-5.9.14"},
+		BootUUID: "b-uuid",
+		RootUUID: "r-uuid",
+		RootFS:   "ext4",
+	}
+	out, err := g.render()
+	if err != nil {
+		t.Fatalf("render() failed: %v", err)
+	}
+	for _, want := range []string{
+		"search --no-floppy --fs-uuid --set b-uuid",
+		"linux  /vmlinuz-5.9.14 root=UUID=r-uuid rootfstype=ext4 systemd.unit=installer.target",
+		"initrd /initrd.img-5.9.14",
+		`menuentry "Linux 5.9.14 (rescue)"`,
+		`menuentry "Install TwitchyLinux"`,
+		"set menu_color_normal=white/black",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("grub.cfg does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "chainloader") {
+		t.Errorf("grub.cfg chainloads without a unified kernel image:\n%s", out)
+	}
+
+	g.ESPUUID, g.UKI = "AB-CD", g.Kernel.ukiPath()
+	if out, err = g.render(); err != nil {
+		t.Fatalf("render() failed: %v", err)
+	}
+	if want := "search --no-floppy --fs-uuid --set AB-CD\n          chainloader /EFI/Linux/twitchylinux-5.9.14.efi"; !strings.Contains(string(out), want) {
+		t.Errorf("grub.cfg does not contain %q:\n%s", want, out)
+	}
+}
+
+func TestSystemdBootEntries(t *testing.T) {
+	k := kernel{Release: "5.9.14", Image: "vmlinuz-5.9.14", Initrd: "initrd.img-5.9.14"}
+	entries := systemdBootEntries(k, "r-uuid", "ext4")
+	e, ok := entries["twitchylinux.conf"]
+	if !ok {
+		t.Fatalf("no default entry in %v", entries)
+	}
+	want := "title   TwitchyLinux\n" +
+		"linux   /twitchylinux/vmlinuz-5.9.14\n" +
+		"initrd  /twitchylinux/initrd.img-5.9.14\n" +
+		"options root=UUID=r-uuid rootfstype=ext4 apparmor=1 security=apparmor\n"
+	if got := e.String(); got != want {
+		t.Errorf("entry = %q, want %q", got, want)
+	}
+	if !strings.Contains(entries["twitchylinux-installer.conf"].Options, "systemd.unit=installer.target") {
+		t.Errorf("installer entry = %+v", entries["twitchylinux-installer.conf"])
+	}
+}
+
+func TestSetupAutologin(t *testing.T) {
+	root, err := ioutil.TempDir("", "pack-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	os.MkdirAll(filepath.Join(root, "home", "twl"), 0755)
+	uid, gid := os.Getuid(), os.Getgid()
+	passwd := "root:x:0:0:root:/root:/bin/bash\ntwl:x:" + strconv.Itoa(uid) + ":" + strconv.Itoa(gid) + ":,,,:/home/twl:/bin/bash\n"
+	ioutil.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(passwd), 0644)
+	ioutil.WriteFile(filepath.Join(root, "etc", "group"), []byte("root:x:0:\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "etc", "shadow"), nil, 0640)
+	ioutil.WriteFile(filepath.Join(root, "home", "twl", ".bashrc"), []byte("# existing\n"), 0644)
+
+	if err := setupAutologin(root, AutologinConfig{User: "twl", Command: "sway"}); err != nil {
+		t.Fatalf("setupAutologin() failed: %v", err)
+	}
+
+	svc, err := ioutil.ReadFile(filepath.Join(root, "etc", "systemd", "system", "autologin@.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(svc), "ExecStart=-/sbin/agetty --noclear -a twl %I $TERM") {
+		t.Errorf("service does not log in twl:\n%s", svc)
+	}
+	link, err := os.Readlink(filepath.Join(root, "etc", "systemd", "system", "getty.target.wants", "autologin@tty1.service"))
+	if err != nil || link != "../autologin@.service" {
+		t.Errorf("wants link = %q, %v", link, err)
+	}
+	bashrc, _ := ioutil.ReadFile(filepath.Join(root, "home", "twl", ".bashrc"))
+	if !strings.HasPrefix(string(bashrc), "# existing\n") || !strings.Contains(string(bashrc), "'/dev/tty1' ]]; then\n  sway\nfi") {
+		t.Errorf(".bashrc = %q", bashrc)
+	}
+
+	if err := setupAutologin(root, AutologinConfig{User: "nobody", Command: "sway"}); err == nil {
+		t.Error("setupAutologin() did not fail for a missing user")
+	}
+}
@@ -0,0 +1,216 @@
+// Package secureboot signs and verifies EFI binaries and kernel modules
+// with user-supplied Secure Boot keys.
+package secureboot
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Files expected in a key directory. The certificate must be PEM encoded,
+// and be enrolled in the firmware db or, with shim, as a MOK.
+const (
+	KeyFile  = "db.key"
+	CertFile = "db.crt"
+)
+
+// Keys describes a signing key and its certificate.
+type Keys struct {
+	KeyPath  string
+	CertPath string
+	Cert     *x509.Certificate
+}
+
+// LoadKeys reads the signing keys from the directory provided.
+func LoadKeys(dir string) (*Keys, error) {
+	k := &Keys{
+		KeyPath:  filepath.Join(dir, KeyFile),
+		CertPath: filepath.Join(dir, CertFile),
+	}
+	if _, err := os.Stat(k.KeyPath); err != nil {
+		return nil, fmt.Errorf("signing key: %v", err)
+	}
+	d, err := ioutil.ReadFile(k.CertPath)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate: %v", err)
+	}
+	b, _ := pem.Decode(d)
+	if b == nil || b.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s is not a PEM encoded certificate", k.CertPath)
+	}
+	if k.Cert, err = x509.ParseCertificate(b.Bytes); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", k.CertPath, err)
+	}
+	return k, nil
+}
+
+// DER returns the certificate in DER form, as enrolled with mokutil.
+func (k *Keys) DER() []byte {
+	return k.Cert.Raw
+}
+
+func run(ctx context.Context, bin string, args ...string) error {
+	cmd := exec.CommandContext(ctx, bin, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v\n%s", bin, err, out)
+	}
+	return nil
+}
+
+// SignEFI signs the EFI binary at path in place.
+func SignEFI(ctx context.Context, k *Keys, path string) error {
+	tmp := path + ".signed"
+	if err := run(ctx, "sbsign", "--key", k.KeyPath, "--cert", k.CertPath, "--output", tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// VerifyEFI returns an error if the EFI binary at path is not signed by
+// the certificate.
+func VerifyEFI(ctx context.Context, k *Keys, path string) error {
+	if err := run(ctx, "sbverify", "--cert", k.CertPath, path); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// moduleSigMagic marks the end of a signed kernel module.
+const moduleSigMagic = "~Module signature appended~\n"
+
+// moduleSigInfoLen is the size of struct module_signature, which precedes
+// the magic.
+const moduleSigInfoLen = 12
+
+// errUnsigned is returned when a module has no signature.
+var errUnsigned = errors.New("module is not signed")
+
+// splitModuleSignature returns the content of a kernel module and its
+// PKCS#7 signature.
+func splitModuleSignature(mod []byte) (content, sig []byte, err error) {
+	if !bytes.HasSuffix(mod, []byte(moduleSigMagic)) {
+		return mod, nil, errUnsigned
+	}
+	end := len(mod) - len(moduleSigMagic)
+	if end < moduleSigInfoLen {
+		return nil, nil, errors.New("truncated module signature")
+	}
+	info := mod[end-moduleSigInfoLen : end]
+	// id_type 2 is PKEY_ID_PKCS7, the only kind the kernel accepts.
+	if info[2] != 2 {
+		return nil, nil, fmt.Errorf("unsupported module signature type %d", info[2])
+	}
+	sigLen := int(binary.BigEndian.Uint32(info[8:]))
+	sigStart := end - moduleSigInfoLen - sigLen
+	if sigLen == 0 || sigStart < 0 {
+		return nil, nil, errors.New("invalid module signature length")
+	}
+	return mod[:sigStart], mod[sigStart : end-moduleSigInfoLen], nil
+}
+
+// SignModule signs the kernel module at path in place with the kernel's
+// sign-file tool, replacing any existing signature.
+func SignModule(ctx context.Context, k *Keys, signFile, path string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	content, _, err := splitModuleSignature(d)
+	switch {
+	case err == errUnsigned:
+	case err != nil:
+		return fmt.Errorf("%s: %v", path, err)
+	default:
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			return err
+		}
+	}
+	return run(ctx, signFile, "sha256", k.KeyPath, k.CertPath, path)
+}
+
+// VerifyModule returns an error if the kernel module at path is not signed
+// by the certificate.
+func VerifyModule(ctx context.Context, k *Keys, path string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	content, sig, err := splitModuleSignature(d)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	tmp, err := ioutil.TempDir("", "twl-modsig")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "content"), content, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "sig"), sig, 0600); err != nil {
+		return err
+	}
+	// Module signatures carry no certificates, so the signer must be
+	// found in the certificate file. The certificate chain is not checked.
+	if err := run(ctx, "openssl", "cms", "-verify", "-binary", "-inform", "DER",
+		"-in", filepath.Join(tmp, "sig"), "-content", filepath.Join(tmp, "content"),
+		"-certfile", k.CertPath, "-nointern", "-noverify", "-out", os.DevNull); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Paths of the MOK enrollment material within the built system.
+const (
+	EnrollCertPath   = "/usr/share/twitchylinux/secureboot/db.der"
+	EnrollScriptPath = "/usr/local/sbin/twl-enroll-mok"
+)
+
+var enrollScript = `#!/bin/sh
+# Queues the certificate TwitchyLinux was signed with for enrollment as a
+# machine owner key. Reboot afterwards and confirm the enrollment in
+# MokManager with the password chosen here.
+set -e
+exec mokutil --import ` + EnrollCertPath + ` "$@"
+`
+
+// WriteEnrollment writes the certificate in DER form, and a script which
+// enrolls it with mokutil, into the system at root.
+func WriteEnrollment(root string, k *Keys) error {
+	cert := filepath.Join(root, EnrollCertPath)
+	if err := os.MkdirAll(filepath.Dir(cert), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cert, k.DER(), 0644); err != nil {
+		return err
+	}
+	script := filepath.Join(root, EnrollScriptPath)
+	if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(script, []byte(enrollScript), 0755)
+}
+
+// VerifyEnrollment returns an error if the enrollment material in the
+// system at root does not match the certificate.
+func VerifyEnrollment(root string, k *Keys) error {
+	d, err := ioutil.ReadFile(filepath.Join(root, EnrollCertPath))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(d, k.DER()) {
+		return fmt.Errorf("%s does not match %s", EnrollCertPath, k.CertPath)
+	}
+	return nil
+}
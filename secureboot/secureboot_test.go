@@ -0,0 +1,160 @@
+package secureboot
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestKeys(t *testing.T, dir string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "TwitchyLinux test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, CertFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, KeyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "twl-sb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := LoadKeys(dir); err == nil {
+		t.Error("LoadKeys() succeeded on an empty directory")
+	}
+	writeTestKeys(t, dir)
+	k, err := LoadKeys(dir)
+	if err != nil {
+		t.Fatalf("LoadKeys() failed: %v", err)
+	}
+	if got := k.Cert.Subject.CommonName; got != "TwitchyLinux test" {
+		t.Errorf("Cert.Subject.CommonName = %q, want %q", got, "TwitchyLinux test")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, CertFile), []byte("not a cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeys(dir); err == nil {
+		t.Error("LoadKeys() accepted an invalid certificate")
+	}
+}
+
+func TestEnrollment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "twl-sb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestKeys(t, dir)
+	k, err := LoadKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "root")
+	if err := VerifyEnrollment(root, k); err == nil {
+		t.Error("VerifyEnrollment() succeeded before writing enrollment material")
+	}
+	if err := WriteEnrollment(root, k); err != nil {
+		t.Fatalf("WriteEnrollment() failed: %v", err)
+	}
+	if err := VerifyEnrollment(root, k); err != nil {
+		t.Errorf("VerifyEnrollment() failed: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(root, EnrollScriptPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&0111 == 0 {
+		t.Errorf("enrollment script is not executable: %v", fi.Mode())
+	}
+}
+
+func signedModule(content, sig []byte) []byte {
+	info := make([]byte, moduleSigInfoLen)
+	info[2] = 2
+	binary.BigEndian.PutUint32(info[8:], uint32(len(sig)))
+	out := append([]byte{}, content...)
+	out = append(out, sig...)
+	out = append(out, info...)
+	return append(out, moduleSigMagic...)
+}
+
+func TestSplitModuleSignature(t *testing.T) {
+	tcs := []struct {
+		name        string
+		mod         []byte
+		wantContent []byte
+		wantSig     []byte
+		wantErr     bool
+	}{
+		{
+			name:        "signed",
+			mod:         signedModule([]byte("\x7fELF module"), []byte("pkcs7")),
+			wantContent: []byte("\x7fELF module"),
+			wantSig:     []byte("pkcs7"),
+		},
+		{
+			name:    "unsigned",
+			mod:     []byte("\x7fELF module"),
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			mod:     []byte("ab" + moduleSigMagic),
+			wantErr: true,
+		},
+		{
+			name:    "bad length",
+			mod:     signedModule(nil, []byte("pkcs7"))[5:],
+			wantErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			content, sig, err := splitModuleSignature(tc.mod)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("splitModuleSignature() err = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(content, tc.wantContent) || !bytes.Equal(sig, tc.wantSig) {
+				t.Errorf("splitModuleSignature() = %q, %q, want %q, %q", content, sig, tc.wantContent, tc.wantSig)
+			}
+		})
+	}
+}
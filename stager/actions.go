@@ -0,0 +1,389 @@
+package stager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/twitchylinux/builder/units"
+)
+
+// ActionType is a kind of install action, which install steps select with
+// the action key of the entries of their do list.
+type ActionType struct {
+	// Name is the value of the action key which selects the type.
+	Name string
+	// Doc describes what the action does, for lint and explain output.
+	Doc string
+	// Config is the struct the other keys of an action are decoded into.
+	// Its string fields are expanded as templates before the unit is made.
+	Config interface{}
+	// Decode decodes the table of an action into a pointer to a new value
+	// of Config. If nil, the table is unmarshalled into one.
+	Decode func(t *toml.Tree) (interface{}, error)
+	// Unit returns the unit which performs an action, given a pointer to
+	// its expanded config.
+	Unit func(config interface{}, env ActionEnv) (units.Unit, error)
+}
+
+// ActionEnv describes the install step an action is part of.
+type ActionEnv struct {
+	// Step is the name of the install step.
+	Step string
+	// ResourceDir is the directory the stage config is in, which resources
+	// are read relative to.
+	ResourceDir string
+}
+
+// ActionField is a key of the config of an action type.
+type ActionField struct {
+	Key, Type string
+}
+
+// Fields returns the keys of the config of the action type, in the order
+// of the fields of its struct.
+func (a ActionType) Fields() []ActionField {
+	typ := reflect.TypeOf(a.Config)
+	var out []ActionField
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("toml"), ",")[0]
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		out = append(out, ActionField{Key: name, Type: kindName(f.Type)})
+	}
+	return out
+}
+
+// decode decodes the table of an action into a pointer to its config.
+func (a ActionType) decode(t *toml.Tree) (interface{}, error) {
+	if a.Decode != nil {
+		return a.Decode(t)
+	}
+	v := reflect.New(reflect.TypeOf(a.Config)).Interface()
+	if err := t.Unmarshal(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// actionTypes are the registered action types, keyed by name.
+var actionTypes = map[string]ActionType{}
+
+// RegisterAction makes an action type available to install steps. It is
+// meant to be called from init functions, and panics if the type is
+// incomplete or its name is already registered.
+func RegisterAction(a ActionType) {
+	if a.Name == "" || a.Unit == nil || a.Config == nil || reflect.TypeOf(a.Config).Kind() != reflect.Struct {
+		panic(fmt.Sprintf("stager: action %q needs a name, a config struct and a unit constructor", a.Name))
+	}
+	if _, dup := actionTypes[a.Name]; dup {
+		panic(fmt.Sprintf("stager: action %q registered twice", a.Name))
+	}
+	actionTypes[a.Name] = a
+}
+
+// ActionTypes returns the registered action types, ordered by name.
+func ActionTypes() []ActionType {
+	out := make([]ActionType, 0, len(actionTypes))
+	for _, name := range sortedKeys(actionTypes) {
+		out = append(out, actionTypes[name])
+	}
+	return out
+}
+
+// actionNames returns the names of the registered action types.
+func actionNames() string {
+	return strings.Join(sortedKeys(actionTypes), ", ")
+}
+
+// lookupAction returns the action type with the name provided.
+func lookupAction(name string) (ActionType, error) {
+	if a, ok := actionTypes[name]; ok {
+		return a, nil
+	}
+	if s := closest(name, sortedKeys(actionTypes)); s != "" {
+		return ActionType{}, fmt.Errorf("unknown action %q, did you mean %s?", name, s)
+	}
+	return ActionType{}, fmt.Errorf("unknown action %q, expected one of %s", name, actionNames())
+}
+
+// decodeActions decodes the config of each action of the install steps in
+// the table t, which confs was unmarshalled from.
+func decodeActions(t *toml.Tree, confs map[string]InstallConf) error {
+	for _, k := range sortedKeys(confs) {
+		tables, _ := t.GetPath([]string{k, "do"}).([]*toml.Tree)
+		actions := confs[k].Actions
+		for i := range actions {
+			if i >= len(tables) {
+				return fmt.Errorf("invalid config: %s: do[%d]: expected a table", k, i)
+			}
+			typ, err := lookupAction(actions[i].Action)
+			if err != nil {
+				return fmt.Errorf("invalid config: %s: do[%d]: %v", k, i, err)
+			}
+			if actions[i].Config, err = typ.decode(tables[i]); err != nil {
+				return fmt.Errorf("invalid config: %s: do[%d]: %v", k, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAction checks the table of an action against the config of its
+// type.
+func (l *linter) checkAction(t *toml.Tree, path []string, pos toml.Position) {
+	key := strings.Join(path, ".")
+	name, ok := t.Get("action").(string)
+	if !ok {
+		l.errorf(pos, "%s.action: expected one of %s", key, actionNames())
+		return
+	}
+	typ, err := lookupAction(name)
+	if err != nil {
+		l.errorf(pos, "%s.action: %v", key, err)
+		return
+	}
+	keys := t.Keys()
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "action" {
+			continue
+		}
+		p := append(path[:len(path):len(path)], k)
+		ft, err := fieldType(reflect.TypeOf(typ.Config), k)
+		if err != nil {
+			l.errorf(pos, "%s: %v", strings.Join(p, "."), err)
+			continue
+		}
+		l.checkValue(t.GetPath([]string{k}), p, pos, ft)
+	}
+}
+
+// kindName describes a config type as it is written in TOML.
+func kindName(typ reflect.Type) string {
+	switch typ.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Slice, reflect.Array:
+		return "array of " + kindName(typ.Elem()) + "s"
+	}
+	return "table"
+}
+
+type downloadAction struct {
+	URL          string `toml:"url"`
+	To           string `toml:"to"`
+	SHA256       string `toml:"sha256"`
+	SignatureURL string `toml:"signature_url"`
+	Keyring      string `toml:"keyring"`
+}
+
+type runAction struct {
+	Bin  string            `toml:"bin"`
+	Args []string          `toml:"args"`
+	Env  map[string]string `toml:"env"`
+}
+
+type sha256sumAction struct {
+	From     string `toml:"from"`
+	Expected string `toml:"expected"`
+}
+
+type appendAction struct {
+	To   string `toml:"to"`
+	Data string `toml:"data"`
+}
+
+type mkdirAction struct {
+	Dir string `toml:"dir"`
+}
+
+type installResourceAction struct {
+	From  string      `toml:"from"`
+	To    string      `toml:"to"`
+	Dir   string      `toml:"dir"`
+	Perms os.FileMode `toml:"perms"`
+}
+
+type extractAction struct {
+	From            string `toml:"from"`
+	To              string `toml:"to"`
+	Format          string `toml:"format"`
+	StripComponents int    `toml:"strip_components"`
+}
+
+type copyAction struct {
+	From string `toml:"from"`
+	To   string `toml:"to"`
+}
+
+type symlinkAction struct {
+	Target string `toml:"target"`
+	Link   string `toml:"link"`
+}
+
+type chownAction struct {
+	Path      string `toml:"path"`
+	User      string `toml:"user"`
+	Group     string `toml:"group"`
+	Recursive bool   `toml:"recursive"`
+}
+
+type chmodAction struct {
+	Path      string `toml:"path"`
+	Mode      uint32 `toml:"mode"`
+	Recursive bool   `toml:"recursive"`
+}
+
+type removeAction struct {
+	Path      string `toml:"path"`
+	Recursive bool   `toml:"recursive"`
+}
+
+func init() {
+	RegisterAction(ActionType{
+		Name:   "download",
+		Doc:    "Downloads url to the file at to, checking its sha256 sum, or its signature at signature_url against keyring, if given.",
+		Config: downloadAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*downloadAction)
+			return &units.Download{
+				URL:          a.URL,
+				To:           a.To,
+				SHA256:       a.SHA256,
+				SignatureURL: a.SignatureURL,
+				Keyring:      a.Keyring,
+			}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "run",
+		Doc:    "Runs bin with args in the system, with env added to its environment.",
+		Config: runAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*runAction)
+			return &units.Cmd{Bin: a.Bin, Args: a.Args, Env: a.Env}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "sha256sum",
+		Doc:    "Checks that the SHA-256 sum of the file at from is expected.",
+		Config: sha256sumAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*sha256sumAction)
+			return &units.CheckHash{File: a.From, ExpectedHash: a.Expected}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "append",
+		Doc:    "Appends data to the file at to.",
+		Config: appendAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*appendAction)
+			return &units.Append{To: a.To, Data: a.Data}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "mkdir",
+		Doc:    "Creates the directory dir and its parents.",
+		Config: mkdirAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			return &units.Mkdir{Dir: c.(*mkdirAction).Dir}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "install-resource",
+		Doc:    "Installs the resource at from, relative to the stage config, to the file at to with perms (default 0744), creating dir first if given.",
+		Config: installResourceAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*installResourceAction)
+			d, err := ioutil.ReadFile(filepath.Join(env.ResourceDir, a.From))
+			if err != nil {
+				return nil, err
+			}
+			var perms os.FileMode = 0744
+			if a.Perms != 0 {
+				perms = a.Perms
+			}
+			return &units.InstallFiles{
+				UnitName: "install-resource: " + filepath.Base(a.From),
+				Mkdir:    a.Dir,
+				Files: []units.FileInfo{
+					{Path: a.To, Perms: perms, Data: d},
+				},
+			}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "extract",
+		Doc:    "Extracts the archive at from into the directory to, removing strip_components leading elements from each path. The format is tar.gz, tar.xz or zip, picked by the extension of from unless format is given.",
+		Config: extractAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*extractAction)
+			if a.StripComponents < 0 {
+				return nil, fmt.Errorf("%s: strip_components must not be negative", env.Step)
+			}
+			return &units.Extract{From: a.From, To: a.To, Format: a.Format, StripComponents: a.StripComponents}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "copy",
+		Doc:    "Copies the file or directory at from to to, or into to if it is a directory.",
+		Config: copyAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*copyAction)
+			return &units.Copy{From: a.From, To: a.To}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "symlink",
+		Doc:    "Creates a symlink at link to target, replacing any file there.",
+		Config: symlinkAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*symlinkAction)
+			return &units.Symlink{Target: a.Target, Link: a.Link}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "chown",
+		Doc:    "Changes the owner of path to the named user and its group, or group if given, and of everything under it if recursive.",
+		Config: chownAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*chownAction)
+			return &units.Chown{Path: a.Path, User: a.User, Group: a.Group, Recursive: a.Recursive}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "chmod",
+		Doc:    "Changes the mode of path to mode, such as 0o4755, and of everything under it if recursive.",
+		Config: chmodAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*chmodAction)
+			return &units.Chmod{Path: a.Path, Mode: a.Mode, Recursive: a.Recursive}, nil
+		},
+	})
+	RegisterAction(ActionType{
+		Name:   "remove",
+		Doc:    "Removes path, and everything under it if recursive. Recursive removals succeed if path does not exist.",
+		Config: removeAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*removeAction)
+			return &units.Remove{Path: a.Path, Recursive: a.Recursive}, nil
+		},
+	})
+}
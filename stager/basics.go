@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"path"
+	"sort"
 
 	"github.com/pelletier/go-toml"
+	"github.com/twitchylinux/builder/conf/kconfig"
 	"github.com/twitchylinux/builder/units"
 )
 
@@ -63,7 +66,15 @@ type LinuxConf struct {
 	Version      string   `toml:"version"`
 	URL          string   `toml:"url"`
 	SHA256       string   `toml:"sha256"`
+	SignatureURL string   `toml:"signature_url"`
+	Keyring      string   `toml:"keyring"`
 	BuildDepPkgs []string `toml:"build_packages"`
+	CCache       bool     `toml:"ccache"`
+
+	// Config specifies kernel config symbols to set on top of the
+	// base config. It is read from the config key directly, as values
+	// may be of mixed types.
+	Config map[string]interface{} `toml:"-"`
 }
 
 func linuxConf(tree *toml.Tree) (*units.Linux, error) {
@@ -79,14 +90,101 @@ func linuxConf(tree *toml.Tree) (*units.Linux, error) {
 		if err := ge.Unmarshal(&conf); err != nil {
 			return nil, err
 		}
+		if c := ge.Get("config"); c != nil {
+			frag, ok := c.(*toml.Tree)
+			if !ok {
+				return nil, fmt.Errorf("invalid config: %s.config is not a structure (got %T)", keyLinux, c)
+			}
+			conf.Config = frag.ToMap()
+		}
 	}
 
-	return &units.Linux{
+	out := &units.Linux{
 		Version:      conf.Version,
 		URL:          conf.URL,
 		SHA256:       conf.SHA256,
+		SignatureURL: conf.SignatureURL,
+		Keyring:      conf.Keyring,
 		BuildDepPkgs: conf.BuildDepPkgs,
-	}, nil
+		CCache:       conf.CCache,
+	}
+	if len(conf.Config) > 0 {
+		frag, err := kconfig.ParseFragment(conf.Config)
+		if err != nil {
+			return nil, fmt.Errorf("%s.config: %v", keyLinux, err)
+		}
+		out.Config = frag
+	}
+	return out, nil
+}
+
+// KernelModuleConf describes an out-of-tree kernel module to build
+// against the custom kernel.
+type KernelModuleConf struct {
+	If           *StepCondition `toml:"if"`
+	Git          string         `toml:"git"`
+	Ref          string         `toml:"ref"`
+	URL          string         `toml:"url"`
+	SHA256       string         `toml:"sha256"`
+	SignatureURL string         `toml:"signature_url"`
+	Keyring      string         `toml:"keyring"`
+	DKMS         string         `toml:"dkms"`
+	Subdir       string         `toml:"subdir"`
+	MakeArgs     []string       `toml:"make_args"`
+	BuildPkgs    []string       `toml:"build_packages"`
+}
+
+func kernelModulesConf(tree *toml.Tree, linux *units.Linux, opts Options) (*units.KernelModules, error) {
+	t := tree.Get(keyLinuxModules)
+	if t == nil {
+		return nil, nil
+	}
+	mt, ok := t.(*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("invalid config: %s is not a structure (got %T)", keyLinuxModules, t)
+	}
+	if linux == nil {
+		return nil, fmt.Errorf("invalid config: %s requires a kernel to be built", keyLinuxModules)
+	}
+	var conf map[string]KernelModuleConf
+	if err := mt.Unmarshal(&conf); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(conf))
+	for n := range conf {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	out := &units.KernelModules{Kernel: linux}
+	for _, n := range names {
+		c := conf[n]
+		skip, err := c.If.ShouldSkip(tree, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", keyLinuxModules, n, err)
+		}
+		if skip {
+			continue
+		}
+		out.Modules = append(out.Modules, units.KernelModule{
+			Name:         n,
+			Git:          c.Git,
+			Ref:          c.Ref,
+			URL:          c.URL,
+			SHA256:       c.SHA256,
+			SignatureURL: c.SignatureURL,
+			Keyring:      c.Keyring,
+			DKMS:         c.DKMS,
+			Subdir:       c.Subdir,
+			MakeArgs:     c.MakeArgs,
+			BuildPkgs:    c.BuildPkgs,
+		})
+	}
+	if len(out.Modules) == 0 {
+		return nil, nil
+	}
+	return out, nil
 }
 
 // LocaleConf describes the locale of the system.
@@ -192,6 +290,16 @@ type MainUserConf struct {
 	Name            string   `toml:"name"`
 	DefaultPassword string   `toml:"default_password"`
 	Groups          []string `toml:"groups"`
+	// Home is the home directory of the user, /home/<name> if not set.
+	Home string `toml:"home"`
+}
+
+// home returns the home directory of the main user.
+func (c MainUserConf) home() string {
+	if c.Home != "" {
+		return c.Home
+	}
+	return "/home/" + c.Name
 }
 
 func shellUserConf(tree *toml.Tree) (*units.ShellCustomization, error) {
@@ -221,6 +329,9 @@ func shellUserConf(tree *toml.Tree) (*units.ShellCustomization, error) {
 		if err := ge.Unmarshal(&userConf); err != nil {
 			return nil, err
 		}
+		if userConf.Home != "" && !path.IsAbs(userConf.Home) {
+			return nil, fmt.Errorf("invalid config: %s.home must be an absolute path, got %q", keyMainUser, userConf.Home)
+		}
 	}
 
 	out := &units.ShellCustomization{
@@ -231,6 +342,7 @@ func shellUserConf(tree *toml.Tree) (*units.ShellCustomization, error) {
 				Username: userConf.Name,
 				Password: userConf.DefaultPassword,
 				Groups:   userConf.Groups,
+				Home:     userConf.home(),
 			},
 		},
 	}
@@ -3,6 +3,7 @@ package stager
 import (
 	"fmt"
 	"reflect"
+	"regexp"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
@@ -22,32 +23,13 @@ func (c *StepCondition) ShouldSkip(tree *toml.Tree, opts Options) (bool, error)
 	if c == nil {
 		return false, nil
 	}
-	env, err := cel.NewEnv(cel.Declarations(decls.NewIdent("conf", decls.Dyn, nil),
-		decls.NewIdent("opts", decls.Dyn, nil),
-		decls.NewIdent("features", decls.Dyn, nil)))
+	env, err := conditionEnv()
 	if err != nil {
 		return false, err
 	}
-
-	var f map[string]interface{}
-	if features := tree.Get("features"); features != nil {
-		switch ft := features.(type) {
-		case *toml.Tree:
-			f = ft.ToMap()
-		case map[string]interface{}:
-			f = ft
-		case []string:
-			f = make(map[string]interface{}, len(ft))
-			for _, v := range ft {
-				f[v] = true
-			}
-		}
-	}
-
-	m := map[string]interface{}{
-		"conf":     tree.ToMap(),
-		"opts":     opts,
-		"features": f,
+	m, err := conditionData(tree, opts)
+	if err != nil {
+		return false, err
 	}
 
 	for i, e := range c.All {
@@ -108,3 +90,70 @@ func (c *StepCondition) eval(env *cel.Env, expr string, m map[string]interface{}
 	}
 	return v.(bool), nil
 }
+
+// conditionEnv returns the environment conditions are evaluated in.
+func conditionEnv() (*cel.Env, error) {
+	return cel.NewEnv(cel.Declarations(decls.NewIdent("conf", decls.Dyn, nil),
+		decls.NewIdent("opts", decls.Dyn, nil),
+		decls.NewIdent("features", decls.Dyn, nil)))
+}
+
+// conditionData returns the variables conditions are evaluated with. The
+// features are resolved as they are by featuresAreSet.
+func conditionData(tree *toml.Tree, opts Options) (map[string]interface{}, error) {
+	f, err := resolveFeatures(tree)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"conf":     tree.ToMap(),
+		"opts":     opts,
+		"features": f,
+	}, nil
+}
+
+// featureRead matches the features read by an expression.
+var featureRead = regexp.MustCompile(`\bfeatures\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// ExprResult is the value of one expression of a condition.
+type ExprResult struct {
+	// Clause is where the expression is in the condition, such as
+	// if.all[1].
+	Clause string
+	Expr   string
+	Value  bool
+	// Err is set if the expression could not be evaluated.
+	Err error
+	// Features are the values of the features the expression reads, keyed
+	// by name. Features which are not set are nil.
+	Features map[string]interface{}
+}
+
+// explain evaluates every expression of the condition, with the variables
+// returned by conditionData.
+func (c *StepCondition) explain(env *cel.Env, m map[string]interface{}) []ExprResult {
+	if c == nil {
+		return nil
+	}
+	features, _ := m["features"].(map[string]interface{})
+
+	var out []ExprResult
+	for _, clause := range []struct {
+		name  string
+		exprs []string
+	}{{"all", c.All}, {"not", c.Not}, {"any", c.Any}} {
+		for i, e := range clause.exprs {
+			r := ExprResult{
+				Clause:   fmt.Sprintf("if.%s[%d]", clause.name, i),
+				Expr:     e,
+				Features: map[string]interface{}{},
+			}
+			r.Value, r.Err = c.eval(env, e, m)
+			for _, match := range featureRead.FindAllStringSubmatch(e, -1) {
+				r.Features[match[1]] = features[match[1]]
+			}
+			out = append(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package stager
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+	"github.com/pelletier/go-toml"
+)
+
+// Explanation describes whether a conditional part of the config, such as
+// an install step, is included in the build.
+type Explanation struct {
+	// Key is the key of the part, such as post_base.install.rust.
+	Key      string
+	Included bool
+	// Reason is set if the part is skipped regardless of its condition.
+	Reason string
+	// Results are the values of the expressions of its condition.
+	Results []ExprResult
+	// Actions are the types of the actions of an install step, in order.
+	Actions []ActionType
+}
+
+// LoadConfig returns the config in the directory provided, with any
+// profiles and overrides applied.
+func LoadConfig(dir string, opts Options) (*toml.Tree, error) {
+	return loadConfig(dir, opts)
+}
+
+// Explain returns whether each install step, udev rule set, network and
+// optional package of the config in the directory provided is included in
+// the build, and why.
+func Explain(dir string, opts Options) ([]Explanation, error) {
+	tree, err := loadConfig(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	env, err := conditionEnv()
+	if err != nil {
+		return nil, err
+	}
+	data, err := conditionData(tree, opts)
+	if err != nil {
+		return nil, err
+	}
+	x := explainer{tree: tree, opts: opts, env: env, data: data}
+
+	if err := x.section(installKeyPostBase, &map[string]InstallConf{}, ""); err != nil {
+		return nil, err
+	}
+	graphical, err := featuresAreSet([]string{"graphical"}, tree)
+	if err != nil {
+		return nil, err
+	}
+	var reason string
+	if !graphical {
+		reason = "features.graphical is not set"
+	}
+	name, _ := data["features"].(map[string]interface{})["graphical_environment"].(string)
+	if err := x.section(rootKeyGraphicalEnv+"."+name+".steps", &map[string]InstallConf{}, reason); err != nil {
+		return nil, err
+	}
+	if err := x.section(installKeyPostGUI, &map[string]InstallConf{}, reason); err != nil {
+		return nil, err
+	}
+	for key, into := range map[string]interface{}{
+		keyUdevRules:    &map[string]UdevRules{},
+		keySysdNetworks: &map[string]systemdNetwork{},
+		keyOptPackages:  &map[string]optPackage{},
+	} {
+		if err := x.section(key, into, ""); err != nil {
+			return nil, err
+		}
+	}
+	return x.out, nil
+}
+
+type explainer struct {
+	tree *toml.Tree
+	opts Options
+	env  *cel.Env
+	data map[string]interface{}
+	out  []Explanation
+}
+
+// section explains the parts of the config under key, which are decoded
+// into a map of structs with an If member. If reason is set, they are all
+// skipped for that reason.
+func (x *explainer) section(key string, into interface{}, reason string) error {
+	t, ok := x.tree.Get(key).(*toml.Tree)
+	if !ok {
+		return nil
+	}
+	if err := t.Unmarshal(into); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	m := reflect.ValueOf(into).Elem()
+	for _, name := range sortedKeys(m.Interface()) {
+		cond := m.MapIndex(reflect.ValueOf(name)).FieldByName("If").Interface().(*StepCondition)
+		e := Explanation{Key: key + "." + name, Reason: reason}
+		skip, err := cond.ShouldSkip(x.tree, x.opts)
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.Key, err)
+		}
+		e.Included = !skip && reason == ""
+		e.Results = cond.explain(x.env, x.data)
+		if c, ok := m.MapIndex(reflect.ValueOf(name)).Interface().(InstallConf); ok {
+			for _, a := range c.Actions {
+				typ, err := lookupAction(a.Action)
+				if err != nil {
+					return fmt.Errorf("%s: %v", e.Key, err)
+				}
+				e.Actions = append(e.Actions, typ)
+			}
+		}
+		x.out = append(x.out, e)
+	}
+	return nil
+}
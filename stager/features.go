@@ -0,0 +1,302 @@
+package stager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Types of features.
+const (
+	featureBool   = "bool"
+	featureString = "string"
+	featureInt    = "int"
+)
+
+// FeatureDef declares a feature, which install steps and other parts of the
+// config may be conditional on.
+type FeatureDef struct {
+	// Type is bool, string or int.
+	Type        string      `toml:"type"`
+	Default     interface{} `toml:"default"`
+	Description string      `toml:"description"`
+	// Implies are bool features which are enabled when this bool feature
+	// is, unless they are set.
+	Implies []string `toml:"implies"`
+	// Conflicts are bool features which may not be enabled with this bool
+	// feature.
+	Conflicts []string `toml:"conflicts"`
+}
+
+// accepts returns true if v is a valid value of the feature.
+func (d FeatureDef) accepts(v interface{}) bool {
+	switch v.(type) {
+	case bool:
+		return d.Type == featureBool
+	case string:
+		return d.Type == featureString
+	case int64:
+		return d.Type == featureInt
+	}
+	return false
+}
+
+// featureDef reads a feature declaration. go-toml cannot decode a value of
+// any type, as defaults are, so declarations are read by hand. Members of
+// the wrong type are reported by the linter.
+func featureDef(t *toml.Tree) FeatureDef {
+	d := FeatureDef{Default: t.Get("default")}
+	d.Type, _ = t.Get("type").(string)
+	d.Description, _ = t.Get("description").(string)
+	d.Implies = stringList(t.Get("implies"))
+	d.Conflicts = stringList(t.Get("conflicts"))
+	return d
+}
+
+func stringList(v interface{}) []string {
+	list, _ := v.([]interface{})
+	out := make([]string, 0, len(list))
+	for _, e := range list {
+		if s, ok := e.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Feature is a declared feature and its value in a config.
+type Feature struct {
+	Name string
+	FeatureDef
+	Value interface{}
+}
+
+// featureSet holds the declarations and values of the features of a config.
+type featureSet struct {
+	defs map[string]FeatureDef
+	// values are the values set by the config, keyed by feature.
+	values map[string]interface{}
+	// declared is set if the config declares features, so values of
+	// features which are not declared are errors.
+	declared bool
+}
+
+// newFeatureSet reads the features declared and set by the config.
+func newFeatureSet(tree *toml.Tree) (*featureSet, error) {
+	f := &featureSet{defs: map[string]FeatureDef{}, values: map[string]interface{}{}}
+	for name, d := range builtinFeatures {
+		f.defs[name] = d
+	}
+	if t, ok := tree.Get(rootKeyFeatureDefs).(*toml.Tree); ok {
+		for _, name := range t.Keys() {
+			dt, ok := t.GetPath([]string{name}).(*toml.Tree)
+			if !ok {
+				return nil, fmt.Errorf("invalid config: %s.%s is not a table", rootKeyFeatureDefs, name)
+			}
+			f.defs[name] = featureDef(dt)
+		}
+		f.declared = true
+	}
+
+	switch ft := tree.Get(rootKeyFeatures).(type) {
+	case *toml.Tree:
+		f.values = ft.ToMap()
+	case map[string]interface{}:
+		f.values = ft
+	case []string:
+		for _, v := range ft {
+			f.values[v] = true
+		}
+	}
+	return f, nil
+}
+
+// resolve returns the value of every feature, reporting invalid
+// declarations and values with the key they are at.
+func (f *featureSet) resolve(report func(key, format string, args ...interface{})) map[string]interface{} {
+	var names []string
+	for name := range f.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	f.checkDefs(names, report)
+
+	set := map[string]interface{}{}
+	for _, name := range sortedKeys(f.values) {
+		v := f.values[name]
+		d, ok := f.defs[name]
+		switch {
+		case !ok && f.declared:
+			if s := closest(name, names); s != "" {
+				report(rootKeyFeatures+"."+name, "unknown feature, did you mean %s?", s)
+			} else {
+				report(rootKeyFeatures+"."+name, "unknown feature, declare it in %s", rootKeyFeatureDefs)
+			}
+		case ok && !d.accepts(v):
+			report(rootKeyFeatures+"."+name, "expected a %s, got %s", d.Type, tomlTypeName(v))
+		default:
+			set[name] = v
+		}
+	}
+
+	// Features which are not set are enabled by the features which imply
+	// them, which may in turn imply others.
+	impliedBy := map[string]string{}
+	value := func(name string) interface{} {
+		if v, ok := set[name]; ok {
+			return v
+		}
+		if impliedBy[name] != "" {
+			return true
+		}
+		return f.defs[name].Default
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, name := range names {
+			if value(name) != true {
+				continue
+			}
+			for _, imp := range f.defs[name].Implies {
+				if _, ok := set[imp]; !ok && impliedBy[imp] == "" {
+					impliedBy[imp], changed = name, true
+				}
+			}
+		}
+	}
+
+	out := make(map[string]interface{}, len(names))
+	for name, v := range set {
+		out[name] = v
+	}
+	for _, name := range names {
+		if v := value(name); v != nil {
+			out[name] = v
+		}
+	}
+	for _, name := range names {
+		if out[name] != true {
+			continue
+		}
+		for _, imp := range f.defs[name].Implies {
+			if out[imp] != true {
+				report(rootKeyFeatures+"."+imp, "implied by %s, but disabled", name)
+			}
+		}
+		for _, c := range f.defs[name].Conflicts {
+			if out[c] == true {
+				report(rootKeyFeatures+"."+name, "conflicts with %s, which is enabled", c)
+			}
+		}
+	}
+	return out
+}
+
+// checkDefs reports invalid feature declarations.
+func (f *featureSet) checkDefs(names []string, report func(key, format string, args ...interface{})) {
+	for _, name := range names {
+		d, key := f.defs[name], rootKeyFeatureDefs+"."+name
+		switch d.Type {
+		case featureBool, featureString, featureInt:
+		default:
+			report(key+".type", "expected one of %s, %s, %s, got %q", featureBool, featureInt, featureString, d.Type)
+			continue
+		}
+		if b, ok := builtinFeatures[name]; ok && b.Type != d.Type {
+			report(key+".type", "%s is a %s feature", name, b.Type)
+		}
+		if d.Default != nil && !d.accepts(d.Default) {
+			report(key+".default", "expected a %s, got %s", d.Type, tomlTypeName(d.Default))
+		}
+		if (len(d.Implies) > 0 || len(d.Conflicts) > 0) && d.Type != featureBool {
+			report(key, "only bool features may imply or conflict with others")
+		}
+		for _, rel := range []struct {
+			field string
+			names []string
+		}{{"implies", d.Implies}, {"conflicts", d.Conflicts}} {
+			for _, other := range rel.names {
+				if o, ok := f.defs[other]; !ok {
+					report(key+"."+rel.field, "unknown feature %s", other)
+				} else if o.Type != featureBool {
+					report(key+"."+rel.field, "%s is not a bool feature", other)
+				} else if other == name {
+					report(key+"."+rel.field, "%s refers to itself", name)
+				}
+			}
+		}
+	}
+}
+
+// resolveFeatures returns the value of every feature of the config, with
+// defaults and implied features applied.
+func resolveFeatures(tree *toml.Tree) (map[string]interface{}, error) {
+	f, err := newFeatureSet(tree)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	out := f.resolve(func(key, format string, args ...interface{}) {
+		errs = append(errs, key+": "+fmt.Sprintf(format, args...))
+	})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return out, nil
+}
+
+// checkFeatures reports invalid feature declarations and values at the
+// file and line which set them.
+func (c *configLoader) checkFeatures() error {
+	f, err := newFeatureSet(c.conf)
+	if err != nil {
+		return err
+	}
+	f.resolve(func(key, format string, args ...interface{}) {
+		s := c.sourceOf(key)
+		c.lint.file = s.file
+		c.lint.errorf(s.pos, "%s: %s", key, fmt.Sprintf(format, args...))
+	})
+	return nil
+}
+
+// sourceOf returns where the value at key, or a value within it, was set.
+// Features which are not set are reported at their declaration.
+func (c *configLoader) sourceOf(key string) setting {
+	if s, ok := c.sources[key]; ok {
+		return s
+	}
+	for _, k := range sortedKeys(c.sources) {
+		if strings.HasPrefix(k, key+".") {
+			return c.sources[k]
+		}
+	}
+	if name := strings.TrimPrefix(key, rootKeyFeatures+"."); name != key {
+		return c.sourceOf(rootKeyFeatureDefs + "." + name)
+	}
+	return setting{file: "builtin"}
+}
+
+// Features returns the features of the config in the directory provided,
+// ordered by name, with their values.
+func Features(dir string, opts Options) ([]Feature, error) {
+	tree, err := loadConfig(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newFeatureSet(tree)
+	if err != nil {
+		return nil, err
+	}
+	values, err := resolveFeatures(tree)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Feature, 0, len(f.defs))
+	for _, name := range sortedKeys(f.defs) {
+		out = append(out, Feature{Name: name, FeatureDef: f.defs[name], Value: values[name]})
+	}
+	return out, nil
+}
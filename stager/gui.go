@@ -13,11 +13,14 @@ type GraphicsConf struct {
 	Steps    map[string]InstallConf `toml:"steps"`
 }
 
-func graphicsConf(opts Options, tree *toml.Tree, resDir string) ([]units.Unit, error) {
-	wantEnv := tree.GetDefault(keyGraphicalEnvName, "gnome")
-	env, ok := wantEnv.(string)
+func graphicsConf(opts Options, tree *toml.Tree, resDir string, done stepSet) ([]units.Unit, error) {
+	features, err := resolveFeatures(tree)
+	if err != nil {
+		return nil, err
+	}
+	env, ok := features["graphical_environment"].(string)
 	if !ok {
-		return nil, fmt.Errorf("%s is %T, not string", keyGraphicalEnvName, wantEnv)
+		return nil, fmt.Errorf("%s is not set", keyGraphicalEnvName)
 	}
 
 	conf := graphicalEnvDefault
@@ -34,18 +37,20 @@ func graphicsConf(opts Options, tree *toml.Tree, resDir string) ([]units.Unit, e
 			return nil, err
 		}
 		conf = allConfs[env]
+		if steps, ok := ge.GetPath([]string{env, "steps"}).(*toml.Tree); ok {
+			if err := decodeActions(steps, conf.Steps); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	out := make([]units.Unit, 0, len(conf.Steps))
-	for k, c := range conf.Steps {
-		skip, err := c.If.ShouldSkip(tree, opts)
-		if err != nil {
-			return nil, fmt.Errorf("%s: %v", k, err)
-		}
-		if skip {
-			continue
-		}
-		ut, err := makeInstallUnit(k, c, tree, resDir)
+	steps, err := orderSteps(opts, tree, conf.Steps, done)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]units.Unit, 0, len(steps))
+	for _, k := range steps {
+		ut, err := makeInstallUnit(k, conf.Steps[k], tree, resDir)
 		if err != nil {
 			return nil, err
 		}
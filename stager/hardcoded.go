@@ -10,26 +10,36 @@ var (
 		&units.Systemd{},
 	}
 
-	defaultFeatures = map[string]bool{
-		"graphical":            true,
-		"features.rootfs-only": true,
+	// builtinFeatures are the features the stager reads itself. The
+	// config may declare them again to change their defaults.
+	builtinFeatures = map[string]FeatureDef{
+		"graphical": {
+			Type:        featureBool,
+			Default:     true,
+			Description: "Install a graphical environment.",
+		},
+		"graphical_environment": {
+			Type:        featureString,
+			Default:     "gnome",
+			Description: "The graphical environment to install, from graphical_environment.",
+		},
 	}
 
 	afterGUIUnits = []units.Unit{}
 
+	// aptComponents and aptArch describe the package indexes which are
+	// enabled in the built system.
+	aptComponents = []string{"main", "contrib", "non-free"}
+	aptArch       = "amd64"
+
 	finalUnits = []units.Unit{
 		&units.Clean{},
-		&units.Grub2{
-			DistroName: "TwitchyLinux",
-			Quiet:      true,
-			ColorNormal: units.GrubColorPair{
-				FG: "white",
-				BG: "black",
-			},
-			ColorHighlight: units.GrubColorPair{
-				FG: "black",
-				BG: "light-gray",
-			},
-		},
+	}
+
+	// secureBootUnits sign the system, then check the signatures as
+	// the last step of the build.
+	secureBootUnits = []units.Unit{
+		&units.SecureBootSign{},
+		&units.SecureBootVerify{},
 	}
 )
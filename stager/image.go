@@ -0,0 +1,80 @@
+package stager
+
+import (
+	"fmt"
+
+	"github.com/pelletier/go-toml"
+	"github.com/twitchylinux/builder/conf/grub"
+	"github.com/twitchylinux/builder/pack"
+	"github.com/twitchylinux/builder/units"
+)
+
+// ImageConfig returns the configuration of the disk image described by
+// the config in the directory provided.
+func ImageConfig(dir string, opts Options) (pack.Config, error) {
+	conf, err := loadConfig(dir, opts)
+	if err != nil {
+		return pack.Config{}, err
+	}
+	return imageConf(conf)
+}
+
+func imageConf(tree *toml.Tree) (pack.Config, error) {
+	out := pack.DefaultConfig()
+	if t := tree.Get(rootKeyImage); t != nil {
+		it, ok := t.(*toml.Tree)
+		if !ok {
+			return pack.Config{}, fmt.Errorf("invalid config: %s is not a structure (got %T)", rootKeyImage, t)
+		}
+		if err := it.Unmarshal(&out); err != nil {
+			return pack.Config{}, err
+		}
+	}
+
+	menu, err := bootloaderConf(tree)
+	if err != nil {
+		return pack.Config{}, err
+	}
+	out.Menu = menu
+
+	// Log in as the main user unless told otherwise.
+	if out.Autologin != nil && out.Autologin.User == "" {
+		if name, ok := tree.Get(keyMainUser + ".name").(string); ok {
+			out.Autologin.User = name
+		}
+	}
+	if err := out.Validate(); err != nil {
+		return pack.Config{}, fmt.Errorf("invalid config: %s: %v", rootKeyImage, err)
+	}
+	return out, nil
+}
+
+// bootloaderConf returns the boot menu described by the bootloader
+// section, which is used both for grub in the built system and for the
+// menus of packed images.
+func bootloaderConf(tree *toml.Tree) (grub.Config, error) {
+	out := grub.DefaultConfig()
+	if t := tree.Get(rootKeyBootloader); t != nil {
+		bt, ok := t.(*toml.Tree)
+		if !ok {
+			return grub.Config{}, fmt.Errorf("invalid config: %s is not a structure (got %T)", rootKeyBootloader, t)
+		}
+		if err := bt.Unmarshal(&out); err != nil {
+			return grub.Config{}, err
+		}
+	}
+	if err := out.Validate(); err != nil {
+		return grub.Config{}, fmt.Errorf("invalid config: %s: %v", rootKeyBootloader, err)
+	}
+	return out, nil
+}
+
+// bootloaderUnits returns the units which install the bootloader the
+// image is configured to boot with. systemd-boot is installed by the
+// packer, so needs no unit.
+func bootloaderUnits(img pack.Config) []units.Unit {
+	if img.Bootloader == pack.BootloaderSystemdBoot {
+		return nil
+	}
+	return []units.Unit{&units.Grub2{Firmware: img.Firmware, Config: img.Menu}}
+}
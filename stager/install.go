@@ -4,43 +4,129 @@ import (
 	"fmt"
 	"go/scanner"
 	"go/token"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"sort"
 	"strings"
 
 	"github.com/pelletier/go-toml"
 	"github.com/twitchylinux/builder/units"
 )
 
-// InstallAction describes a step during installation.
+// InstallAction describes a step during installation. The other keys of
+// its table are decoded by the type of action it names.
 type InstallAction struct {
 	Action string `toml:"action"`
-
-	URL   string      `toml:"url"`
-	From  string      `toml:"from"`
-	To    string      `toml:"to"`
-	Data  string      `toml:"data"`
-	Dir   string      `toml:"dir"`
-	Perms os.FileMode `toml:"perms"`
-
-	Expected string `toml:"expected"`
-
-	Bin  string            `toml:"bin"`
-	Args []string          `toml:"args"`
-	Env  map[string]string `toml:"env"`
+	// Config is a pointer to the decoded config of the action.
+	Config interface{} `toml:"-"`
 }
 
 // InstallConf desribes a set of packages to be installed.
 type InstallConf struct {
-	Order    int             `toml:"order_priority"`
+	Order int `toml:"order_priority"`
+	// After names steps which, unless skipped, are installed first.
+	After []string `toml:"after"`
+	// Requires names steps which must be installed first.
+	Requires []string        `toml:"requires"`
 	If       *StepCondition  `toml:"if"`
 	Packages []string        `toml:"packages"`
 	Actions  []InstallAction `toml:"do"`
 }
 
-func installsUnderKey(opts Options, tree *toml.Tree, key string, resDir string) ([]units.Unit, error) {
+// stepSet records the install steps of the stages computed so far, and
+// whether each is installed or was skipped by its condition.
+type stepSet map[string]bool
+
+// orderSteps returns the names of the steps which are not skipped, ordered
+// so each comes after the steps it names in after or requires. Otherwise,
+// steps with a higher order_priority come first, then steps are ordered by
+// name. Steps may also name those of earlier stages, which are recorded in
+// done. done is updated with the steps of this stage.
+func orderSteps(opts Options, tree *toml.Tree, confs map[string]InstallConf, done stepSet) ([]string, error) {
+	keys := sortedKeys(confs)
+	installed := stepSet{}
+	for _, k := range keys {
+		skip, err := confs[k].If.ShouldSkip(tree, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		installed[k] = !skip
+	}
+
+	// next maps each step to those which must come after it, and waiting
+	// counts the steps in this stage which must come before each step.
+	next, waiting := map[string][]string{}, map[string]int{}
+	for _, k := range keys {
+		if !installed[k] {
+			continue
+		}
+		c := confs[k]
+		for _, dep := range c.Requires {
+			ok, known := installed[dep]
+			if !known {
+				ok, known = done[dep]
+			}
+			if !known {
+				return nil, fmt.Errorf("invalid config: %s requires %s, which is not a step of this or an earlier stage", k, dep)
+			}
+			if !ok {
+				return nil, fmt.Errorf("invalid config: %s requires %s, which is skipped by its if condition", k, dep)
+			}
+		}
+		for _, deps := range [][]string{c.After, c.Requires} {
+			for _, dep := range deps {
+				if dep == k {
+					return nil, fmt.Errorf("invalid config: %s is ordered after itself", k)
+				}
+				if ok, known := installed[dep]; known {
+					if ok {
+						next[dep] = append(next[dep], k)
+						waiting[k]++
+					}
+					continue
+				}
+				if _, known := done[dep]; !known {
+					return nil, fmt.Errorf("invalid config: %s is ordered after %s, which is not a step of this or an earlier stage", k, dep)
+				}
+			}
+		}
+	}
+
+	var out []string
+	placed := map[string]bool{}
+	for {
+		best := ""
+		for _, k := range keys {
+			if !installed[k] || placed[k] || waiting[k] > 0 {
+				continue
+			}
+			if best == "" || confs[k].Order > confs[best].Order {
+				best = k
+			}
+		}
+		if best == "" {
+			break
+		}
+		placed[best] = true
+		out = append(out, best)
+		for _, k := range next[best] {
+			waiting[k]--
+		}
+	}
+
+	var cycle []string
+	for _, k := range keys {
+		if installed[k] && !placed[k] {
+			cycle = append(cycle, k)
+		}
+	}
+	if len(cycle) > 0 {
+		return nil, fmt.Errorf("invalid config: steps %s are ordered after each other", strings.Join(cycle, ", "))
+	}
+	for k, ok := range installed {
+		done[k] = ok
+	}
+	return out, nil
+}
+
+func installsUnderKey(opts Options, tree *toml.Tree, key string, resDir string, done stepSet) ([]units.Unit, error) {
 	if t := tree.Get(key); t != nil {
 		installs, ok := t.(*toml.Tree)
 		if !ok {
@@ -53,40 +139,22 @@ func installsUnderKey(opts Options, tree *toml.Tree, key string, resDir string)
 		if err := installs.Unmarshal(&conf); err != nil {
 			return nil, err
 		}
+		if err := decodeActions(installs, conf); err != nil {
+			return nil, err
+		}
 
-		out := make([]units.Unit, 0, len(conf))
-		for k, c := range conf {
-			skip, err := c.If.ShouldSkip(tree, opts)
-			if err != nil {
-				return nil, fmt.Errorf("%s: %v", k, err)
-			}
-			if skip {
-				continue
-			}
-			ut, err := makeInstallUnit(k, c, tree, resDir)
+		steps, err := orderSteps(opts, tree, conf, done)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]units.Unit, 0, len(steps))
+		for _, k := range steps {
+			ut, err := makeInstallUnit(k, conf[k], tree, resDir)
 			if err != nil {
 				return nil, err
 			}
 			out = append(out, ut)
 		}
-
-		sort.Slice(out, func(i int, j int) bool {
-			var lhs, rhs int
-			switch l := out[i].(type) {
-			case *units.InstallTools:
-				lhs = l.Order
-			case *units.Composite:
-				lhs = l.Order
-			}
-			switch r := out[j].(type) {
-			case *units.InstallTools:
-				rhs = r.Order
-			case *units.Composite:
-				rhs = r.Order
-			}
-			return lhs > rhs
-		})
-
 		return out, nil
 	}
 
@@ -113,8 +181,20 @@ func makeInstallUnit(k string, c InstallConf, tree *toml.Tree, resDir string) (u
 		Pkgs:     c.Packages,
 	}}
 	// Add the actions.
-	for _, a := range c.Actions {
-		u, err := actionToUnit(a, tree, resDir)
+	x, err := newExpander(tree)
+	if err != nil {
+		return nil, err
+	}
+	for i, a := range c.Actions {
+		typ, err := lookupAction(a.Action)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %s: do[%d]: %v", k, i, err)
+		}
+		conf, err := x.expandConfig(a.Config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: %s: do[%d].%v", k, i, err)
+		}
+		u, err := typ.Unit(conf, ActionEnv{Step: k, ResourceDir: resDir})
 		if err != nil {
 			return nil, err
 		}
@@ -168,55 +248,3 @@ func evalStringSection(src string, tree *toml.Tree) (string, error) {
 	}
 	return out, nil
 }
-
-func actionToUnit(a InstallAction, tree *toml.Tree, resDir string) (units.Unit, error) {
-	for i := range a.Args {
-		if strings.HasPrefix(a.Args[i], "{{") && strings.HasSuffix(a.Args[i], "}}") && len(a.Args[i]) > 4 {
-			out, err := evalStringSection(a.Args[i][2:len(a.Args[i])-2], tree)
-			if err != nil {
-				return nil, err
-			}
-			a.Args[i] = out
-		}
-	}
-
-	for key, val := range a.Env {
-		if strings.HasPrefix(val, "{{") && strings.HasSuffix(val, "}}") && len(val) > 4 {
-			out, err := evalStringSection(val[2:len(val)-2], tree)
-			if err != nil {
-				return nil, err
-			}
-			a.Env[key] = out
-		}
-	}
-
-	switch a.Action {
-	case "download":
-		return &units.Download{URL: a.URL, To: a.To}, nil
-	case "run":
-		return &units.Cmd{Bin: a.Bin, Args: a.Args, Env: a.Env}, nil
-	case "sha256sum":
-		return &units.CheckHash{File: a.From, ExpectedHash: a.Expected}, nil
-	case "append":
-		return &units.Append{To: a.To, Data: a.Data}, nil
-	case "mkdir":
-		return &units.Mkdir{Dir: a.Dir}, nil
-	case "install-resource":
-		d, err := ioutil.ReadFile(filepath.Join(resDir, a.From))
-		if err != nil {
-			return nil, err
-		}
-		var perms os.FileMode = 0744
-		if a.Perms != 0 {
-			perms = a.Perms
-		}
-		return &units.InstallFiles{
-			UnitName: "install-resource: " + filepath.Base(a.From),
-			Mkdir:    a.Dir,
-			Files: []units.FileInfo{
-				{Path: a.To, Perms: perms, Data: d},
-			},
-		}, nil
-	}
-	return nil, fmt.Errorf("unknown action: %q", a.Action)
-}
@@ -1,9 +1,11 @@
 package stager
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/pelletier/go-toml"
+	"github.com/twitchylinux/builder/units"
 )
 
 func TestStringTemplateInterpolation(t *testing.T) {
@@ -33,3 +35,198 @@ func TestStringTemplateInterpolation(t *testing.T) {
 		})
 	}
 }
+
+// testAction has a field of each kind expandConfig expands.
+type testAction struct {
+	URL  string            `toml:"url"`
+	To   string            `toml:"to"`
+	Data string            `toml:"data"`
+	Dir  string            `toml:"dir"`
+	From string            `toml:"from"`
+	Bin  string            `toml:"bin"`
+	Args []string          `toml:"args"`
+	Env  map[string]string `toml:"env"`
+}
+
+func TestExpandConfig(t *testing.T) {
+	tree, err := toml.TreeFromMap(map[string]interface{}{
+		"base": map[string]interface{}{
+			"main_user": map[string]interface{}{"name": "alice"},
+			"linux":     map[string]interface{}{"version": "5.9.14"},
+		},
+		"features": map[string]interface{}{"SWE": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := newExpander(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := &testAction{
+		URL:  "https://example.com/{{.host.machine}}/{{arch}}.tar.gz",
+		To:   `{{join home ".config" "app"}}`,
+		Data: `{{if .features.SWE}}dev{{end}} {{home "root"}}`,
+		Bin:  "make",
+		Args: []string{"{{base.main_user.name}}", `{{"v" + base.linux.version}}`},
+		Env:  map[string]string{"KERNELRELEASE": "{{.base.linux.version}}"},
+	}
+	got, err := x.expandConfig(in)
+	if err != nil {
+		t.Fatalf("expandConfig() failed: %v", err)
+	}
+	want := &testAction{
+		URL:  "https://example.com/x86_64/amd64.tar.gz",
+		To:   "/home/alice/.config/app",
+		Data: "dev /root",
+		Bin:  "make",
+		Args: []string{"alice", "v5.9.14"},
+		Env:  map[string]string{"KERNELRELEASE": "5.9.14"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandConfig() = %+v, want %+v", got, want)
+	}
+	if in.To != `{{join home ".config" "app"}}` {
+		t.Errorf("expandConfig() modified its input: %+v", in)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		action  *testAction
+		wantErr string
+	}{
+		{"missing key", &testAction{Dir: "{{.base.nope}}"}, `dir: template: :1:7: executing "" at <.base.nope>: map has no entry for key "nope"`},
+		{"unknown user", &testAction{Args: []string{"x", `{{home "bob"}}`}}, `args[1]: template: :1:2: executing "" at <home "bob">: error calling home: "bob" is not a configured user`},
+		{"bad template", &testAction{From: "{{join"}, `from: template: :1: unclosed action`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := x.expandConfig(tc.action); err == nil || err.Error() != tc.wantErr {
+				t.Errorf("expandConfig() returned %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpandResolved(t *testing.T) {
+	tree, err := toml.Load(`
+[base.main_user]
+name = "alice"
+home = "/srv/alice"
+
+[feature_defs.dev]
+type = "bool"
+default = true
+implies = ["docs"]
+
+[feature_defs.docs]
+type = "bool"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := newExpander(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := x.expand("{{.features.dev}} {{.features.docs}} {{home}}")
+	if err != nil {
+		t.Fatalf("expand() failed: %v", err)
+	}
+	if want := "true true /srv/alice"; got != want {
+		t.Errorf("expand() = %q, want %q", got, want)
+	}
+}
+
+type greetAction struct {
+	Greeting string `toml:"greeting"`
+	Times    int    `toml:"times"`
+}
+
+func TestRegisterAction(t *testing.T) {
+	RegisterAction(ActionType{
+		Name:   "test-greet",
+		Doc:    "Greets the user.",
+		Config: greetAction{},
+		Unit: func(c interface{}, env ActionEnv) (units.Unit, error) {
+			a := c.(*greetAction)
+			args := []string{env.Step}
+			for i := 0; i < a.Times; i++ {
+				args = append(args, a.Greeting)
+			}
+			return &units.Cmd{Bin: "echo", Args: args}, nil
+		},
+	})
+	defer delete(actionTypes, "test-greet")
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("RegisterAction() did not panic for a duplicate name")
+			}
+		}()
+		RegisterAction(ActionType{Name: "test-greet", Config: greetAction{}, Unit: actionTypes["test-greet"].Unit})
+	}()
+
+	if got, want := actionTypes["test-greet"].Fields(), []ActionField{{"greeting", "string"}, {"times", "integer"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields() = %v, want %v", got, want)
+	}
+
+	c, err := UnitsFromConfig("testdata/actions", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getUnits(t, c, reflect.TypeOf(&units.Composite{})), []units.Unit{
+		&units.Composite{
+			UnitName: "greet",
+			Ops: []units.Unit{
+				&units.InstallTools{UnitName: "greet"},
+				&units.Cmd{Bin: "echo", Args: []string{"greet", "hi alice", "hi alice"}},
+			},
+		},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("units = %+v, want %+v", got, want)
+	}
+
+	e, err := ParseEdit(`post_base.install.greet.do=[{action = "test-greet", times = "many"}, {action = "test-gret"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "invalid config:\n" +
+		"-D: post_base.install.greet.do.times: expected an integer, got a string\n" +
+		"-D: post_base.install.greet.do.action: unknown action \"test-gret\", did you mean test-greet?"
+	if err := Lint("testdata/actions", Options{Edits: []Edit{e}}); err == nil || err.Error() != want {
+		t.Errorf("Lint() = %v, want %q", err, want)
+	}
+}
+
+func TestNativeActions(t *testing.T) {
+	c, err := UnitsFromConfig("testdata/native_actions", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := getUnits(t, c, reflect.TypeOf(&units.Composite{})), []units.Unit{
+		&units.Composite{
+			UnitName: "tool",
+			Ops: []units.Unit{
+				&units.InstallTools{UnitName: "tool"},
+				&units.Extract{From: "/tool.tar.xz", To: "/opt/tool", StripComponents: 1},
+				&units.Copy{From: "/opt/tool/tool", To: "/usr/local/bin/tool"},
+				&units.Symlink{Target: "/usr/local/bin/tool", Link: "/usr/bin/t"},
+				&units.Chmod{Path: "/usr/local/bin/tool", Mode: 04755},
+				&units.Chown{Path: "/home/alice/.config", User: "alice", Recursive: true},
+				&units.Remove{Path: "/opt/tool", Recursive: true},
+			},
+		},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("units = %+v, want %+v", got, want)
+	}
+
+	e, err := ParseEdit(`post_base.install.tool.do=[{action = "extract", from = "/a.zip", to = "/b", strip_components = -1}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnitsFromConfig("testdata/native_actions", Options{Edits: []Edit{e}}); err == nil || err.Error() != "tool: strip_components must not be negative" {
+		t.Errorf("UnitsFromConfig() = %v, want an error for strip_components", err)
+	}
+}
@@ -0,0 +1,240 @@
+package stager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// keyInclude lists files, relative to the file it is in, which are
+	// loaded before that file. Values set by the file take precedence over
+	// those it includes, and later includes over earlier ones.
+	keyInclude = "include"
+	// profileDir is the directory of the stage config holding profiles,
+	// which are layered over the stage config when selected.
+	profileDir = "profiles"
+	// sourceOverride is the source of values set with -D.
+	sourceOverride = "-D"
+)
+
+// setting is where the effective value of a key was set.
+type setting struct {
+	path []string
+	file string
+	pos  toml.Position
+}
+
+// configLoader reads config files into a single tree. Values are layered
+// in order of precedence: the files of the stage config directory, each
+// selected profile, override files, then overrides.
+type configLoader struct {
+	conf *toml.Tree
+	lint *linter
+	// sources records where the value of each key was set, keyed by the
+	// full key.
+	sources map[string]setting
+	// loading are the files being loaded, to detect include cycles.
+	loading []string
+}
+
+func newConfigLoader() *configLoader {
+	conf, _ := toml.Load("")
+	return &configLoader{
+		conf:    conf,
+		lint:    newLinter(),
+		sources: map[string]setting{},
+	}
+}
+
+// load reads the config in dir, the profiles and the overrides.
+func (c *configLoader) load(dir string, opts Options) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			if err := c.loadFile(filepath.Join(dir, f.Name()), true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range opts.Profiles {
+		path := filepath.Join(dir, profileDir, name+".toml")
+		if strings.ContainsRune(name, filepath.Separator) || !fileExists(path) {
+			return fmt.Errorf("unknown profile %q, want one of: %s", name, strings.Join(profiles(dir), ", "))
+		}
+		if err := c.loadFile(path, false); err != nil {
+			return err
+		}
+	}
+	for _, path := range opts.OverrideFiles {
+		if err := c.loadFile(path, false); err != nil {
+			return err
+		}
+	}
+
+	// Keys are applied in order, so a table is set before its members.
+	for _, key := range sortedKeys(opts.Overrides) {
+		c.conf.Set(key, opts.Overrides[key])
+		c.record(strings.Split(key, "."), sourceOverride, toml.Position{})
+	}
+	for _, e := range opts.Edits {
+		c.apply(e, sourceOverride)
+	}
+	if err := c.checkFeatures(); err != nil {
+		return err
+	}
+	if len(c.lint.problems) > 0 {
+		return c.lint.problems
+	}
+	return nil
+}
+
+// loadFile layers a config file, and the files it includes, over the
+// config loaded so far. Values set in more than one file of the stage
+// config directory are reported, so those files are loaded as unordered.
+func (c *configLoader) loadFile(path string, unordered bool) error {
+	for i, p := range c.loading {
+		if p == path {
+			return fmt.Errorf("%s: include cycle: %s", path, strings.Join(append(c.loading[i:], path), " -> "))
+		}
+	}
+	c.loading = append(c.loading, path)
+	defer func() { c.loading = c.loading[:len(c.loading)-1] }()
+
+	t, err := toml.LoadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	includes, err := c.includes(path, t)
+	if err != nil {
+		return err
+	}
+	for _, inc := range includes {
+		if err := c.loadFile(inc, false); err != nil {
+			return err
+		}
+	}
+
+	c.lint.checkFile(path, t, unordered)
+	c.recordTree(t, nil, path)
+	return unionTree(c.conf, t, nil)
+}
+
+// includes returns the paths of the files included by the config file at
+// path, removing the include directive from its tree.
+func (c *configLoader) includes(path string, t *toml.Tree) ([]string, error) {
+	v := t.Get(keyInclude)
+	if v == nil {
+		return nil, nil
+	}
+	pos := t.GetPosition(keyInclude)
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s:%d:%d: %s: expected an array of strings, got %s", path, pos.Line, pos.Col, keyInclude, tomlTypeName(v))
+	}
+	out := make([]string, 0, len(list))
+	for _, e := range list {
+		s, ok := e.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d:%d: %s: expected an array of strings, got %s", path, pos.Line, pos.Col, keyInclude, tomlTypeName(e))
+		}
+		inc := filepath.Join(filepath.Dir(path), s)
+		if !fileExists(inc) {
+			return nil, fmt.Errorf("%s:%d:%d: %s: %s does not exist", path, pos.Line, pos.Col, keyInclude, inc)
+		}
+		out = append(out, inc)
+	}
+	return out, t.Delete(keyInclude)
+}
+
+// recordTree records the values set by the tree of a config file.
+func (c *configLoader) recordTree(t *toml.Tree, path []string, file string) {
+	for _, k := range t.Keys() {
+		p := append(path[:len(path):len(path)], k)
+		if sub, ok := t.GetPath([]string{k}).(*toml.Tree); ok {
+			c.recordTree(sub, p, file)
+			continue
+		}
+		c.record(p, file, positionOr(t.GetPositionPath([]string{k}), t.Position()))
+	}
+}
+
+// record records where the value of the key at path was set, forgetting
+// the sources of any values it replaces.
+func (c *configLoader) record(path []string, file string, pos toml.Position) {
+	if file == sourceOverride {
+		// Overrides are not read from a file.
+		pos = toml.Position{}
+	}
+	key := strings.Join(path, ".")
+	for k := range c.sources {
+		if strings.HasPrefix(k, key+".") {
+			delete(c.sources, k)
+		}
+	}
+	for i := 1; i < len(path); i++ {
+		delete(c.sources, strings.Join(path[:i], "."))
+	}
+	c.sources[key] = setting{path: path, file: file, pos: pos}
+}
+
+func fileExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// profiles returns the names of the profiles in the stage config.
+func profiles(dir string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, profileDir, "*.toml"))
+	out := make([]string, len(matches))
+	for i, m := range matches {
+		out[i] = strings.TrimSuffix(filepath.Base(m), ".toml")
+	}
+	return out
+}
+
+// Source is where the effective value of a config key was set.
+type Source struct {
+	Key   string
+	Value interface{}
+	// File is the config file which set the value, or -D if it was set
+	// by an override.
+	File      string
+	Line, Col int
+}
+
+func (s Source) String() string {
+	if s.File == sourceOverride {
+		return s.File
+	}
+	return fmt.Sprintf("%s:%d:%d", s.File, s.Line, s.Col)
+}
+
+// Sources returns where each value of the config in the directory
+// provided was set, ordered by key.
+func Sources(dir string, opts Options) ([]Source, error) {
+	c := newConfigLoader()
+	if err := c.load(dir, opts); err != nil {
+		return nil, err
+	}
+	out := make([]Source, 0, len(c.sources))
+	for _, k := range sortedKeys(c.sources) {
+		s := c.sources[k]
+		out = append(out, Source{
+			Key:   k,
+			Value: c.conf.GetPath(s.path),
+			File:  s.file,
+			Line:  s.pos.Line,
+			Col:   s.pos.Col,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,56 @@
+package stager
+
+import (
+	"fmt"
+
+	"github.com/pelletier/go-toml"
+	"github.com/twitchylinux/builder/oci"
+)
+
+// OCIConfig returns the configuration of the container image exported
+// from a built system, described by the config in the directory provided.
+func OCIConfig(dir string, opts Options) (oci.Config, error) {
+	conf, err := loadConfig(dir, opts)
+	if err != nil {
+		return oci.Config{}, err
+	}
+	return ociConf(conf)
+}
+
+func ociConf(tree *toml.Tree) (oci.Config, error) {
+	out := oci.DefaultConfig()
+	if t := tree.Get(rootKeyOCI); t != nil {
+		ot, ok := t.(*toml.Tree)
+		if !ok {
+			return oci.Config{}, fmt.Errorf("invalid config: %s is not a structure (got %T)", rootKeyOCI, t)
+		}
+		if err := ot.Unmarshal(&out); err != nil {
+			return oci.Config{}, err
+		}
+	}
+
+	// Describe the image as the system describes itself, unless told
+	// otherwise.
+	if t, ok := tree.Get(keyReleaseInfo).(*toml.Tree); ok {
+		var rel ReleaseConf
+		if err := t.Unmarshal(&rel); err != nil {
+			return oci.Config{}, err
+		}
+		if out.Labels == nil {
+			out.Labels = map[string]string{}
+		}
+		for k, v := range map[string]string{
+			"org.opencontainers.image.title":  rel.PrettyName,
+			"org.opencontainers.image.vendor": rel.Name,
+			"org.opencontainers.image.url":    rel.URL,
+		} {
+			if _, set := out.Labels[k]; !set && v != "" {
+				out.Labels[k] = v
+			}
+		}
+	}
+	if err := out.Validate(); err != nil {
+		return oci.Config{}, fmt.Errorf("invalid config: %s: %v", rootKeyOCI, err)
+	}
+	return out, nil
+}
@@ -33,7 +33,8 @@ func optPackagesConfig(opts Options, tree *toml.Tree) (*units.Composite, error)
 	}
 
 	var out []units.Unit
-	for name, pkg := range conf {
+	for _, name := range sortedKeys(conf) {
+		pkg := conf[name]
 		skip, err := pkg.If.ShouldSkip(tree, opts)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,162 @@
+package stager
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// EditOp is the way an Edit changes the value of a key.
+type EditOp string
+
+// Ways a value can be edited.
+const (
+	// EditSet replaces the value.
+	EditSet EditOp = "="
+	// EditAppend appends elements to a list.
+	EditAppend EditOp = "+="
+	// EditRemove removes all elements equal to those given from a list.
+	EditRemove EditOp = "-="
+)
+
+// Edit changes the value of a config key, as given by a -D build option.
+type Edit struct {
+	Key   string
+	Op    EditOp
+	Value interface{}
+	// Text is the value as written. It is used as the value of keys which
+	// hold a string if the value is not a string literal.
+	Text string
+}
+
+// ParseEdit parses an edit of the form key=value, key+=value or
+// key-=value. The value is a TOML value, such as 42, [1, 2] or
+// {a = "b"}, or else a string.
+func ParseEdit(s string) (Edit, error) {
+	idx := strings.Index(s, "=")
+	if idx < 1 {
+		return Edit{}, fmt.Errorf("invalid override %q: must be of the form key=value", s)
+	}
+	e := Edit{Key: s[:idx], Op: EditSet, Text: s[idx+1:]}
+	switch e.Key[len(e.Key)-1] {
+	case '+':
+		e.Key, e.Op = e.Key[:len(e.Key)-1], EditAppend
+	case '-':
+		e.Key, e.Op = e.Key[:len(e.Key)-1], EditRemove
+	}
+	if e.Key == "" {
+		return Edit{}, fmt.Errorf("invalid override %q: must be of the form key=value", s)
+	}
+
+	e.Value = e.Text
+	if t, err := toml.Load("v = " + e.Text); err == nil {
+		e.Value = t.Get("v")
+	}
+	return e, nil
+}
+
+func (e Edit) String() string {
+	return e.Key + string(e.Op) + e.Text
+}
+
+// apply applies the edit to the config, reporting problems with the value
+// as being in file.
+func (c *configLoader) apply(e Edit, file string) {
+	path := strings.Split(e.Key, ".")
+	c.lint.file = file
+	typ, err := schemaType(path)
+	if err != nil {
+		c.lint.errorf(toml.Position{}, "%v", err)
+		return
+	}
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	v := e.Value
+	if typ != nil && typ.Kind() == reflect.String {
+		if _, ok := v.(string); !ok {
+			v = e.Text
+		}
+	}
+	if e.Op != EditSet {
+		if typ == nil || (typ.Kind() != reflect.Slice && typ.Kind() != reflect.Interface) {
+			c.lint.errorf(toml.Position{}, "%s: %s only applies to lists", e.Key, e.Op)
+			return
+		}
+		// A single element may be given without brackets.
+		if _, isList := v.([]interface{}); !isList {
+			if typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String {
+				if _, ok := v.(string); !ok {
+					v = e.Text
+				}
+			}
+			v = []interface{}{v}
+		}
+	}
+	if !c.check(path, v, typ) {
+		return
+	}
+
+	if e.Op != EditSet {
+		var current []interface{}
+		switch cv := c.conf.GetPath(path).(type) {
+		case nil:
+		case []interface{}:
+			current = cv
+		default:
+			c.lint.errorf(toml.Position{}, "%s: %s only applies to lists, but it is %s", e.Key, e.Op, tomlTypeName(cv))
+			return
+		}
+		v = editList(current, v.([]interface{}), e.Op)
+	}
+	c.conf.SetPath(path, v)
+	c.record(path, file, toml.Position{})
+	if t, ok := v.(*toml.Tree); ok {
+		c.recordTree(t, path, file)
+	}
+}
+
+// check reports if v is not a valid value for the key at path, which is
+// decoded into typ.
+func (c *configLoader) check(path []string, v interface{}, typ reflect.Type) bool {
+	key := strings.Join(path, ".")
+	if disabledByZero[key] && v == int64(0) {
+		return true
+	}
+	n := len(c.lint.problems)
+	c.lint.unordered = false
+	if typ == nil {
+		if t, ok := v.(*toml.Tree); ok {
+			c.lint.checkTable(t, path, nil, toml.Position{})
+		} else {
+			c.lint.errorf(toml.Position{}, "%s: expected a table, got %s", key, tomlTypeName(v))
+		}
+	} else {
+		c.lint.checkValue(v, path, toml.Position{}, typ)
+	}
+	return len(c.lint.problems) == n
+}
+
+// editList returns a copy of the list with elements appended or removed.
+func editList(list, elems []interface{}, op EditOp) []interface{} {
+	if op == EditAppend {
+		return append(append([]interface{}{}, list...), elems...)
+	}
+	out := []interface{}{}
+	for _, v := range list {
+		remove := false
+		for _, e := range elems {
+			if reflect.DeepEqual(v, e) {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			out = append(out, v)
+		}
+	}
+	return out
+}
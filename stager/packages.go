@@ -0,0 +1,72 @@
+package stager
+
+import (
+	"strings"
+
+	"github.com/twitchylinux/builder/units"
+)
+
+// collectPackages returns the apt packages installed by each of the given
+// units, keyed by unit name.
+func collectPackages(uts []units.Unit, out map[string][]string) {
+	for _, u := range uts {
+		switch ut := u.(type) {
+		case *units.InstallTools:
+			out[ut.UnitName] = append(out[ut.UnitName], aptPackages(ut.Pkgs)...)
+		case *units.OptPackage:
+			out[ut.OptName] = append(out[ut.OptName], aptPackages(ut.Packages)...)
+		case *units.Linux:
+			out[ut.Name()] = append(out[ut.Name()], aptPackages(ut.BuildDepPkgs)...)
+		case *units.Composite:
+			collectPackages(ut.Ops, out)
+		}
+	}
+}
+
+// aptPackages filters out references to local .deb files, which are not
+// present in the package index.
+func aptPackages(pkgs []string) []string {
+	out := make([]string, 0, len(pkgs))
+	for _, p := range pkgs {
+		if strings.HasSuffix(p, ".deb") || strings.HasPrefix(p, "/") {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// withPackageCheck inserts a unit validating the packages named by all other
+// units, so that typos are reported before the build starts.
+func withPackageCheck(uts []units.Unit) []units.Unit {
+	var (
+		dbstrp    *units.Debootstrap
+		insertIdx int
+	)
+	for i, u := range uts {
+		switch ut := u.(type) {
+		case *units.Preflight:
+			insertIdx = i + 1
+		case *units.Debootstrap:
+			dbstrp = ut
+		}
+	}
+	if dbstrp == nil {
+		return uts
+	}
+
+	pkgs := map[string][]string{}
+	collectPackages(uts, pkgs)
+	check := &units.CheckPackages{
+		Track:      dbstrp.Track,
+		URL:        dbstrp.URL,
+		Components: aptComponents,
+		Arch:       aptArch,
+		Pkgs:       pkgs,
+	}
+
+	out := make([]units.Unit, 0, len(uts)+1)
+	out = append(out, uts[:insertIdx]...)
+	out = append(out, check)
+	return append(out, uts[insertIdx:]...)
+}
@@ -0,0 +1,387 @@
+package stager
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/twitchylinux/builder/conf/grub"
+	"github.com/twitchylinux/builder/editdist"
+	"github.com/twitchylinux/builder/oci"
+	"github.com/twitchylinux/builder/pack"
+	"github.com/twitchylinux/builder/verify"
+)
+
+// schema maps the keys of config sections to the types they are decoded
+// into. Keys of intermediate tables, such as post_base, are implied.
+// Where a section nests within another, the more specific key wins.
+var schema = map[string]reflect.Type{
+	rootKeyFeatures:      reflect.TypeOf(map[string]interface{}{}),
+	rootKeyFeatureDefs:   reflect.TypeOf(map[string]FeatureDef{}),
+	keyDebian:            reflect.TypeOf(DebootstrapConf{}),
+	keyLocale:            reflect.TypeOf(LocaleConf{}),
+	keyLinux:             reflect.TypeOf(LinuxConf{}),
+	keyLinux + ".config": reflect.TypeOf(map[string]interface{}{}),
+	keyLinuxModules:      reflect.TypeOf(map[string]KernelModuleConf{}),
+	keyReleaseInfo:       reflect.TypeOf(ReleaseConf{}),
+	keyShellCust:         reflect.TypeOf(ShellConf{}),
+	keyMainUser:          reflect.TypeOf(MainUserConf{}),
+	rootKeyGraphicalEnv:  reflect.TypeOf(map[string]GraphicsConf{}),
+	installKeyPostGUI:    reflect.TypeOf(map[string]InstallConf{}),
+	installKeyPostBase:   reflect.TypeOf(map[string]InstallConf{}),
+	keyUdevRules:         reflect.TypeOf(map[string]UdevRules{}),
+	keySysdNetworks:      reflect.TypeOf(map[string]systemdNetwork{}),
+	keyOptPackages:       reflect.TypeOf(map[string]optPackage{}),
+	rootKeyImage:         reflect.TypeOf(pack.Config{}),
+	rootKeyBootloader:    reflect.TypeOf(grub.Config{}),
+	keyVerifyBoot:        reflect.TypeOf(verify.Config{}),
+	rootKeyOCI:           reflect.TypeOf(oci.Config{}),
+}
+
+// disabledByZero are the sections which may be set to 0 to disable them.
+var disabledByZero = map[string]bool{
+	rootKeyGraphicalEnv: true,
+	installKeyPostBase:  true,
+	installKeyPostGUI:   true,
+}
+
+// Lint checks the config in the directory provided. Keys which are
+// unknown, have values of the wrong type, or are set in more than one file
+// are reported as Problems. Otherwise, the config is checked as it would
+// be by a build and by each command which reads it.
+func Lint(dir string, opts Options) error {
+	if _, err := UnitGroups(dir, opts); err != nil {
+		return err
+	}
+	if _, err := VerifyConfig(dir, opts); err != nil {
+		return err
+	}
+	_, err := OCIConfig(dir, opts)
+	return err
+}
+
+// schemaType returns the type the value at path is decoded into, or nil
+// if it is an intermediate table.
+func schemaType(path []string) (reflect.Type, error) {
+	key := strings.Join(path, ".")
+	for i := len(path); i > 0; i-- {
+		typ, ok := schema[strings.Join(path[:i], ".")]
+		if !ok {
+			continue
+		}
+		for _, k := range path[i:] {
+			var err error
+			if typ, err = fieldType(typ, k); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		return typ, nil
+	}
+	if isSchemaPrefix(key) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown section %s", key)
+}
+
+// isSchemaPrefix returns true if key is an intermediate table of a
+// section in the schema.
+func isSchemaPrefix(key string) bool {
+	for k := range schema {
+		if strings.HasPrefix(k, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Problem describes an error at a position in a config file.
+type Problem struct {
+	File      string
+	Line, Col int
+	Msg       string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Col, p.Msg)
+}
+
+// Problems are errors found in config files, in the order of the files.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	lines := make([]string, len(p))
+	for i := range p {
+		lines[i] = p[i].String()
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
+
+// definition is where a value is set in a config file.
+type definition struct {
+	file string
+	pos  toml.Position
+}
+
+// linter checks config files against the schema.
+type linter struct {
+	file     string
+	problems Problems
+	// inArray is set while checking the elements of an array, whose keys
+	// repeat.
+	inArray bool
+	// unordered is set while checking a file whose values may not be set
+	// by another unordered file.
+	unordered bool
+	// defined records where each value is set, keyed by the full key, so
+	// values set in more than one file are reported.
+	defined map[string]definition
+}
+
+func newLinter() *linter {
+	return &linter{defined: map[string]definition{}}
+}
+
+func (l *linter) errorf(pos toml.Position, format string, args ...interface{}) {
+	l.problems = append(l.problems, Problem{
+		File: l.file,
+		Line: pos.Line,
+		Col:  pos.Col,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// checkFile checks the tree read from a config file. Values it sets which
+// were set by an earlier unordered file are reported if it is unordered.
+func (l *linter) checkFile(file string, t *toml.Tree, unordered bool) {
+	l.file, l.unordered = file, unordered
+	start := len(l.problems)
+	l.checkTable(t, nil, nil, t.Position())
+
+	found := l.problems[start:]
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Line != found[j].Line {
+			return found[i].Line < found[j].Line
+		}
+		return found[i].Col < found[j].Col
+	})
+}
+
+// checkTable checks the keys of the table at path, which is decoded into
+// typ. typ is nil for intermediate tables. Problems with keys which have
+// no position, as in inline tables within arrays, are reported at pos.
+func (l *linter) checkTable(t *toml.Tree, path []string, typ reflect.Type, pos toml.Position) {
+	pos = positionOr(t.Position(), pos)
+	keys := t.Keys()
+	sort.Strings(keys)
+	for _, k := range keys {
+		var (
+			p   = append(path[:len(path):len(path)], k)
+			key = strings.Join(p, ".")
+			v   = t.GetPath([]string{k})
+			pos = positionOr(t.GetPositionPath([]string{k}), pos)
+		)
+		if _, isTable := v.(*toml.Tree); !isTable && !l.inArray && l.unordered {
+			if d, ok := l.defined[key]; ok {
+				l.errorf(pos, "%s is already set at %s:%d:%d", key, d.file, d.pos.Line, d.pos.Col)
+			} else {
+				l.defined[key] = definition{file: l.file, pos: pos}
+			}
+		}
+
+		if disabledByZero[key] && v == int64(0) {
+			continue
+		}
+		if st, ok := schema[key]; ok {
+			l.checkValue(v, p, pos, st)
+			continue
+		}
+		if isSchemaPrefix(key) {
+			if sub, ok := v.(*toml.Tree); ok {
+				l.checkTable(sub, p, nil, pos)
+			} else {
+				l.errorf(pos, "%s: expected a table, got %s", key, tomlTypeName(v))
+			}
+			continue
+		}
+		if typ == nil {
+			l.errorf(pos, "unknown section %s", key)
+			continue
+		}
+		ft, err := fieldType(typ, k)
+		if err != nil {
+			l.errorf(pos, "%s: %v", key, err)
+			continue
+		}
+		l.checkValue(v, p, pos, ft)
+	}
+}
+
+// checkValue checks that the value at path can be decoded into typ.
+func (l *linter) checkValue(v interface{}, path []string, pos toml.Position, typ reflect.Type) {
+	key := strings.Join(path, ".")
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Interface:
+		return
+	case reflect.Struct, reflect.Map:
+		if typ == reflect.TypeOf(InstallAction{}) {
+			if sub, ok := v.(*toml.Tree); ok {
+				l.checkAction(sub, path, pos)
+			} else {
+				l.errorf(pos, "%s: expected a table, got %s", key, tomlTypeName(v))
+			}
+			return
+		}
+		if typ == reflect.TypeOf(time.Time{}) {
+			if _, ok := v.(time.Time); !ok {
+				l.errorf(pos, "%s: expected a datetime, got %s", key, tomlTypeName(v))
+			}
+			return
+		}
+		sub, ok := v.(*toml.Tree)
+		if !ok {
+			l.errorf(pos, "%s: expected a table, got %s", key, tomlTypeName(v))
+			return
+		}
+		l.checkTable(sub, path, typ, pos)
+	case reflect.Slice, reflect.Array:
+		inArray := l.inArray
+		l.inArray = true
+		defer func() { l.inArray = inArray }()
+		switch vs := v.(type) {
+		case []*toml.Tree:
+			for _, t := range vs {
+				l.checkValue(t, path, positionOr(t.Position(), pos), typ.Elem())
+			}
+		case []interface{}:
+			for _, e := range vs {
+				l.checkValue(e, path, pos, typ.Elem())
+			}
+		default:
+			l.errorf(pos, "%s: expected an array, got %s", key, tomlTypeName(v))
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			l.errorf(pos, "%s: expected a string, got %s", key, tomlTypeName(v))
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			l.errorf(pos, "%s: expected a boolean, got %s", key, tomlTypeName(v))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, ok := v.(int64); !ok {
+			l.errorf(pos, "%s: expected an integer, got %s", key, tomlTypeName(v))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, ok := v.(int64); !ok || i < 0 {
+			l.errorf(pos, "%s: expected a non-negative integer, got %s", key, tomlTypeName(v))
+		}
+	case reflect.Float32, reflect.Float64:
+		switch v.(type) {
+		case float64, int64:
+		default:
+			l.errorf(pos, "%s: expected a number, got %s", key, tomlTypeName(v))
+		}
+	}
+}
+
+// fieldType returns the type of the member k of a table decoded into typ.
+func fieldType(typ reflect.Type, k string) (reflect.Type, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Map:
+		return typ.Elem(), nil
+	case reflect.Interface:
+		return typ, nil
+	case reflect.Struct:
+		names := tomlFieldNames(typ)
+		if ft, ok := names[k]; ok {
+			return ft, nil
+		}
+		var valid []string
+		for n := range names {
+			valid = append(valid, n)
+		}
+		if s := closest(k, valid); s != "" {
+			return nil, fmt.Errorf("unknown key, did you mean %s?", s)
+		}
+		sort.Strings(valid)
+		return nil, fmt.Errorf("unknown key, expected one of %s", strings.Join(valid, ", "))
+	}
+	return nil, fmt.Errorf("expected %s, got a table", typ.Kind())
+}
+
+// tomlFieldNames returns the types of the fields of a struct, keyed by
+// the names go-toml decodes them from.
+func tomlFieldNames(typ reflect.Type) map[string]reflect.Type {
+	out := map[string]reflect.Type{}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("toml"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = strings.TrimSpace(tag)
+		}
+		out[name] = f.Type
+		if lower := strings.ToLower(name); lower != name {
+			out[lower] = f.Type
+		}
+	}
+	return out
+}
+
+// positionOr returns pos, or fallback if pos is unknown, as it is for
+// inline tables in arrays.
+func positionOr(pos, fallback toml.Position) toml.Position {
+	if pos.Invalid() {
+		return fallback
+	}
+	return pos
+}
+
+func tomlTypeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "a string"
+	case int64:
+		return "an integer"
+	case float64:
+		return "a float"
+	case bool:
+		return "a boolean"
+	case time.Time:
+		return "a datetime"
+	case *toml.Tree:
+		return "a table"
+	case []*toml.Tree, []interface{}:
+		return "an array"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// closest returns the candidate within two edits of s, if any.
+func closest(s string, candidates []string) string {
+	best, bestDist := "", 3
+	sort.Strings(candidates)
+	for _, c := range candidates {
+		if d := editdist.Distance(s, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
@@ -3,9 +3,8 @@ package stager
 
 import (
 	"fmt"
-	"io/ioutil"
-	"path/filepath"
 	"reflect"
+	"sort"
 
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
@@ -14,16 +13,19 @@ import (
 )
 
 const (
-	rootKeyBase    = "base"
-	keyDebian      = rootKeyBase + ".debian"
-	keyLocale      = rootKeyBase + ".locale"
-	keyLinux       = rootKeyBase + ".linux"
-	keyReleaseInfo = rootKeyBase + ".release_info"
-	keyShellCust   = rootKeyBase + ".shell_customization"
-	keyMainUser    = rootKeyBase + ".main_user"
+	rootKeyBase     = "base"
+	keyDebian       = rootKeyBase + ".debian"
+	keyLocale       = rootKeyBase + ".locale"
+	keyLinux        = rootKeyBase + ".linux"
+	keyLinuxModules = keyLinux + ".modules"
+	keyReleaseInfo  = rootKeyBase + ".release_info"
+	keyShellCust    = rootKeyBase + ".shell_customization"
+	keyMainUser     = rootKeyBase + ".main_user"
 
+	rootKeyFeatures     = "features"
+	rootKeyFeatureDefs  = "feature_defs"
 	rootKeyGraphicalEnv = "graphical_environment"
-	keyGraphicalEnvName = "features.graphical_environment"
+	keyGraphicalEnvName = rootKeyFeatures + ".graphical_environment"
 	installKeyPostBase  = "post_base.install"
 	installKeyPostGUI   = rootKeyGraphicalEnv + ".post.install"
 	rootKeyUdev         = "udev"
@@ -32,11 +34,28 @@ const (
 	keySysdNetworks     = rootKeySysd + ".networks"
 	rootKeyOptional     = "optional"
 	keyOptPackages      = rootKeyOptional + ".packages"
+	rootKeyImage        = "image"
+	rootKeyBootloader   = "bootloader"
+	rootKeyVerify       = "verify"
+	keyVerifyBoot       = rootKeyVerify + ".boot"
+	rootKeyOCI          = "oci"
 )
 
+// sortedKeys returns the keys of a map with string keys in order, so
+// units are generated in the same order for the same config.
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, k.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
 func unionTree(target, in *toml.Tree, inPrefix []string) error {
 	for _, k := range in.Keys() {
-		v := in.Get(k)
+		v := in.GetPath([]string{k})
 		t, isTree := v.(*toml.Tree)
 
 		if !isTree {
@@ -56,87 +75,119 @@ func unionTree(target, in *toml.Tree, inPrefix []string) error {
 type Options struct {
 	// Overrides specifies the value for a given config key. If the key is
 	// already set in the config file, this value will take precedence.
+	// Values are not checked against the schema.
 	Overrides map[string]interface{}
+	// Edits are applied in order after Overrides, and checked against the
+	// schema.
+	Edits []Edit
+	// OverrideFiles are config files layered over the config and any
+	// profiles, in order.
+	OverrideFiles []string
+	// SecureBoot adds units which sign the system for Secure Boot. The
+	// keys are provided to the units at build time, never by the config.
+	SecureBoot bool
+	// Reproducible adds a final unit which normalizes the system, so
+	// builds of the same config are identical.
+	Reproducible bool
+	// Profiles names profiles in the profiles directory of the stage
+	// config, which are layered over it in order.
+	Profiles []string
+}
+
+// loadConfig reads the config files in the directory provided into a
+// single tree, layering any profiles and overrides over them.
+func loadConfig(dir string, opts Options) (*toml.Tree, error) {
+	c := newConfigLoader()
+	if err := c.load(dir, opts); err != nil {
+		return nil, err
+	}
+	return c.conf, nil
+}
+
+// UnitGroup is a named stage of the build, such as the base system or
+// the graphical environment.
+type UnitGroup struct {
+	Name  string
+	Units []units.Unit
 }
 
 // UnitsFromConfig returns a set of units that represent the configuration
 // in the directory provided.
 func UnitsFromConfig(dir string, opts Options) ([]units.Unit, error) {
-	var (
-		conf, _ = toml.Load("")
-		out     []units.Unit
-	)
-	files, err := ioutil.ReadDir(dir)
+	groups, err := UnitGroups(dir, opts)
 	if err != nil {
 		return nil, err
 	}
-	for _, f := range files {
-		if !f.IsDir() {
-			t, err := toml.LoadFile(filepath.Join(dir, f.Name()))
-			if err != nil {
-				return nil, err
-			}
-			if err := unionTree(conf, t, nil); err != nil {
-				return nil, err
-			}
-		}
+	var out []units.Unit
+	for _, g := range groups {
+		out = append(out, g.Units...)
 	}
+	return withPackageCheck(out), nil
+}
 
-	// Apply any configuration overrides.
-	for key, val := range opts.Overrides {
-		conf.Set(key, val)
+// UnitGroups returns the units which represent the configuration in the
+// directory provided, grouped by the stage of the build they belong to.
+// The check of package names, which runs before anything is installed,
+// is not part of any group.
+func UnitGroups(dir string, opts Options) ([]UnitGroup, error) {
+	conf, err := loadConfig(dir, opts)
+	if err != nil {
+		return nil, err
 	}
 
 	// Build base system.
-	out, err = baseUnitsFromConf(out, conf)
+	base, err := baseUnitsFromConf(nil, conf, opts)
 	if err != nil {
 		return nil, err
 	}
+	out := []UnitGroup{{Name: "base", Units: base}}
 
 	// Install specified packages.
-	installs, err := installsUnderKey(opts, conf, installKeyPostBase, dir)
+	steps := stepSet{}
+	installs, err := installsUnderKey(opts, conf, installKeyPostBase, dir, steps)
 	if err != nil {
 		return nil, err
 	}
-	out = append(out, installs...)
+	out = append(out, UnitGroup{Name: "packages", Units: installs})
 
 	doGraphicalInstaller, err := featuresAreSet([]string{"graphical"}, conf)
 	if err != nil {
 		return nil, err
 	}
 	if doGraphicalInstaller {
-		ge, err := graphicsConf(opts, conf, dir)
+		ge, err := graphicsConf(opts, conf, dir, steps)
 		if err != nil {
 			return nil, err
 		}
-		out = append(out, ge...)
 		// Install post-GUI packages.
 		if ge != nil {
-			if installs, err = installsUnderKey(opts, conf, installKeyPostGUI, dir); err != nil {
+			if installs, err = installsUnderKey(opts, conf, installKeyPostGUI, dir, steps); err != nil {
 				return nil, err
 			}
-			out = append(out, installs...)
-			out = append(out, afterGUIUnits...)
+			ge = append(ge, installs...)
+			ge = append(ge, afterGUIUnits...)
 		}
+		out = append(out, UnitGroup{Name: "graphical", Units: ge})
 	}
 
+	var system []units.Unit
 	udev, err := udevConf(opts, conf)
 	if err != nil {
 		return nil, err
 	}
 	if udev != nil {
-		out = append(out, udev)
+		system = append(system, udev)
 	}
 	sysdNet, err := systemdNetConfig(opts, conf)
 	if err != nil {
 		return nil, err
 	}
 	if sysdNet != nil {
-		out = append(out, sysdNet)
+		system = append(system, sysdNet)
 	}
 
 	if doGraphicalInstaller {
-		out = append(out, &units.Installer{})
+		system = append(system, &units.Installer{})
 	}
 
 	optPkgs, err := optPackagesConfig(opts, conf)
@@ -144,10 +195,23 @@ func UnitsFromConfig(dir string, opts Options) ([]units.Unit, error) {
 		return nil, err
 	}
 	if optPkgs != nil {
-		out = append(out, optPkgs)
+		system = append(system, optPkgs)
 	}
-	out = append(out, finalUnits...)
-	return out, nil
+	out = append(out, UnitGroup{Name: "system", Units: system})
+
+	final := append([]units.Unit{}, finalUnits...)
+	img, err := imageConf(conf)
+	if err != nil {
+		return nil, err
+	}
+	final = append(final, bootloaderUnits(img)...)
+	if opts.SecureBoot {
+		final = append(final, secureBootUnits...)
+	}
+	if opts.Reproducible {
+		final = append(final, &units.Normalize{})
+	}
+	return append(out, UnitGroup{Name: "final", Units: final}), nil
 }
 
 func featuresAreSet(wantFeatures []string, tree *toml.Tree) (bool, error) {
@@ -155,28 +219,9 @@ func featuresAreSet(wantFeatures []string, tree *toml.Tree) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-
-	var f map[string]interface{}
-	if features := tree.Get("features"); features != nil {
-		switch ft := features.(type) {
-		case *toml.Tree:
-			f = ft.ToMap()
-		case map[string]interface{}:
-			f = ft
-		case []string:
-			f = make(map[string]interface{}, len(ft))
-			for _, v := range ft {
-				f[v] = true
-			}
-		}
-	}
-	if f == nil {
-		f = map[string]interface{}{}
-	}
-	for feature, v := range defaultFeatures {
-		if _, present := f[feature]; !present {
-			f[feature] = v
-		}
+	f, err := resolveFeatures(tree)
+	if err != nil {
+		return false, err
 	}
 
 	m := map[string]interface{}{
@@ -220,7 +265,7 @@ func evalCEL(env *cel.Env, expr string, m map[string]interface{}) (bool, error)
 	return v.(bool), nil
 }
 
-func baseUnitsFromConf(out []units.Unit, conf *toml.Tree) ([]units.Unit, error) {
+func baseUnitsFromConf(out []units.Unit, conf *toml.Tree, opts Options) ([]units.Unit, error) {
 	out = append(out, &units.Preflight{})
 	dbstrp, err := debootstrapConf(conf)
 	if err != nil {
@@ -240,6 +285,13 @@ func baseUnitsFromConf(out []units.Unit, conf *toml.Tree) ([]units.Unit, error)
 		return nil, err
 	}
 	out = append(out, linux)
+	modules, err := kernelModulesConf(conf, linux, opts)
+	if err != nil {
+		return nil, err
+	}
+	if modules != nil {
+		out = append(out, modules)
+	}
 
 	shellUnits, err := shellUserConf(conf)
 	if err != nil {
@@ -4,7 +4,11 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/twitchylinux/builder/conf/grub"
+	"github.com/twitchylinux/builder/oci"
+	"github.com/twitchylinux/builder/pack"
 	"github.com/twitchylinux/builder/units"
+	"github.com/twitchylinux/builder/verify"
 )
 
 func getUnit(t *testing.T, units []units.Unit, typ reflect.Type) units.Unit {
@@ -134,6 +138,7 @@ func TestLoadShellCustomization(t *testing.T) {
 				Username: "twl",
 				Password: "twl",
 				Groups:   []string{"yeet"},
+				Home:     "/home/twl",
 			},
 		},
 	}); !reflect.DeepEqual(got, want) {
@@ -176,6 +181,32 @@ func TestLoadPostInstall(t *testing.T) {
 	}
 }
 
+func TestInstallOrdering(t *testing.T) {
+	c, err := UnitsFromConfig("testdata/install_order", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, u := range getUnits(t, c, reflect.TypeOf(&units.InstallTools{})) {
+		got = append(got, u.(*units.InstallTools).UnitName)
+	}
+	if want := []string{"base", "toolchain", "tool", "docs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("install order = %v, want %v", got, want)
+	}
+
+	_, err = UnitsFromConfig("testdata/install_order", Options{
+		Overrides: map[string]interface{}{"features.extras": false},
+	})
+	if want := "invalid config: tool requires toolchain, which is skipped by its if condition"; err == nil || err.Error() != want {
+		t.Errorf("UnitsFromConfig() with toolchain skipped returned %v, want %q", err, want)
+	}
+
+	_, err = UnitsFromConfig("testdata/install_cycle", Options{})
+	if want := "invalid config: steps a, b are ordered after each other"; err == nil || err.Error() != want {
+		t.Errorf("UnitsFromConfig() with a cycle returned %v, want %q", err, want)
+	}
+}
+
 func TestLoadComposites(t *testing.T) {
 	c, err := UnitsFromConfig("testdata/composite", Options{})
 	if err != nil {
@@ -243,9 +274,8 @@ toolLoop:
 func TestStageConfOrdering(t *testing.T) {
 	c, err := UnitsFromConfig("../resources/stage-conf", Options{
 		Overrides: map[string]interface{}{
-			"features.essential":   false,
-			"features.graphical":   true,
-			"features.rootfs-only": false,
+			"features.essential": false,
+			"features.graphical": true,
 		},
 	})
 	if err != nil {
@@ -393,6 +423,7 @@ func TestOverrides(t *testing.T) {
 				Username: "yolo_swaggins",
 				Password: "twl",
 				Groups:   []string{"yeet"},
+				Home:     "/home/yolo_swaggins",
 			},
 		},
 	}); !reflect.DeepEqual(got, want) {
@@ -445,6 +476,119 @@ func TestConditional(t *testing.T) {
 	}
 }
 
+func TestExplain(t *testing.T) {
+	explanations, err := Explain("testdata/conditional", Options{
+		Overrides: map[string]interface{}{
+			"some.value.set":     true,
+			"some.value.not_set": false,
+			"features.yeet":      true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byKey := map[string]Explanation{}
+	for _, e := range explanations {
+		byKey[e.Key] = e
+	}
+	if got, want := len(explanations), 10; got != want {
+		t.Errorf("len(explanations) = %d, want %d", got, want)
+	}
+	for key, want := range map[string]bool{
+		"post_base.install.any-exist":      true,
+		"post_base.install.any-not-exist":  false,
+		"post_base.install.all-some-false": false,
+		"post_base.install.composite":      true,
+	} {
+		if got := byKey[key].Included; got != want {
+			t.Errorf("%s: Included = %v, want %v", key, got, want)
+		}
+	}
+
+	if got, want := byKey["post_base.install.all-some-false"].Results, []ExprResult{
+		{Clause: "if.all[0]", Expr: "has(features.nope)", Features: map[string]interface{}{"nope": nil}},
+		{Clause: "if.all[1]", Expr: "false", Features: map[string]interface{}{}},
+		{Clause: "if.all[2]", Expr: "true", Value: true, Features: map[string]interface{}{}},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Results = %+v, want %+v", got, want)
+	}
+	if got, want := byKey["post_base.install.all-true"].Results[3].Features, map[string]interface{}{"yeet": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Features = %v, want %v", got, want)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	features, err := Features("testdata/features", Options{
+		Edits: []Edit{{Key: "features.compilers", Op: EditSet, Value: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{}
+	for _, f := range features {
+		values[f.Name] = f.Value
+	}
+	if want := map[string]interface{}{
+		"compilers":             true,
+		"graphical":             false,
+		"graphical_environment": "gnome",
+		"tiny":                  false,
+		"tools":                 true,
+	}; !reflect.DeepEqual(values, want) {
+		t.Errorf("features = %v, want %v", values, want)
+	}
+
+	// Defaults apply to conditions, and graphical is declared off.
+	groups, err := UnitGroups("testdata/features", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, g := range groups {
+		for _, u := range g.Units {
+			if it, ok := u.(*units.InstallTools); ok {
+				names = append(names, it.UnitName)
+			}
+		}
+	}
+	if want := []string{"docs"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("install steps = %v, want %v", names, want)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		edits []string
+		want  string
+	}{
+		{"unknown", []string{"features.tool=true"}, "-D: features.tool: unknown feature, did you mean tools?"},
+		{"type", []string{"features.tiny=yes"}, "-D: features.tiny: expected a bool, got a string"},
+		{"implies", []string{"features.compilers=true", "features.tools=false"}, "-D: features.tools: implied by compilers, but disabled"},
+		{"conflicts", []string{"features.tiny=true", "features.tools=true"}, "-D: features.tiny: conflicts with tools, which is enabled"},
+		{"implied conflict", []string{"features.tiny=true", "features.compilers=true"}, "-D: features.tiny: conflicts with tools, which is enabled"},
+		{"default", []string{"feature_defs.tiny.default=1"}, "-D: feature_defs.tiny.default: expected a bool, got an integer"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts Options
+			for _, s := range tc.edits {
+				e, err := ParseEdit(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts.Edits = append(opts.Edits, e)
+			}
+			_, err := LoadConfig("testdata/features", opts)
+			problems, ok := err.(Problems)
+			if !ok || len(problems) != 1 {
+				t.Fatalf("LoadConfig() = %v, want one problem", err)
+			}
+			if got := problems[0].String(); got != tc.want {
+				t.Errorf("problem = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestSystemdNetworkDHCP(t *testing.T) {
 	c, err := UnitsFromConfig("testdata/sysd-network", Options{
 		Overrides: map[string]interface{}{
@@ -546,3 +690,427 @@ func TestOptionalPackages(t *testing.T) {
 		}
 	}
 }
+
+func TestPackageCheck(t *testing.T) {
+	c, err := UnitsFromConfig("testdata/post_base_install", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c[1].(*units.CheckPackages); !ok {
+		t.Errorf("c[1] = %T, want *units.CheckPackages", c[1])
+	}
+	check := getUnit(t, c, reflect.TypeOf(&units.CheckPackages{})).(*units.CheckPackages)
+	if got, want := check.Track, debootstrapDefault.Track; got != want {
+		t.Errorf("check.Track = %q, want %q", got, want)
+	}
+	for unit, want := range map[string][]string{
+		"cli":   {"screen", "htop"},
+		"med":   {"med"},
+		"last":  {"last"},
+		"gnome": {"gnome"},
+	} {
+		if got := check.Pkgs[unit]; !reflect.DeepEqual(got, want) {
+			t.Errorf("check.Pkgs[%q] = %v, want %v", unit, got, want)
+		}
+	}
+}
+
+func TestLinuxConfigFragment(t *testing.T) {
+	c, err := UnitsFromConfig("testdata/linux_config", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linux := getUnit(t, c, reflect.TypeOf(&units.Linux{})).(*units.Linux)
+	if got, want := linux.Config, map[string]string{
+		"CONFIG_USB_SERIAL":   "m",
+		"CONFIG_VIDEO_DEV":    "y",
+		"CONFIG_DEBUG_INFO":   "n",
+		"CONFIG_LOCALVERSION": "\"-twl\"",
+		"CONFIG_NR_CPUS":      "64",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("linux.Config = %v, want %v", got, want)
+	}
+}
+
+func TestKernelModules(t *testing.T) {
+	c, err := UnitsFromConfig("testdata/kernel_modules", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linux := getUnit(t, c, reflect.TypeOf(&units.Linux{})).(*units.Linux)
+	km := getUnit(t, c, reflect.TypeOf(&units.KernelModules{})).(*units.KernelModules)
+	if got, want := km, (&units.KernelModules{
+		Kernel: linux,
+		Modules: []units.KernelModule{
+			{
+				Name:      "rtl8812au",
+				URL:       "https://example.com/rtl8812au.tar.gz",
+				SHA256:    "0123",
+				MakeArgs:  []string{"CONFIG_PLATFORM_I386_PC=y"},
+				BuildPkgs: []string{"bc"},
+			},
+			{Name: "v4l2loopback", Git: "https://github.com/umlaeute/v4l2loopback", Ref: "v0.12.5"},
+			{Name: "wireguard", DKMS: "wireguard-dkms"},
+		},
+	}); !reflect.DeepEqual(got, want) {
+		t.Errorf("KernelModules = %+v, want %+v", got, want)
+	}
+
+	var linuxIdx, modIdx int
+	for i, u := range c {
+		switch u.(type) {
+		case *units.Linux:
+			linuxIdx = i
+		case *units.KernelModules:
+			modIdx = i
+		}
+	}
+	if modIdx != linuxIdx+1 {
+		t.Errorf("KernelModules at index %d, want directly after Linux (%d)", modIdx, linuxIdx)
+	}
+
+	c, err = UnitsFromConfig("testdata/kernel_modules", Options{Overrides: map[string]interface{}{"features.av": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	km = getUnit(t, c, reflect.TypeOf(&units.KernelModules{})).(*units.KernelModules)
+	if got, want := km.Modules[0], (units.KernelModule{Name: "akvcam", Git: "https://github.com/webcamoid/akvcam", Ref: "1.2.0"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("KernelModules.Modules[0] = %+v, want %+v", got, want)
+	}
+}
+
+func TestImageConfig(t *testing.T) {
+	c, err := ImageConfig("testdata/image", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := pack.DefaultConfig()
+	want.PartitionTable = pack.TableGPT
+	want.RootSizeMB = 8192
+	want.Exclude = []string{"deb-pkgs"}
+	want.Autologin = &pack.AutologinConfig{User: "twl", Command: "sway"}
+	want.ISO.VolumeID = "TWL_TEST"
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("ImageConfig() = %+v, want %+v", c, want)
+	}
+
+	if _, err := ImageConfig("testdata/image", Options{Overrides: map[string]interface{}{"image.partition_table": "apm"}}); err == nil {
+		t.Error("ImageConfig() accepted an invalid partition table")
+	}
+
+	c, err = ImageConfig("testdata/image", Options{Overrides: map[string]interface{}{"image.encryption.key_file": "/root/key"}})
+	if err != nil {
+		t.Fatalf("ImageConfig() with encryption failed: %v", err)
+	}
+	if c.Encryption == nil || c.Encryption.KeyFile != "/root/key" {
+		t.Errorf("Encryption = %+v, want key file /root/key", c.Encryption)
+	}
+
+	c, err = ImageConfig("../resources/stage-conf", Options{})
+	if err != nil {
+		t.Fatalf("ImageConfig(resources) failed: %v", err)
+	}
+	if c.Autologin == nil || c.Autologin.User != "twl" {
+		t.Errorf("Autologin = %+v, want the main user", c.Autologin)
+	}
+}
+
+func TestBootloaderUnits(t *testing.T) {
+	c, err := UnitsFromConfig("../resources/stage-conf", Options{Overrides: map[string]interface{}{
+		"image.firmware": "hybrid",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grub := getUnit(t, c, reflect.TypeOf(&units.Grub2{})).(*units.Grub2)
+	if grub.Firmware != units.GrubHybrid {
+		t.Errorf("grub.Firmware = %q, want %q", grub.Firmware, units.GrubHybrid)
+	}
+	if grub.Config.DistroName != "TwitchyLinux" {
+		t.Errorf("grub.Config.DistroName = %q, want %q", grub.Config.DistroName, "TwitchyLinux")
+	}
+
+	img := pack.DefaultConfig()
+	img.Firmware, img.Bootloader = pack.FirmwareUEFI, pack.BootloaderSystemdBoot
+	if u := bootloaderUnits(img); len(u) != 0 {
+		t.Errorf("bootloaderUnits(systemd-boot) = %v, want none", u)
+	}
+}
+
+func TestBootloaderConf(t *testing.T) {
+	c, err := ImageConfig("testdata/bootloader", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := grub.DefaultConfig()
+	want.DistroName = "TwitchyTest"
+	want.Timeout = 3
+	want.Default = "TwitchyTest"
+	want.Cmdline = "quiet splash"
+	want.Background = "/usr/share/images/grub/bg.png"
+	want.ColorNormal = "light-gray/black"
+	want.Entries = []grub.Entry{
+		{Title: "Memory test", Linux: "/memtest86+.bin"},
+		{Title: "Firmware setup", Commands: []string{"fwsetup"}, EFIOnly: true},
+	}
+	if !reflect.DeepEqual(c.Menu, want) {
+		t.Errorf("Menu = %+v, want %+v", c.Menu, want)
+	}
+
+	if _, err := ImageConfig("testdata/bootloader", Options{Overrides: map[string]interface{}{"bootloader.color_normal": "plaid/black"}}); err == nil {
+		t.Error("ImageConfig() accepted an invalid color")
+	}
+}
+
+func TestSecureBootUnits(t *testing.T) {
+	c, err := UnitsFromConfig("../resources/stage-conf", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range c {
+		if _, ok := u.(*units.SecureBootSign); ok {
+			t.Error("SecureBootSign unit present without SecureBoot set")
+		}
+	}
+
+	if c, err = UnitsFromConfig("../resources/stage-conf", Options{SecureBoot: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c) < 2 {
+		t.Fatalf("got %d units, want at least 2", len(c))
+	}
+	if _, ok := c[len(c)-2].(*units.SecureBootSign); !ok {
+		t.Errorf("second to last unit = %T, want *units.SecureBootSign", c[len(c)-2])
+	}
+	if _, ok := c[len(c)-1].(*units.SecureBootVerify); !ok {
+		t.Errorf("last unit = %T, want *units.SecureBootVerify", c[len(c)-1])
+	}
+}
+
+func TestReproducibleUnits(t *testing.T) {
+	opts := Options{Reproducible: true, SecureBoot: true}
+	c, err := UnitsFromConfig("../resources/stage-conf", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c[len(c)-1].(*units.Normalize); !ok {
+		t.Errorf("last unit = %T, want *units.Normalize", c[len(c)-1])
+	}
+
+	// Units from maps in the config are always generated in order.
+	for i := 0; i < 5; i++ {
+		again, err := UnitsFromConfig("../resources/stage-conf", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c, again) {
+			t.Fatal("UnitsFromConfig() returned units in a different order")
+		}
+	}
+}
+
+func TestVerifyConfig(t *testing.T) {
+	c, err := VerifyConfig("../resources/stage-conf", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.WaitFor != verify.WaitLogin || c.User != "twl" || c.Password != "twl" {
+		t.Errorf("VerifyConfig() = %+v, want a login as the main user", c)
+	}
+	if len(c.Checks) == 0 {
+		t.Error("VerifyConfig() has no checks")
+	}
+
+	c, err = VerifyConfig("../resources/stage-conf", Options{Overrides: map[string]interface{}{"features.boot_test": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.WaitFor != verify.WaitMarker {
+		t.Errorf("WaitFor = %q with features.boot_test, want %q", c.WaitFor, verify.WaitMarker)
+	}
+}
+
+func TestOCIConfig(t *testing.T) {
+	c, err := OCIConfig("testdata/oci", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := oci.DefaultConfig()
+	want.Tag = "ci"
+	want.Entrypoint = []string{"/bin/bash", "-lc"}
+	want.Env = []string{"LANG=C.UTF-8"}
+	want.LayerPerGroup = true
+	want.Labels = map[string]string{
+		"org.opencontainers.image.title":  "TwitchyLinux (test)",
+		"org.opencontainers.image.vendor": "Twitchy CI",
+		"org.opencontainers.image.url":    "https://github.com/TwitchyLinux",
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("OCIConfig() = %+v, want %+v", c, want)
+	}
+
+	if _, err := OCIConfig("testdata/oci", Options{Overrides: map[string]interface{}{"oci.tag": "a/b"}}); err == nil {
+		t.Error("OCIConfig() accepted an invalid tag")
+	}
+	if _, err := OCIConfig("../resources/stage-conf", Options{}); err != nil {
+		t.Errorf("OCIConfig(resources) failed: %v", err)
+	}
+}
+
+func TestUnitGroups(t *testing.T) {
+	groups, err := UnitGroups("../resources/stage-conf", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		names []string
+		all   []units.Unit
+	)
+	for _, g := range groups {
+		names = append(names, g.Name)
+		all = append(all, g.Units...)
+	}
+	if want := []string{"base", "packages", "graphical", "system", "final"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("groups = %v, want %v", names, want)
+	}
+
+	uts, err := UnitsFromConfig("../resources/stage-conf", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The package check is the only unit not in a group.
+	if len(uts) != len(all)+1 {
+		t.Errorf("UnitsFromConfig() has %d units, groups have %d", len(uts), len(all))
+	}
+}
+
+func TestLint(t *testing.T) {
+	err := Lint("testdata/lint", Options{})
+	problems, ok := err.(Problems)
+	if !ok {
+		t.Fatalf("Lint() = %v, want Problems", err)
+	}
+	want := []string{
+		"testdata/lint/a.toml:5:1: base.locale.generate: unknown key, expected one of area, default, generate_locales, zone",
+		"testdata/lint/a.toml:7:1: post_base.install.cli.do.arg: unknown key, did you mean args?",
+		"testdata/lint/a.toml:8:1: post_base.install.cli.order_prority: unknown key, did you mean order_priority?",
+		"testdata/lint/a.toml:9:1: post_base.install.cli.packages: expected an array, got a string",
+		"testdata/lint/a.toml:10:1: post_base.install.cli.if.anny: unknown key, did you mean any?",
+		"testdata/lint/b.toml:2:1: features.graphical is already set at testdata/lint/a.toml:2:1",
+		"testdata/lint/b.toml:5:1: image.root_size_mb: expected an integer, got a string",
+		"testdata/lint/b.toml:7:1: unknown section mystery",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Lint() returned %d problems, want %d:\n%v", len(problems), len(want), problems)
+	}
+	for i := range want {
+		if got := problems[i].String(); got != want[i] {
+			t.Errorf("problems[%d] = %q, want %q", i, got, want[i])
+		}
+	}
+
+	if err := Lint("../resources/stage-conf", Options{}); err != nil {
+		t.Errorf("Lint(resources) failed: %v", err)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	sources, err := Sources("testdata/layers", Options{
+		Profiles:  []string{"dev"},
+		Overrides: map[string]interface{}{"base.main_user.default_password": "hunter2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Source{
+		{Key: "base.main_user.default_password", Value: "hunter2", File: "-D"},
+		{Key: "base.main_user.groups", Value: []interface{}{"sudo", "video"}, File: "testdata/layers/profiles/common.toml", Line: 3, Col: 1},
+		{Key: "base.main_user.name", Value: "dev", File: "testdata/layers/profiles/dev.toml", Line: 4, Col: 1},
+	}
+	if !reflect.DeepEqual(sources, want) {
+		t.Errorf("Sources() = %+v, want %+v", sources, want)
+	}
+
+	for _, tc := range []struct {
+		profile, wantErr string
+	}{
+		{"kiosk", `unknown profile "kiosk", want one of: common, dev, loop`},
+		{"loop", "testdata/layers/profiles/loop.toml: include cycle: testdata/layers/profiles/loop.toml -> testdata/layers/profiles/loop.toml"},
+	} {
+		if _, err := Sources("testdata/layers", Options{Profiles: []string{tc.profile}}); err == nil || err.Error() != tc.wantErr {
+			t.Errorf("Sources() with profile %s returned %v, want %q", tc.profile, err, tc.wantErr)
+		}
+	}
+
+	for _, p := range []string{"minimal", "kiosk"} {
+		if err := Lint("../resources/stage-conf", Options{Profiles: []string{p}}); err != nil {
+			t.Errorf("Lint() with profile %s failed: %v", p, err)
+		}
+	}
+}
+
+func TestEdits(t *testing.T) {
+	var edits []Edit
+	for _, s := range []string{
+		"base.main_user.groups+=video",
+		`base.main_user.groups+=["kvm", "audio"]`,
+		"base.main_user.groups-=sudo",
+		"base.main_user.name=5.10",
+		"base.release_info.url=https://example.com",
+		"image.root_size_mb=4096",
+		`image.encryption={key_file = "/root/key"}`,
+	} {
+		e, err := ParseEdit(s)
+		if err != nil {
+			t.Fatalf("ParseEdit(%q) failed: %v", s, err)
+		}
+		edits = append(edits, e)
+	}
+	sources, err := Sources("testdata/layers", Options{
+		Edits:         edits,
+		OverrideFiles: []string{"testdata/layers_override/release.toml"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	for _, s := range sources {
+		got[s.Key] = s.Value
+	}
+	want := map[string]interface{}{
+		"base.main_user.default_password": "twl",
+		"base.main_user.groups":           []interface{}{"video", "kvm", "audio"},
+		"base.main_user.name":             "5.10",
+		"base.release_info.name":          "Kiosk",
+		"base.release_info.url":           "https://example.com",
+		"image.root_size_mb":              int64(4096),
+		"image.encryption.key_file":       "/root/key",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Sources() = %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		edit, wantErr string
+	}{
+		{"image.root_size_mb=big", "invalid config:\n-D: image.root_size_mb: expected an integer, got a string"},
+		{"base.main_user.nmae=x", "invalid config:\n-D: base.main_user.nmae: unknown key, did you mean name?"},
+		{"base.main_user.name+=x", "invalid config:\n-D: base.main_user.name: += only applies to lists"},
+		{"nope.x=1", "invalid config:\n-D: unknown section nope.x"},
+	} {
+		e, err := ParseEdit(tc.edit)
+		if err != nil {
+			t.Fatalf("ParseEdit(%q) failed: %v", tc.edit, err)
+		}
+		if _, err := Sources("testdata/layers", Options{Edits: []Edit{e}}); err == nil || err.Error() != tc.wantErr {
+			t.Errorf("Sources() with %s returned %v, want %q", tc.edit, err, tc.wantErr)
+		}
+	}
+	if _, err := ParseEdit("=x"); err == nil {
+		t.Error("ParseEdit() accepted an edit without a key")
+	}
+}
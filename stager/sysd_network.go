@@ -43,7 +43,8 @@ func systemdNetConfig(opts Options, tree *toml.Tree) (*units.Composite, error) {
 	}
 
 	var outFiles []units.FileInfo
-	for name, ruleSet := range conf {
+	for _, name := range sortedKeys(conf) {
+		ruleSet := conf[name]
 		skip, err := ruleSet.If.ShouldSkip(tree, opts)
 		if err != nil {
 			return nil, err
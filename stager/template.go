@@ -0,0 +1,166 @@
+package stager
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/pelletier/go-toml"
+)
+
+// unameMachines maps Debian architectures to the machine names reported
+// by uname, which many downloads are named by.
+var unameMachines = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+	"i386":  "i686",
+}
+
+// expander expands the templates in the fields of install actions. Values
+// are Go templates, executed with the merged config as their data, so
+// {{.base.linux.version}} is the kernel version. Features under .features
+// are resolved, with defaults and implied features applied. Host facts are
+// under .host, and the functions are:
+//
+//	join   joins path elements, as in {{join home ".config"}}.
+//	home   returns the home directory of the main user, or of the named
+//	       user, which must be the main user or root. The home of the
+//	       main user is base.main_user.home, or else /home/<name>.
+//	arch   returns the Debian architecture of the built system.
+type expander struct {
+	tree  *toml.Tree
+	data  map[string]interface{}
+	funcs template.FuncMap
+}
+
+func newExpander(tree *toml.Tree) (*expander, error) {
+	features, err := resolveFeatures(tree)
+	if err != nil {
+		return nil, err
+	}
+	x := &expander{tree: tree, data: tree.ToMap()}
+	x.data[rootKeyFeatures] = features
+	x.data["host"] = map[string]interface{}{
+		"arch":    aptArch,
+		"machine": unameMachines[aptArch],
+		"cpus":    runtime.NumCPU(),
+	}
+	x.funcs = template.FuncMap{
+		"join": path.Join,
+		"home": x.home,
+		"arch": func() string { return aptArch },
+	}
+	return x, nil
+}
+
+// home returns the home directory of a configured user, the main user if
+// no user is named.
+func (x *expander) home(user ...string) (string, error) {
+	var mainUser MainUserConf
+	if t, ok := x.tree.Get(keyMainUser).(*toml.Tree); ok {
+		if err := t.Unmarshal(&mainUser); err != nil {
+			return "", err
+		}
+	}
+	var name string
+	switch len(user) {
+	case 0:
+		if mainUser.Name == "" {
+			return "", fmt.Errorf("%s.name is not set", keyMainUser)
+		}
+		name = mainUser.Name
+	case 1:
+		name = user[0]
+	default:
+		return "", fmt.Errorf("home takes at most one user, got %d", len(user))
+	}
+
+	switch name {
+	case "root":
+		return "/root", nil
+	case mainUser.Name:
+		return mainUser.home(), nil
+	}
+	return "", fmt.Errorf("%q is not a configured user", name)
+}
+
+// expand returns s with its templates expanded.
+func (x *expander) expand(s string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	t, err := template.New("").Funcs(x.funcs).Option("missingkey=error").Parse(s)
+	if err != nil {
+		// Values used to be a single expression of config keys and quoted
+		// strings joined by +, such as {{base.linux.version}}, which are
+		// not valid templates.
+		if strings.HasPrefix(s, "{{") && strings.HasSuffix(s, "}}") && len(s) > 4 {
+			if out, lErr := evalStringSection(s[2:len(s)-2], x.tree); lErr == nil {
+				return out, nil
+			}
+		}
+		return "", err
+	}
+	var out strings.Builder
+	if err := t.Execute(&out, x.data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// expandConfig returns a copy of the config of an action, a pointer to a
+// struct, with the templates in each string field expanded.
+func (x *expander) expandConfig(config interface{}) (interface{}, error) {
+	in := reflect.ValueOf(config).Elem()
+	out := reflect.New(in.Type())
+	v := out.Elem()
+	v.Set(in)
+	for i := 0; i < v.NumField(); i++ {
+		f, sf := v.Field(i), v.Type().Field(i)
+		name := strings.Split(sf.Tag.Get("toml"), ",")[0]
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		switch f.Interface().(type) {
+		case string:
+			s, err := x.expand(f.String())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetString(s)
+		case []string:
+			in := f.Interface().([]string)
+			if in == nil {
+				continue
+			}
+			out := make([]string, len(in))
+			for j := range in {
+				s, err := x.expand(in[j])
+				if err != nil {
+					return nil, fmt.Errorf("%s[%d]: %v", name, j, err)
+				}
+				out[j] = s
+			}
+			f.Set(reflect.ValueOf(out))
+		case map[string]string:
+			in := f.Interface().(map[string]string)
+			if in == nil {
+				continue
+			}
+			out := make(map[string]string, len(in))
+			for _, k := range sortedKeys(in) {
+				s, err := x.expand(in[k])
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %v", name, k, err)
+				}
+				out[k] = s
+			}
+			f.Set(reflect.ValueOf(out))
+		}
+	}
+	return out.Interface(), nil
+}
@@ -87,7 +87,8 @@ func udevConf(opts Options, tree *toml.Tree) (*units.InstallFiles, error) {
 		outFiles []units.FileInfo
 		i        int
 	)
-	for name, ruleSet := range conf {
+	for _, name := range sortedKeys(conf) {
+		ruleSet := conf[name]
 		skip, err := ruleSet.If.ShouldSkip(tree, opts)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,53 @@
+package stager
+
+import (
+	"fmt"
+
+	"github.com/pelletier/go-toml"
+	"github.com/twitchylinux/builder/verify"
+)
+
+// VerifyConfig returns the configuration used to boot and check images,
+// described by the config in the directory provided.
+func VerifyConfig(dir string, opts Options) (verify.Config, error) {
+	conf, err := loadConfig(dir, opts)
+	if err != nil {
+		return verify.Config{}, err
+	}
+	return verifyConf(conf)
+}
+
+func verifyConf(tree *toml.Tree) (verify.Config, error) {
+	out := verify.DefaultConfig()
+	// Systems with the boot test hooks announce themselves, and need no
+	// password.
+	bootTest, err := featuresAreSet([]string{"boot_test"}, tree)
+	if err != nil {
+		return verify.Config{}, err
+	}
+	if bootTest {
+		out.WaitFor = verify.WaitMarker
+	}
+
+	if t := tree.Get(keyVerifyBoot); t != nil {
+		vt, ok := t.(*toml.Tree)
+		if !ok {
+			return verify.Config{}, fmt.Errorf("invalid config: %s is not a structure (got %T)", keyVerifyBoot, t)
+		}
+		if err := vt.Unmarshal(&out); err != nil {
+			return verify.Config{}, err
+		}
+	}
+
+	// Log in as the main user unless told otherwise.
+	if out.WaitFor == verify.WaitLogin && out.User == "" {
+		if name, ok := tree.Get(keyMainUser + ".name").(string); ok {
+			out.User = name
+			out.Password, _ = tree.Get(keyMainUser + ".default_password").(string)
+		}
+	}
+	if err := out.Validate(); err != nil {
+		return verify.Config{}, fmt.Errorf("invalid config: %s: %v", keyVerifyBoot, err)
+	}
+	return out, nil
+}
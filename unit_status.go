@@ -9,7 +9,7 @@ import (
 	"github.com/twitchylinux/builder/units"
 )
 
-const statusDir = "build-status"
+const statusDir = units.StatusDir
 
 type unitStatus string
 
@@ -0,0 +1,63 @@
+package units
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ManifestPath is the path within the built system at which the build
+// manifest is written.
+const ManifestPath = "/usr/share/twitchylinux/build-manifest.json"
+
+// Manifest records details of how the system was built.
+type Manifest struct {
+	Version string         `json:"version,omitempty"`
+	Linux   *LinuxManifest `json:"linux,omitempty"`
+}
+
+// LinuxManifest describes the kernel built into the system.
+type LinuxManifest struct {
+	Version string   `json:"version"`
+	Patches []string `json:"patches"`
+	// Modules lists the out-of-tree modules built for the kernel.
+	Modules []string `json:"modules,omitempty"`
+}
+
+// ReadManifest reads the build manifest of the system at dir. An empty
+// manifest is returned if none has been written yet.
+func ReadManifest(dir string) (*Manifest, error) {
+	d, err := ioutil.ReadFile(filepath.Join(dir, ManifestPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Manifest{}, nil
+		}
+		return nil, err
+	}
+	var out Manifest
+	if err := json.Unmarshal(d, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateManifest applies the given function to the build manifest of the
+// system being built, writing the result.
+func UpdateManifest(opts Opts, update func(m *Manifest)) error {
+	m, err := ReadManifest(opts.Dir)
+	if err != nil {
+		return err
+	}
+	m.Version = opts.Version
+	update(m)
+
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(opts.Dir, filepath.Dir(ManifestPath)), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(opts.Dir, ManifestPath), append(d, '\n'), 0644)
+}
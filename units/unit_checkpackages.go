@@ -0,0 +1,143 @@
+package units
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/twitchylinux/builder/conf/apt"
+)
+
+// CheckPackages validates that every package named in the build exists in
+// the package indexes of the configured suite, before anything is installed.
+// Indexes are fetched through the deb proxy, if one is configured.
+type CheckPackages struct {
+	Track      string
+	URL        string
+	Components []string
+	Arch       string
+
+	// Pkgs maps the name of each unit to the packages it installs.
+	Pkgs map[string][]string
+}
+
+// Name implements Unit.
+func (c *CheckPackages) Name() string {
+	return "Check-packages"
+}
+
+// Run implements Unit.
+func (c *CheckPackages) Run(ctx context.Context, opts Opts) error {
+	if opts.SkipPackageCheck {
+		fmt.Fprintln(opts.L.Stdout(), "Skipping the check of package names.")
+		return nil
+	}
+	idx := apt.NewIndex()
+	if opts.AptListsDir != "" {
+		if err := c.readIndexes(idx, opts.AptListsDir); err != nil {
+			return err
+		}
+	} else {
+		for _, component := range c.Components {
+			opts.L.SetSubstage("Fetching " + component + " index")
+			if err := c.fetchIndex(ctx, &opts, idx, component); err != nil {
+				return fmt.Errorf("fetching %s index: %v", component, err)
+			}
+		}
+	}
+	if idx.NumPackages() == 0 {
+		return fmt.Errorf("no packages found in indexes for %s", c.Track)
+	}
+
+	opts.L.SetSubstage("Checking package names")
+	var unitNames []string
+	for name := range c.Pkgs {
+		unitNames = append(unitNames, name)
+	}
+	sort.Strings(unitNames)
+
+	var problems []string
+	for _, name := range unitNames {
+		for _, pkg := range c.Pkgs[name] {
+			if idx.Contains(pkg) {
+				continue
+			}
+			msg := fmt.Sprintf("  %s: unknown package %q", name, pkg)
+			if suggestions := idx.Suggest(pkg, 3); len(suggestions) > 0 {
+				msg += fmt.Sprintf(" (did you mean %s?)", strings.Join(suggestions, ", "))
+			}
+			problems = append(problems, msg)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d package(s) not found in %s:\n%s", len(problems), c.Track, strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func (c *CheckPackages) indexURL(component string) string {
+	return strings.TrimSuffix(c.URL, "/") + "/dists/" + c.Track + "/" + component + "/binary-" + c.Arch + "/Packages.gz"
+}
+
+func (c *CheckPackages) fetchIndex(ctx context.Context, opts *Opts, idx *apt.Index, component string) error {
+	client := http.DefaultClient
+	if opts.DebProxy != "" {
+		proxy, err := url.Parse("http://" + opts.DebProxy)
+		if err != nil {
+			return err
+		}
+		client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+	}
+
+	req, err := http.NewRequest("GET", c.indexURL(component), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+	}
+
+	r, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return idx.ParseIndex(r)
+}
+
+// readIndexes populates the index from a directory of uncompressed Packages
+// files, such as /var/lib/apt/lists.
+func (c *CheckPackages) readIndexes(idx *apt.Index, dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), "_Packages") {
+			continue
+		}
+		fd, err := os.Open(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		err = idx.ParseIndex(fd)
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name(), err)
+		}
+	}
+	return nil
+}
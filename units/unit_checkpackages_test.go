@@ -0,0 +1,34 @@
+package units
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPackages(t *testing.T) {
+	lists, err := ioutil.TempDir("", "apt-lists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(lists)
+	if err := ioutil.WriteFile(filepath.Join(lists, "deb.debian.org_debian_dists_buster_main_binary-amd64_Packages"), []byte("Package: vim\n\nPackage: git\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &CheckPackages{Track: "buster", Pkgs: map[string][]string{"tools": {"vim", "gti"}}}
+	l := &testLogger{}
+	err = c.Run(context.Background(), Opts{AptListsDir: lists, L: l})
+	if want := "1 package(s) not found in buster:\n  tools: unknown package \"gti\" (did you mean git?)"; err == nil || err.Error() != want {
+		t.Errorf("Run() returned %v, want %q", err, want)
+	}
+	if l.stderr.Len() > 0 {
+		t.Errorf("Run() wrote the problems to stderr as well as returning them: %q", l.stderr.String())
+	}
+
+	if err := c.Run(context.Background(), Opts{SkipPackageCheck: true, L: &testLogger{}}); err != nil {
+		t.Errorf("Run() with the check skipped failed: %v", err)
+	}
+}
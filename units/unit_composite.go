@@ -38,6 +38,7 @@ func (c *Cmd) Run(ctx context.Context, opts Opts) error {
 			env = append(env, fmt.Sprintf("%s=%s", k, v))
 		}
 		cmd.Env = env
+		opts.setEpoch(cmd)
 	}
 	cmd.Stdout = opts.L.Stdout()
 	cmd.Stderr = opts.L.Stderr()
@@ -119,6 +120,12 @@ func (c *Append) Run(ctx context.Context, opts Opts) error {
 type Download struct {
 	URL string
 	To  string
+
+	// SHA256, SignatureURL and Keyring optionally describe how the
+	// downloaded file should be verified. See VerifyDownload.
+	SHA256       string
+	SignatureURL string
+	Keyring      string
 }
 
 // Name implements Unit.
@@ -128,7 +135,19 @@ func (d *Download) Name() string {
 
 // Run implements Unit.
 func (d *Download) Run(ctx context.Context, opts Opts) error {
-	return DownloadFile(ctx, &opts, d.URL, filepath.Join(opts.Dir, d.To))
+	p := filepath.Join(opts.Dir, d.To)
+	if err := DownloadFile(ctx, &opts, d.URL, p); err != nil {
+		return err
+	}
+	if d.SHA256 == "" && d.SignatureURL == "" {
+		return nil
+	}
+	return VerifyDownload(ctx, &opts, VerifySpec{
+		URL:          d.URL,
+		SHA256:       d.SHA256,
+		SignatureURL: d.SignatureURL,
+		Keyring:      d.Keyring,
+	}, p)
 }
 
 // EnableUnit enables a systemd unit.
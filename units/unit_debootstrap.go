@@ -20,6 +20,7 @@ func (d *Debootstrap) Name() string {
 // Run implements Unit.
 func (d *Debootstrap) Run(ctx context.Context, opts Opts) error {
 	dbstrp := exec.CommandContext(ctx, "debootstrap")
+	opts.setEpoch(dbstrp)
 	if opts.DebProxy != "" {
 		dbstrp.Env = append(dbstrp.Env, "http_proxy=http://"+opts.DebProxy)
 	}
@@ -0,0 +1,635 @@
+package units
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/twitchylinux/builder/conf/user"
+	"github.com/ulikunitz/xz"
+)
+
+// maxSymlinks bounds the symlinks followed when resolving a path in the
+// system, as the kernel does.
+const maxSymlinks = 40
+
+// zipUnixExtra is the tag of the Info-ZIP extra field holding the owner of
+// an entry.
+const zipUnixExtra = 0x7875
+
+// targetPath returns the host path of the path p in the system built in
+// root. Symlinks are followed as they would be in a chroot of root, so
+// the result never leaves it. If followLast is false, the last element of
+// p is not followed if it is a symlink. Paths which name a parent of the
+// root with .. are an error.
+func targetPath(root, p string, followLast bool) (string, error) {
+	if p == "" {
+		return "", fmt.Errorf("no path given")
+	}
+	depth := 0
+	for _, elem := range strings.Split(p, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return "", fmt.Errorf("%s escapes the build directory", p)
+			}
+		default:
+			depth++
+		}
+	}
+
+	var (
+		resolved = "/"
+		rest     = strings.Split(p, "/")
+		links    int
+	)
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		if len(rest) == 0 && !followLast {
+			resolved = next
+			break
+		}
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// unixMode converts a Unix file mode, such as 04755, to an os.FileMode.
+func unixMode(m uint32) os.FileMode {
+	out := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		out |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		out |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		out |= os.ModeSticky
+	}
+	return out
+}
+
+// Extract unpacks an archive in the system into a directory of the system.
+// Entries keep the owner recorded in the archive when building as root.
+type Extract struct {
+	From string
+	To   string
+	// Format is one of tar.gz, tar.xz or zip. If empty, it is picked by the
+	// extension of From.
+	Format string
+	// StripComponents removes that many leading elements from the paths of
+	// the archive, skipping entries with no elements left, as tar does.
+	StripComponents int
+}
+
+// Name implements Unit.
+func (c *Extract) Name() string {
+	return "extract " + filepath.Base(c.From)
+}
+
+func (c *Extract) format() (string, error) {
+	if c.Format != "" {
+		return c.Format, nil
+	}
+	for suffix, f := range map[string]string{
+		".tar.gz": "tar.gz",
+		".tgz":    "tar.gz",
+		".tar.xz": "tar.xz",
+		".txz":    "tar.xz",
+		".zip":    "zip",
+	} {
+		if strings.HasSuffix(c.From, suffix) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("%s: unknown archive format, want tar.gz, tar.xz or zip", c.From)
+}
+
+// Run implements Unit.
+func (c *Extract) Run(ctx context.Context, opts Opts) error {
+	format, err := c.format()
+	if err != nil {
+		return err
+	}
+	src, err := targetPath(opts.Dir, c.From, true)
+	if err != nil {
+		return err
+	}
+	dest, err := targetPath(opts.Dir, c.To, true)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	if format == "zip" {
+		return c.extractZip(opts.Dir, src)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.From, err)
+		}
+		defer gz.Close()
+		r = gz
+	case "tar.xz":
+		if r, err = xz.NewReader(f); err != nil {
+			return fmt.Errorf("%s: %v", c.From, err)
+		}
+	default:
+		return fmt.Errorf("unknown archive format %q, want tar.gz, tar.xz or zip", format)
+	}
+	return c.extractTar(ctx, opts.Dir, tar.NewReader(r))
+}
+
+// entryPath returns the path in the system of an entry of the archive, or
+// an empty string if it is stripped.
+func (c *Extract) entryPath(name string) (string, error) {
+	var elems []string
+	for _, e := range strings.Split(name, "/") {
+		if e != "" && e != "." {
+			elems = append(elems, e)
+		}
+	}
+	if len(elems) <= c.StripComponents {
+		return "", nil
+	}
+	rel := strings.Join(elems[c.StripComponents:], "/")
+	if p := path.Clean(rel); p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("%s: entry %s escapes %s", c.From, name, c.To)
+	}
+	return path.Join(c.To, rel), nil
+}
+
+func (c *Extract) extractTar(ctx context.Context, root string, r *tar.Reader) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.From, err)
+		}
+		p, err := c.entryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			continue
+		}
+		dest, err := targetPath(root, p, false)
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = makeDir(dest)
+		case tar.TypeReg:
+			err = writeEntry(dest, r)
+		case tar.TypeSymlink:
+			err = makeSymlink(hdr.Linkname, dest)
+		case tar.TypeLink:
+			// The owner and mode belong to the target, which is already
+			// extracted.
+			var target string
+			if target, err = c.entryPath(hdr.Linkname); err == nil && target == "" {
+				err = fmt.Errorf("link target %s is stripped", hdr.Linkname)
+			}
+			if err == nil {
+				if target, err = targetPath(root, target, false); err == nil {
+					if err = removeNonDir(dest); err == nil {
+						err = os.Link(target, dest)
+					}
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s: %v", c.From, hdr.Name, err)
+			}
+			continue
+		default:
+			// Devices and FIFOs are made by packages, not downloads.
+			continue
+		}
+		if err == nil {
+			err = setMeta(dest, mode, []int{hdr.Uid, hdr.Gid})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", c.From, hdr.Name, err)
+		}
+	}
+}
+
+// setMeta gives an entry its owner, if one is given, then its mode. The
+// owner is only set when building as root. Ownership is set before the
+// mode, as chown clears the setuid and setgid bits.
+func setMeta(dest string, mode os.FileMode, owner []int) error {
+	if owner != nil && os.Geteuid() == 0 {
+		if err := os.Lchown(dest, owner[0], owner[1]); err != nil {
+			return err
+		}
+	}
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chmod(dest, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
+
+func (c *Extract) extractZip(root, src string) error {
+	z, err := zip.OpenReader(src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.From, err)
+	}
+	defer z.Close()
+
+	for _, f := range z.File {
+		p, err := c.entryPath(f.Name)
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			continue
+		}
+		dest, err := targetPath(root, p, false)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+
+		switch {
+		case mode.IsDir():
+			err = makeDir(dest)
+		case mode&os.ModeSymlink != 0:
+			var target []byte
+			if target, err = readZipFile(f); err == nil {
+				err = makeSymlink(string(target), dest)
+			}
+		default:
+			var r io.ReadCloser
+			if r, err = f.Open(); err == nil {
+				err = writeEntry(dest, r)
+				r.Close()
+			}
+		}
+		if err == nil {
+			var owner []int
+			if uid, gid, ok := zipOwner(f); ok {
+				owner = []int{uid, gid}
+			}
+			err = setMeta(dest, mode, owner)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", c.From, f.Name, err)
+		}
+	}
+	return nil
+}
+
+// zipOwner returns the owner of a zip entry, which Info-ZIP records in the
+// 'ux' extra field. Entries without it are owned by the builder.
+func zipOwner(f *zip.File) (uid, gid int, ok bool) {
+	for extra := f.Extra; len(extra) >= 4; {
+		tag, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return 0, 0, false
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if tag != zipUnixExtra || size < 1 || field[0] != 1 {
+			continue
+		}
+		var ids []int
+		for field = field[1:]; len(field) > 0; {
+			n := int(field[0])
+			if len(field) < 1+n || n > 8 {
+				return 0, 0, false
+			}
+			var id uint64
+			for i := n; i > 0; i-- {
+				id = id<<8 | uint64(field[i])
+			}
+			ids = append(ids, int(id))
+			field = field[1+n:]
+		}
+		if len(ids) != 2 {
+			return 0, 0, false
+		}
+		return ids[0], ids[1], true
+	}
+	return 0, 0, false
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// makeDir creates a directory and its parents. Its mode is set by setMeta.
+func makeDir(dest string) error {
+	return os.MkdirAll(dest, 0755)
+}
+
+// writeEntry writes the file at dest, replacing any file or symlink there
+// rather than writing through it. Its mode is set by setMeta.
+func writeEntry(dest string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := removeNonDir(dest); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// makeSymlink creates the symlink link to target, replacing any file or
+// symlink at link.
+func makeSymlink(target, link string) error {
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	if err := removeNonDir(link); err != nil {
+		return err
+	}
+	return os.Symlink(target, link)
+}
+
+// removeNonDir removes the file or symlink at p, if there is one.
+func removeNonDir(p string) error {
+	fi, err := os.Lstat(p)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case fi.IsDir():
+		return fmt.Errorf("%s is a directory", p)
+	}
+	return os.Remove(p)
+}
+
+// Copy copies a file or directory within the system. If To is an existing
+// directory, From is copied into it.
+type Copy struct {
+	From string
+	To   string
+}
+
+// Name implements Unit.
+func (c *Copy) Name() string {
+	return "copy " + filepath.Base(c.From)
+}
+
+// Run implements Unit.
+func (c *Copy) Run(ctx context.Context, opts Opts) error {
+	src, err := targetPath(opts.Dir, c.From, true)
+	if err != nil {
+		return err
+	}
+	to := c.To
+	if dest, err := targetPath(opts.Dir, to, true); err != nil {
+		return err
+	} else if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		to = path.Join(to, path.Base(c.From))
+	}
+	// Copying a directory into itself would find the copies as it walks.
+	dest, err := targetPath(opts.Dir, to, true)
+	if err != nil {
+		return err
+	}
+	if dest == src || strings.HasPrefix(dest, src+string(filepath.Separator)) {
+		return fmt.Errorf("cannot copy %s into itself, %s", c.From, c.To)
+	}
+
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		dest, err := targetPath(opts.Dir, path.Join(to, filepath.ToSlash(rel)), false)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := makeDir(dest); err != nil {
+				return err
+			}
+			return setMeta(dest, fi.Mode(), nil)
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return makeSymlink(target, dest)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := writeEntry(dest, f); err != nil {
+				return err
+			}
+			return setMeta(dest, fi.Mode(), nil)
+		}
+		return fmt.Errorf("%s: cannot copy %v", p, fi.Mode().Type())
+	})
+}
+
+// Symlink creates a symlink in the system, replacing any file or symlink
+// at Link. Target is used as given, and resolved in the system.
+type Symlink struct {
+	Target string
+	Link   string
+}
+
+// Name implements Unit.
+func (c *Symlink) Name() string {
+	return "symlink " + filepath.Base(c.Link)
+}
+
+// Run implements Unit.
+func (c *Symlink) Run(ctx context.Context, opts Opts) error {
+	link, err := targetPath(opts.Dir, c.Link, false)
+	if err != nil {
+		return err
+	}
+	return makeSymlink(c.Target, link)
+}
+
+// Chown changes the owner of a path in the system to a user of the
+// system, looked up by name. The group is the primary group of the user
+// unless Group names another.
+type Chown struct {
+	Path      string
+	User      string
+	Group     string
+	Recursive bool
+}
+
+// Name implements Unit.
+func (c *Chown) Name() string {
+	return "chown " + filepath.Base(c.Path)
+}
+
+// Run implements Unit.
+func (c *Chown) Run(ctx context.Context, opts Opts) error {
+	conf, err := user.ReadConfig(opts.Dir)
+	if err != nil {
+		return err
+	}
+	u, ok := conf.User(c.User)
+	if !ok {
+		return fmt.Errorf("chown %s: unknown user %q", c.Path, c.User)
+	}
+	gid := u.GID
+	if c.Group != "" {
+		g, ok := conf.Group(c.Group)
+		if !ok {
+			return fmt.Errorf("chown %s: unknown group %q", c.Path, c.Group)
+		}
+		gid = g.ID
+	}
+
+	// Symlinks are changed themselves, not the files they point to.
+	p, err := targetPath(opts.Dir, c.Path, false)
+	if err != nil {
+		return err
+	}
+	if !c.Recursive {
+		return os.Lchown(p, u.UID, gid)
+	}
+	return filepath.Walk(p, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, u.UID, gid)
+	})
+}
+
+// Chmod changes the mode of a path in the system. Symlinks within a
+// recursive change are skipped.
+type Chmod struct {
+	Path string
+	// Mode is a Unix mode, such as 04755.
+	Mode      uint32
+	Recursive bool
+}
+
+// Name implements Unit.
+func (c *Chmod) Name() string {
+	return "chmod " + filepath.Base(c.Path)
+}
+
+// Run implements Unit.
+func (c *Chmod) Run(ctx context.Context, opts Opts) error {
+	p, err := targetPath(opts.Dir, c.Path, true)
+	if err != nil {
+		return err
+	}
+	mode := unixMode(c.Mode)
+	if !c.Recursive {
+		return os.Chmod(p, mode)
+	}
+	return filepath.Walk(p, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+			return err
+		}
+		return os.Chmod(p, mode)
+	})
+}
+
+// Remove removes a path from the system. Symlinks are removed, not the
+// files they point to. Unless it is recursive, directories must be empty,
+// and the path must exist.
+type Remove struct {
+	Path      string
+	Recursive bool
+}
+
+// Name implements Unit.
+func (c *Remove) Name() string {
+	return "remove " + filepath.Base(c.Path)
+}
+
+// Run implements Unit.
+func (c *Remove) Run(ctx context.Context, opts Opts) error {
+	p, err := targetPath(opts.Dir, c.Path, false)
+	if err != nil {
+		return err
+	}
+	if p == filepath.Clean(opts.Dir) {
+		return fmt.Errorf("remove %s: refusing to remove the root of the system", c.Path)
+	}
+	if c.Recursive {
+		return os.RemoveAll(p)
+	}
+	return os.Remove(p)
+}
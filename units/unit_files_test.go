@@ -0,0 +1,385 @@
+package units
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func makeRoot(t *testing.T) string {
+	t.Helper()
+	root, err := ioutil.TempDir("", "twl-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return root
+}
+
+func TestTargetPath(t *testing.T) {
+	root := makeRoot(t)
+	for _, d := range []string{"usr/lib", "opt"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"lib":       "usr/lib",
+		"opt/abs":   "/usr",
+		"opt/up":    "../../../../etc",
+		"opt/loop1": "loop2",
+		"opt/loop2": "loop1",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		path       string
+		followLast bool
+		want       string
+		wantErr    string
+	}{
+		{path: "/lib/x", want: "/usr/lib/x"},
+		{path: "/lib", followLast: true, want: "/usr/lib"},
+		{path: "/lib", want: "/lib"},
+		{path: "/opt/abs/lib", want: "/usr/lib"},
+		{path: "/opt/up/passwd", want: "/etc/passwd"},
+		{path: "/opt/../usr/./lib", want: "/usr/lib"},
+		{path: "relative/x", want: "/relative/x"},
+		{path: "/../etc/passwd", wantErr: "/../etc/passwd escapes the build directory"},
+		{path: "/usr/../../etc", wantErr: "/usr/../../etc escapes the build directory"},
+		{path: "/opt/loop1", followLast: true, wantErr: "/opt/loop1: too many levels of symbolic links"},
+	} {
+		got, err := targetPath(root, tc.path, tc.followLast)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("targetPath(%q) returned %v, want %q", tc.path, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("targetPath(%q) failed: %v", tc.path, err)
+			continue
+		}
+		if want := filepath.Join(root, tc.want); got != want {
+			t.Errorf("targetPath(%q) = %q, want %q", tc.path, got, want)
+		}
+	}
+}
+
+type archiveEntry struct {
+	name, data, link string
+	mode             int64
+	dir              bool
+	// owner is the uid and gid of the entry, if set.
+	owner []int
+}
+
+var testEntries = []archiveEntry{
+	{name: "pkg-1.0/", dir: true, mode: 0755},
+	{name: "pkg-1.0/bin/", dir: true, mode: 0755},
+	{name: "pkg-1.0/bin/tool", data: "#!/bin/sh\n", mode: 0755},
+	{name: "pkg-1.0/README", data: "hello", mode: 0644},
+	{name: "pkg-1.0/docs", link: "README", mode: 0777},
+}
+
+func writeTar(t *testing.T, w io.Writer, entries []archiveEntry) {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: e.mode, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if e.owner != nil {
+			hdr.Uid, hdr.Gid = e.owner[0], e.owner[1]
+		}
+		switch {
+		case e.dir:
+			hdr.Typeflag = tar.TypeDir
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeArchive(t *testing.T, path, format string, entries []archiveEntry) {
+	var buf bytes.Buffer
+	switch format {
+	case "tar.gz":
+		gz := gzip.NewWriter(&buf)
+		writeTar(t, gz, entries)
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "tar.xz":
+		x, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTar(t, x, entries)
+		if err := x.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "zip":
+		zw := zip.NewWriter(&buf)
+		for _, e := range entries {
+			fh := &zip.FileHeader{Name: e.name}
+			if e.owner != nil {
+				// The Info-ZIP 'ux' field: version 1, then 4 byte ids.
+				fh.Extra = []byte{0x75, 0x78, 11, 0, 1, 4, 0, 0, 0, 0, 4, 0, 0, 0, 0}
+				binary.LittleEndian.PutUint32(fh.Extra[6:], uint32(e.owner[0]))
+				binary.LittleEndian.PutUint32(fh.Extra[11:], uint32(e.owner[1]))
+			}
+			data := e.data
+			switch {
+			case e.dir:
+				fh.SetMode(os.ModeDir | unixMode(uint32(e.mode)))
+			case e.link != "":
+				fh.SetMode(os.ModeSymlink | 0777)
+				data = e.link
+			default:
+				fh.SetMode(unixMode(uint32(e.mode)))
+			}
+			w, err := zw.CreateHeader(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	for _, format := range []string{"tar.gz", "tar.xz", "zip"} {
+		t.Run(format, func(t *testing.T) {
+			root := makeRoot(t)
+			writeArchive(t, filepath.Join(root, "pkg."+format), format, testEntries)
+
+			u := &Extract{From: "/pkg." + format, To: "/opt/pkg", StripComponents: 1}
+			if err := u.Run(context.Background(), Opts{Dir: root}); err != nil {
+				t.Fatalf("Run() failed: %v", err)
+			}
+			for p, want := range map[string]string{"bin/tool": "#!/bin/sh\n", "README": "hello"} {
+				got, err := ioutil.ReadFile(filepath.Join(root, "opt/pkg", p))
+				if err != nil || string(got) != want {
+					t.Errorf("%s = %q, %v, want %q", p, got, err, want)
+				}
+			}
+			if fi, err := os.Stat(filepath.Join(root, "opt/pkg/bin/tool")); err != nil || fi.Mode().Perm() != 0755 {
+				t.Errorf("bin/tool mode = %v, %v, want 0755", fi.Mode(), err)
+			}
+			if link, err := os.Readlink(filepath.Join(root, "opt/pkg/docs")); err != nil || link != "README" {
+				t.Errorf("docs links to %q, %v, want README", link, err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "opt/pkg/pkg-1.0")); !os.IsNotExist(err) {
+				t.Errorf("pkg-1.0 was not stripped: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership is only kept when running as root")
+	}
+	for _, format := range []string{"tar.gz", "zip"} {
+		t.Run(format, func(t *testing.T) {
+			root := makeRoot(t)
+			writeArchive(t, filepath.Join(root, "pkg."+format), format, []archiveEntry{
+				{name: "pkg/", dir: true, mode: 0755, owner: []int{1234, 5678}},
+				{name: "pkg/owned", data: "x", mode: 0644, owner: []int{1234, 5678}},
+				{name: "pkg/unowned", data: "x", mode: 0644},
+				{name: "pkg/suid", data: "x", mode: 04755, owner: []int{1234, 5678}},
+				{name: "pkg/sgid/", dir: true, mode: 02755, owner: []int{1234, 5678}},
+			})
+
+			if err := (&Extract{From: "/pkg." + format, To: "/opt"}).Run(context.Background(), Opts{Dir: root}); err != nil {
+				t.Fatalf("Run() failed: %v", err)
+			}
+			for p, want := range map[string][2]uint32{"pkg": {1234, 5678}, "pkg/owned": {1234, 5678}, "pkg/unowned": {0, 0}} {
+				fi, err := os.Lstat(filepath.Join(root, "opt", p))
+				if err != nil {
+					t.Fatal(err)
+				}
+				st := fi.Sys().(*syscall.Stat_t)
+				if got := [2]uint32{st.Uid, st.Gid}; got != want {
+					t.Errorf("%s is owned by %v, want %v", p, got, want)
+				}
+			}
+			// Owners are set before modes, as chown clears these bits.
+			for p, want := range map[string]os.FileMode{"pkg/suid": os.ModeSetuid | 0755, "pkg/sgid": os.ModeDir | os.ModeSetgid | 0755} {
+				if fi, err := os.Lstat(filepath.Join(root, "opt", p)); err != nil || fi.Mode() != want {
+					t.Errorf("mode of %s = %v, %v, want %v", p, fi.Mode(), err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChownSymlink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	root := makeRoot(t)
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(root, "etc/passwd"), []byte("bob:x:4321:4321::/home/bob:/bin/bash\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "etc/group"), []byte("bob:x:4321:\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "target"), []byte("x"), 0644)
+	if err := os.Symlink("target", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&Chown{Path: "/link", User: "bob"}).Run(context.Background(), Opts{Dir: root}); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	for p, want := range map[string]uint32{"link": 4321, "target": 0} {
+		fi, err := os.Lstat(filepath.Join(root, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Sys().(*syscall.Stat_t).Uid; got != want {
+			t.Errorf("%s is owned by %d, want %d", p, got, want)
+		}
+	}
+}
+
+func TestExtractEscapes(t *testing.T) {
+	outside := makeRoot(t)
+	for _, tc := range []struct {
+		name    string
+		entries []archiveEntry
+		wantErr string
+	}{
+		{
+			name:    "dotdot",
+			entries: []archiveEntry{{name: "a/../../evil", data: "x", mode: 0644}},
+			wantErr: "/evil.tar.gz: entry a/../../evil escapes /opt",
+		},
+		{
+			// A symlink out of the root is followed within it, as it would be
+			// in the built system.
+			name: "symlink",
+			entries: []archiveEntry{
+				{name: "out", link: outside, mode: 0777},
+				{name: "out/evil", data: "x", mode: 0644},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := makeRoot(t)
+			writeArchive(t, filepath.Join(root, "evil.tar.gz"), "tar.gz", tc.entries)
+
+			err := (&Extract{From: "/evil.tar.gz", To: "/opt"}).Run(context.Background(), Opts{Dir: root})
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Errorf("Run() returned %v, want %q", err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("Run() failed: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+				t.Errorf("file written outside the root: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileUnits(t *testing.T) {
+	root := makeRoot(t)
+	for p, data := range map[string]string{
+		"src/a/one":   "1",
+		"src/a/b/two": "2",
+		"etc/passwd":  fmt.Sprintf("alice:x:%d:%d::/home/alice:/bin/bash\n", os.Getuid(), os.Getgid()),
+		"etc/group":   fmt.Sprintf("alice:x:%d:\nstaff:x:%d:alice\n", os.Getgid(), os.Getgid()),
+	} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, p), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "dest"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx, opts := context.Background(), Opts{Dir: root}
+
+	for _, u := range []Unit{
+		&Copy{From: "/src/a", To: "/dest"},
+		&Copy{From: "/src/a/one", To: "/dest/one-copy"},
+		&Symlink{Target: "/dest/a/one", Link: "/usr/bin/one"},
+		&Chmod{Path: "/dest/a", Mode: 0750, Recursive: true},
+		&Chmod{Path: "/dest/one-copy", Mode: 04755},
+		&Chown{Path: "/dest/a", User: "alice", Group: "staff", Recursive: true},
+		&Remove{Path: "/src", Recursive: true},
+	} {
+		if err := u.Run(ctx, opts); err != nil {
+			t.Fatalf("%s failed: %v", u.Name(), err)
+		}
+	}
+
+	if got, err := ioutil.ReadFile(filepath.Join(root, "dest/a/b/two")); err != nil || string(got) != "2" {
+		t.Errorf("dest/a/b/two = %q, %v, want 2", got, err)
+	}
+	if link, err := os.Readlink(filepath.Join(root, "usr/bin/one")); err != nil || link != "/dest/a/one" {
+		t.Errorf("usr/bin/one links to %q, %v", link, err)
+	}
+	for p, want := range map[string]os.FileMode{
+		"dest/a/b/two":  0750,
+		"dest/a/b":      os.ModeDir | 0750,
+		"dest/one-copy": os.ModeSetuid | 0755,
+	} {
+		if fi, err := os.Stat(filepath.Join(root, p)); err != nil || fi.Mode() != want {
+			t.Errorf("mode of %s = %v, %v, want %v", p, fi.Mode(), err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "src")); !os.IsNotExist(err) {
+		t.Errorf("src was not removed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		unit    Unit
+		wantErr string
+	}{
+		{&Chown{Path: "/dest", User: "bob"}, `chown /dest: unknown user "bob"`},
+		{&Remove{Path: "/", Recursive: true}, "remove /: refusing to remove the root of the system"},
+		{&Remove{Path: "/dest/../.."}, "/dest/../.. escapes the build directory"},
+		{&Copy{From: "/etc/../../x", To: "/y"}, "/etc/../../x escapes the build directory"},
+		{&Copy{From: "/dest/a", To: "/dest/a/b"}, "cannot copy /dest/a into itself"},
+	} {
+		if err := tc.unit.Run(ctx, opts); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s returned %v, want %q", tc.unit.Name(), err, tc.wantErr)
+		}
+	}
+}
@@ -5,21 +5,28 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+
+	"github.com/twitchylinux/builder/conf/grub"
 )
 
-// GrubColorPair describes a color pair in grub config.
-type GrubColorPair struct {
-	FG, BG string
-}
+// Grub firmware targets.
+const (
+	GrubBIOS   = "bios"
+	GrubUEFI   = "uefi"
+	GrubHybrid = "hybrid"
+)
+
+// grubCustomScript is the script in /etc/grub.d which adds configured
+// menu entries.
+const grubCustomScript = "45_twitchylinux"
 
 // Grub2 is a unit which installs Grub2.
 type Grub2 struct {
-	DistroName string
-	Quiet      bool
-
-	ColorNormal    GrubColorPair
-	ColorHighlight GrubColorPair
+	// Firmware is the firmware grub is installed for: bios, uefi or
+	// hybrid. BIOS is assumed if unset.
+	Firmware string
+	// Config describes the menu generated by update-grub.
+	Config grub.Config
 }
 
 // Name implements Unit.
@@ -27,6 +34,19 @@ func (i *Grub2) Name() string {
 	return "Grub2"
 }
 
+func (i *Grub2) packages() []string {
+	switch i.Firmware {
+	case GrubUEFI:
+		return []string{"grub-efi-amd64"}
+	case GrubHybrid:
+		// grub-pc and grub-efi-amd64 conflict, so the BIOS modules
+		// are installed without the package which manages them.
+		return []string{"grub-efi-amd64", "grub-pc-bin"}
+	default:
+		return []string{"grub2"}
+	}
+}
+
 // Run implements Unit.
 func (i *Grub2) Run(ctx context.Context, opts Opts) error {
 	chroot, err := prepareChroot(opts.Dir)
@@ -35,21 +55,16 @@ func (i *Grub2) Run(ctx context.Context, opts Opts) error {
 	}
 	defer chroot.Close()
 
-	if err := chroot.AptInstall(ctx, &opts, "grub2"); err != nil {
+	if err := chroot.AptInstall(ctx, &opts, i.packages()...); err != nil {
 		return err
 	}
 	os.Remove(filepath.Join(opts.Dir, "etc", "grub.d", "05_debian_theme"))
 
-	conf, err := ioutil.ReadFile(filepath.Join(opts.Dir, "etc", "default", "grub"))
-	if err != nil {
+	if err := ioutil.WriteFile(filepath.Join(opts.Dir, "etc", "default", "grub"), []byte(i.Config.DefaultFile()), 0644); err != nil {
 		return err
 	}
-	conf = append(conf, []byte("GRUB_COLOR_NORMAL=\""+i.ColorNormal.FG+"/"+i.ColorNormal.BG+"\"\n")...)
-	conf = append(conf, []byte("GRUB_COLOR_HIGHLIGHT=\""+i.ColorHighlight.FG+"/"+i.ColorHighlight.BG+"\"\n")...)
-	if i.Quiet {
-		conf = []byte(strings.Replace(string(conf), "\nGRUB_CMDLINE_LINUX_DEFAULT=\"quiet\"", "\nGRUB_CMDLINE_LINUX_DEFAULT=\"\"", -1))
+	if script := i.Config.CustomScript(); script != "" {
+		return ioutil.WriteFile(filepath.Join(opts.Dir, "etc", "grub.d", grubCustomScript), []byte(script), 0755)
 	}
-	conf = []byte(strings.Replace(string(conf), "echo Debian`", "echo Debian/"+i.DistroName+"`", -1))
-
-	return ioutil.WriteFile(filepath.Join(opts.Dir, "etc", "default", "grub"), conf, 0644)
+	return nil
 }
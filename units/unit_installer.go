@@ -58,6 +58,7 @@ func (i *Installer) build(ctx context.Context, opts *Opts, chroot *Chroot) error
 		return fmt.Errorf("building installer: %v", err)
 	}
 	cmd.Env = []string{"GOPATH=/tmp-twlinst-build", "GOCACHE=/tmp-gocache", "PATH=/bin:/usr/bin:/usr/local/go/bin:/sbin:/usr/sbin"}
+	opts.setEpoch(cmd)
 	cmd.Stdout = opts.L.Stdout()
 	cmd.Stderr = opts.L.Stderr()
 	return cmd.Run()
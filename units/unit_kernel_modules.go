@@ -0,0 +1,199 @@
+package units
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// moduleSrcDir is the directory within the system where the sources of
+// out-of-tree kernel modules are placed.
+const moduleSrcDir = "/usr/src/twl-modules"
+
+// KernelModule describes an out-of-tree kernel module. Exactly one of Git,
+// URL or DKMS must be set.
+type KernelModule struct {
+	Name string
+
+	// Git and Ref describe a git repository and the commit, tag or branch
+	// to build.
+	Git string
+	Ref string
+
+	// URL is the location of a tarball of the module source, which is
+	// verified against SHA256, or SignatureURL and Keyring.
+	URL          string
+	SHA256       string
+	SignatureURL string
+	Keyring      string
+
+	// DKMS names a Debian package which registers the module with DKMS.
+	DKMS string
+
+	// Subdir is the directory within the source containing the Kbuild
+	// makefile, if not the top level.
+	Subdir string
+	// MakeArgs are extra arguments passed to make, such as CONFIG_ flags.
+	MakeArgs []string
+	// BuildPkgs are packages which must be installed to build the module.
+	BuildPkgs []string
+}
+
+func (m *KernelModule) validate() error {
+	set := 0
+	for _, s := range []string{m.Git, m.URL, m.DKMS} {
+		if s != "" {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		return errors.New("exactly one of git, url or dkms must be specified")
+	case m.Git != "" && m.Ref == "":
+		return errors.New("a ref must be specified for git sources")
+	case m.URL != "" && m.SHA256 == "" && m.SignatureURL == "":
+		return errors.New("a sha256 or signature_url must be specified for tarball sources")
+	case strings.Contains(m.Name, "/") || m.Name == "" || m.Name == "." || m.Name == "..":
+		return fmt.Errorf("invalid module name %q", m.Name)
+	case path.IsAbs(m.Subdir) || strings.HasPrefix(path.Clean(m.Subdir), ".."):
+		return fmt.Errorf("subdir %q must be relative to the module source", m.Subdir)
+	}
+	return nil
+}
+
+func (m *KernelModule) srcDir() string {
+	return path.Join(moduleSrcDir, m.Name)
+}
+
+// KernelModules is a unit that builds out-of-tree kernel modules against
+// the headers of the kernel built by the Linux unit.
+type KernelModules struct {
+	Kernel  *Linux
+	Modules []KernelModule
+}
+
+// Name implements Unit.
+func (k *KernelModules) Name() string {
+	return "Kernel-modules"
+}
+
+// Run implements Unit.
+func (k *KernelModules) Run(ctx context.Context, opts Opts) error {
+	for i := range k.Modules {
+		if err := k.Modules[i].validate(); err != nil {
+			return fmt.Errorf("module %s: %v", k.Modules[i].Name, err)
+		}
+	}
+	release, err := k.Kernel.Release(opts)
+	if err != nil {
+		return err
+	}
+	buildDir := path.Join("/lib/modules", release, "build")
+	if _, err := os.Stat(filepath.Join(opts.Dir, buildDir)); err != nil {
+		return fmt.Errorf("headers for Linux %s are not installed: %v", release, err)
+	}
+
+	chroot, err := prepareChroot(opts.Dir)
+	if err != nil {
+		return err
+	}
+	defer chroot.Close()
+
+	built := make([]string, 0, len(k.Modules))
+	for _, m := range k.Modules {
+		opts.L.SetSubstage("Building " + m.Name)
+		if len(m.BuildPkgs) > 0 {
+			if err := chroot.AptInstall(ctx, &opts, m.BuildPkgs...); err != nil {
+				return err
+			}
+		}
+
+		if m.DKMS != "" {
+			if err := k.buildDKMS(ctx, chroot, opts, m, release); err != nil {
+				return fmt.Errorf("module %s: %v", m.Name, err)
+			}
+		} else {
+			if err := k.fetch(ctx, chroot, opts, m); err != nil {
+				return fmt.Errorf("module %s: fetching source: %v", m.Name, err)
+			}
+			if err := k.build(ctx, chroot, opts, m, buildDir); err != nil {
+				return fmt.Errorf("module %s: %v", m.Name, err)
+			}
+		}
+		built = append(built, m.Name)
+	}
+
+	opts.L.SetSubstage("Updating module dependencies")
+	if err := chroot.Shell(ctx, &opts, "depmod", "-a", release); err != nil {
+		return err
+	}
+	opts.L.SetSubstage("Updating initramfs")
+	if err := chroot.Shell(ctx, &opts, "update-initramfs", "-u", "-k", release); err != nil {
+		return err
+	}
+
+	return UpdateManifest(opts, func(man *Manifest) {
+		if man.Linux == nil {
+			man.Linux = &LinuxManifest{Version: k.Kernel.Version}
+		}
+		man.Linux.Modules = built
+	})
+}
+
+func (k *KernelModules) fetch(ctx context.Context, chroot *Chroot, opts Opts, m KernelModule) error {
+	if err := os.RemoveAll(filepath.Join(opts.Dir, m.srcDir())); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(opts.Dir, m.srcDir()), 0755); err != nil {
+		return err
+	}
+
+	if m.Git != "" {
+		if err := chroot.AptInstall(ctx, &opts, "git"); err != nil {
+			return err
+		}
+		if err := chroot.Shell(ctx, &opts, "git", "clone", m.Git, m.srcDir()); err != nil {
+			return err
+		}
+		return chroot.Shell(ctx, &opts, "git", "-C", m.srcDir(), "checkout", "--detach", m.Ref)
+	}
+
+	tarball := path.Join(moduleSrcDir, m.Name+"-src.tar")
+	if err := DownloadFile(ctx, &opts, m.URL, filepath.Join(opts.Dir, tarball)); err != nil {
+		return err
+	}
+	defer os.Remove(filepath.Join(opts.Dir, tarball))
+	verify := VerifySpec{URL: m.URL, SHA256: m.SHA256, SignatureURL: m.SignatureURL, Keyring: m.Keyring}
+	if err := VerifyDownload(ctx, &opts, verify, filepath.Join(opts.Dir, tarball)); err != nil {
+		return err
+	}
+	return chroot.Shell(ctx, &opts, "tar", "xf", tarball, "-C", m.srcDir(), "--strip-components=1")
+}
+
+func (k *KernelModules) build(ctx context.Context, chroot *Chroot, opts Opts, m KernelModule, buildDir string) error {
+	src := m.srcDir()
+	if m.Subdir != "" {
+		src = path.Join(src, m.Subdir)
+	}
+	args := []string{"-C", buildDir, "M=" + src, opts.makeNumThreadsArg()}
+	args = append(args, m.MakeArgs...)
+
+	if err := chroot.Shell(ctx, &opts, "make", append(args, "modules")...); err != nil {
+		return err
+	}
+	return chroot.Shell(ctx, &opts, "make", append(args, "modules_install")...)
+}
+
+// buildDKMS installs a package which registers a module with DKMS, then
+// builds and installs it for the custom kernel. DKMS otherwise only builds
+// for the running kernel, which is the kernel of the build host.
+func (k *KernelModules) buildDKMS(ctx context.Context, chroot *Chroot, opts Opts, m KernelModule, release string) error {
+	if err := chroot.AptInstall(ctx, &opts, "dkms", m.DKMS); err != nil {
+		return err
+	}
+	return chroot.Shell(ctx, &opts, "dkms", "autoinstall", "-k", release)
+}
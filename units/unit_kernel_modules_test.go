@@ -0,0 +1,34 @@
+package units
+
+import "testing"
+
+func TestKernelModuleValidate(t *testing.T) {
+	tcs := []struct {
+		name string
+		m    KernelModule
+		ok   bool
+	}{
+		{"git", KernelModule{Name: "a", Git: "https://x/a.git", Ref: "v1"}, true},
+		{"git no ref", KernelModule{Name: "a", Git: "https://x/a.git"}, false},
+		{"tarball", KernelModule{Name: "a", URL: "https://x/a.tar.gz", SHA256: "00"}, true},
+		{"tarball signed", KernelModule{Name: "a", URL: "https://x/a.tar.gz", SignatureURL: "https://x/a.sig"}, true},
+		{"tarball unverified", KernelModule{Name: "a", URL: "https://x/a.tar.gz"}, false},
+		{"dkms", KernelModule{Name: "a", DKMS: "a-dkms"}, true},
+		{"no source", KernelModule{Name: "a"}, false},
+		{"two sources", KernelModule{Name: "a", DKMS: "a-dkms", Git: "https://x/a.git", Ref: "v1"}, false},
+		{"bad name", KernelModule{Name: "../a", DKMS: "a-dkms"}, false},
+		{"escaping subdir", KernelModule{Name: "a", DKMS: "a-dkms", Subdir: "../../etc"}, false},
+		{"subdir", KernelModule{Name: "a", DKMS: "a-dkms", Subdir: "src/driver"}, true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.m.validate()
+			if tc.ok && err != nil {
+				t.Errorf("validate() failed: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("validate() did not fail")
+			}
+		})
+	}
+}
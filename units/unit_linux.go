@@ -1,13 +1,16 @@
 package units
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
+	"strconv"
+
+	"github.com/twitchylinux/builder/conf/kconfig"
 )
 
 // Linux is a unit that builds the Linux kernel.
@@ -16,6 +19,20 @@ type Linux struct {
 	URL          string
 	SHA256       string
 	BuildDepPkgs []string
+
+	// SignatureURL and Keyring describe a detached PGP signature over the
+	// source tarball, and the keyring (relative to resources) to verify it
+	// against. kernel.org signatures over the uncompressed tarball are
+	// supported.
+	SignatureURL string
+	Keyring      string
+
+	// Config describes kernel config symbols which should be set on top of
+	// the base config, formatted as they appear in a .config file.
+	Config map[string]string
+	// CCache enables the use of ccache while compiling. It only has an
+	// effect when a kernel cache directory is configured.
+	CCache bool
 }
 
 // Name implements Unit.
@@ -23,6 +40,25 @@ func (l *Linux) Name() string {
 	return "Linux"
 }
 
+// Release returns the kernel release string the built kernel reports,
+// which names its directory under /lib/modules. It includes the
+// CONFIG_LOCALVERSION of the merged config.
+func (l *Linux) Release(opts Opts) (string, error) {
+	conf, err := l.config(opts)
+	if err != nil {
+		return "", err
+	}
+	v, ok := conf.Get("CONFIG_LOCALVERSION")
+	if !ok {
+		return l.Version, nil
+	}
+	local, err := strconv.Unquote(v)
+	if err != nil {
+		return "", fmt.Errorf("CONFIG_LOCALVERSION: %v", err)
+	}
+	return l.Version + local, nil
+}
+
 func (l *Linux) dirFilename() string {
 	return "linux-" + l.Version
 }
@@ -51,11 +87,37 @@ func (l *Linux) Run(ctx context.Context, opts Opts) error {
 		return err
 	}
 
+	var cacheKey string
+	if opts.KernelCacheDir != "" {
+		if cacheKey, err = l.cacheKey(opts); err != nil {
+			return fmt.Errorf("computing kernel cache key: %v", err)
+		}
+		hit, err := l.restoreCached(opts, cacheKey)
+		if err != nil {
+			return fmt.Errorf("restoring cached kernel packages: %v", err)
+		}
+		if hit {
+			fmt.Fprintf(opts.L.Stdout(), "Using cached kernel packages for %s (%s).\n", l.Version, cacheKey)
+			patches, err := l.patchFiles(opts)
+			if err != nil {
+				return err
+			}
+			for i := range patches {
+				patches[i] = filepath.Base(patches[i])
+			}
+			if err := l.recordManifest(opts, patches); err != nil {
+				return err
+			}
+			return l.runInstallLinux(ctx, chroot, opts)
+		}
+	}
+
 	opts.L.SetSubstage("Downloading Linux " + l.Version)
 	if err := DownloadFile(ctx, &opts, l.URL, l.tarPath(&opts, false)); err != nil {
 		return fmt.Errorf("Linux source download failed: %v", err)
 	}
-	if err := CheckSHA256(l.tarPath(&opts, false), l.SHA256); err != nil {
+	verify := VerifySpec{URL: l.URL, SHA256: l.SHA256, SignatureURL: l.SignatureURL, Keyring: l.Keyring}
+	if err := VerifyDownload(ctx, &opts, verify, l.tarPath(&opts, false)); err != nil {
 		return err
 	}
 
@@ -69,15 +131,22 @@ func (l *Linux) Run(ctx context.Context, opts Opts) error {
 		return err
 	}
 
-	d, err := ioutil.ReadFile(filepath.Join(opts.Resources, "linux", ".config"))
+	if err := l.writeConfig(opts); err != nil {
+		return err
+	}
+	patches, err := l.applyPatches(ctx, opts)
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(filepath.Join(opts.Dir, l.dirFilename(), ".config"), d, 0644); err != nil {
+	if err := l.recordManifest(opts, patches); err != nil {
 		return err
 	}
 
-	if err := l.applyPatches(ctx, opts); err != nil {
+	opts.L.SetSubstage("Configuring")
+	if err := chroot.Shell(ctx, &opts, "make", "-C", l.dirFilename(), opts.makeNumThreadsArg(), "olddefconfig"); err != nil {
+		return err
+	}
+	if err := l.verifyConfig(opts); err != nil {
 		return err
 	}
 
@@ -85,39 +154,133 @@ func (l *Linux) Run(ctx context.Context, opts Opts) error {
 		return err
 	}
 	opts.L.SetSubstage("Building")
-	if err := chroot.Shell(ctx, &opts, "make", "-C", l.dirFilename(), opts.makeNumThreadsArg(), "deb-pkg"); err != nil {
+	if err := l.build(ctx, chroot, opts); err != nil {
 		return err
 	}
 
+	if opts.KernelCacheDir != "" {
+		opts.L.SetSubstage("Caching kernel packages")
+		if err := l.storeCached(opts, cacheKey); err != nil {
+			return fmt.Errorf("caching kernel packages: %v", err)
+		}
+	}
 	return l.runInstallLinux(ctx, chroot, opts)
 }
 
-func (l *Linux) applyPatches(ctx context.Context, opts Opts) error {
-	opts.L.SetSubstage("Patching")
-	patchDir := filepath.Join(opts.Resources, "linux", "patches")
-	patches, err := ioutil.ReadDir(patchDir)
+// build compiles the kernel into deb packages, using ccache if requested.
+func (l *Linux) build(ctx context.Context, chroot *Chroot, opts Opts) error {
+	args := []string{"-C", l.dirFilename(), opts.makeNumThreadsArg()}
+	var env []string
+
+	if l.CCache {
+		if opts.KernelCacheDir == "" {
+			fmt.Fprintln(opts.L.Stderr(), "Warning: ccache requested without a kernel cache directory, building without it.")
+		} else {
+			if err := chroot.AptInstall(ctx, &opts, "ccache"); err != nil {
+				return err
+			}
+			unmount, err := l.mountCCache(opts)
+			if err != nil {
+				return fmt.Errorf("mounting ccache directory: %v", err)
+			}
+			defer unmount()
+			args = append(args, "CC=ccache gcc")
+			env = append(env, "CCACHE_DIR="+ccacheChrootDir)
+		}
+	}
+
+	cmd, err := chroot.CmdContext(ctx, &opts, "make", append(args, "deb-pkg")...)
 	if err != nil {
 		return err
 	}
-	for _, p := range patches {
-		pd, err := os.Open(filepath.Join(patchDir, p.Name()))
-		if err != nil {
-			return err
-		}
-		c := exec.CommandContext(ctx, "patch", "-f", "-p1")
-		c.Dir = filepath.Join(opts.Dir, l.dirFilename())
-		c.Stdin = pd
-		c.Stdout = opts.L.Stdout()
-		c.Stderr = opts.L.Stderr()
-		if err := c.Run(); err != nil {
-			pd.Close()
-			return err
+	if opts.SourceDateEpoch != 0 {
+		// Kbuild embeds the build time, user and host in the kernel.
+		env = append(env, fmt.Sprintf("KBUILD_BUILD_TIMESTAMP=@%d", opts.SourceDateEpoch),
+			"KBUILD_BUILD_USER=twl", "KBUILD_BUILD_HOST=twitchylinux")
+	}
+	if len(env) > 0 {
+		// Keep the environment set up for the chroot, such as
+		// SOURCE_DATE_EPOCH.
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
 		}
-		pd.Close()
+		cmd.Env = append(cmd.Env, env...)
+	}
+	cmd.Stdout = opts.L.Stdout()
+	cmd.Stderr = opts.L.Stderr()
+	return cmd.Run()
+}
+
+// config returns the base kernel config merged with any requested
+// symbols.
+func (l *Linux) config(opts Opts) (*kconfig.Config, error) {
+	f, err := os.Open(filepath.Join(opts.Resources, "linux", ".config"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf, err := kconfig.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing base kernel config: %v", err)
+	}
+	conf.Merge(l.Config)
+	return conf, nil
+}
+
+// mergedConfig returns the merged kernel config, as written to the
+// source tree.
+func (l *Linux) mergedConfig(opts Opts) ([]byte, error) {
+	conf, err := l.config(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := conf.Serialize(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeConfig writes the merged kernel config into the source tree.
+func (l *Linux) writeConfig(opts Opts) error {
+	d, err := l.mergedConfig(opts)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(opts.Dir, l.dirFilename(), ".config"), d, 0644)
+}
+
+// verifyConfig checks that every requested symbol kept its value after
+// the config was resolved by the kernel build system.
+func (l *Linux) verifyConfig(opts Opts) error {
+	f, err := os.Open(filepath.Join(opts.Dir, l.dirFilename(), ".config"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resolved, err := kconfig.Parse(f)
+	if err != nil {
+		return fmt.Errorf("parsing resolved kernel config: %v", err)
+	}
+
+	if mismatches := kconfig.Verify(resolved, l.Config); len(mismatches) > 0 {
+		report := kconfig.Report(mismatches)
+		fmt.Fprint(opts.L.Stderr(), report)
+		return errors.New(report)
 	}
 	return nil
 }
 
+func (l *Linux) recordManifest(opts Opts, patches []string) error {
+	return UpdateManifest(opts, func(m *Manifest) {
+		m.Linux = &LinuxManifest{
+			Version: l.Version,
+			Patches: patches,
+		}
+	})
+}
+
 func (l *Linux) installDeps(ctx context.Context, chroot *Chroot, opts Opts) error {
 	cmd, err := chroot.CmdContext(ctx, &opts, "apt-get", append([]string{"install", "-y"}, l.BuildDepPkgs...)...)
 	if err != nil {
@@ -151,12 +314,10 @@ func (l *Linux) runInstallLinux(ctx context.Context, chroot *Chroot, opts Opts)
 	}
 
 	for _, f := range files {
-		for _, wantPkg := range []string{"linux-headers-", "linux-image-"} {
-			if strings.Contains(f.Name(), wantPkg) && strings.HasSuffix(f.Name(), ".deb") {
-				opts.L.SetSubstage("Install " + wantPkg + l.Version)
-				if err := chroot.Shell(ctx, &opts, "dpkg", "--install", f.Name()); err != nil {
-					return err
-				}
+		if pkg := kernelDebKind(f.Name()); pkg != "" {
+			opts.L.SetSubstage("Install " + pkg + l.Version)
+			if err := chroot.Shell(ctx, &opts, "dpkg", "--install", f.Name()); err != nil {
+				return err
 			}
 		}
 	}
@@ -165,5 +326,9 @@ func (l *Linux) runInstallLinux(ctx context.Context, chroot *Chroot, opts Opts)
 	if err := chroot.AptInstall(ctx, &opts, "initramfs-tools"); err != nil {
 		return err
 	}
-	return chroot.Shell(ctx, &opts, "update-initramfs", "-c", "-k", l.Version)
+	release, err := l.Release(opts)
+	if err != nil {
+		return err
+	}
+	return chroot.Shell(ctx, &opts, "update-initramfs", "-c", "-k", release)
 }
@@ -0,0 +1,173 @@
+package units
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// kernelCacheFormat is mixed into every cache key, and should be bumped
+	// if the way kernel packages are built changes in an incompatible way.
+	kernelCacheFormat = "1"
+
+	ccacheChrootDir = "/var/cache/twl-ccache"
+)
+
+// kernelDebKind returns the kind of kernel package the filename refers to,
+// or the empty string if it is not a kernel image or headers package.
+func kernelDebKind(filename string) string {
+	if !strings.HasSuffix(filename, ".deb") {
+		return ""
+	}
+	for _, kind := range []string{"linux-headers-", "linux-image-"} {
+		if strings.Contains(filename, kind) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// cacheKey computes a hash over all inputs which affect the built kernel
+// packages: the source, the resolved config, the patches applied, and the
+// build timestamp of reproducible builds.
+func (l *Linux) cacheKey(opts Opts) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "format=%s\nversion=%s\n", kernelCacheFormat, l.Version)
+	if opts.SourceDateEpoch != 0 {
+		fmt.Fprintf(h, "source-date-epoch=%d\n", opts.SourceDateEpoch)
+	}
+	if l.SHA256 != "" {
+		fmt.Fprintf(h, "source-sha256=%s\n", strings.ToLower(l.SHA256))
+	} else {
+		fmt.Fprintf(h, "source-url=%s\n", l.URL)
+	}
+
+	conf, err := l.mergedConfig(opts)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "config=%d\n", len(conf))
+	h.Write(conf)
+
+	patches, err := l.patchFiles(opts)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range patches {
+		d, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "patch=%s:%d\n", filepath.Base(p), len(d))
+		h.Write(d)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func (l *Linux) cachedPackagesDir(opts Opts, key string) string {
+	return filepath.Join(opts.KernelCacheDir, "packages", l.Version+"-"+key)
+}
+
+// restoreCached copies previously built kernel packages matching the key
+// into the build directory, returning false if none were cached.
+func (l *Linux) restoreCached(opts Opts, key string) (bool, error) {
+	dir := l.cachedPackagesDir(opts, key)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	var restored int
+	for _, f := range files {
+		if kernelDebKind(f.Name()) == "" {
+			continue
+		}
+		if err := copyFile(filepath.Join(dir, f.Name()), filepath.Join(opts.Dir, f.Name())); err != nil {
+			return false, err
+		}
+		restored++
+	}
+	return restored > 0, nil
+}
+
+// storeCached copies the built kernel packages into the cache directory.
+// Packages are staged into a temporary directory first, so an interrupted
+// copy never results in a partial cache entry.
+func (l *Linux) storeCached(opts Opts, key string) error {
+	if err := os.MkdirAll(filepath.Join(opts.KernelCacheDir, "packages"), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Join(opts.KernelCacheDir, "packages"), ".staging-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	files, err := ioutil.ReadDir(opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if kernelDebKind(f.Name()) == "" {
+			continue
+		}
+		if err := copyFile(filepath.Join(opts.Dir, f.Name()), filepath.Join(tmp, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	dir := l.cachedPackagesDir(opts, key)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// mountCCache bind-mounts the persistent ccache directory into the build
+// root, returning a function which unmounts it.
+func (l *Linux) mountCCache(opts Opts) (func() error, error) {
+	src, dst := filepath.Join(opts.KernelCacheDir, "ccache"), filepath.Join(opts.Dir, ccacheChrootDir)
+	if err := os.MkdirAll(src, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+	if err := syscall.Mount(src, dst, "bind", syscall.MS_BIND, ""); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return unmount(dst)
+	}, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	s, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
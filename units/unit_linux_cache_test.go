@@ -0,0 +1,122 @@
+package units
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeLinuxResources(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "linux-resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "linux", "patches"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "linux", ".config"), []byte("CONFIG_A=y\n# CONFIG_B is not set\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "linux", "patches", "a.patch"), []byte("patch a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLinuxCacheKey(t *testing.T) {
+	res := makeLinuxResources(t)
+	defer os.RemoveAll(res)
+	opts := Opts{Resources: res}
+	l := &Linux{Version: "5.9.14", SHA256: "abcd"}
+
+	base, err := l.cacheKey(opts)
+	if err != nil {
+		t.Fatalf("cacheKey() failed: %v", err)
+	}
+	if again, _ := l.cacheKey(opts); again != base {
+		t.Errorf("cacheKey() is not stable: %q != %q", again, base)
+	}
+
+	tcs := []struct {
+		name   string
+		mutate func()
+	}{
+		{"version", func() { l.Version = "5.9.15" }},
+		{"source", func() { l.SHA256 = "ef01" }},
+		{"config fragment", func() { l.Config = map[string]string{"CONFIG_B": "y"} }},
+		{"patch", func() {
+			ioutil.WriteFile(filepath.Join(res, "linux", "patches", "b.patch"), []byte("patch b\n"), 0644)
+		}},
+		{"reproducible", func() { opts.SourceDateEpoch = 1600000000 }},
+		{"source date epoch", func() { opts.SourceDateEpoch = 1600000001 }},
+	}
+	prev := base
+	for _, tc := range tcs {
+		tc.mutate()
+		key, err := l.cacheKey(opts)
+		if err != nil {
+			t.Fatalf("%s: cacheKey() failed: %v", tc.name, err)
+		}
+		if key == prev {
+			t.Errorf("%s: cacheKey() did not change", tc.name)
+		}
+		prev = key
+	}
+}
+
+func TestLinuxCacheStoreRestore(t *testing.T) {
+	res := makeLinuxResources(t)
+	defer os.RemoveAll(res)
+	build, err := ioutil.TempDir("", "linux-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(build)
+	cache, err := ioutil.TempDir("", "linux-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+
+	opts := Opts{Resources: res, Dir: build, KernelCacheDir: cache}
+	l := &Linux{Version: "5.9.14"}
+	debs := []string{"linux-image-5.9.14_5.9.14-1_amd64.deb", "linux-headers-5.9.14_5.9.14-1_amd64.deb"}
+	for _, d := range append(debs, "linux-libc-dev_5.9.14-1_amd64.deb") {
+		if err := ioutil.WriteFile(filepath.Join(build, d), []byte(d), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if hit, err := l.restoreCached(opts, "key"); err != nil || hit {
+		t.Fatalf("restoreCached() = %v, %v, want false, nil", hit, err)
+	}
+	if err := l.storeCached(opts, "key"); err != nil {
+		t.Fatalf("storeCached() failed: %v", err)
+	}
+	files, err := ioutil.ReadDir(l.cachedPackagesDir(opts, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(debs) {
+		t.Errorf("cached %d files, want %d", len(files), len(debs))
+	}
+
+	for _, d := range debs {
+		os.Remove(filepath.Join(build, d))
+	}
+	if hit, err := l.restoreCached(opts, "key"); err != nil || !hit {
+		t.Fatalf("restoreCached() = %v, %v, want true, nil", hit, err)
+	}
+	for _, d := range debs {
+		got, err := ioutil.ReadFile(filepath.Join(build, d))
+		if err != nil {
+			t.Errorf("reading restored package: %v", err)
+			continue
+		}
+		if string(got) != d {
+			t.Errorf("restored %s = %q, want %q", d, got, d)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package units
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+// seriesFilename is the name of the file in the patches directory which
+// lists the patches to apply, in order.
+const seriesFilename = "series"
+
+// seriesEntry describes a patch listed in a series file.
+type seriesEntry struct {
+	Name string
+	// Constraint limits the kernel versions the patch is applied to. If
+	// nil, the patch is always applied.
+	Constraint *semver.Constraints
+}
+
+// parseSeries reads a quilt-style series file. Each line names a patch,
+// optionally followed by a version constraint such as '>= 5.4, < 5.10'.
+// Blank lines and lines starting with '#' are ignored.
+func parseSeries(r io.Reader) ([]seriesEntry, error) {
+	var (
+		s    = bufio.NewScanner(r)
+		out  []seriesEntry
+		line int
+	)
+	for s.Scan() {
+		line++
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		var e seriesEntry
+		if idx := strings.IndexAny(l, " \t"); idx >= 0 {
+			c, err := semver.NewConstraint(strings.TrimSpace(l[idx:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid version constraint: %v", line, err)
+			}
+			e.Name, e.Constraint = l[:idx], c
+		} else {
+			e.Name = l
+		}
+		if strings.Contains(e.Name, "/") {
+			return nil, fmt.Errorf("line %d: patch %q must be a filename within the patches directory", line, e.Name)
+		}
+		out = append(out, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("scanning series: %v", err)
+	}
+	return out, nil
+}
+
+func (l *Linux) patchDir(opts Opts) string {
+	return filepath.Join(opts.Resources, "linux", "patches")
+}
+
+// patchFiles returns the paths of the patches which apply to this kernel
+// version, in the order they should be applied. Patches are listed in the
+// series file if present, otherwise every file in the patches directory is
+// applied in directory order.
+func (l *Linux) patchFiles(opts Opts) ([]string, error) {
+	dir := l.patchDir(opts)
+
+	f, err := os.Open(filepath.Join(dir, seriesFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		patches, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]string, 0, len(patches))
+		for _, p := range patches {
+			out = append(out, filepath.Join(dir, p.Name()))
+		}
+		return out, nil
+	}
+	defer f.Close()
+
+	series, err := parseSeries(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, seriesFilename), err)
+	}
+	v, err := semver.NewVersion(l.Version)
+	if err != nil {
+		return nil, fmt.Errorf("parsing kernel version: %v", err)
+	}
+
+	var out []string
+	for _, e := range series {
+		if e.Constraint != nil && !e.Constraint.Check(v) {
+			continue
+		}
+		p := filepath.Join(dir, e.Name)
+		if _, err := os.Stat(p); err != nil {
+			return nil, fmt.Errorf("series: %v", err)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// patchFailures extracts the lines of patch output which describe why a
+// patch did not apply.
+func patchFailures(output []byte) []string {
+	var out []string
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		switch {
+		case strings.HasPrefix(l, "Hunk #") && strings.Contains(l, "FAILED"),
+			strings.HasPrefix(l, "can't find file to patch"),
+			strings.HasPrefix(l, "Reversed (or previously applied) patch detected"),
+			strings.HasPrefix(l, "patch: **** "),
+			strings.HasPrefix(l, "checking file "):
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func runPatch(ctx context.Context, dir, patch string, args ...string) ([]byte, error) {
+	c := exec.CommandContext(ctx, "patch", append([]string{"-f", "-p1", "-i", patch}, args...)...)
+	c.Dir = dir
+	return c.CombinedOutput()
+}
+
+// patchedFiles returns the files a patch changes, relative to the tree it
+// is applied to with -p1.
+func patchedFiles(patch string) ([]string, error) {
+	f, err := os.Open(patch)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := s.Text()
+		if !strings.HasPrefix(l, "--- ") && !strings.HasPrefix(l, "+++ ") {
+			continue
+		}
+		name := strings.Trim(strings.SplitN(l[4:], "\t", 2)[0], "\" ")
+		idx := strings.Index(name, "/")
+		if idx < 0 {
+			continue
+		}
+		name = filepath.Clean(name[idx+1:])
+		if name == ".." || strings.HasPrefix(name, "../") || filepath.IsAbs(name) {
+			continue
+		}
+		out = append(out, name)
+	}
+	return out, s.Err()
+}
+
+// checkPatches applies the patches in order to a scratch copy of the files
+// they change, returning an error describing every hunk which would fail.
+// As in the real tree, each patch is checked against the files as changed
+// by the patches before it.
+func (l *Linux) checkPatches(ctx context.Context, opts Opts, patches []string) error {
+	scratch, err := ioutil.TempDir("", "twl-patch-check")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	src := filepath.Join(opts.Dir, l.dirFilename())
+	for _, p := range patches {
+		files, err := patchedFiles(p)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			dst := filepath.Join(scratch, f)
+			if _, err := os.Lstat(dst); err == nil {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(src, f)); err != nil {
+				// Files made by the patch are not in the tree.
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if err := copyFile(filepath.Join(src, f), dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	var (
+		report strings.Builder
+		failed int
+	)
+	for _, p := range patches {
+		out, err := runPatch(ctx, scratch, p, "--no-backup-if-mismatch")
+		if err == nil {
+			continue
+		}
+		if _, isExit := err.(*exec.ExitError); !isExit {
+			return err
+		}
+
+		failed++
+		fmt.Fprintf(&report, "  %s:\n", filepath.Base(p))
+		reasons := patchFailures(out)
+		if len(reasons) == 0 {
+			reasons = []string{strings.TrimSpace(string(out))}
+		}
+		for _, r := range reasons {
+			fmt.Fprintf(&report, "    %s\n", r)
+		}
+	}
+
+	if failed > 0 {
+		msg := fmt.Sprintf("%d of %d patch(es) do not apply to Linux %s:\n%s", failed, len(patches), l.Version, report.String())
+		fmt.Fprint(opts.L.Stderr(), msg)
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// applyPatches checks and applies the patches for this kernel version,
+// returning the names of the patches applied.
+func (l *Linux) applyPatches(ctx context.Context, opts Opts) ([]string, error) {
+	opts.L.SetSubstage("Patching")
+	patches, err := l.patchFiles(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.checkPatches(ctx, opts, patches); err != nil {
+		return nil, err
+	}
+
+	applied := make([]string, 0, len(patches))
+	for _, p := range patches {
+		out, err := runPatch(ctx, filepath.Join(opts.Dir, l.dirFilename()), p)
+		opts.L.Stdout().Write(out)
+		if err != nil {
+			return nil, fmt.Errorf("applying %s: %v", filepath.Base(p), err)
+		}
+		applied = append(applied, filepath.Base(p))
+	}
+	return applied, nil
+}
@@ -0,0 +1,129 @@
+package units
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSeries(t *testing.T) {
+	series, err := parseSeries(strings.NewReader(`# comment
+a.patch
+
+b.patch   >= 5.4, < 5.10
+c.patch >=5.10
+`))
+	if err != nil {
+		t.Fatalf("parseSeries() failed: %v", err)
+	}
+	if len(series) != 3 {
+		t.Fatalf("len(series) = %d, want 3", len(series))
+	}
+	if series[0].Name != "a.patch" || series[0].Constraint != nil {
+		t.Errorf("series[0] = %+v, want unconstrained a.patch", series[0])
+	}
+	if series[1].Name != "b.patch" || series[1].Constraint == nil {
+		t.Errorf("series[1] = %+v, want constrained b.patch", series[1])
+	}
+
+	for _, bad := range []string{"a.patch >= banana", "../a.patch"} {
+		if _, err := parseSeries(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseSeries(%q) did not fail", bad)
+		}
+	}
+}
+
+func TestPatchFilesSeries(t *testing.T) {
+	res := makeLinuxResources(t)
+	defer os.RemoveAll(res)
+	dir := filepath.Join(res, "linux", "patches")
+	for _, p := range []string{"b.patch", "old.patch", "new.patch"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, p), []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, seriesFilename), []byte("b.patch\nold.patch < 5.10\nnew.patch >= 5.10\na.patch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		version string
+		want    []string
+	}{
+		{"5.9.14", []string{"b.patch", "old.patch", "a.patch"}},
+		{"5.10.1", []string{"b.patch", "new.patch", "a.patch"}},
+	}
+	for _, tc := range tcs {
+		l := &Linux{Version: tc.version}
+		got, err := l.patchFiles(Opts{Resources: res})
+		if err != nil {
+			t.Fatalf("patchFiles() failed: %v", err)
+		}
+		for i := range got {
+			got[i] = filepath.Base(got[i])
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("patchFiles(%s) = %v, want %v", tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestCheckPatches(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not installed")
+	}
+	res := makeLinuxResources(t)
+	defer os.RemoveAll(res)
+	build, err := ioutil.TempDir("", "linux-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(build)
+
+	l := &Linux{Version: "5.9.14"}
+	src := filepath.Join(build, l.dirFilename())
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "file.c"), []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(res, "linux", "patches")
+	good := "--- a/file.c\n+++ b/file.c\n@@ -1,3 +1,3 @@\n one\n-two\n+TWO\n three\n"
+	bad := "--- a/file.c\n+++ b/file.c\n@@ -1,3 +1,3 @@\n uno\n-dos\n+DOS\n tres\n"
+	// c.patch only applies on top of a.patch.
+	stacked := "--- a/file.c\n+++ b/file.c\n@@ -1,3 +1,3 @@\n one\n-TWO\n+2\n three\n"
+	ioutil.WriteFile(filepath.Join(dir, "a.patch"), []byte(good), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.patch"), []byte(bad), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "c.patch"), []byte(stacked), 0644)
+
+	opts := Opts{Resources: res, Dir: build, L: &testLogger{}}
+	err = l.checkPatches(context.Background(), opts, []string{filepath.Join(dir, "a.patch"), filepath.Join(dir, "b.patch")})
+	if err == nil {
+		t.Fatal("checkPatches() did not fail")
+	}
+	for _, want := range []string{"1 of 2 patch(es)", "b.patch", "Hunk #1 FAILED"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("checkPatches() error %q does not contain %q", err, want)
+		}
+	}
+
+	if err := l.checkPatches(context.Background(), opts, []string{filepath.Join(dir, "a.patch")}); err != nil {
+		t.Errorf("checkPatches() failed: %v", err)
+	}
+	if err := l.checkPatches(context.Background(), opts, []string{filepath.Join(dir, "a.patch"), filepath.Join(dir, "c.patch")}); err != nil {
+		t.Errorf("checkPatches() failed on stacked patches: %v", err)
+	}
+	if err := l.checkPatches(context.Background(), opts, []string{filepath.Join(dir, "c.patch")}); err == nil {
+		t.Error("checkPatches() did not fail without the patch c.patch depends on")
+	}
+	if d, _ := ioutil.ReadFile(filepath.Join(src, "file.c")); string(d) != "one\ntwo\nthree\n" {
+		t.Errorf("checking modified the source tree: %q", d)
+	}
+}
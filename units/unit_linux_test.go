@@ -0,0 +1,40 @@
+package units
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinuxRelease(t *testing.T) {
+	res := makeLinuxResources(t)
+	defer os.RemoveAll(res)
+	opts := Opts{Resources: res}
+
+	tcs := []struct {
+		name   string
+		base   string
+		config map[string]string
+		want   string
+	}{
+		{"none", "CONFIG_A=y\n", nil, "5.9.14"},
+		{"base", "CONFIG_A=y\nCONFIG_LOCALVERSION=\"-base\"\n", nil, "5.9.14-base"},
+		{"fragment", "CONFIG_LOCALVERSION=\"-base\"\n", map[string]string{"CONFIG_LOCALVERSION": "\"-twl\""}, "5.9.14-twl"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(filepath.Join(res, "linux", ".config"), []byte(tc.base), 0644); err != nil {
+				t.Fatal(err)
+			}
+			l := &Linux{Version: "5.9.14", Config: tc.config}
+			got, err := l.Release(opts)
+			if err != nil {
+				t.Fatalf("Release() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Release() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -35,6 +35,7 @@ tzdata tzdata/Areas select `+d.Area+`
 		return err
 	}
 	cmd.Env = localeEnv
+	opts.setEpoch(cmd)
 	cmd.Stdout = opts.L.Stdout()
 	cmd.Stderr = opts.L.Stderr()
 	return cmd.Run()
@@ -88,6 +89,7 @@ func (d *Locale) Run(ctx context.Context, opts Opts) error {
 		return err
 	}
 	cmd.Env = localeEnv
+	opts.setEpoch(cmd)
 	cmd.Stdout = opts.L.Stdout()
 	cmd.Stderr = opts.L.Stderr()
 	if err := cmd.Run(); err != nil {
@@ -98,6 +100,7 @@ func (d *Locale) Run(ctx context.Context, opts Opts) error {
 		return err
 	}
 	cmd.Env = localeEnv
+	opts.setEpoch(cmd)
 	cmd.Stdin = strings.NewReader("locales locales/locales_to_be_generated multiselect " + strings.Join(d.Generate, ", ") + "\n")
 	cmd.Stdout = opts.L.Stdout()
 	cmd.Stderr = opts.L.Stderr()
@@ -109,6 +112,7 @@ func (d *Locale) Run(ctx context.Context, opts Opts) error {
 		return err
 	}
 	cmd.Env = localeEnv
+	opts.setEpoch(cmd)
 	cmd.Stdin = strings.NewReader("locales locales/default_environment_locale select " + d.Default + "\n")
 	cmd.Stdout = opts.L.Stdout()
 	cmd.Stderr = opts.L.Stderr()
@@ -124,6 +128,7 @@ func (d *Locale) Run(ctx context.Context, opts Opts) error {
 		return err
 	}
 	cmd.Env = localeEnv
+	opts.setEpoch(cmd)
 	cmd.Stdout = opts.L.Stdout()
 	cmd.Stderr = opts.L.Stderr()
 	if err := cmd.Run(); err != nil {
@@ -0,0 +1,269 @@
+package units
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostStateGlobs match files which hold state specific to the machine or
+// time the system was built on. They are regenerated as needed on boot.
+var hostStateGlobs = []string{
+	"var/cache/ldconfig/aux-cache",
+	"var/cache/man/index.db",
+	"var/cache/man/*/index.db",
+	"var/cache/apt/*.bin",
+	"var/cache/debconf/*-old",
+	"var/lib/dpkg/*-old",
+	"var/lib/systemd/random-seed",
+	"var/lib/systemd/catalog/database",
+}
+
+// StatusDir is the directory of the build directory in which the status
+// of each unit is recorded. It is not part of the built system.
+const StatusDir = "build-status"
+
+// ChangeTimesFile is the file in StatusDir which records the change times
+// of files before ClampTimes changed them.
+const ChangeTimesFile = "change-times"
+
+// shadowFiles hold the date each password was last changed, in days
+// since the epoch.
+var shadowFiles = []string{"etc/shadow", "etc/shadow-"}
+
+// Normalize is a unit which makes the built system reproducible: it
+// removes host-specific state, regenerates caches, and clamps file times
+// to SOURCE_DATE_EPOCH. It must run after every other unit.
+type Normalize struct{}
+
+// Name implements Unit.
+func (n *Normalize) Name() string {
+	return "Normalize"
+}
+
+// Run implements Unit.
+func (n *Normalize) Run(ctx context.Context, opts Opts) error {
+	if opts.SourceDateEpoch == 0 {
+		return errors.New("reproducible builds require SOURCE_DATE_EPOCH")
+	}
+
+	opts.L.SetSubstage("Removing host-specific state")
+	if err := clearHostState(opts.Dir); err != nil {
+		return err
+	}
+	for _, f := range shadowFiles {
+		if err := clampShadow(filepath.Join(opts.Dir, f), opts.SourceDateEpoch/(24*60*60)); err != nil {
+			return err
+		}
+	}
+
+	opts.L.SetSubstage("Regenerating library cache")
+	chroot, err := prepareChroot(opts.Dir)
+	if err != nil {
+		return err
+	}
+	if err := chroot.Shell(ctx, &opts, "ldconfig"); err != nil {
+		chroot.Close()
+		return err
+	}
+	if err := chroot.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(opts.Dir, "var", "cache", "ldconfig", "aux-cache")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	opts.L.SetSubstage("Clamping file times")
+	return ClampTimes(opts.Dir, opts.SourceDateEpoch)
+}
+
+// clearHostState removes state specific to the build host from the system
+// at root. The machine ID is emptied rather than removed, so systemd
+// generates one on first boot.
+func clearHostState(root string) error {
+	for _, g := range hostStateGlobs {
+		matches, err := filepath.Glob(filepath.Join(root, g))
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			if err := os.Remove(m); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "etc", "machine-id"), nil, 0444); err != nil {
+		return err
+	}
+	dbusID := filepath.Join(root, "var", "lib", "dbus", "machine-id")
+	if fi, err := os.Lstat(dbusID); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		if err := os.Remove(dbusID); err != nil {
+			return err
+		}
+		if err := os.Symlink("/etc/machine-id", dbusID); err != nil {
+			return err
+		}
+	}
+
+	// Logs record when and where the system was built.
+	return filepath.Walk(filepath.Join(root, "var", "log"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() && fi.Size() > 0 {
+			return os.Truncate(path, 0)
+		}
+		return nil
+	})
+}
+
+// clampShadowDates sets the last password change of every entry in a
+// shadow file which is later than the given day.
+func clampShadowDates(shadow []byte, day int64) []byte {
+	lines := bytes.Split(shadow, []byte("\n"))
+	for i, l := range lines {
+		fields := bytes.Split(l, []byte(":"))
+		if len(fields) < 3 {
+			continue
+		}
+		if d, err := strconv.ParseInt(string(fields[2]), 10, 64); err == nil && d > day {
+			fields[2] = []byte(strconv.FormatInt(day, 10))
+			lines[i] = bytes.Join(fields, []byte(":"))
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+func clampShadow(path string, day int64) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, clampShadowDates(d, day), fi.Mode().Perm())
+}
+
+// ClampTimes sets the access and modification times of every file of the
+// system built in root which is newer than the epoch to the epoch.
+// Symlinks are changed rather than their targets. The status directory
+// is left alone, as it records when each unit finished.
+//
+// Setting the times of a file sets its change time to now, so the change
+// time of each file is first recorded in ChangeTimesFile, which
+// ReadChangeTimes reads.
+func ClampTimes(root string, epoch int64) error {
+	if err := os.MkdirAll(filepath.Join(root, StatusDir), 0755); err != nil {
+		return err
+	}
+	// The file is appended to, so a file clamped by an earlier run keeps
+	// the change time recorded then.
+	f, err := os.OpenFile(filepath.Join(root, StatusDir, ChangeTimesFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := clampTimes(root, epoch, w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func clampTimes(root string, epoch int64, changeTimes io.Writer) error {
+	var (
+		limit = time.Unix(epoch, 0)
+		ts    = []unix.Timespec{{Sec: epoch}, {Sec: epoch}}
+	)
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == StatusDir {
+			return filepath.SkipDir
+		}
+		if !fi.ModTime().After(limit) {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if _, err := fmt.Fprintf(changeTimes, "%d %s\n", syscall.TimespecToNsec(st.Ctim), strconv.Quote(rel)); err != nil {
+				return err
+			}
+		}
+		return clampTime(path, ts)
+	})
+}
+
+// ReadChangeTimes returns the change times of the files of the system
+// built in dir from before ClampTimes changed them, keyed by their path
+// relative to dir. It returns nil if the times were never clamped.
+func ReadChangeTimes(dir string) (map[string]time.Time, error) {
+	f, err := os.Open(filepath.Join(dir, StatusDir, ChangeTimesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	out := map[string]time.Time{}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.SplitN(s.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: line %d: expected a time and a path", ChangeTimesFile, line)
+		}
+		ns, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", ChangeTimesFile, line, err)
+		}
+		rel, err := strconv.Unquote(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", ChangeTimesFile, line, err)
+		}
+		if _, ok := out[rel]; !ok {
+			out[rel] = time.Unix(0, ns)
+		}
+	}
+	return out, s.Err()
+}
+
+func clampTime(path string, ts []unix.Timespec) error {
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return fmt.Errorf("setting times of %s: %v", path, err)
+	}
+	return nil
+}
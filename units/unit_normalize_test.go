@@ -0,0 +1,148 @@
+package units
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClampShadowDates(t *testing.T) {
+	in := "root:*:18600:0:99999:7:::\ntwl:$6$abc:18000:0:99999:7:::\nbad line\n"
+	want := "root:*:18500:0:99999:7:::\ntwl:$6$abc:18000:0:99999:7:::\nbad line\n"
+	if got := string(clampShadowDates([]byte(in), 18500)); got != want {
+		t.Errorf("clampShadowDates() = %q, want %q", got, want)
+	}
+}
+
+func TestClearHostState(t *testing.T) {
+	root, err := ioutil.TempDir("", "twl-normalize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for f, data := range map[string]string{
+		"etc/machine-id":                   "0123456789abcdef0123456789abcdef\n",
+		"var/lib/dbus/machine-id":          "0123456789abcdef0123456789abcdef\n",
+		"var/cache/man/en/index.db":        "index",
+		"var/cache/ldconfig/aux-cache":     "cache",
+		"var/lib/dpkg/status-old":          "old",
+		"var/lib/dpkg/status":              "status",
+		"var/log/apt/history.log":          "Start-Date: 2020-12-21",
+		"var/lib/systemd/random-seed":      "seed",
+		"usr/share/doc/keep/index.db":      "keep",
+		"var/cache/apt/pkgcache.bin":       "cache",
+		"var/cache/apt/archives/a.deb":     "deb",
+		"var/cache/debconf/config.dat-old": "old",
+	} {
+		p := filepath.Join(root, f)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := clearHostState(root); err != nil {
+		t.Fatalf("clearHostState() failed: %v", err)
+	}
+	for _, f := range []string{"var/cache/man/en/index.db", "var/cache/ldconfig/aux-cache", "var/lib/dpkg/status-old", "var/lib/systemd/random-seed", "var/cache/apt/pkgcache.bin", "var/cache/debconf/config.dat-old"} {
+		if _, err := os.Lstat(filepath.Join(root, f)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", f, err)
+		}
+	}
+	for _, f := range []string{"var/lib/dpkg/status", "usr/share/doc/keep/index.db", "var/cache/apt/archives/a.deb"} {
+		if _, err := os.Lstat(filepath.Join(root, f)); err != nil {
+			t.Errorf("%s was removed: %v", f, err)
+		}
+	}
+	if d, _ := ioutil.ReadFile(filepath.Join(root, "etc", "machine-id")); len(d) != 0 {
+		t.Errorf("machine-id = %q, want empty", d)
+	}
+	if l, err := os.Readlink(filepath.Join(root, "var", "lib", "dbus", "machine-id")); err != nil || l != "/etc/machine-id" {
+		t.Errorf("dbus machine-id links to %q, %v", l, err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "var", "log", "apt", "history.log")); err != nil || fi.Size() != 0 {
+		t.Errorf("history.log was not truncated: %v", err)
+	}
+}
+
+func TestClampTimes(t *testing.T) {
+	root, err := ioutil.TempDir("", "twl-normalize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr", "bin", "new"), nil, 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr", "bin", "old"), nil, 0755)
+	old := time.Unix(1000, 0)
+	os.Chtimes(filepath.Join(root, "usr", "bin", "old"), old, old)
+	os.Symlink("new", filepath.Join(root, "usr", "bin", "link"))
+
+	const epoch = 1600000000
+	os.MkdirAll(filepath.Join(root, StatusDir), 0755)
+	ioutil.WriteFile(filepath.Join(root, StatusDir, "Debootstrap"), []byte("complete"), 0644)
+	fi, err := os.Lstat(filepath.Join(root, "usr", "bin", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCtime := time.Unix(0, syscall.TimespecToNsec(fi.Sys().(*syscall.Stat_t).Ctim))
+
+	if err := ClampTimes(root, epoch); err != nil {
+		t.Fatalf("ClampTimes() failed: %v", err)
+	}
+	for f, want := range map[string]int64{
+		"":             epoch,
+		"usr/bin":      epoch,
+		"usr/bin/new":  epoch,
+		"usr/bin/old":  1000,
+		"usr/bin/link": epoch,
+	} {
+		fi, err := os.Lstat(filepath.Join(root, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.ModTime().Unix(); got != want {
+			t.Errorf("%q mtime = %d, want %d", f, got, want)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(root, StatusDir, "Debootstrap")); err != nil || fi.ModTime().Unix() == epoch {
+		t.Errorf("the status of a unit was clamped: %v", err)
+	}
+
+	ctimes, err := ReadChangeTimes(root)
+	if err != nil {
+		t.Fatalf("ReadChangeTimes() failed: %v", err)
+	}
+	if got := ctimes["usr/bin/new"]; !got.Equal(newCtime) {
+		t.Errorf("change time of usr/bin/new = %v, want %v", got, newCtime)
+	}
+	if _, ok := ctimes["usr/bin/old"]; ok {
+		t.Error("the change time of usr/bin/old was recorded, though it was not clamped")
+	}
+}
+
+func TestSetEpoch(t *testing.T) {
+	opts := Opts{SourceDateEpoch: 1600000000}
+	cmd := exec.Command("true")
+	cmd.Env = localeEnv
+	opts.setEpoch(cmd)
+	if got := strings.Join(cmd.Env, " "); got != "DEBIAN_FRONTEND=noninteractive DEBCONF_NONINTERACTIVE_SEEN=true SOURCE_DATE_EPOCH=1600000000" {
+		t.Errorf("env = %q", got)
+	}
+	if len(localeEnv) != 2 {
+		t.Errorf("setEpoch() modified localeEnv: %v", localeEnv)
+	}
+
+	cmd = exec.Command("true")
+	(&Opts{}).setEpoch(cmd)
+	if cmd.Env != nil {
+		t.Errorf("env = %v without an epoch, want the builder's", cmd.Env)
+	}
+}
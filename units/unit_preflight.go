@@ -32,6 +32,14 @@ var (
 		"xz",
 	}
 
+	// secureBootBinaries are needed on the host to sign and verify the
+	// system when Secure Boot keys are provided.
+	secureBootBinaries = []string{
+		"sbsign",
+		"sbverify",
+		"openssl",
+	}
+
 	neededVersions = []versionCheck{
 		{
 			bin:        "bash",
@@ -162,6 +170,16 @@ func (p *Preflight) Run(ctx context.Context, opts Opts) error {
 			return fmt.Errorf("could not find %s on host", bin)
 		}
 	}
+	if opts.SecureBootKeys != "" {
+		for _, bin := range secureBootBinaries {
+			if _, err := FindBinary(bin); err != nil {
+				return fmt.Errorf("could not find %s on host, needed for Secure Boot signing", bin)
+			}
+		}
+		if _, err := loadSecureBootKeys(opts); err != nil {
+			return err
+		}
+	}
 
 	for _, chk := range neededVersions {
 		versStr, err := CmdCombined(ctx, chk.bin, chk.args...)
@@ -0,0 +1,195 @@
+package units
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/twitchylinux/builder/secureboot"
+)
+
+// outOfTreeModuleDirs are the directories under /lib/modules/<release>
+// which modules not built with the kernel are installed to.
+var outOfTreeModuleDirs = []string{"extra", "updates"}
+
+// kernelReleases returns the releases of the kernels installed in /boot of
+// the system at root.
+func kernelReleases(root string) ([]string, error) {
+	images, err := filepath.Glob(filepath.Join(root, "boot", "vmlinuz-*"))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(images))
+	for _, img := range images {
+		out = append(out, strings.TrimPrefix(filepath.Base(img), "vmlinuz-"))
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// outOfTreeModules returns the paths of modules for the given kernel
+// release which were not built with the kernel.
+func outOfTreeModules(root, release string) ([]string, error) {
+	var out []string
+	for _, dir := range outOfTreeModuleDirs {
+		base := filepath.Join(root, "lib", "modules", release, dir)
+		err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == base {
+					return nil
+				}
+				return err
+			}
+			if info.Mode().IsRegular() && strings.HasSuffix(path, ".ko") {
+				out = append(out, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// signFilePath returns the host path to the sign-file tool shipped with
+// the headers of the given kernel release.
+func signFilePath(root, release string) (string, error) {
+	build := filepath.Join(root, "lib", "modules", release, "build")
+	target, err := os.Readlink(build)
+	switch {
+	case err == nil && filepath.IsAbs(target):
+		// Absolute links are relative to the built system.
+		build = filepath.Join(root, target)
+	case err == nil:
+		build = filepath.Join(filepath.Dir(build), target)
+	}
+	p := filepath.Join(build, "scripts", "sign-file")
+	if _, err := os.Stat(p); err != nil {
+		return "", fmt.Errorf("sign-file for Linux %s: %v", release, err)
+	}
+	return p, nil
+}
+
+func loadSecureBootKeys(opts Opts) (*secureboot.Keys, error) {
+	if opts.SecureBootKeys == "" {
+		return nil, errors.New("no Secure Boot key directory specified")
+	}
+	return secureboot.LoadKeys(opts.SecureBootKeys)
+}
+
+// SecureBootSign is a unit which signs the installed kernels and
+// out-of-tree kernel modules with the Secure Boot keys, and installs the
+// certificate for enrollment as a machine owner key. Keys are read from
+// the host and never copied into the system.
+type SecureBootSign struct{}
+
+// Name implements Unit.
+func (s *SecureBootSign) Name() string {
+	return "Secure-boot-sign"
+}
+
+// Run implements Unit.
+func (s *SecureBootSign) Run(ctx context.Context, opts Opts) error {
+	keys, err := loadSecureBootKeys(opts)
+	if err != nil {
+		return err
+	}
+	releases, err := kernelReleases(opts.Dir)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		return errors.New("no kernels installed")
+	}
+
+	chroot, err := prepareChroot(opts.Dir)
+	if err != nil {
+		return err
+	}
+	defer chroot.Close()
+
+	for _, r := range releases {
+		opts.L.SetSubstage("Signing Linux " + r)
+		if err := secureboot.SignEFI(ctx, keys, filepath.Join(opts.Dir, "boot", "vmlinuz-"+r)); err != nil {
+			return err
+		}
+
+		mods, err := outOfTreeModules(opts.Dir, r)
+		if err != nil {
+			return err
+		}
+		if len(mods) == 0 {
+			continue
+		}
+		signFile, err := signFilePath(opts.Dir, r)
+		if err != nil {
+			return err
+		}
+		for _, m := range mods {
+			if err := secureboot.SignModule(ctx, keys, signFile, m); err != nil {
+				return err
+			}
+		}
+		// The initramfs may contain unsigned copies of the modules.
+		if err := chroot.Shell(ctx, &opts, "update-initramfs", "-u", "-k", r); err != nil {
+			return err
+		}
+	}
+
+	opts.L.SetSubstage("Writing MOK enrollment material")
+	if err := chroot.AptInstall(ctx, &opts, "mokutil"); err != nil {
+		return err
+	}
+	return secureboot.WriteEnrollment(opts.Dir, keys)
+}
+
+// SecureBootVerify is a unit which checks that everything signed by
+// SecureBootSign carries a valid signature from the Secure Boot keys.
+type SecureBootVerify struct{}
+
+// Name implements Unit.
+func (s *SecureBootVerify) Name() string {
+	return "Secure-boot-verify"
+}
+
+// Run implements Unit.
+func (s *SecureBootVerify) Run(ctx context.Context, opts Opts) error {
+	keys, err := loadSecureBootKeys(opts)
+	if err != nil {
+		return err
+	}
+	releases, err := kernelReleases(opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, r := range releases {
+		opts.L.SetSubstage("Verifying Linux " + r)
+		if err := secureboot.VerifyEFI(ctx, keys, filepath.Join(opts.Dir, "boot", "vmlinuz-"+r)); err != nil {
+			failures = append(failures, err.Error())
+		}
+		mods, err := outOfTreeModules(opts.Dir, r)
+		if err != nil {
+			return err
+		}
+		for _, m := range mods {
+			if err := secureboot.VerifyModule(ctx, keys, m); err != nil {
+				failures = append(failures, err.Error())
+			}
+		}
+	}
+	if err := secureboot.VerifyEnrollment(opts.Dir, keys); err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d signature check(s) failed:\n  %s", len(failures), strings.Join(failures, "\n  "))
+	}
+	return nil
+}
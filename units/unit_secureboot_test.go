@@ -0,0 +1,72 @@
+package units
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSecureBootTargets(t *testing.T) {
+	root, err := ioutil.TempDir("", "twl-sb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []string{
+		"boot/vmlinuz-5.9.14-twl",
+		"boot/vmlinuz-5.8.0",
+		"lib/modules/5.9.14-twl/kernel/drivers/in-tree.ko",
+		"lib/modules/5.9.14-twl/extra/v4l2loopback.ko",
+		"lib/modules/5.9.14-twl/updates/dkms/zfs.ko",
+		"lib/modules/5.9.14-twl/updates/dkms/README",
+		"usr/src/linux-headers-5.9.14-twl/scripts/sign-file",
+	} {
+		p := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("/usr/src/linux-headers-5.9.14-twl", filepath.Join(root, "lib/modules/5.9.14-twl/build")); err != nil {
+		t.Fatal(err)
+	}
+
+	releases, err := kernelReleases(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"5.8.0", "5.9.14-twl"}; !reflect.DeepEqual(releases, want) {
+		t.Errorf("kernelReleases() = %v, want %v", releases, want)
+	}
+
+	mods, err := outOfTreeModules(root, "5.9.14-twl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(root, "lib/modules/5.9.14-twl/extra/v4l2loopback.ko"),
+		filepath.Join(root, "lib/modules/5.9.14-twl/updates/dkms/zfs.ko"),
+	}
+	if !reflect.DeepEqual(mods, want) {
+		t.Errorf("outOfTreeModules() = %v, want %v", mods, want)
+	}
+	if mods, err := outOfTreeModules(root, "5.8.0"); err != nil || len(mods) != 0 {
+		t.Errorf("outOfTreeModules(5.8.0) = %v, %v, want none", mods, err)
+	}
+
+	signFile, err := signFilePath(root, "5.9.14-twl")
+	if err != nil {
+		t.Fatalf("signFilePath() failed: %v", err)
+	}
+	if want := filepath.Join(root, "usr/src/linux-headers-5.9.14-twl/scripts/sign-file"); signFile != want {
+		t.Errorf("signFilePath() = %q, want %q", signFile, want)
+	}
+	if _, err := signFilePath(root, "5.8.0"); err == nil {
+		t.Error("signFilePath() succeeded without headers")
+	}
+}
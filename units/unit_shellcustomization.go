@@ -17,6 +17,9 @@ type UserSpec struct {
 	Username string
 	Password string
 	Groups   []string
+	// Home is the home directory of the user. If empty, the default of
+	// adduser.conf is used.
+	Home string
 }
 
 // ShellCustomization is a unit which customizes the accounts + shell.
@@ -70,7 +73,11 @@ func (d *ShellCustomization) makeUser(ctx context.Context, opts *Opts) error {
 	}
 
 	for _, usr := range d.Users {
-		if err := c.UpsertUser(usr.Username, user.OptCreateSkel()); err != nil {
+		userOpts := []user.AddUserOpt{user.OptCreateSkel()}
+		if usr.Home != "" {
+			userOpts = append(userOpts, user.OptHomedir(usr.Home))
+		}
+		if err := c.UpsertUser(usr.Username, userOpts...); err != nil {
 			return fmt.Errorf("could not upsert user %q: %v", usr.Username, err)
 		}
 
@@ -5,6 +5,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"os/exec"
 )
 
 // Opts describes options provided to the units.
@@ -25,12 +27,46 @@ type Opts struct {
 	NumThreads int
 
 	DebProxy string
+	// AptListsDir is an optional directory of apt Packages indexes to use
+	// when validating package names, instead of fetching them.
+	AptListsDir string
+	// SkipPackageCheck disables the check of package names, which
+	// otherwise fetches the package indexes unless AptListsDir is set.
+	SkipPackageCheck bool
+	// PinHashes records the hashes of downloads verified by their
+	// signature in the resources directory. The resources directory is
+	// otherwise never written to.
+	PinHashes bool
+	// KernelCacheDir is an optional host directory where built kernel
+	// packages are cached between builds.
+	KernelCacheDir string
+	// SecureBootKeys is an optional host directory containing the keys
+	// used to sign the kernel, modules and bootloader for Secure Boot.
+	SecureBootKeys string
+	// SourceDateEpoch, if non-zero, makes the build reproducible. It is
+	// passed to every command as SOURCE_DATE_EPOCH, and newer file
+	// times are clamped to it.
+	SourceDateEpoch int64
 }
 
 func (o *Opts) makeNumThreadsArg() string {
 	return fmt.Sprintf("-j%d", o.NumThreads)
 }
 
+// setEpoch adds SOURCE_DATE_EPOCH to the environment of the command in
+// reproducible builds. Commands without an environment are given that of
+// the builder.
+func (o *Opts) setEpoch(cmd *exec.Cmd) {
+	if o.SourceDateEpoch == 0 {
+		return
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env[:len(env):len(env)], fmt.Sprintf("SOURCE_DATE_EPOCH=%d", o.SourceDateEpoch))
+}
+
 // Logger implements status reporting and logging for executing units.
 type Logger interface {
 	Stderr() io.Writer
@@ -1,10 +1,22 @@
 package units
 
 import (
+	"bytes"
+	"io"
 	"runtime"
 	"testing"
 )
 
+// testLogger implements Logger, capturing output.
+type testLogger struct {
+	stdout, stderr bytes.Buffer
+}
+
+func (l *testLogger) Stderr() io.Writer                        { return &l.stderr }
+func (l *testLogger) Stdout() io.Writer                        { return &l.stdout }
+func (l *testLogger) SetSubstage(string)                       {}
+func (l *testLogger) SetProgress(msg string, fraction float64) {}
+
 func TestFindBinary(t *testing.T) {
 	if runtime.GOOS != "linux" {
 		t.SkipNow()
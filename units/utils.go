@@ -60,6 +60,7 @@ func Shell(ctx context.Context, opts *Opts, bin string, args ...string) error {
 	cmd.Args = append([]string{p}, args...)
 	cmd.Stdout = opts.L.Stdout()
 	cmd.Stderr = opts.L.Stderr()
+	opts.setEpoch(cmd)
 	return cmd.Run()
 }
 
@@ -82,6 +82,7 @@ func (c *Chroot) CmdContext(ctx context.Context, opts *Opts, bin string, args ..
 
 	cmd := exec.CommandContext(ctx, c.chrootPath)
 	cmd.Args = append([]string{c.chrootPath, c.Dir, p}, args...)
+	opts.setEpoch(cmd)
 	return cmd, nil
 }
 
@@ -108,6 +109,7 @@ func (c *Chroot) AptInstall(ctx context.Context, opts *Opts, packages ...string)
 	if opts.DebProxy != "" {
 		cmd.Env = append(cmd.Env, "http_proxy=http://"+opts.DebProxy)
 	}
+	opts.setEpoch(cmd)
 	return cmd.Run()
 }
 
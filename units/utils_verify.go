@@ -0,0 +1,233 @@
+package units
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
+)
+
+// PinFilename is the name of the file in the resources directory which
+// records the hashes of downloads after their signature was verified.
+const PinFilename = "pinned-hashes.json"
+
+// VerifySpec describes how a downloaded file should be verified.
+type VerifySpec struct {
+	// URL is the location the file was fetched from.
+	URL string
+	// SHA256 is the expected hash of the file, if known.
+	SHA256 string
+	// SignatureURL is the location of a detached PGP signature.
+	SignatureURL string
+	// Keyring is the path to the keyring containing trusted signing keys,
+	// relative to the resources directory.
+	Keyring string
+}
+
+// VerifyDownload checks the integrity of a downloaded file. The file is
+// checked against the configured hash, or a pinned hash, if either is
+// available. Otherwise, the detached signature is fetched and verified. If
+// opts.PinHashes is set, the hash of the file is then pinned for later
+// builds.
+func VerifyDownload(ctx context.Context, opts *Opts, spec VerifySpec, path string) error {
+	if spec.SHA256 != "" {
+		if err := CheckSHA256(path, spec.SHA256); err != nil {
+			return err
+		}
+		if spec.SignatureURL == "" {
+			return nil
+		}
+	} else {
+		pinned, err := readPin(opts, spec.URL)
+		if err != nil {
+			return err
+		}
+		if pinned != "" {
+			return CheckSHA256(path, pinned)
+		}
+	}
+
+	if spec.SignatureURL == "" {
+		return fmt.Errorf("no hash or signature to verify %s against", spec.URL)
+	}
+	if spec.Keyring == "" {
+		return fmt.Errorf("no keyring to verify the signature of %s", spec.URL)
+	}
+
+	sigPath := path + ".sig"
+	if err := DownloadFile(ctx, opts, spec.SignatureURL, sigPath); err != nil {
+		return fmt.Errorf("downloading signature: %v", err)
+	}
+	defer os.Remove(sigPath)
+
+	signer, err := VerifySignature(filepath.Join(opts.Resources, spec.Keyring), path, sigPath, signedContentExt(spec.SignatureURL, path))
+	if err != nil {
+		return fmt.Errorf("verifying signature of %s: %v", filepath.Base(path), err)
+	}
+	for _, id := range signer.Identities {
+		fmt.Fprintf(opts.L.Stdout(), "Good signature on %s from %s (%X).\n", filepath.Base(path), id.Name, signer.PrimaryKey.Fingerprint)
+		break
+	}
+
+	if spec.SHA256 == "" && opts.PinHashes {
+		return pinHash(opts, spec.URL, path)
+	}
+	return nil
+}
+
+// signedContentExt returns the compression extension of the file which
+// must be removed to get the signed content. For instance, kernel.org
+// signs the uncompressed tarball, so linux-5.9.tar.sign is a signature over
+// the decompressed content of linux-5.9.tar.xz.
+func signedContentExt(sigURL, filePath string) string {
+	signed := sigURL
+	if u, err := url.Parse(sigURL); err == nil {
+		signed = u.Path
+	}
+	signed = path.Base(signed)
+	for _, ext := range []string{".sign", ".sig", ".asc"} {
+		signed = strings.TrimSuffix(signed, ext)
+	}
+
+	base := filepath.Base(filePath)
+	for _, ext := range []string{".xz", ".gz"} {
+		if strings.HasSuffix(base, ext) && !strings.HasSuffix(signed, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// VerifySignature checks the detached signature at sigPath over the file at
+// path against the keys in the keyring, returning the signing key. If
+// compressionExt is set, the signature covers the decompressed content.
+func VerifySignature(keyringPath, path, sigPath, compressionExt string) (*openpgp.Entity, error) {
+	keyring, err := readKeyring(keyringPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading keyring: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var signed io.Reader = bufio.NewReader(f)
+	switch compressionExt {
+	case ".xz":
+		if signed, err = xz.NewReader(signed); err != nil {
+			return nil, err
+		}
+	case ".gz":
+		gz, err := gzip.NewReader(signed)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		signed = gz
+	case "":
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compressionExt)
+	}
+
+	sig, err := os.Open(sigPath)
+	if err != nil {
+		return nil, err
+	}
+	defer sig.Close()
+	sigReader := bufio.NewReader(sig)
+	if isArmored(sigReader) {
+		return openpgp.CheckArmoredDetachedSignature(keyring, signed, sigReader)
+	}
+	return openpgp.CheckDetachedSignature(keyring, signed, sigReader)
+}
+
+func isArmored(r *bufio.Reader) bool {
+	prefix, _ := r.Peek(len("-----BEGIN"))
+	return string(prefix) == "-----BEGIN"
+}
+
+func readKeyring(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var keyring openpgp.EntityList
+	if isArmored(r) {
+		keyring, err = openpgp.ReadArmoredKeyRing(r)
+	} else {
+		keyring, err = openpgp.ReadKeyRing(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("keyring contains no keys")
+	}
+	return keyring, nil
+}
+
+func readPins(opts *Opts) (map[string]string, error) {
+	pins := map[string]string{}
+	d, err := ioutil.ReadFile(filepath.Join(opts.Resources, PinFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pins, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(d, &pins); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", PinFilename, err)
+	}
+	return pins, nil
+}
+
+func readPin(opts *Opts, url string) (string, error) {
+	pins, err := readPins(opts)
+	if err != nil {
+		return "", err
+	}
+	return pins[url], nil
+}
+
+// pinHash records the hash of the file in the pin file, so later builds can
+// verify the download without its signature.
+func pinHash(opts *Opts, url, path string) error {
+	pins, err := readPins(opts)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	pins[url] = fmt.Sprintf("%x", h.Sum(nil))
+
+	d, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(opts.Resources, PinFilename), append(d, '\n'), 0644)
+}
@@ -0,0 +1,181 @@
+package units
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func makeSigner(t *testing.T, dir string) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity("Test Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "keyring.asc"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestVerifySignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer := makeSigner(t, dir)
+	content := []byte("linux source tree\n")
+
+	// Detached binary signature over the file itself.
+	plain := filepath.Join(dir, "file.tar")
+	ioutil.WriteFile(plain, content, 0644)
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(plain+".sig", sig.Bytes(), 0644)
+
+	// Armored signature over the uncompressed content, as kernel.org does.
+	var compressed bytes.Buffer
+	xw, err := xz.NewWriter(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(content)
+	xw.Close()
+	tarball := filepath.Join(dir, "linux.tar.xz")
+	ioutil.WriteFile(tarball, compressed.Bytes(), 0644)
+	var armored bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&armored, signer, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "linux.tar.sign"), armored.Bytes(), 0644)
+
+	keyring := filepath.Join(dir, "keyring.asc")
+	if _, err := VerifySignature(keyring, plain, plain+".sig", ""); err != nil {
+		t.Errorf("VerifySignature(binary) failed: %v", err)
+	}
+	ext := signedContentExt("https://cdn.kernel.org/pub/linux/kernel/v5.x/linux.tar.sign", tarball)
+	if ext != ".xz" {
+		t.Errorf("signedContentExt() = %q, want .xz", ext)
+	}
+	got, err := VerifySignature(keyring, tarball, filepath.Join(dir, "linux.tar.sign"), ext)
+	if err != nil {
+		t.Fatalf("VerifySignature(armored, xz) failed: %v", err)
+	}
+	if got.PrimaryKey.KeyId != signer.PrimaryKey.KeyId {
+		t.Errorf("signer = %X, want %X", got.PrimaryKey.KeyId, signer.PrimaryKey.KeyId)
+	}
+
+	ioutil.WriteFile(plain, []byte("tampered\n"), 0644)
+	if _, err := VerifySignature(keyring, plain, plain+".sig", ""); err == nil {
+		t.Error("VerifySignature() accepted a tampered file")
+	}
+}
+
+func TestSignedContentExt(t *testing.T) {
+	tcs := []struct {
+		sig, file, want string
+	}{
+		{"https://example.com/linux-5.9.tar.sign", "/linux-5.9.tar.xz", ".xz"},
+		{"https://example.com/go.tar.gz.asc", "/go.tar.gz", ""},
+		{"https://example.com/thing.sig?x=1", "/thing.gz", ".gz"},
+		{"https://example.com/key.pub.sig", "/key.pub", ""},
+	}
+	for _, tc := range tcs {
+		if got := signedContentExt(tc.sig, tc.file); got != tc.want {
+			t.Errorf("signedContentExt(%q, %q) = %q, want %q", tc.sig, tc.file, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyDownloadPinned(t *testing.T) {
+	res, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(res)
+	opts := &Opts{Resources: res, L: &testLogger{}}
+	f := filepath.Join(res, "file")
+	ioutil.WriteFile(f, []byte("content"), 0644)
+
+	spec := VerifySpec{URL: "https://example.com/file"}
+	if err := VerifyDownload(context.Background(), opts, spec, f); err == nil {
+		t.Error("VerifyDownload() succeeded without a hash, pin or signature")
+	}
+
+	if err := pinHash(opts, spec.URL, f); err != nil {
+		t.Fatalf("pinHash() failed: %v", err)
+	}
+	d, _ := ioutil.ReadFile(filepath.Join(res, PinFilename))
+	var pins map[string]string
+	if err := json.Unmarshal(d, &pins); err != nil || pins[spec.URL] == "" {
+		t.Fatalf("pin file = %q (%v), want pin for %s", d, err, spec.URL)
+	}
+	if err := VerifyDownload(context.Background(), opts, spec, f); err != nil {
+		t.Errorf("VerifyDownload() failed against pin: %v", err)
+	}
+
+	ioutil.WriteFile(f, []byte("changed"), 0644)
+	if err := VerifyDownload(context.Background(), opts, spec, f); err == nil {
+		t.Error("VerifyDownload() accepted a file not matching its pin")
+	}
+}
+
+func TestVerifyDownloadPinsOnlyWhenAsked(t *testing.T) {
+	res, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(res)
+	signer := makeSigner(t, res)
+	content := []byte("content\n")
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(sig.Bytes())
+	}))
+	defer srv.Close()
+
+	f := filepath.Join(res, "file")
+	ioutil.WriteFile(f, content, 0644)
+	spec := VerifySpec{URL: "https://example.com/file", SignatureURL: srv.URL + "/file.sig", Keyring: "keyring.asc"}
+
+	opts := &Opts{Resources: res, L: &testLogger{}}
+	if err := VerifyDownload(context.Background(), opts, spec, f); err != nil {
+		t.Fatalf("VerifyDownload() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(res, PinFilename)); !os.IsNotExist(err) {
+		t.Errorf("VerifyDownload() wrote to the resources directory without PinHashes: %v", err)
+	}
+
+	opts.PinHashes = true
+	if err := VerifyDownload(context.Background(), opts, spec, f); err != nil {
+		t.Fatalf("VerifyDownload() failed: %v", err)
+	}
+	if pin, err := readPin(opts, spec.URL); err != nil || pin == "" {
+		t.Errorf("readPin() = %q, %v, want the pinned hash", pin, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/twitchylinux/builder/pack"
+	"github.com/twitchylinux/builder/stager"
+	"github.com/twitchylinux/builder/verify"
+)
+
+// verifyImage runs checks against a packed image or built system. In boot
+// mode, it boots the image in QEMU and runs the checks described by the
+// verify.boot section of the stage config over its serial console. In
+// reproducible mode, it compares two build directories.
+func verifyImage(ctx context.Context, args []string) error {
+	if len(args) >= 1 && args[0] == "reproducible" {
+		return verifyReproducible(args[1:])
+	}
+	if len(args) < 2 || args[0] != "boot" {
+		printUsage()
+		return errors.New("verify requires a mode (boot or reproducible) and an image file")
+	}
+	image := args[1]
+	if _, err := os.Stat(image); err != nil {
+		return err
+	}
+
+	opts, err := stageConfigOpts(args[2:])
+	if err != nil {
+		return err
+	}
+	confDir := filepath.Join(resourceDir(), "stage-conf")
+	conf, err := stager.VerifyConfig(confDir, opts)
+	if err != nil {
+		return err
+	}
+	img, err := stager.ImageConfig(confDir, opts)
+	if err != nil {
+		return err
+	}
+
+	logPath := image + ".console.log"
+	log, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancelCtxOnSignal(cancel)
+	fmt.Printf("Booting %s, console output is written to %s\n", image, logPath)
+	report, err := verify.Boot(ctx, verify.Options{
+		Image:  image,
+		Config: conf,
+		// Hybrid images are booted with BIOS, as are ISOs.
+		UEFI:       img.Firmware == pack.FirmwareUEFI && filepath.Ext(image) != ".iso",
+		ConsoleLog: log,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	if !report.Passed {
+		return fmt.Errorf("verification failed, see %s", logPath)
+	}
+	return nil
+}
+
+// verifyReproducible compares two builds of the same configuration,
+// explaining any differences between them.
+func verifyReproducible(args []string) error {
+	if len(args) != 2 {
+		printUsage()
+		return errors.New("verify reproducible requires two build directories")
+	}
+	report, err := verify.CompareTrees(args[0], args[1], func(rel string) bool {
+		return rel == statusDir
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	if !report.Reproducible() {
+		return fmt.Errorf("%s and %s differ", args[0], args[1])
+	}
+	return nil
+}
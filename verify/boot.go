@@ -0,0 +1,121 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Options describes an image to boot.
+type Options struct {
+	Image  string
+	Config Config
+	// UEFI boots the image with UEFI firmware rather than BIOS.
+	UEFI bool
+	// ConsoleLog receives everything written to the serial console.
+	ConsoleLog io.Writer
+}
+
+// Report describes the outcome of booting and checking an image.
+type Report struct {
+	Passed bool
+	// BootErr describes why the system did not become ready for checks.
+	BootErr  string
+	BootTime time.Duration
+	Checks   []CheckResult
+}
+
+// String returns a human-readable summary of the report.
+func (r *Report) String() string {
+	var out strings.Builder
+	if r.BootErr != "" {
+		fmt.Fprintf(&out, "FAIL boot: %s\n", r.BootErr)
+	} else {
+		fmt.Fprintf(&out, "PASS boot (%v)\n", r.BootTime.Round(time.Second))
+	}
+	for _, c := range r.Checks {
+		if c.Passed {
+			fmt.Fprintf(&out, "PASS %s\n", c.Name)
+			continue
+		}
+		fmt.Fprintf(&out, "FAIL %s: %s\n", c.Name, c.Err)
+		if c.Output != "" {
+			fmt.Fprintf(&out, "     output:\n       %s\n", strings.Replace(c.Output, "\n", "\n       ", -1))
+		}
+	}
+	if r.Passed {
+		out.WriteString("PASSED\n")
+	} else {
+		out.WriteString("FAILED\n")
+	}
+	return out.String()
+}
+
+// Boot boots the image in QEMU and runs the configured checks over its
+// serial console. Failures of the image are described by the report; an
+// error is only returned if the VM could not be started.
+func Boot(ctx context.Context, opts Options) (*Report, error) {
+	if err := opts.Config.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.ConsoleLog == nil {
+		opts.ConsoleLog = ioutil.Discard
+	}
+	var ovmf string
+	if opts.UEFI {
+		var err error
+		if ovmf, err = findOVMF(&opts.Config); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "qemu-system-x86_64", qemuArgs(&opts.Config, opts.Image, ovmf, kvmAvailable())...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = opts.ConsoleLog
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting qemu: %v", err)
+	}
+	defer func() {
+		cancel()
+		cmd.Wait()
+	}()
+
+	return check(ctx, newConsole(stdout, stdin, opts.ConsoleLog), &opts.Config), nil
+}
+
+// check waits for the system on the console to boot, then runs the
+// checks.
+func check(ctx context.Context, c *console, conf *Config) *Report {
+	var (
+		r     = &Report{}
+		start = time.Now()
+	)
+	if err := c.waitReady(ctx, conf, start.Add(time.Duration(conf.BootTimeoutSecs)*time.Second)); err != nil {
+		r.BootErr = err.Error()
+		return r
+	}
+	r.BootTime = time.Since(start)
+
+	r.Passed = true
+	for i, chk := range conf.Checks {
+		res := c.run(ctx, i, chk)
+		r.Checks = append(r.Checks, res)
+		if !res.Passed {
+			r.Passed = false
+		}
+	}
+	return r
+}
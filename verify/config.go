@@ -0,0 +1,108 @@
+// Package verify boots packed images in QEMU and checks them over the
+// serial console.
+package verify
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// What the boot waits for before running checks.
+const (
+	// WaitLogin waits for a getty login prompt, then logs in as User.
+	WaitLogin = "login"
+	// WaitMarker waits for the marker printed by the boot test unit,
+	// which also logs in root on the serial console.
+	WaitMarker = "marker"
+)
+
+// DefaultMarker is printed to the serial console by the boot test unit
+// once the system has booted.
+const DefaultMarker = "TWL-BOOT-OK"
+
+// Check is a command run on the booted system.
+type Check struct {
+	Name string `toml:"name"`
+	// Run is a shell command line.
+	Run string `toml:"run"`
+	// Expect is a regular expression which the output must match, if set.
+	Expect string `toml:"expect"`
+	// ExitCode is the exit status the command must return.
+	ExitCode int `toml:"exit_code"`
+	// TimeoutSecs bounds how long the command may run, 60 seconds if
+	// unset.
+	TimeoutSecs int `toml:"timeout_secs"`
+}
+
+func (c *Check) timeout() time.Duration {
+	if c.TimeoutSecs <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.TimeoutSecs) * time.Second
+}
+
+// Config describes how an image is booted and checked.
+type Config struct {
+	MemoryMB int `toml:"memory_mb"`
+	CPUs     int `toml:"cpus"`
+	// BootTimeoutSecs bounds the time from starting QEMU until the
+	// system is ready for checks.
+	BootTimeoutSecs int `toml:"boot_timeout_secs"`
+	// WaitFor is either login or marker.
+	WaitFor string `toml:"wait_for"`
+	Marker  string `toml:"marker"`
+	// User and Password are used to log in when waiting for a login
+	// prompt.
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	// OVMF is the path to UEFI firmware for QEMU. If unset, common
+	// locations are searched when booting UEFI images.
+	OVMF   string  `toml:"ovmf"`
+	Checks []Check `toml:"checks"`
+}
+
+// DefaultConfig returns the configuration used when none is specified.
+func DefaultConfig() Config {
+	return Config{
+		MemoryMB:        2048,
+		CPUs:            2,
+		BootTimeoutSecs: 600,
+		WaitFor:         WaitLogin,
+		Marker:          DefaultMarker,
+	}
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c *Config) Validate() error {
+	if c.MemoryMB < 256 {
+		return fmt.Errorf("memory_mb must be at least 256, got %d", c.MemoryMB)
+	}
+	if c.CPUs < 1 {
+		return fmt.Errorf("cpus must be at least 1, got %d", c.CPUs)
+	}
+	if c.BootTimeoutSecs <= 0 {
+		return fmt.Errorf("boot_timeout_secs must be positive")
+	}
+	switch c.WaitFor {
+	case WaitLogin:
+		if c.User == "" {
+			return fmt.Errorf("waiting for %s requires a user", WaitLogin)
+		}
+	case WaitMarker:
+		if c.Marker == "" {
+			return fmt.Errorf("waiting for %s requires a marker", WaitMarker)
+		}
+	default:
+		return fmt.Errorf("unknown wait_for %q (want %q or %q)", c.WaitFor, WaitLogin, WaitMarker)
+	}
+	for _, chk := range c.Checks {
+		if chk.Name == "" || chk.Run == "" {
+			return fmt.Errorf("checks require a name and a command")
+		}
+		if _, err := regexp.Compile(chk.Expect); err != nil {
+			return fmt.Errorf("check %s: invalid expect pattern: %v", chk.Name, err)
+		}
+	}
+	return nil
+}
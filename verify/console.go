@@ -0,0 +1,191 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errConsoleClosed is returned when the console ends while waiting for
+// output, usually because the VM exited.
+var errConsoleClosed = errors.New("console closed")
+
+// console is a serial console which output can be waited for.
+type console struct {
+	w io.Writer
+
+	mu sync.Mutex
+	// buf holds output which has not been consumed by expect.
+	buf     []byte
+	closed  bool
+	changed chan struct{}
+}
+
+// newConsole reads output from r until it ends, copying it to log.
+// Input is written to w.
+func newConsole(r io.Reader, w io.Writer, log io.Writer) *console {
+	c := &console{w: w, changed: make(chan struct{})}
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, err := r.Read(b)
+			if n > 0 {
+				log.Write(b[:n])
+				c.mu.Lock()
+				c.buf = append(c.buf, b[:n]...)
+				c.notifyLocked()
+				c.mu.Unlock()
+			}
+			if err != nil {
+				c.mu.Lock()
+				c.closed = true
+				c.notifyLocked()
+				c.mu.Unlock()
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *console) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// send writes s to the console.
+func (c *console) send(s string) error {
+	_, err := io.WriteString(c.w, s)
+	return err
+}
+
+// expect waits for output matching re. It returns the submatches and the
+// output preceding the match, all of which is consumed.
+func (c *console) expect(ctx context.Context, re *regexp.Regexp, timeout time.Duration) ([]string, string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		if loc := re.FindSubmatchIndex(c.buf); loc != nil {
+			var subs []string
+			for i := 0; i < len(loc); i += 2 {
+				if loc[i] < 0 {
+					subs = append(subs, "")
+					continue
+				}
+				subs = append(subs, string(c.buf[loc[i]:loc[i+1]]))
+			}
+			before := string(c.buf[:loc[0]])
+			c.buf = c.buf[loc[1]:]
+			c.mu.Unlock()
+			return subs, before, nil
+		}
+		closed, changed := c.closed, c.changed
+		c.mu.Unlock()
+		if closed {
+			return nil, "", errConsoleClosed
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, "", fmt.Errorf("timed out after %v waiting for %q", timeout, re)
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+}
+
+var (
+	loginPrompt    = regexp.MustCompile(`login: $`)
+	passwordPrompt = regexp.MustCompile(`[Pp]assword: $`)
+	// The shell computes the ready marker, so the echo of the command
+	// which prints it does not match. Clearing the prompt keeps it out of
+	// the output of checks.
+	readyCmd    = "stty -echo; PS1=''; PS2=''; echo TWL-$((20+22))-READY\n"
+	readyMarker = regexp.MustCompile(`TWL-42-READY\r?\n`)
+)
+
+// waitReady waits for the system to boot as configured, then for a shell
+// on the console, until the deadline.
+func (c *console) waitReady(ctx context.Context, conf *Config, deadline time.Time) error {
+	switch conf.WaitFor {
+	case WaitMarker:
+		re := regexp.MustCompile(regexp.QuoteMeta(conf.Marker))
+		if _, _, err := c.expect(ctx, re, time.Until(deadline)); err != nil {
+			return fmt.Errorf("waiting for boot marker: %v", err)
+		}
+	case WaitLogin:
+		if _, _, err := c.expect(ctx, loginPrompt, time.Until(deadline)); err != nil {
+			return fmt.Errorf("waiting for login prompt: %v", err)
+		}
+		if err := c.send(conf.User + "\n"); err != nil {
+			return err
+		}
+		if conf.Password != "" {
+			if _, _, err := c.expect(ctx, passwordPrompt, time.Until(deadline)); err != nil {
+				return fmt.Errorf("waiting for password prompt: %v", err)
+			}
+			if err := c.send(conf.Password + "\n"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The shell may not be up yet, so the handshake is retried.
+	for {
+		if err := c.send(readyCmd); err != nil {
+			return err
+		}
+		_, _, err := c.expect(ctx, readyMarker, 5*time.Second)
+		if err == nil {
+			return nil
+		}
+		if err == errConsoleClosed || ctx.Err() != nil || time.Now().After(deadline) {
+			return fmt.Errorf("waiting for shell: %v", err)
+		}
+	}
+}
+
+// CheckResult describes the outcome of a check.
+type CheckResult struct {
+	Name     string
+	Passed   bool
+	ExitCode int
+	Output   string
+	// Err describes why the check failed.
+	Err string
+}
+
+// run runs the nth check in the shell on the console.
+func (c *console) run(ctx context.Context, n int, chk Check) CheckResult {
+	res := CheckResult{Name: chk.Name, ExitCode: -1}
+	marker := fmt.Sprintf("TWL-CHECK-%d-", n)
+	if err := c.send(chk.Run + "\necho " + marker + "$?\n"); err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	subs, out, err := c.expect(ctx, regexp.MustCompile(marker+`(\d+)\r?\n`), chk.timeout())
+	if err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	res.Output = strings.TrimSpace(strings.Replace(out, "\r\n", "\n", -1))
+	res.ExitCode, _ = strconv.Atoi(subs[1])
+
+	switch {
+	case res.ExitCode != chk.ExitCode:
+		res.Err = fmt.Sprintf("exit status %d, want %d", res.ExitCode, chk.ExitCode)
+	case chk.Expect != "" && !regexp.MustCompile(chk.Expect).MatchString(res.Output):
+		res.Err = fmt.Sprintf("output does not match %q", chk.Expect)
+	default:
+		res.Passed = true
+	}
+	return res
+}
@@ -0,0 +1,70 @@
+package verify
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ovmfPaths are common locations of UEFI firmware for QEMU.
+var ovmfPaths = []string{
+	"/usr/share/ovmf/OVMF.fd",
+	"/usr/share/qemu/OVMF.fd",
+	"/usr/share/OVMF/OVMF.fd",
+	"/usr/share/edk2/ovmf/OVMF.fd",
+}
+
+// findOVMF returns the path to UEFI firmware for QEMU.
+func findOVMF(conf *Config) (string, error) {
+	if conf.OVMF != "" {
+		if _, err := os.Stat(conf.OVMF); err != nil {
+			return "", fmt.Errorf("ovmf: %v", err)
+		}
+		return conf.OVMF, nil
+	}
+	for _, p := range ovmfPaths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no UEFI firmware found (install ovmf, or set ovmf in the verify config)")
+}
+
+// kvmAvailable returns true if the host can run VMs with KVM.
+func kvmAvailable() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// qemuArgs returns the arguments to qemu-system-x86_64 which boot the
+// image with its serial console on stdio. The image is opened in snapshot
+// mode, so it is not modified. An empty ovmf boots with BIOS firmware.
+func qemuArgs(conf *Config, image, ovmf string, kvm bool) []string {
+	args := []string{
+		"-m", strconv.Itoa(conf.MemoryMB),
+		"-smp", strconv.Itoa(conf.CPUs),
+		"-display", "none",
+		"-monitor", "none",
+		"-serial", "stdio",
+		"-no-reboot",
+	}
+	if kvm {
+		args = append(args, "-accel", "kvm", "-cpu", "host")
+	} else {
+		args = append(args, "-accel", "tcg")
+	}
+	if ovmf != "" {
+		args = append(args, "-bios", ovmf)
+	}
+	if strings.HasSuffix(image, ".iso") {
+		args = append(args, "-cdrom", image)
+	} else {
+		args = append(args, "-drive", "file="+image+",format=raw,if=virtio,snapshot=on")
+	}
+	return args
+}
@@ -0,0 +1,305 @@
+package verify
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// knownCauses explain mismatches in paths which commonly differ between
+// builds, in the order they are checked.
+var knownCauses = []struct {
+	patterns []string
+	cause    string
+}{
+	{[]string{"etc/machine-id", "var/lib/dbus/machine-id"}, "machine ID generated during the build (cleared in reproducible builds)"},
+	{[]string{"etc/ssh/ssh_host_*"}, "SSH host keys generated during the build"},
+	{[]string{"etc/shadow", "etc/shadow-"}, "password change dates (clamped in reproducible builds)"},
+	{[]string{"etc/ld.so.cache", "var/cache/ldconfig/*"}, "ldconfig cache"},
+	{[]string{"var/cache/man/*", "var/cache/man/*/*"}, "man-db index"},
+	{[]string{"var/log/*", "var/log/*/*"}, "build logs"},
+	{[]string{"var/lib/apt/lists/*", "var/cache/apt/*"}, "apt indexes fetched at build time; build against a snapshot mirror"},
+	{[]string{"var/lib/dpkg/*", "var/cache/debconf/*"}, "package database; the builds installed different packages or versions"},
+	{[]string{"var/lib/systemd/*", "var/lib/systemd/*/*"}, "systemd state created during the build"},
+	{[]string{"*.pyc"}, "Python bytecode, which records source file times"},
+	{[]string{"boot/*", "lib/modules/*", "deb-pkgs/*"}, "kernel build"},
+}
+
+// Mismatch describes a difference between two builds.
+type Mismatch struct {
+	Path string
+	// What differs, such as content or mtime.
+	What   string
+	Detail string
+	// Cause is the likely reason for the difference.
+	Cause string
+}
+
+// ReproReport describes the differences between two builds.
+type ReproReport struct {
+	A, B       string
+	Files      int
+	Mismatches []Mismatch
+}
+
+// Reproducible returns true if the builds are identical.
+func (r *ReproReport) Reproducible() bool {
+	return len(r.Mismatches) == 0
+}
+
+// maxPerCause bounds the mismatches listed for each cause.
+const maxPerCause = 20
+
+// String returns the report in a human-readable form, with mismatches
+// grouped by cause.
+func (r *ReproReport) String() string {
+	var out strings.Builder
+	if r.Reproducible() {
+		fmt.Fprintf(&out, "%s and %s are identical (%d files).\n", r.A, r.B, r.Files)
+		return out.String()
+	}
+	fmt.Fprintf(&out, "%s and %s differ: %d mismatches in %d files.\n", r.A, r.B, len(r.Mismatches), r.Files)
+
+	byCause := map[string][]Mismatch{}
+	var causes []string
+	for _, m := range r.Mismatches {
+		if _, ok := byCause[m.Cause]; !ok {
+			causes = append(causes, m.Cause)
+		}
+		byCause[m.Cause] = append(byCause[m.Cause], m)
+	}
+	sort.Slice(causes, func(i, j int) bool {
+		return len(byCause[causes[i]]) > len(byCause[causes[j]])
+	})
+	for _, c := range causes {
+		ms := byCause[c]
+		fmt.Fprintf(&out, "\n%s (%d):\n", c, len(ms))
+		for i, m := range ms {
+			if i == maxPerCause {
+				fmt.Fprintf(&out, "  ... and %d more\n", len(ms)-maxPerCause)
+				break
+			}
+			fmt.Fprintf(&out, "  %s: %s %s\n", m.Path, m.What, m.Detail)
+		}
+	}
+	return out.String()
+}
+
+// fileInfo is the metadata of a file which is compared between builds.
+type fileInfo struct {
+	fi os.FileInfo
+	st *syscall.Stat_t
+}
+
+func walkTree(root string, skip func(rel string) bool) (map[string]fileInfo, error) {
+	out := map[string]fileInfo{}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if skip != nil && rel != "." && skip(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%s: stat.sys is %T, expected syscall.Stat_t", path, fi.Sys())
+		}
+		out[rel] = fileInfo{fi: fi, st: st}
+		return nil
+	})
+	return out, err
+}
+
+// CompareTrees compares two build directories, returning a report of
+// every difference in the files, their contents and metadata. Paths for
+// which skip returns true are not compared.
+func CompareTrees(a, b string, skip func(rel string) bool) (*ReproReport, error) {
+	filesA, err := walkTree(a, skip)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := walkTree(b, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(filesA))
+	for p := range filesA {
+		paths = append(paths, p)
+	}
+	for p := range filesB {
+		if _, ok := filesA[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	r := &ReproReport{A: a, B: b, Files: len(paths)}
+	for _, p := range paths {
+		fa, inA := filesA[p]
+		fb, inB := filesB[p]
+		var diffs []Mismatch
+		switch {
+		case !inA:
+			diffs = []Mismatch{{What: "missing", Detail: "from " + a}}
+		case !inB:
+			diffs = []Mismatch{{What: "missing", Detail: "from " + b}}
+		default:
+			if diffs, err = compareFile(filepath.Join(a, p), filepath.Join(b, p), fa, fb); err != nil {
+				return nil, err
+			}
+		}
+		for _, d := range diffs {
+			d.Path = p
+			d.Cause = explain(p, d.What)
+			r.Mismatches = append(r.Mismatches, d)
+		}
+	}
+	return r, nil
+}
+
+func compareFile(pathA, pathB string, a, b fileInfo) ([]Mismatch, error) {
+	var out []Mismatch
+	if ta, tb := a.fi.Mode()&os.ModeType, b.fi.Mode()&os.ModeType; ta != tb {
+		return []Mismatch{{What: "type", Detail: fmt.Sprintf("%v != %v", ta, tb)}}, nil
+	}
+	if pa, pb := a.st.Mode&07777, b.st.Mode&07777; pa != pb {
+		out = append(out, Mismatch{What: "mode", Detail: fmt.Sprintf("%04o != %04o", pa, pb)})
+	}
+	if a.st.Uid != b.st.Uid || a.st.Gid != b.st.Gid {
+		out = append(out, Mismatch{What: "owner", Detail: fmt.Sprintf("%d:%d != %d:%d", a.st.Uid, a.st.Gid, b.st.Uid, b.st.Gid)})
+	}
+
+	switch mode := a.fi.Mode(); {
+	case mode.IsRegular():
+		same, err := sameContents(pathA, pathB, a.fi.Size(), b.fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			out = append(out, Mismatch{What: "content", Detail: fmt.Sprintf("(%d and %d bytes)", a.fi.Size(), b.fi.Size())})
+		}
+	case mode&os.ModeSymlink != 0:
+		la, err := os.Readlink(pathA)
+		if err != nil {
+			return nil, err
+		}
+		lb, err := os.Readlink(pathB)
+		if err != nil {
+			return nil, err
+		}
+		if la != lb {
+			out = append(out, Mismatch{What: "target", Detail: fmt.Sprintf("%s != %s", la, lb)})
+		}
+	case mode&os.ModeDevice != 0:
+		if a.st.Rdev != b.st.Rdev {
+			out = append(out, Mismatch{What: "device", Detail: fmt.Sprintf("%d != %d", a.st.Rdev, b.st.Rdev)})
+		}
+	}
+
+	if ma, mb := a.fi.ModTime().Unix(), b.fi.ModTime().Unix(); ma != mb {
+		out = append(out, Mismatch{What: "mtime", Detail: fmt.Sprintf("%d != %d", ma, mb)})
+	}
+	xa, err := xattrNames(pathA)
+	if err != nil {
+		return nil, err
+	}
+	xb, err := xattrNames(pathB)
+	if err != nil {
+		return nil, err
+	}
+	if xa != xb {
+		out = append(out, Mismatch{What: "xattrs", Detail: fmt.Sprintf("%q != %q", xa, xb)})
+	}
+	return out, nil
+}
+
+func sameContents(a, b string, sizeA, sizeB int64) (bool, error) {
+	if sizeA != sizeB {
+		return false, nil
+	}
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 64<<10), make([]byte, 64<<10)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// xattrNames returns the sorted names of the extended attributes of a
+// file, joined with commas.
+func xattrNames(path string) (string, error) {
+	sz, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return "", nil
+		}
+		return "", err
+	}
+	if sz == 0 {
+		return "", nil
+	}
+	buf := make([]byte, sz)
+	if sz, err = unix.Llistxattr(path, buf); err != nil {
+		return "", err
+	}
+	names := strings.Split(strings.TrimRight(string(buf[:sz]), "\x00"), "\x00")
+	sort.Strings(names)
+	return strings.Join(names, ","), nil
+}
+
+// explain returns the likely cause of a mismatch.
+func explain(rel, what string) string {
+	for _, k := range knownCauses {
+		for _, p := range k.patterns {
+			if m, _ := filepath.Match(p, rel); m {
+				return k.cause
+			}
+		}
+	}
+	switch what {
+	case "mtime":
+		return "file times newer than SOURCE_DATE_EPOCH; build with --source-date-epoch"
+	case "missing":
+		return "files present in only one build"
+	case "owner":
+		return "user and group IDs allocated in a different order"
+	}
+	return "unknown; compare the files with diffoscope"
+}
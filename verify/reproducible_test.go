@@ -0,0 +1,67 @@
+package verify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompareTrees(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "repro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	epoch := time.Unix(1600000000, 0)
+	for _, root := range []string{"a", "b"} {
+		root = filepath.Join(tmp, root)
+		for _, d := range []string{"etc", "usr/bin", "build-status"} {
+			os.MkdirAll(filepath.Join(root, d), 0755)
+		}
+		ioutil.WriteFile(filepath.Join(root, "usr", "bin", "bash"), []byte("#!bash"), 0755)
+		ioutil.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("twl\n"), 0644)
+		ioutil.WriteFile(filepath.Join(root, "build-status", "Debootstrap"), []byte(root), 0644)
+		os.Symlink("usr/bin", filepath.Join(root, "bin"))
+	}
+	a, b := filepath.Join(tmp, "a"), filepath.Join(tmp, "b")
+	ioutil.WriteFile(filepath.Join(a, "etc", "machine-id"), []byte("1234\n"), 0444)
+	ioutil.WriteFile(filepath.Join(b, "etc", "machine-id"), []byte("5678\n"), 0444)
+	ioutil.WriteFile(filepath.Join(b, "usr", "bin", "sh"), nil, 0755)
+	os.Chmod(filepath.Join(b, "etc", "hostname"), 0600)
+	filepath.Walk(tmp, func(path string, fi os.FileInfo, err error) error {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			os.Chtimes(path, epoch, epoch)
+		}
+		return nil
+	})
+	os.Chtimes(filepath.Join(b, "usr", "bin", "bash"), time.Now(), time.Now())
+
+	skip := func(rel string) bool { return rel == "build-status" }
+	r, err := CompareTrees(a, a, skip)
+	if err != nil {
+		t.Fatalf("CompareTrees() failed: %v", err)
+	}
+	if !r.Reproducible() {
+		t.Errorf("tree differs from itself: %s", r)
+	}
+
+	if r, err = CompareTrees(a, b, skip); err != nil {
+		t.Fatalf("CompareTrees() failed: %v", err)
+	}
+	var got []string
+	for _, m := range r.Mismatches {
+		got = append(got, m.Path+" "+m.What)
+	}
+	want := []string{"etc/hostname mode", "etc/machine-id content", "usr/bin/bash mtime", "usr/bin/sh missing"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatches = %v, want %v", got, want)
+	}
+	if s := r.String(); !strings.Contains(s, "machine ID") || !strings.Contains(s, "SOURCE_DATE_EPOCH") {
+		t.Errorf("report does not explain mismatches:\n%s", s)
+	}
+}
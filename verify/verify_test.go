@@ -0,0 +1,121 @@
+package verify
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSystem emulates a booted system on a serial console, answering the
+// commands used by the tests.
+func fakeSystem(in io.Reader, out io.WriteCloser, banner string) {
+	defer out.Close()
+	io.WriteString(out, banner)
+	var status int
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		switch line := s.Text(); {
+		case line == strings.TrimSuffix(readyCmd, "\n"):
+			io.WriteString(out, "TWL-42-READY\r\n")
+		case strings.HasPrefix(line, "echo TWL-CHECK-"):
+			io.WriteString(out, strings.Replace(line[len("echo "):], "$?", fmt.Sprint(status), 1)+"\r\n")
+		case line == "uname -r":
+			io.WriteString(out, "5.9.14\r\n")
+			status = 0
+		case line == "false":
+			status = 1
+		case line == "twl" || line == "hunter2":
+			if line == "twl" {
+				io.WriteString(out, "Password: ")
+			}
+		default:
+			status = 127
+		}
+	}
+}
+
+func runFake(t *testing.T, conf Config, banner string) *Report {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go fakeSystem(inR, outW, banner)
+	defer inW.Close()
+	return check(context.Background(), newConsole(outR, inW, ioutil.Discard), &conf)
+}
+
+func TestCheck(t *testing.T) {
+	conf := DefaultConfig()
+	conf.WaitFor = WaitMarker
+	conf.Checks = []Check{
+		{Name: "kernel", Run: "uname -r", Expect: `^5\.9\.`},
+		{Name: "wrong kernel", Run: "uname -r", Expect: `^6\.`},
+		{Name: "fails", Run: "false"},
+		{Name: "expected failure", Run: "false", ExitCode: 1},
+	}
+	r := runFake(t, conf, "Loading Linux...\r\n"+DefaultMarker+"\r\n")
+	if r.BootErr != "" {
+		t.Fatalf("boot failed: %s", r.BootErr)
+	}
+	if r.Passed {
+		t.Error("report passed with failing checks")
+	}
+
+	var got []bool
+	for _, c := range r.Checks {
+		got = append(got, c.Passed)
+	}
+	if want := []bool{true, false, false, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("check results = %v, want %v\n%s", got, want, r)
+	}
+	if r.Checks[0].Output != "5.9.14" {
+		t.Errorf("check output = %q, want %q", r.Checks[0].Output, "5.9.14")
+	}
+	if r.Checks[2].ExitCode != 1 {
+		t.Errorf("check exit code = %d, want 1", r.Checks[2].ExitCode)
+	}
+	if !strings.Contains(r.String(), "FAIL fails: exit status 1, want 0") {
+		t.Errorf("report does not describe failure:\n%s", r)
+	}
+}
+
+func TestCheckLogin(t *testing.T) {
+	conf := DefaultConfig()
+	conf.WaitFor, conf.User, conf.Password = WaitLogin, "twl", "hunter2"
+	conf.Checks = []Check{{Name: "kernel", Run: "uname -r"}}
+	r := runFake(t, conf, "Debian GNU/Linux twl ttyS0\r\n\r\ntwl login: ")
+	if !r.Passed {
+		t.Errorf("report failed:\n%s", r)
+	}
+}
+
+func TestCheckBootFailure(t *testing.T) {
+	conf := DefaultConfig()
+	// The console ends as the VM exits.
+	c := newConsole(strings.NewReader("Kernel panic - not syncing\r\n"), ioutil.Discard, ioutil.Discard)
+	r := check(context.Background(), c, &conf)
+	if r.Passed || !strings.Contains(r.BootErr, "console closed") {
+		t.Errorf("report = %+v, want boot failure", r)
+	}
+}
+
+func TestQemuArgs(t *testing.T) {
+	conf := DefaultConfig()
+	args := strings.Join(qemuArgs(&conf, "twl.img", "", false), " ")
+	for _, want := range []string{"-m 2048", "-serial stdio", "-accel tcg", "-drive file=twl.img,format=raw,if=virtio,snapshot=on"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("qemuArgs() = %q, missing %q", args, want)
+		}
+	}
+
+	args = strings.Join(qemuArgs(&conf, "twl.iso", "/usr/share/ovmf/OVMF.fd", true), " ")
+	for _, want := range []string{"-accel kvm -cpu host", "-bios /usr/share/ovmf/OVMF.fd", "-cdrom twl.iso"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("qemuArgs() = %q, missing %q", args, want)
+		}
+	}
+}